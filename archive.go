@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/redis/go-redis/v9"
+)
+
+var ErrSettlementExists = errors.New("settlement already exists")
+
+// SettlementDocumentVersion is the version of the SettlementDocument layout written by
+// ExportSettlement.
+const SettlementDocumentVersion = 1
+
+// SettlementDocument is the JSON archive of a settlement written by ExportSettlement.
+type SettlementDocument struct {
+	Version         int            `json:"version"`
+	Organization    string         `json:"organization"`
+	EnterpriseUnit  string         `json:"enterprise_unit"`
+	SettlementDocID string         `json:"settlement_doc_id"`
+	Tills           []DocumentTill `json:"tills"`
+}
+
+type DocumentTill struct {
+	ID      string           `json:"id"`
+	Tenders []DocumentTender `json:"tenders"`
+}
+
+type DocumentTender struct {
+	ID            string                 `json:"id"`
+	Currency      string                 `json:"currency,omitempty"`
+	Amount        Money                  `json:"amount"`
+	Denominations []DocumentDenomination `json:"denominations,omitempty"`
+}
+
+type DocumentDenomination struct {
+	Name      string `json:"name"`
+	Currency  string `json:"currency,omitempty"`
+	Count     int    `json:"count"`
+	Amount    Money  `json:"amount"`
+	CountOnly bool   `json:"countOnly,omitempty"`
+}
+
+// ExportSettlement reads the whole settlement from the primary, reserved pseudo-tills
+// included, and returns it as a SettlementDocument in JSON. Tills, tenders and
+// denominations are sorted, so exporting the same state twice gives the same bytes.
+func (c Client) ExportSettlement(ctx context.Context, key Key) ([]byte, error) {
+	tills, err := c.GetExpectedTenders(ctx, key, WithReservedTills(), WithPrimary())
+	if err != nil {
+		return nil, err
+	}
+	doc := SettlementDocument{
+		Version:         SettlementDocumentVersion,
+		Organization:    key.Organization,
+		EnterpriseUnit:  key.EnterpriseUnit,
+		SettlementDocID: key.SettlementDocID,
+		Tills:           make([]DocumentTill, 0, len(tills)),
+	}
+	for _, till := range tills {
+		docTill := DocumentTill{ID: till.ID, Tenders: make([]DocumentTender, 0, len(till.Tenders))}
+		for _, tender := range till.Tenders {
+			docTender := DocumentTender{ID: tender.ID, Currency: tender.Currency, Amount: tender.Amount}
+			for _, denomination := range tender.TenderBreakdowns {
+				docTender.Denominations = append(docTender.Denominations, DocumentDenomination{
+					Name:      denomination.Name,
+					Currency:  denomination.Currency,
+					Count:     denomination.Count,
+					Amount:    denomination.Amount,
+					CountOnly: denomination.CountOnly,
+				})
+			}
+			sort.Slice(docTender.Denominations, func(i, j int) bool {
+				a, b := docTender.Denominations[i], docTender.Denominations[j]
+				if a.Name != b.Name {
+					return a.Name < b.Name
+				}
+				return a.Currency < b.Currency
+			})
+			docTill.Tenders = append(docTill.Tenders, docTender)
+		}
+		sort.Slice(docTill.Tenders, func(i, j int) bool {
+			a, b := docTill.Tenders[i], docTill.Tenders[j]
+			if a.ID != b.ID {
+				return a.ID < b.ID
+			}
+			return a.Currency < b.Currency
+		})
+		doc.Tills = append(doc.Tills, docTill)
+	}
+	sort.Slice(doc.Tills, func(i, j int) bool { return doc.Tills[i].ID < doc.Tills[j].ID })
+
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return nil, fmt.Errorf("export settlement %s: %w", key.SettlementDocID, err)
+	}
+	return data, nil
+}
+
+// ImportSettlement restores a settlement exported with ExportSettlement, writing every
+// tender total and denomination as an absolute value in one WATCHed MULTI/EXEC. The key
+// comes from the document, laid out in the client's KeyFormat, and the checksum is
+// recomputed when the client has a ChecksumSecret. It fails with ErrSettlementExists if
+// the settlement already has tills, so an archive is never added on top of live balances;
+// use ForceImportSettlement to replace them. Closed marks, idempotency keys, events and
+// stored transactions aren't archived and so aren't restored.
+func (c Client) ImportSettlement(ctx context.Context, data []byte) error {
+	return c.importSettlement(ctx, data, false)
+}
+
+// ForceImportSettlement is ImportSettlement replacing any existing settlement: its keys
+// are deleted in the same MULTI/EXEC that writes the imported state.
+func (c Client) ForceImportSettlement(ctx context.Context, data []byte) error {
+	return c.importSettlement(ctx, data, true)
+}
+
+func (c Client) importSettlement(ctx context.Context, data []byte, force bool) error {
+	done, err := c.begin()
+	if err != nil {
+		return err
+	}
+	defer done()
+	var doc SettlementDocument
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return fmt.Errorf("import settlement: %w", err)
+	}
+	if doc.Version != SettlementDocumentVersion {
+		return fmt.Errorf("import settlement: unsupported document version %d", doc.Version)
+	}
+	key := c.NewKey(doc.Organization, doc.EnterpriseUnit, doc.SettlementDocID)
+	tills, err := documentTills(doc)
+	if err != nil {
+		return fmt.Errorf("import settlement %s: %w", key.SettlementDocID, err)
+	}
+	return c.writeSettlement(ctx, key, tills, force)
+}
+
+// CopySettlement copies every till of src, reserved pseudo-tills included, to dst as
+// absolute values, e.g. to carry balances forward into the next period. The keys may
+// differ in organization and enterprise unit too. Like ImportSettlement it fails with
+// ErrSettlementExists if dst already has tills; use ForceCopySettlement to replace them.
+// Only balances are copied, not closed marks, idempotency keys, events or transactions.
+func (c Client) CopySettlement(ctx context.Context, src, dst Key) error {
+	return c.copySettlement(ctx, src, dst, false)
+}
+
+// ForceCopySettlement is CopySettlement replacing any existing dst settlement.
+func (c Client) ForceCopySettlement(ctx context.Context, src, dst Key) error {
+	return c.copySettlement(ctx, src, dst, true)
+}
+
+func (c Client) copySettlement(ctx context.Context, src, dst Key, force bool) error {
+	done, err := c.begin()
+	if err != nil {
+		return err
+	}
+	defer done()
+	if src.BaseKey() == dst.BaseKey() {
+		return fmt.Errorf("cannot copy settlement %s onto itself", src.SettlementDocID)
+	}
+	tills, err := c.getExpectedTenders(ctx, src, ReadOptions{IncludeReserved: true, Primary: true})
+	if err != nil {
+		return err
+	}
+	return c.writeSettlement(ctx, dst, tills, force)
+}
+
+// writeSettlement writes tills as the whole of the settlement in one WATCHed MULTI/EXEC,
+// replacing an existing one only when force is set.
+func (c Client) writeSettlement(ctx context.Context, key Key, tills []Till, force bool) error {
+	return c.Watch(ctx, func(tx *redis.Tx) error {
+		existing, err := tx.SCard(ctx, key.TillsSetKey()).Result()
+		if err != nil {
+			return err
+		}
+		var stale []string
+		if existing > 0 {
+			if !force {
+				return fmt.Errorf("%w: %s has %d tills", ErrSettlementExists, key.SettlementDocID, existing)
+			}
+			if stale, err = c.settlementKeys(ctx, key); err != nil {
+				return err
+			}
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			if len(stale) > 0 {
+				pipe.Del(ctx, stale...)
+			}
+			c.touchSettlement(ctx, pipe, key)
+			if len(tills) > 0 {
+				markUnlogged(ctx, pipe, key)
+			}
+			var checksum int64
+			for _, till := range tills {
+				pipe.SAdd(ctx, key.TillsSetKey(), till.ID)
+				for _, tender := range till.Tenders {
+					tenderID := tender.StoredID()
+					pipe.Set(ctx, key.TenderKey(till.ID, tenderID), tender.Amount, 0)
+					pipe.SAdd(ctx, key.TendersSetKey(till.ID), tenderID)
+					for _, denomination := range tender.TenderBreakdowns {
+						name := denomination.storedName(tender.Currency)
+						setDenomination(ctx, pipe, key.DenominationKey(till.ID, tenderID, name), denomination)
+						pipe.SAdd(ctx, key.DenominationsSetKey(till.ID, tenderID), name)
+					}
+				}
+				if len(c.ChecksumSecret) > 0 {
+					checksum += c.tillChecksum(key, till.ID, till.Tenders)
+				}
+			}
+			if len(c.ChecksumSecret) > 0 {
+				pipe.Set(ctx, key.ChecksumKey(), checksum, 0)
+			}
+			return nil
+		})
+		return err
+	}, key.TillsSetKey())
+}
+
+// documentTills converts a SettlementDocument back into tills, rejecting duplicates and
+// invalid currencies.
+func documentTills(doc SettlementDocument) ([]Till, error) {
+	tills := make([]Till, 0, len(doc.Tills))
+	seen := make(map[string]map[string]map[string]struct{})
+	for _, docTill := range doc.Tills {
+		if docTill.ID == "" {
+			return nil, errors.New("till without an ID")
+		}
+		if _, ok := seen[docTill.ID]; ok {
+			return nil, fmt.Errorf("duplicate till %s", docTill.ID)
+		}
+		seen[docTill.ID] = make(map[string]map[string]struct{})
+		till := Till{ID: docTill.ID}
+		for _, docTender := range docTill.Tenders {
+			if err := checkCurrency(docTender.ID, docTender.Currency); err != nil {
+				return nil, fmt.Errorf("till %s tender %s: %w", docTill.ID, docTender.ID, err)
+			}
+			tender := Tender{ID: docTender.ID, Currency: docTender.Currency, Amount: docTender.Amount}
+			tenderID := tender.StoredID()
+			if _, ok := seen[docTill.ID][tenderID]; ok {
+				return nil, fmt.Errorf("duplicate tender %s in till %s", tenderID, docTill.ID)
+			}
+			names := make(map[string]struct{})
+			seen[docTill.ID][tenderID] = names
+			for _, docDenomination := range docTender.Denominations {
+				if err := checkCurrency(docDenomination.Name, docDenomination.Currency); err != nil {
+					return nil, fmt.Errorf("till %s tender %s denomination %s: %w", docTill.ID, tenderID, docDenomination.Name, err)
+				}
+				denomination := TenderInfo{
+					Name:      docDenomination.Name,
+					Currency:  docDenomination.Currency,
+					Count:     docDenomination.Count,
+					Amount:    docDenomination.Amount,
+					CountOnly: docDenomination.CountOnly,
+				}
+				if denomination.Currency == "" {
+					denomination.Currency = tender.Currency
+				}
+				name := denomination.storedName(tender.Currency)
+				if _, ok := names[name]; ok {
+					return nil, fmt.Errorf("duplicate denomination %s in till %s tender %s", name, docTill.ID, tenderID)
+				}
+				names[name] = struct{}{}
+				tender.TenderBreakdowns = append(tender.TenderBreakdowns, denomination)
+			}
+			till.Tenders = append(till.Tenders, tender)
+		}
+		tills = append(tills, till)
+	}
+	return tills, nil
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestExportSettlement(t *testing.T) {
+	c, _ := newTestClient(t)
+	ctx := context.Background()
+	euros := Tender{ID: "cash", Currency: "EUR", Amount: 5, TenderBreakdowns: []TenderInfo{{Name: "bill", Count: 1, Amount: 5}}}
+	mustProcess(t, c,
+		transfer(VaultTill, "till-2", cash(3), Tender{ID: "card", Amount: 7}),
+		transfer(VaultTill, "till-1", euros),
+	)
+
+	data, err := c.ExportSettlement(ctx, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc SettlementDocument
+	if err := json.Unmarshal(data, &doc); err != nil {
+		t.Fatal(err)
+	}
+	want := SettlementDocument{
+		Version:         SettlementDocumentVersion,
+		Organization:    testKey.Organization,
+		EnterpriseUnit:  testKey.EnterpriseUnit,
+		SettlementDocID: testKey.SettlementDocID,
+		Tills: []DocumentTill{
+			{ID: "till-1", Tenders: []DocumentTender{
+				{ID: "cash", Currency: "EUR", Amount: 5, Denominations: []DocumentDenomination{{Name: "bill", Currency: "EUR", Count: 1, Amount: 5}}},
+			}},
+			{ID: "till-2", Tenders: []DocumentTender{
+				{ID: "card", Amount: 7},
+				{ID: "cash", Amount: 3, Denominations: []DocumentDenomination{{Name: "bill", Count: 3, Amount: 3}}},
+			}},
+			{ID: VaultTill, Tenders: []DocumentTender{
+				{ID: "card", Amount: -7},
+				{ID: "cash", Amount: -3, Denominations: []DocumentDenomination{{Name: "bill", Count: -3, Amount: -3}}},
+				{ID: "cash", Currency: "EUR", Amount: -5, Denominations: []DocumentDenomination{{Name: "bill", Currency: "EUR", Count: -1, Amount: -5}}},
+			}},
+		},
+	}
+	if !reflect.DeepEqual(doc, want) {
+		t.Errorf("ExportSettlement() = %+v, want %+v", doc, want)
+	}
+
+	again, err := c.ExportSettlement(ctx, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(again, data) {
+		t.Errorf("exporting the same state twice gave %s and %s", data, again)
+	}
+}
+
+func TestImportSettlement(t *testing.T) {
+	c, _ := newTestClient(t)
+	ctx := context.Background()
+	euros := Tender{ID: "cash", Currency: "EUR", Amount: 5, TenderBreakdowns: []TenderInfo{{Name: "bill", Count: 1, Amount: 5}}}
+	mustProcess(t, c, transfer(VaultTill, "till-1", cash(3), euros, Tender{ID: "card", Amount: 7}))
+	want, err := c.GetExpectedTenders(ctx, testKey, WithReservedTills())
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := c.ExportSettlement(ctx, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.ImportSettlement(ctx, data); !errors.Is(err, ErrSettlementExists) {
+		t.Fatalf("ImportSettlement() over live balances error = %v, want %v", err, ErrSettlementExists)
+	}
+	if err := c.DeleteSettlement(ctx, testKey); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.ImportSettlement(ctx, data); err != nil {
+		t.Fatal(err)
+	}
+	got, err := c.GetExpectedTenders(ctx, testKey, WithReservedTills())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("GetExpectedTenders() after import = %+v, want %+v", got, want)
+	}
+
+	// A forced import replaces the settlement, dropping tills the archive doesn't have
+	mustProcess(t, c, transfer(VaultTill, "till-2", cash(1)))
+	if err := c.ForceImportSettlement(ctx, data); err != nil {
+		t.Fatal(err)
+	}
+	if got, err = c.GetExpectedTenders(ctx, testKey, WithReservedTills()); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("GetExpectedTenders() after forced import = %+v, want %+v", got, want)
+	}
+
+	for _, bad := range []string{
+		`not json`,
+		`{"version":2}`,
+		`{"version":1,"organization":"o","enterprise_unit":"e","settlement_doc_id":"s","tills":[{"id":"t"},{"id":"t"}]}`,
+	} {
+		if err := c.ForceImportSettlement(ctx, []byte(bad)); err == nil {
+			t.Errorf("ForceImportSettlement(%s) succeeded", bad)
+		}
+	}
+}
+
+func TestCopySettlement(t *testing.T) {
+	c, _ := newTestClient(t)
+	ctx := context.Background()
+	mustProcess(t, c, transfer(VaultTill, "till-1", cash(8), Tender{ID: "cash", Currency: "EUR", Amount: 3}))
+	want, err := c.GetExpectedTenders(ctx, testKey, WithReservedTills())
+	if err != nil {
+		t.Fatal(err)
+	}
+	next := Key{Organization: testKey.Organization, EnterpriseUnit: "other-eu", SettlementDocID: "settlement-2"}
+
+	if err := c.CopySettlement(ctx, testKey, next); err != nil {
+		t.Fatal(err)
+	}
+	got, err := c.GetExpectedTenders(ctx, next, WithReservedTills())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("copied settlement = %+v, want %+v", got, want)
+	}
+
+	// Later changes to the source reach the copy only through a forced copy
+	mustProcess(t, c, transfer(VaultTill, "till-2", cash(1)))
+	if err := c.CopySettlement(ctx, testKey, next); !errors.Is(err, ErrSettlementExists) {
+		t.Errorf("CopySettlement() onto a live settlement error = %v, want %v", err, ErrSettlementExists)
+	}
+	if tills, err := c.ListTills(ctx, next); err != nil || !reflect.DeepEqual(tills, []string{"till-1"}) {
+		t.Errorf("ListTills() of the copy = %v, %v, want only till-1", tills, err)
+	}
+	if err := c.ForceCopySettlement(ctx, testKey, next); err != nil {
+		t.Fatal(err)
+	}
+	if tills, err := c.ListTills(ctx, next); err != nil || !reflect.DeepEqual(tills, []string{"till-1", "till-2"}) {
+		t.Errorf("ListTills() after ForceCopySettlement() = %v, %v, want till-1 and till-2", tills, err)
+	}
+	if err := c.CopySettlement(ctx, testKey, testKey); err == nil {
+		t.Error("CopySettlement() onto itself succeeded")
+	}
+}
@@ -0,0 +1,470 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+var ErrMixedCurrencies = errors.New("amounts in different currencies")
+
+// TillContributions returns, for each till touched by the last window entries of the
+// transaction log, the net amount those transactions moved into it minus what they
+// moved out, reserved pseudo-tills included. Only transactions stored with a
+// TransactionID are in the log. The net amounts add up tender totals, so it fails with
+// ErrMixedCurrencies if the window moves tenders of more than one currency, counting
+// tenders without one as a currency of their own.
+func (c Client) TillContributions(ctx context.Context, key Key, window int) (map[string]Money, error) {
+	if window <= 0 {
+		return nil, fmt.Errorf("invalid window %d", window)
+	}
+	entries, err := c.reader(ReadOptions{}).XRevRangeN(ctx, key.TransactionLogKey(), "+", "-", int64(window)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("read transaction log of settlement %s: %w", key.SettlementDocID, err)
+	}
+	contributions := make(map[string]Money)
+	var currency string
+	var seen bool
+	for _, entry := range entries {
+		a, err := c.loggedTransaction(ctx, key, entry)
+		if err != nil {
+			return nil, err
+		}
+		for _, tender := range a.Tenders {
+			if !seen {
+				currency, seen = tender.Currency, true
+			}
+			if tender.Currency != currency {
+				return nil, fmt.Errorf("%w: %q and %q in the last %d transactions of settlement %s", ErrMixedCurrencies, currency, tender.Currency, window, key.SettlementDocID)
+			}
+		}
+		for _, delta := range transactionDeltas(a.Source, a.Destination, a.Direction, a.Tenders) {
+			if delta.Denomination == "" {
+				contributions[delta.Till] += delta.Amount
+			}
+		}
+	}
+	return contributions, nil
+}
+
+// OpenClose is a tender's balance in a till over the period covered by the transaction
+// log.
+type OpenClose struct {
+	Opening Money // Before the first logged transaction moving the tender in the till
+	Closing Money // The current balance
+}
+
+// TenderOpenClose returns the opening and closing balance of every tender the transaction
+// log moves, keyed by till and then stored tender ID, reserved pseudo-tills included. The
+// closing balance is the tender's current total and the opening one is what it was before
+// the logged transactions, found by replaying them backwards from it. Changes made outside
+// the log, such as opening floats or transactions without a TransactionID, are taken to
+// precede it. The log and the totals are read from the primary under WATCH of the log, so
+// they match even while transactions are being applied.
+func (c Client) TenderOpenClose(ctx context.Context, key Key) (map[string]map[string]OpenClose, error) {
+	_, balances, err := c.logBalances(ctx, key)
+	return balances, err
+}
+
+// logBalances returns the decoded transaction log along with the balances of
+// TenderOpenClose, read together.
+func (c Client) logBalances(ctx context.Context, key Key) ([]LogEntry, map[string]map[string]OpenClose, error) {
+	var log []LogEntry
+	var balances map[string]map[string]OpenClose
+	err := c.watchRetry(ctx, func(tx *redis.Tx) error {
+		entries, err := tx.XRange(ctx, key.TransactionLogKey(), "-", "+").Result()
+		if err != nil {
+			return fmt.Errorf("read transaction log of settlement %s: %w", key.SettlementDocID, err)
+		}
+		log = make([]LogEntry, len(entries))
+		balances = make(map[string]map[string]OpenClose)
+		for i, entry := range entries {
+			if log[i], err = c.logEntry(ctx, key, entry); err != nil {
+				return err
+			}
+			direction, _ := log[i].Direction.sign()
+			for _, delta := range transactionDeltas(log[i].Source, log[i].Destination, direction, log[i].Tenders) {
+				if delta.Denomination != "" {
+					continue
+				}
+				if balances[delta.Till] == nil {
+					balances[delta.Till] = make(map[string]OpenClose)
+				}
+				b := balances[delta.Till][delta.Tender]
+				b.Opening -= delta.Amount
+				balances[delta.Till][delta.Tender] = b
+			}
+		}
+
+		totals := make(map[string]map[string]*redis.StringCmd)
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			for tillID, tenders := range balances {
+				totals[tillID] = make(map[string]*redis.StringCmd)
+				for tenderID := range tenders {
+					totals[tillID][tenderID] = pipe.Get(ctx, key.TenderKey(tillID, tenderID))
+				}
+			}
+			return nil
+		})
+		if err != nil && !errors.Is(err, redis.Nil) {
+			return fmt.Errorf("read tender totals of settlement %s: %w", key.SettlementDocID, err)
+		}
+		for tillID, tenders := range balances {
+			for tenderID, b := range tenders {
+				raw, err := totals[tillID][tenderID].Result()
+				switch {
+				case errors.Is(err, redis.Nil):
+					raw = "0"
+				case err != nil:
+					return fmt.Errorf("read %s: %w", key.TenderKey(tillID, tenderID), err)
+				}
+				total, err := parseMoney(raw)
+				if err != nil {
+					return &ParseError{Key: key.TenderKey(tillID, tenderID), Value: raw, Err: err}
+				}
+				b.Opening += total
+				b.Closing = total
+				tenders[tenderID] = b
+			}
+		}
+		return nil
+	}, key.TransactionLogKey())
+	if err != nil {
+		return nil, nil, err
+	}
+	return log, balances, nil
+}
+
+// GetTillTransactions returns the stored transactions with tillID as their source or
+// destination, in the order they were applied, and an empty slice when there are none.
+// The transaction log is read a page of transactionBatchSize entries at a time, so
+// transactions applied meanwhile may or may not be included.
+func (c Client) GetTillTransactions(ctx context.Context, key Key, tillID string) ([]Transaction, error) {
+	r := c.reader(ReadOptions{})
+	txs := make([]Transaction, 0)
+	start := "-"
+	for {
+		entries, err := r.XRangeN(ctx, key.TransactionLogKey(), start, "+", transactionBatchSize).Result()
+		if err != nil {
+			return nil, fmt.Errorf("read transaction log of settlement %s: %w", key.SettlementDocID, err)
+		}
+		var ids []string
+		for _, entry := range entries {
+			e, err := c.logEntry(ctx, key, entry)
+			if err != nil {
+				return nil, err
+			}
+			if e.Source == tillID || e.Destination == tillID {
+				ids = append(ids, e.TransactionID)
+			}
+		}
+		if len(ids) > 0 {
+			page, err := storedTransactions(ctx, r, key, ids)
+			if err != nil {
+				return nil, err
+			}
+			txs = append(txs, page...)
+		}
+		if len(entries) < transactionBatchSize {
+			return txs, nil
+		}
+		start = "(" + entries[len(entries)-1].ID
+	}
+}
+
+// ExportTransactionLog writes the stored transactions applied from from up to, but not
+// including, to as NDJSON to w, one transaction per line in the order they were applied.
+// A transaction's time is that of its transaction log entry, whose stream ID the server
+// assigned when it was applied, to the millisecond. The log is read and written a page of
+// transactionBatchSize entries at a time, so a large range is never held in memory and
+// transactions applied meanwhile may or may not be included.
+func (c Client) ExportTransactionLog(ctx context.Context, key Key, from, to time.Time, w io.Writer) error {
+	if !to.After(from) {
+		return fmt.Errorf("invalid export range %s to %s", from, to)
+	}
+	r := c.reader(ReadOptions{})
+	encoder := json.NewEncoder(w)
+	start, end := strconv.FormatInt(from.UnixMilli(), 10), strconv.FormatInt(to.UnixMilli()-1, 10)
+	for {
+		entries, err := r.XRangeN(ctx, key.TransactionLogKey(), start, end, transactionBatchSize).Result()
+		if err != nil {
+			return fmt.Errorf("read transaction log of settlement %s: %w", key.SettlementDocID, err)
+		}
+		ids := make([]string, 0, len(entries))
+		for _, entry := range entries {
+			e, err := c.logEntry(ctx, key, entry)
+			if err != nil {
+				return err
+			}
+			ids = append(ids, e.TransactionID)
+		}
+		if len(ids) > 0 {
+			txs, err := storedTransactions(ctx, r, key, ids)
+			if err != nil {
+				return err
+			}
+			for _, t := range txs {
+				if err := encoder.Encode(t); err != nil {
+					return fmt.Errorf("write transaction log of settlement %s: %w", key.SettlementDocID, err)
+				}
+			}
+		}
+		if len(entries) < transactionBatchSize {
+			return nil
+		}
+		start = "(" + entries[len(entries)-1].ID
+	}
+}
+
+// DenomChange is the net change of one of a till's denominations over a segment of the
+// transaction log, see ChangedDenominations.
+type DenomChange struct {
+	Till         string
+	Tender       string // Stored tender ID, see Tender.StoredID
+	Denomination string // Stored denomination name
+	Count        int
+	Amount       Money
+}
+
+// ChangedDenominations replays the transaction log entries after fromID up to and including
+// toID and returns each denomination they changed on net, ordered by till, tender, then
+// denomination. An empty fromID starts at the beginning of the log and an empty toID runs to
+// its end; the IDs are the stream entry IDs of LogEntry.ID. Tender totals aren't reported,
+// and only transactions stored with a TransactionID are in the log. The segment is read a
+// page of transactionBatchSize entries at a time, like GetTillTransactions.
+func (c Client) ChangedDenominations(ctx context.Context, key Key, fromID, toID string) ([]DenomChange, error) {
+	type changeKey struct{ till, tender, denomination string }
+	changes := make(map[changeKey]*DenomChange)
+	r := c.reader(ReadOptions{})
+	start, end := "-", "+"
+	if fromID != "" {
+		start = "(" + fromID
+	}
+	if toID != "" {
+		end = toID
+	}
+	for {
+		entries, err := r.XRangeN(ctx, key.TransactionLogKey(), start, end, transactionBatchSize).Result()
+		if err != nil {
+			return nil, fmt.Errorf("read transaction log of settlement %s: %w", key.SettlementDocID, err)
+		}
+		for _, entry := range entries {
+			e, err := c.logEntry(ctx, key, entry)
+			if err != nil {
+				return nil, err
+			}
+			direction, _ := e.Direction.sign()
+			for _, delta := range transactionDeltas(e.Source, e.Destination, direction, e.Tenders) {
+				if delta.Denomination == "" {
+					continue
+				}
+				k := changeKey{delta.Till, delta.Tender, delta.Denomination}
+				change, ok := changes[k]
+				if !ok {
+					change = &DenomChange{Till: k.till, Tender: k.tender, Denomination: k.denomination}
+					changes[k] = change
+				}
+				change.Count += delta.Count
+				change.Amount += delta.Amount
+			}
+		}
+		if len(entries) < transactionBatchSize {
+			break
+		}
+		start = "(" + entries[len(entries)-1].ID
+	}
+
+	out := []DenomChange{}
+	for _, change := range changes {
+		if change.Count != 0 || change.Amount != 0 {
+			out = append(out, *change)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		a, b := out[i], out[j]
+		if a.Till != b.Till {
+			return a.Till < b.Till
+		}
+		if a.Tender != b.Tender {
+			return a.Tender < b.Tender
+		}
+		return a.Denomination < b.Denomination
+	})
+	return out, nil
+}
+
+// AuditReport writes a plain-text audit of the settlement's transaction log to w: the
+// opening balances, each logged transaction in order with the balances it changed, and the
+// closing balances, followed by a reconciliation of the balances replayed from the opening
+// ones against the closing ones. Balances are those of TenderOpenClose, so anything changed
+// outside the log shows up in the opening balances, and amounts are shown with
+// FormatAmount. The report is written once it is complete, so nothing reaches w on error.
+func (c Client) AuditReport(ctx context.Context, key Key, w io.Writer) error {
+	log, balances, err := c.logBalances(ctx, key)
+	if err != nil {
+		return err
+	}
+	amount := func(tenderID string, m Money) string {
+		return FormatAmount(m, tenderFromStoredID(tenderID).Currency)
+	}
+	var b strings.Builder
+	writeBalances := func(title string, balance func(OpenClose) Money) {
+		fmt.Fprintf(&b, "%s\n", title)
+		for _, tillID := range sortedKeys(balances) {
+			for _, tenderID := range sortedKeys(balances[tillID]) {
+				fmt.Fprintf(&b, "  %s %s %s\n", tillID, tenderID, amount(tenderID, balance(balances[tillID][tenderID])))
+			}
+		}
+	}
+
+	fmt.Fprintf(&b, "Audit of settlement %s\n", key.SettlementDocID)
+	writeBalances("Opening balances", func(oc OpenClose) Money { return oc.Opening })
+	replayed := make(map[string]map[string]Money, len(balances))
+	for tillID, tenders := range balances {
+		replayed[tillID] = make(map[string]Money, len(tenders))
+		for tenderID, oc := range tenders {
+			replayed[tillID][tenderID] = oc.Opening
+		}
+	}
+	fmt.Fprintf(&b, "Transactions\n")
+	for i, e := range log {
+		fmt.Fprintf(&b, "  %d. %s %s %s -> %s", i+1, e.TransactionID, e.Direction, e.Source, e.Destination)
+		if e.Kind == LogCorrection {
+			fmt.Fprintf(&b, ", correcting %s", e.Ref)
+		}
+		fmt.Fprintf(&b, "\n")
+		direction, _ := e.Direction.sign()
+		for _, delta := range transactionDeltas(e.Source, e.Destination, direction, e.Tenders) {
+			if delta.Denomination != "" {
+				continue
+			}
+			before := replayed[delta.Till][delta.Tender]
+			replayed[delta.Till][delta.Tender] += delta.Amount
+			fmt.Fprintf(&b, "     %s %s %s -> %s\n", delta.Till, delta.Tender, amount(delta.Tender, before), amount(delta.Tender, before+delta.Amount))
+		}
+	}
+	writeBalances("Closing balances", func(oc OpenClose) Money { return oc.Closing })
+
+	fmt.Fprintf(&b, "Reconciliation\n")
+	var mismatches int
+	for _, tillID := range sortedKeys(balances) {
+		for _, tenderID := range sortedKeys(balances[tillID]) {
+			if got, want := replayed[tillID][tenderID], balances[tillID][tenderID].Closing; got != want {
+				mismatches++
+				fmt.Fprintf(&b, "  %s %s replayed %s, closing %s\n", tillID, tenderID, amount(tenderID, got), amount(tenderID, want))
+			}
+		}
+	}
+	if mismatches == 0 {
+		fmt.Fprintf(&b, "  %d transactions reconcile with the closing balances\n", len(log))
+	}
+	if _, err := io.WriteString(w, b.String()); err != nil {
+		return fmt.Errorf("write audit report of settlement %s: %w", key.SettlementDocID, err)
+	}
+	return nil
+}
+
+// Collision is an idempotency key carried by stored transactions that differ in more than
+// their TransactionID, a caller reusing the key for a different transaction.
+type Collision struct {
+	IdempotencyKey string
+	TransactionIDs []string // Of the transactions carrying the key, in the order they were applied
+	Live           bool     // The key still has an idempotency marker, so it is still rejected
+}
+
+// AuditIdempotencyCollisions returns the idempotency keys shared by stored transactions
+// with different payloads, ordered by key. Such transactions were all applied, since a
+// reused key only gets past the check once its marker has expired, see IdempotencyTTL. Each
+// key is checked against the applied keys and the legacy applied set for whether it is
+// still live. Only transactions stored with a TransactionID can be audited; the log is read
+// a page of transactionBatchSize entries at a time, like GetTillTransactions.
+func (c Client) AuditIdempotencyCollisions(ctx context.Context, key Key) ([]Collision, error) {
+	r := c.reader(ReadOptions{})
+	byKey := make(map[string][]Transaction)
+	start := "-"
+	for {
+		entries, err := r.XRangeN(ctx, key.TransactionLogKey(), start, "+", transactionBatchSize).Result()
+		if err != nil {
+			return nil, fmt.Errorf("read transaction log of settlement %s: %w", key.SettlementDocID, err)
+		}
+		ids := make([]string, 0, len(entries))
+		for _, entry := range entries {
+			e, err := c.logEntry(ctx, key, entry)
+			if err != nil {
+				return nil, err
+			}
+			ids = append(ids, e.TransactionID)
+		}
+		if len(ids) > 0 {
+			txs, err := storedTransactions(ctx, r, key, ids)
+			if err != nil {
+				return nil, err
+			}
+			for _, t := range txs {
+				if t.IdempotencyKey != "" {
+					byKey[t.IdempotencyKey] = append(byKey[t.IdempotencyKey], t)
+				}
+			}
+		}
+		if len(entries) < transactionBatchSize {
+			break
+		}
+		start = "(" + entries[len(entries)-1].ID
+	}
+
+	collisions := []Collision{}
+	for _, idempotencyKey := range sortedKeys(byKey) {
+		txs := byKey[idempotencyKey]
+		differ := false
+		for _, t := range txs[1:] {
+			if differ = differentPayloads(txs[0], t); differ {
+				break
+			}
+		}
+		if !differ {
+			continue
+		}
+		collision := Collision{IdempotencyKey: idempotencyKey}
+		for _, t := range txs {
+			collision.TransactionIDs = append(collision.TransactionIDs, t.TransactionID)
+		}
+		collisions = append(collisions, collision)
+	}
+	if len(collisions) == 0 {
+		return collisions, nil
+	}
+
+	expiries := make([]*redis.FloatCmd, len(collisions))
+	legacy := make([]*redis.BoolCmd, len(collisions))
+	_, err := r.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, collision := range collisions {
+			expiries[i] = pipe.ZScore(ctx, key.AppliedKeysKey(), collision.IdempotencyKey)
+			legacy[i] = pipe.SIsMember(ctx, key.AppliedSetKey(), collision.IdempotencyKey)
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return nil, fmt.Errorf("read idempotency markers of settlement %s: %w", key.SettlementDocID, err)
+	}
+	now := c.now().UnixMilli()
+	for i := range collisions {
+		expires, err := expiries[i].Result()
+		collisions[i].Live = err == nil && int64(expires) > now || legacy[i].Val()
+	}
+	return collisions, nil
+}
+
+// differentPayloads reports whether a and b differ in more than their TransactionID.
+func differentPayloads(a, b Transaction) bool {
+	a.TransactionID, b.TransactionID = "", ""
+	return !reflect.DeepEqual(a, b)
+}
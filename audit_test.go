@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTillContributions(t *testing.T) {
+	c, _ := newTestClient(t)
+	ctx := context.Background()
+	debit := stored("tx-4", transfer("till-1", "till-3", cash(5)))
+	debit.Direction = DirectionDebit
+	mustProcess(t, c,
+		stored("tx-1", transfer(VaultTill, "till-1", cash(100))),
+		stored("tx-2", transfer("till-1", "till-2", cash(30), Tender{ID: "card", Amount: 20})),
+		transfer("till-2", "till-3", cash(1000)), // Not stored, so not in the log
+		stored("tx-3", transfer("till-2", VaultTill, cash(10))),
+		debit,
+	)
+
+	tests := []struct {
+		window int
+		want   map[string]Money
+	}{
+		{window: 1, want: map[string]Money{"till-1": 5, "till-3": -5}},
+		{window: 3, want: map[string]Money{"till-1": -45, "till-2": 40, "till-3": -5, VaultTill: 10}},
+		{window: 10, want: map[string]Money{"till-1": 55, "till-2": 40, "till-3": -5, VaultTill: -90}},
+	}
+	for _, tt := range tests {
+		got, err := c.TillContributions(ctx, testKey, tt.window)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("TillContributions(%d) = %v, want %v", tt.window, got, tt.want)
+		}
+	}
+
+	if _, err := c.TillContributions(ctx, testKey, 0); err == nil {
+		t.Error("TillContributions() over an empty window succeeded")
+	}
+	mustProcess(t, c, stored("tx-5", transfer("till-1", "till-2", Tender{ID: "cash", Currency: "EUR", Amount: 1})))
+	if _, err := c.TillContributions(ctx, testKey, 2); !errors.Is(err, ErrMixedCurrencies) {
+		t.Errorf("TillContributions() over two currencies error = %v, want %v", err, ErrMixedCurrencies)
+	}
+}
+
+func TestTenderOpenClose(t *testing.T) {
+	c, _ := newTestClient(t)
+	ctx := context.Background()
+	// The opening floats aren't stored, so they precede the log
+	mustProcess(t, c,
+		transfer(VaultTill, "till-1", cash(50)),
+		transfer(VaultTill, "till-2", Tender{ID: "card", Amount: 7}),
+		stored("tx-1", transfer("till-1", "till-2", cash(20))),
+		stored("tx-2", transfer(VaultTill, "till-1", cash(5), Tender{ID: "cash", Currency: "EUR", Amount: 3})),
+		stored("tx-3", transfer("till-2", "till-3", cash(15))),
+	)
+	// So is removing a tender: with its total gone, it opened at minus what the log moved in
+	if err := c.RemoveTender(ctx, testKey, "till-3", "cash"); err != nil {
+		t.Fatal(err)
+	}
+	got, err := c.TenderOpenClose(ctx, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]map[string]OpenClose{
+		VaultTill: {"cash": {Opening: -50, Closing: -55}, "cash@EUR": {Opening: 0, Closing: -3}},
+		"till-1":  {"cash": {Opening: 50, Closing: 35}, "cash@EUR": {Opening: 0, Closing: 3}},
+		"till-2":  {"cash": {Opening: 0, Closing: 5}},
+		"till-3":  {"cash": {Opening: -15, Closing: 0}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("TenderOpenClose() = %v, want %v", got, want)
+	}
+}
+
+func TestGetTillTransactions(t *testing.T) {
+	c, _ := newTestClient(t)
+	ctx := context.Background()
+	log := []Transaction{
+		stored("tx-1", transfer(VaultTill, "till-1", cash(100))),
+		stored("tx-2", transfer("till-1", "till-2", cash(30))),
+		stored("tx-3", transfer(VaultTill, "till-3", cash(10))),
+		transfer("till-3", "till-2", cash(1)), // Not stored, so not in the log
+		stored("tx-4", transfer("till-2", "till-3", Tender{ID: "card", Amount: 4})),
+	}
+	mustProcess(t, c, log...)
+	if err := c.ReverseTransactionByID(ctx, testKey, "tx-2"); err != nil {
+		t.Fatal(err)
+	}
+	reversal, err := c.GetTransaction(ctx, testKey, "tx-2"+reversalSuffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		tillID string
+		want   []Transaction
+	}{
+		{tillID: "till-1", want: []Transaction{log[0], log[1], reversal}},
+		{tillID: "till-2", want: []Transaction{log[1], log[4], reversal}},
+		{tillID: "till-3", want: []Transaction{log[2], log[4]}},
+		{tillID: "till-4", want: []Transaction{}},
+	}
+	for _, tt := range tests {
+		got, err := c.GetTillTransactions(ctx, testKey, tt.tillID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("GetTillTransactions(%s) = %+v, want %+v", tt.tillID, got, tt.want)
+		}
+	}
+}
+
+func TestExportTransactionLog(t *testing.T) {
+	c, mr := newTestClient(t)
+	ctx := context.Background()
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	// The log's stream IDs are assigned from the server's clock
+	var log []Transaction
+	for i := 0; i < 5; i++ {
+		mr.SetTime(start.Add(time.Duration(i) * time.Hour))
+		tx := stored(fmt.Sprintf("tx-%d", i), transfer(VaultTill, "till-1", cash(Money(i+1))))
+		mustProcess(t, c, tx, transfer(VaultTill, "till-2", cash(1))) // Not stored, so not exported
+		log = append(log, tx)
+	}
+
+	tests := []struct {
+		from, to time.Time
+		want     []Transaction
+	}{
+		{from: start, to: start.Add(5 * time.Hour), want: log},
+		{from: start.Add(time.Hour), to: start.Add(3 * time.Hour), want: log[1:3]},
+		{from: start.Add(30 * time.Minute), to: start.Add(time.Hour + time.Millisecond), want: log[1:2]},
+		{from: start.Add(5 * time.Hour), to: start.Add(6 * time.Hour)},
+	}
+	for _, tt := range tests {
+		var b bytes.Buffer
+		if err := c.ExportTransactionLog(ctx, testKey, tt.from, tt.to, &b); err != nil {
+			t.Fatal(err)
+		}
+		var got []Transaction
+		decoder := json.NewDecoder(&b)
+		for decoder.More() {
+			var tx Transaction
+			if err := decoder.Decode(&tx); err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, tx)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ExportTransactionLog(%s, %s) = %+v, want %+v", tt.from, tt.to, got, tt.want)
+		}
+	}
+
+	if err := c.ExportTransactionLog(ctx, testKey, start, start, &bytes.Buffer{}); err == nil {
+		t.Error("ExportTransactionLog() over an empty range succeeded")
+	}
+}
+
+func TestChangedDenominations(t *testing.T) {
+	c, _ := newTestClient(t)
+	ctx := context.Background()
+	coins := Tender{ID: "cash", Currency: "EUR", Amount: 5, TenderBreakdowns: []TenderInfo{{Name: "coin", Count: 5, Amount: 5}}}
+	mustProcess(t, c,
+		stored("tx-1", transfer(VaultTill, "till-1", cash(100))),
+		stored("tx-2", transfer("till-1", "till-2", cash(30), coins)),
+		transfer("till-2", "till-1", cash(1)), // Not stored, so not in the log
+		stored("tx-3", transfer("till-2", "till-1", cash(30))),
+		stored("tx-4", transfer("till-1", "till-3", cash(10))),
+	)
+	log, _, err := c.GetTransactionLog(ctx, testKey, "", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	coin := coins.TenderBreakdowns[0].storedName(coins.Currency)
+
+	tests := []struct {
+		fromID, toID string
+		want         []DenomChange
+	}{
+		{want: []DenomChange{
+			{Till: "till-1", Tender: "cash", Denomination: "bill", Count: 90, Amount: 90},
+			{Till: "till-1", Tender: "cash@EUR", Denomination: coin, Count: -5, Amount: -5},
+			{Till: "till-2", Tender: "cash@EUR", Denomination: coin, Count: 5, Amount: 5},
+			{Till: "till-3", Tender: "cash", Denomination: "bill", Count: 10, Amount: 10},
+			{Till: VaultTill, Tender: "cash", Denomination: "bill", Count: -100, Amount: -100},
+		}},
+		// The bills moved by tx-2 come back in tx-3
+		{fromID: log[0].ID, toID: log[2].ID, want: []DenomChange{
+			{Till: "till-1", Tender: "cash@EUR", Denomination: coin, Count: -5, Amount: -5},
+			{Till: "till-2", Tender: "cash@EUR", Denomination: coin, Count: 5, Amount: 5},
+		}},
+		{fromID: log[2].ID, want: []DenomChange{
+			{Till: "till-1", Tender: "cash", Denomination: "bill", Count: -10, Amount: -10},
+			{Till: "till-3", Tender: "cash", Denomination: "bill", Count: 10, Amount: 10},
+		}},
+		{fromID: log[3].ID, want: []DenomChange{}},
+	}
+	for _, tt := range tests {
+		got, err := c.ChangedDenominations(ctx, testKey, tt.fromID, tt.toID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ChangedDenominations(%q, %q) = %+v, want %+v", tt.fromID, tt.toID, got, tt.want)
+		}
+	}
+}
+
+func TestAuditReport(t *testing.T) {
+	c, _ := newTestClient(t)
+	ctx := context.Background()
+	mustProcess(t, c,
+		transfer(VaultTill, "till-1", cash(500)), // Not stored, so part of the opening balances
+		stored("tx-1", transfer("till-1", "till-2", cash(120))),
+		stored("tx-2", transfer(VaultTill, "till-2", Tender{ID: "cash", Currency: "EUR", Amount: 250})),
+	)
+	if err := c.CorrectTransaction(ctx, "tx-1", stored("tx-3", transfer("till-2", "till-1", cash(20)))); err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	if err := c.AuditReport(ctx, testKey, &b); err != nil {
+		t.Fatal(err)
+	}
+	want := `Audit of settlement ` + testKey.SettlementDocID + `
+Opening balances
+  till-1 cash 5.00
+  till-2 cash 0.00
+  till-2 cash@EUR €0.00
+  vault cash@EUR €0.00
+Transactions
+  1. tx-1 credit till-1 -> till-2
+     till-2 cash 0.00 -> 1.20
+     till-1 cash 5.00 -> 3.80
+  2. tx-2 credit vault -> till-2
+     till-2 cash@EUR €0.00 -> €2.50
+     vault cash@EUR €0.00 -> -€2.50
+  3. tx-3 credit till-2 -> till-1, correcting tx-1
+     till-1 cash 3.80 -> 4.00
+     till-2 cash 1.20 -> 1.00
+Closing balances
+  till-1 cash 4.00
+  till-2 cash 1.00
+  till-2 cash@EUR €2.50
+  vault cash@EUR -€2.50
+Reconciliation
+  3 transactions reconcile with the closing balances
+`
+	if got := b.String(); got != want {
+		t.Errorf("AuditReport() =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestAuditIdempotencyCollisions(t *testing.T) {
+	c, _ := newTestClient(t)
+	ctx := context.Background()
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := &testClock{now: start}
+	c.Clock, c.IdempotencyTTL = clock.Now, time.Hour
+	keyed := func(id, idempotencyKey string, amount Money) Transaction {
+		tx := stored(id, transfer(VaultTill, "till-1", cash(amount)))
+		tx.IdempotencyKey = idempotencyKey
+		return tx
+	}
+	if got, err := c.AuditIdempotencyCollisions(ctx, testKey); err != nil || len(got) != 0 {
+		t.Errorf("AuditIdempotencyCollisions() of an empty log = %v, %v, want none", got, err)
+	}
+
+	mustProcess(t, c, keyed("tx-1", "k1", 10), keyed("tx-3", "k2", 5), keyed("tx-5", "k3", 1))
+	// Each marker has expired, so every reuse is applied; k2 is sent again unchanged
+	clock.Set(start.Add(2 * time.Hour))
+	mustProcess(t, c, keyed("tx-2", "k1", 99), keyed("tx-4", "k2", 5), keyed("tx-6", "k3", 2))
+	clock.Set(start.Add(4 * time.Hour))
+	mustProcess(t, c, keyed("tx-7", "k1", 7))
+
+	got, err := c.AuditIdempotencyCollisions(ctx, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Collision{
+		{IdempotencyKey: "k1", TransactionIDs: []string{"tx-1", "tx-2", "tx-7"}, Live: true},
+		{IdempotencyKey: "k3", TransactionIDs: []string{"tx-5", "tx-6"}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("AuditIdempotencyCollisions() = %+v, want %+v", got, want)
+	}
+}
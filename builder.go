@@ -0,0 +1,89 @@
+package main
+
+import "fmt"
+
+// TransactionBuilder assembles a Transaction step by step, see NewTransaction. The first
+// mistake is remembered and reported by Build.
+type TransactionBuilder struct {
+	t       Transaction
+	tenders map[string]int // Tender ID -> index in t.Tenders
+	err     error
+}
+
+// NewTransaction starts a credit transaction in the given settlement, e.g.
+//
+//	NewTransaction(org, eu, id).From("till-1").To("till-2").AddTender("cash", 150).
+//		AddDenomination("cash", "dollar bill", 1, 100).AddDenomination("cash", "quarter", 2, 50).Build()
+func NewTransaction(org, eu, settlementID string) *TransactionBuilder {
+	return &TransactionBuilder{
+		t:       Transaction{Org: org, EU: eu, SettlementDocID: settlementID, Direction: DirectionCredit},
+		tenders: make(map[string]int),
+	}
+}
+
+func (b *TransactionBuilder) From(till string) *TransactionBuilder {
+	b.t.Source = till
+	return b
+}
+
+func (b *TransactionBuilder) To(till string) *TransactionBuilder {
+	b.t.Destination = till
+	return b
+}
+
+// Direction overrides the default DirectionCredit.
+func (b *TransactionBuilder) Direction(d Direction) *TransactionBuilder {
+	b.t.Direction = d
+	return b
+}
+
+// AddTender adds a tender moving amount. Adding the same tender ID twice is an error.
+func (b *TransactionBuilder) AddTender(id string, amount Money) *TransactionBuilder {
+	if _, ok := b.tenders[id]; ok {
+		b.fail(fmt.Errorf("%w: tender %s added twice", ErrInvalidTransaction, id))
+		return b
+	}
+	b.tenders[id] = len(b.t.Tenders)
+	b.t.Tenders = append(b.t.Tenders, Tender{ID: id, Amount: amount})
+	return b
+}
+
+// AddDenomination adds a breakdown to a tender already added with AddTender.
+func (b *TransactionBuilder) AddDenomination(tenderID, name string, count int, amount Money) *TransactionBuilder {
+	i, ok := b.tenders[tenderID]
+	if !ok {
+		b.fail(fmt.Errorf("%w: denomination %s of unknown tender %s", ErrInvalidTransaction, name, tenderID))
+		return b
+	}
+	b.t.Tenders[i].TenderBreakdowns = append(b.t.Tenders[i].TenderBreakdowns, TenderInfo{Name: name, Count: count, Amount: amount})
+	return b
+}
+
+// IdempotencyKey sets the transaction's IdempotencyKey.
+func (b *TransactionBuilder) IdempotencyKey(k string) *TransactionBuilder {
+	b.t.IdempotencyKey = k
+	return b
+}
+
+func (b *TransactionBuilder) fail(err error) {
+	if b.err == nil {
+		b.err = err
+	}
+}
+
+// Build returns the transaction, or the first error from building it or from the checks
+// ProcessTransaction runs before reading Redis on a default client: a valid direction,
+// distinct source and destination, non-empty key components, non-negative amounts and
+// counts, and breakdowns summing to their tender's amount.
+func (b *TransactionBuilder) Build() (Transaction, error) {
+	if b.err != nil {
+		return Transaction{}, b.err
+	}
+	if _, err := checkTransaction(b.t); err != nil {
+		return Transaction{}, err
+	}
+	if _, err := (Client{}).prepareTenders(b.t.Tenders); err != nil {
+		return Transaction{}, err
+	}
+	return b.t, nil
+}
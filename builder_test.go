@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestTransactionBuilder(t *testing.T) {
+	got, err := NewTransaction(testKey.Organization, testKey.EnterpriseUnit, testKey.SettlementDocID).
+		From(VaultTill).To("till-1").
+		AddTender("cash", 150).AddDenomination("cash", "dollar bill", 1, 100).AddDenomination("cash", "quarter", 2, 50).
+		AddTender("card", 20).
+		IdempotencyKey("k-1").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Transaction{
+		Org:             testKey.Organization,
+		EU:              testKey.EnterpriseUnit,
+		SettlementDocID: testKey.SettlementDocID,
+		Source:          VaultTill,
+		Destination:     "till-1",
+		Direction:       DirectionCredit,
+		Tenders: []Tender{
+			{ID: "cash", Amount: 150, TenderBreakdowns: []TenderInfo{{Name: "dollar bill", Count: 1, Amount: 100}, {Name: "quarter", Count: 2, Amount: 50}}},
+			{ID: "card", Amount: 20},
+		},
+		IdempotencyKey: "k-1",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Build() = %+v, want %+v", got, want)
+	}
+	c, _ := newTestClient(t)
+	mustProcess(t, c, got)
+	if got := tenderAmount(t, c, "till-1", "cash"); got != 150 {
+		t.Errorf("till-1 cash after processing the built transaction = %v, want 150", got)
+	}
+
+	tests := []struct {
+		name  string
+		build func(b *TransactionBuilder) *TransactionBuilder
+	}{
+		{name: "tender added twice", build: func(b *TransactionBuilder) *TransactionBuilder { return b.AddTender("cash", 1).AddTender("cash", 1) }},
+		{name: "unknown tender", build: func(b *TransactionBuilder) *TransactionBuilder { return b.AddDenomination("cash", "bill", 1, 1) }},
+		{name: "breakdown not summing", build: func(b *TransactionBuilder) *TransactionBuilder {
+			return b.AddTender("cash", 5).AddDenomination("cash", "bill", 4, 4)
+		}},
+		{name: "negative count", build: func(b *TransactionBuilder) *TransactionBuilder {
+			return b.AddTender("cash", 1).AddDenomination("cash", "bill", -1, 1)
+		}},
+		{name: "same source and destination", build: func(b *TransactionBuilder) *TransactionBuilder { return b.AddTender("cash", 1).To(VaultTill) }},
+		{name: "invalid direction", build: func(b *TransactionBuilder) *TransactionBuilder { return b.AddTender("cash", 1).Direction("up") }},
+	}
+	for _, tt := range tests {
+		b := NewTransaction(testKey.Organization, testKey.EnterpriseUnit, testKey.SettlementDocID).From(VaultTill).To("till-1")
+		if _, err := tt.build(b).Build(); !errors.Is(err, ErrInvalidTransaction) {
+			t.Errorf("%s: Build() error = %v, want %v", tt.name, err, ErrInvalidTransaction)
+		}
+	}
+	if _, err := NewTransaction(testKey.Organization, testKey.EnterpriseUnit, "").To("till-1").AddTender("cash", 1).Build(); err == nil {
+		t.Error("Build() without a settlement ID succeeded")
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"strconv"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// The settlement checksum is a weighted sum over every stored value: each tender total and
+// each denomination count and amount contributes value * coefficient, where the
+// coefficient is derived from an HMAC of the key and field under the client's
+// ChecksumSecret. Because the sum is linear, writes keep it current with a single INCRBY
+// of their delta, while VerifyChecksum recomputes it from the current state. Editing a
+// value out of band changes the recomputed sum but not the stored one, and without the
+// secret the edit can't be compensated for. Set memberships are not covered.
+//
+// Amounts are already integer minor units, so they and counts are used as-is and the sum
+// is exact. Coefficients are kept to 20 bits so the sum stays far from int64 overflow for
+// realistic balances.
+const checksumCoeffBits = 20
+
+func (c Client) checksumCoefficient(redisKey, field string) int64 {
+	mac := hmac.New(sha256.New, c.ChecksumSecret)
+	mac.Write([]byte(redisKey))
+	mac.Write([]byte{0})
+	mac.Write([]byte(field))
+	return int64(binary.BigEndian.Uint32(mac.Sum(nil)) >> (32 - checksumCoeffBits))
+}
+
+// tillChecksum is the checksum contribution of the given tender values held by a till.
+func (c Client) tillChecksum(key Key, tillID string, tenders []Tender) int64 {
+	var sum int64
+	for _, tender := range tenders {
+		tenderID := tender.StoredID()
+		sum += c.checksumCoefficient(key.TenderKey(tillID, tenderID), "") * int64(tender.Amount)
+		for _, denomination := range tender.TenderBreakdowns {
+			denominationKey := key.DenominationKey(tillID, tenderID, denomination.storedName(tender.Currency))
+			sum += c.checksumCoefficient(denominationKey, "count") * int64(denomination.Count)
+			sum += c.checksumCoefficient(denominationKey, "amount") * int64(denomination.Amount)
+		}
+	}
+	return sum
+}
+
+// transactionChecksumDelta is the checksum change caused by writeTransaction applying tenders.
+func (c Client) transactionChecksumDelta(key Key, source, destination string, direction int, tenders []Tender) int64 {
+	delta := c.tillChecksum(key, destination, tenders)
+	if source != "" {
+		delta -= c.tillChecksum(key, source, tenders)
+	}
+	return int64(direction) * delta
+}
+
+// VerifyChecksum recomputes the settlement's checksum from its current state and compares
+// it with the running checksum maintained by writes. false means some value was changed
+// without going through this package. The client must have a ChecksumSecret.
+func (c Client) VerifyChecksum(ctx context.Context, key Key) (bool, error) {
+	if len(c.ChecksumSecret) == 0 {
+		return false, errors.New("checksum verification requires a ChecksumSecret")
+	}
+
+	var stored int64
+	raw, err := c.Get(ctx, key.ChecksumKey()).Result()
+	switch {
+	case errors.Is(err, redis.Nil):
+	case err != nil:
+		return false, err
+	default:
+		if stored, err = strconv.ParseInt(raw, 10, 64); err != nil {
+			return false, &ParseError{Key: key.ChecksumKey(), Value: raw, Err: err}
+		}
+	}
+
+	tills, err := c.allTills(ctx, key)
+	if err != nil {
+		return false, err
+	}
+	var computed int64
+	for _, till := range tills {
+		computed += c.tillChecksum(key, till.ID, till.Tenders)
+	}
+	return computed == stored, nil
+}
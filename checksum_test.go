@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestVerifyChecksum(t *testing.T) {
+	c, mr := newTestClient(t)
+	ctx := context.Background()
+	if _, err := c.VerifyChecksum(ctx, testKey); err == nil {
+		t.Error("VerifyChecksum() without a ChecksumSecret succeeded")
+	}
+	c.ChecksumSecret = []byte("secret")
+	debit := transfer("till-1", "till-2", Tender{ID: "card", Amount: 3})
+	debit.Direction = DirectionDebit
+	mustProcess(t, c,
+		transfer(VaultTill, "till-1", cash(100), Tender{ID: "cash", Currency: "EUR", Amount: 4}),
+		transfer("till-1", "till-2", cash(30)),
+		debit,
+	)
+	if !mr.Exists(testKey.ChecksumKey()) {
+		t.Fatal("no running checksum stored")
+	}
+	if ok, err := c.VerifyChecksum(ctx, testKey); err != nil || !ok {
+		t.Fatalf("VerifyChecksum() = %v, %v, want true", ok, err)
+	}
+
+	// An edit made behind the client's back is caught, and undoing it restores the match
+	denominationKey := testKey.DenominationKey("till-2", "cash", "bill")
+	mr.HSet(denominationKey, "count", "31")
+	if ok, err := c.VerifyChecksum(ctx, testKey); err != nil || ok {
+		t.Errorf("VerifyChecksum() after an out-of-band edit = %v, %v, want false", ok, err)
+	}
+	mr.HSet(denominationKey, "count", "30")
+	if ok, err := c.VerifyChecksum(ctx, testKey); err != nil || !ok {
+		t.Errorf("VerifyChecksum() after undoing the edit = %v, %v, want true", ok, err)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+)
+
+const cliUsage = `usage: playground [-addr host:port] <command> [flags]
+
+commands:
+  process  apply a Transaction read as JSON from stdin
+  get      print the settlement's tills as JSON
+  delete   delete every key of the settlement
+  demo     apply two sample transactions and print the result`
+
+// runCLI runs the command line tool on args, the arguments after the program name.
+func runCLI(ctx context.Context, args []string, stdin io.Reader, stdout io.Writer) error {
+	global := flag.NewFlagSet("playground", flag.ContinueOnError)
+	global.SetOutput(io.Discard)
+	addr := global.String("addr", "localhost:6379", "Redis address")
+	if err := global.Parse(args); err != nil {
+		return fmt.Errorf("%v\n%s", err, cliUsage)
+	}
+	if global.NArg() == 0 {
+		return fmt.Errorf("missing command\n%s", cliUsage)
+	}
+	command, args := global.Arg(0), global.Args()[1:]
+
+	run, ok := map[string]func(context.Context, Client, []string, io.Reader, io.Writer) error{
+		"process": runProcess,
+		"get":     runGet,
+		"delete":  runDelete,
+		"demo": func(ctx context.Context, client Client, _ []string, _ io.Reader, stdout io.Writer) error {
+			return demo(ctx, client, stdout)
+		},
+	}[command]
+	if !ok {
+		return fmt.Errorf("unknown command %q\n%s", command, cliUsage)
+	}
+	client, err := Connect(*addr)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	return run(ctx, client, args, stdin, stdout)
+}
+
+func runProcess(ctx context.Context, client Client, args []string, stdin io.Reader, _ io.Writer) error {
+	if len(args) > 0 {
+		return fmt.Errorf("process takes no arguments, the transaction is read from stdin")
+	}
+	var t Transaction
+	decoder := json.NewDecoder(stdin)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&t); err != nil {
+		return fmt.Errorf("decode transaction: %w", err)
+	}
+	return client.ProcessTransaction(ctx, t)
+}
+
+func runGet(ctx context.Context, client Client, args []string, _ io.Reader, stdout io.Writer) error {
+	key, err := parseKeyFlags("get", args)
+	if err != nil {
+		return err
+	}
+	tills, err := client.GetExpectedTenders(ctx, key)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(tills)
+}
+
+func runDelete(ctx context.Context, client Client, args []string, _ io.Reader, _ io.Writer) error {
+	key, err := parseKeyFlags("delete", args)
+	if err != nil {
+		return err
+	}
+	return client.DeleteSettlement(ctx, key)
+}
+
+// parseKeyFlags parses the -org, -eu and -settlement flags of a command, all required.
+func parseKeyFlags(command string, args []string) (Key, error) {
+	flags := flag.NewFlagSet(command, flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	var key Key
+	flags.StringVar(&key.Organization, "org", "", "organization")
+	flags.StringVar(&key.EnterpriseUnit, "eu", "", "enterprise unit")
+	flags.StringVar(&key.SettlementDocID, "settlement", "", "settlement document ID")
+	if err := flags.Parse(args); err != nil {
+		return Key{}, fmt.Errorf("%s: %w", command, err)
+	}
+	if flags.NArg() > 0 {
+		return Key{}, fmt.Errorf("%s: unexpected arguments %v", command, flags.Args())
+	}
+	if key.Organization == "" || key.EnterpriseUnit == "" || key.SettlementDocID == "" {
+		return Key{}, fmt.Errorf("%s: -org, -eu and -settlement are required", command)
+	}
+	return key, nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRunCLI(t *testing.T) {
+	c, mr := newTestClient(t)
+	ctx := context.Background()
+	addr := []string{"-addr", mr.Addr()}
+	keyFlags := []string{"-org", testKey.Organization, "-eu", testKey.EnterpriseUnit, "-settlement", testKey.SettlementDocID}
+
+	tx, err := json.Marshal(transfer(VaultTill, "till-1", cash(25)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := runCLI(ctx, append(addr, "process"), bytes.NewReader(tx), &bytes.Buffer{}); err != nil {
+		t.Fatal(err)
+	}
+
+	var stdout bytes.Buffer
+	if err := runCLI(ctx, append(append(addr, "get"), keyFlags...), strings.NewReader(""), &stdout); err != nil {
+		t.Fatal(err)
+	}
+	var got []Till
+	if err := json.Unmarshal(stdout.Bytes(), &got); err != nil {
+		t.Fatalf("get output %q: %v", stdout.String(), err)
+	}
+	want, err := c.GetExpectedTenders(ctx, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("get printed %+v, want %+v", got, want)
+	}
+
+	if err := runCLI(ctx, append(append(addr, "delete"), keyFlags...), strings.NewReader(""), &bytes.Buffer{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.GetExpectedTenders(ctx, testKey); !errors.Is(err, ErrSettlementNotFound) {
+		t.Errorf("GetExpectedTenders() after delete error = %v, want %v", err, ErrSettlementNotFound)
+	}
+
+	for _, args := range [][]string{
+		addr,
+		append(addr, "unknown"),
+		append(addr, "get", "-org", "o"),
+	} {
+		if err := runCLI(ctx, args, strings.NewReader(""), &bytes.Buffer{}); err == nil {
+			t.Errorf("runCLI(%v) succeeded", args)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Connection defaults applied by Connect.
+const (
+	DefaultPoolSize     = 20
+	DefaultMinIdleConns = 2
+	DefaultDialTimeout  = 5 * time.Second
+	DefaultReadTimeout  = 3 * time.Second
+	DefaultWriteTimeout = 3 * time.Second
+)
+
+// ConnOption adjusts the redis.Options Connect builds. Any func(*redis.Options) works, for
+// settings without a helper here.
+type ConnOption func(*redis.Options)
+
+// WithPoolSize sets the maximum number of connections in the pool.
+func WithPoolSize(n int) ConnOption {
+	return func(o *redis.Options) {
+		o.PoolSize = n
+	}
+}
+
+// WithMinIdleConns sets how many idle connections the pool keeps open.
+func WithMinIdleConns(n int) ConnOption {
+	return func(o *redis.Options) {
+		o.MinIdleConns = n
+	}
+}
+
+// WithDialTimeout bounds establishing a new connection.
+func WithDialTimeout(d time.Duration) ConnOption {
+	return func(o *redis.Options) {
+		o.DialTimeout = d
+	}
+}
+
+// WithReadTimeout bounds waiting for a reply.
+func WithReadTimeout(d time.Duration) ConnOption {
+	return func(o *redis.Options) {
+		o.ReadTimeout = d
+	}
+}
+
+// WithWriteTimeout bounds sending a command.
+func WithWriteTimeout(d time.Duration) ConnOption {
+	return func(o *redis.Options) {
+		o.WriteTimeout = d
+	}
+}
+
+// WithAuth sets the password, and the ACL username unless it is empty.
+func WithAuth(username, password string) ConnOption {
+	return func(o *redis.Options) {
+		o.Username = username
+		o.Password = password
+	}
+}
+
+// WithProtocol selects the RESP version, 2 or 3. go-redis negotiates RESP3 by default and
+// falls back to RESP2 on servers without it; replies are decoded the same either way.
+func WithProtocol(version int) ConnOption {
+	return func(o *redis.Options) {
+		o.Protocol = version
+	}
+}
+
+// WithDB selects the database.
+func WithDB(db int) ConnOption {
+	return func(o *redis.Options) {
+		o.DB = db
+	}
+}
+
+// connOptions returns the redis.Options for addr: the Default* pool and timeout settings
+// overridden by opts in order.
+func connOptions(addr string, opts []ConnOption) *redis.Options {
+	o := &redis.Options{
+		Addr:         addr,
+		PoolSize:     DefaultPoolSize,
+		MinIdleConns: DefaultMinIdleConns,
+		DialTimeout:  DefaultDialTimeout,
+		ReadTimeout:  DefaultReadTimeout,
+		WriteTimeout: DefaultWriteTimeout,
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// Connect is NewClient for addr with the Default* pool and timeout settings, adjusted by
+// opts. Use NewClient to start from bare redis.Options instead.
+func Connect(addr string, opts ...ConnOption) (Client, error) {
+	return NewClient(connOptions(addr, opts))
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func TestConnect(t *testing.T) {
+	mr := miniredis.RunT(t)
+	c, err := Connect(mr.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	o := c.Options()
+	if o.Addr != mr.Addr() || o.PoolSize != DefaultPoolSize || o.MinIdleConns != DefaultMinIdleConns ||
+		o.DialTimeout != DefaultDialTimeout || o.ReadTimeout != DefaultReadTimeout || o.WriteTimeout != DefaultWriteTimeout {
+		t.Errorf("Connect() options = %+v, want the defaults", o)
+	}
+
+	mr.RequireUserAuth("teller", "secret")
+	c, err = Connect(mr.Addr(),
+		WithPoolSize(7),
+		WithMinIdleConns(1),
+		WithDialTimeout(time.Second),
+		WithReadTimeout(2*time.Second),
+		WithWriteTimeout(4*time.Second),
+		WithAuth("teller", "secret"),
+		WithDB(3),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	o = c.Options()
+	if o.PoolSize != 7 || o.MinIdleConns != 1 || o.DialTimeout != time.Second || o.ReadTimeout != 2*time.Second ||
+		o.WriteTimeout != 4*time.Second || o.Username != "teller" || o.Password != "secret" || o.DB != 3 {
+		t.Errorf("Connect() options = %+v, want the overrides", o)
+	}
+	if _, err := Connect(mr.Addr(), WithAuth("teller", "wrong")); err == nil {
+		t.Error("Connect() with a wrong password succeeded")
+	}
+}
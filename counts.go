@@ -0,0 +1,365 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+)
+
+var countCSVHeader = []string{"tender", "denomination", "count"}
+
+type countRow struct {
+	tender string
+	row    int
+	TenderInfo
+}
+
+// ImportCountCSV applies a cashier's count sheet to a till. The CSV must have the header
+// tender,denomination,count; each row sets the denomination's absolute count, with the
+// amount computed from faces (face value per denomination name). A denomination without a
+// face value is count-only, which it must already be if the till holds it; a count-only
+// denomination the till holds stays count-only whatever faces says. Tender totals are
+// adjusted by the change in the listed denominations' amounts, leaving unlisted
+// denominations untouched. The whole file is validated before anything is written and
+// then applied in one WATCHed MULTI/EXEC; malformed rows are reported by row number, and
+// tender IDs, which are stored IDs, and denomination names are validated like a
+// transaction's. Counting a till marked closed fails with ErrTillClosed.
+func (c Client) ImportCountCSV(ctx context.Context, key Key, tillID string, r io.Reader, faces map[string]Money) error {
+	done, err := c.begin()
+	if err != nil {
+		return err
+	}
+	defer done()
+	if err := checkKeyComponent(tillID); err != nil {
+		return fmt.Errorf("%w: till %v", ErrInvalidTransaction, err)
+	}
+	rows, err := parseCountCSV(r, faces)
+	if err != nil {
+		return err
+	}
+	if err := c.checkCountRows(rows); err != nil {
+		return err
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+	if err := c.checkTillsOpen(ctx, key, tillID); err != nil {
+		return err
+	}
+
+	var watched []string
+	for _, row := range rows {
+		watched = append(watched, key.TenderKey(tillID, row.tender), key.DenominationKey(tillID, row.tender, row.Name))
+	}
+	return c.Watch(ctx, func(tx *redis.Tx) error {
+		var tenderIDs []string
+		previous := make(map[string][]TenderInfo)
+		updated := make(map[string][]TenderInfo)
+		for _, row := range rows {
+			denominationKey := key.DenominationKey(tillID, row.tender, row.Name)
+			fields, err := tx.HGetAll(ctx, denominationKey).Result()
+			if err != nil {
+				return err
+			}
+			old := TenderInfo{Name: row.Name}
+			if raw, ok := fields["count"]; ok {
+				count, err := strconv.ParseInt(raw, 10, 64)
+				if err != nil {
+					return &ParseError{Key: denominationKey, Field: "count", Value: raw, Err: err}
+				}
+				old.Count = int(count)
+			}
+			raw, hasAmount := fields["amount"]
+			if hasAmount {
+				if old.Amount, err = parseMoney(raw); err != nil {
+					return &ParseError{Key: denominationKey, Field: "amount", Value: raw, Err: err}
+				}
+			}
+			switch {
+			case len(fields) > 0 && !hasAmount:
+				old.CountOnly = true
+				row.CountOnly, row.Amount = true, 0
+			case hasAmount && row.CountOnly:
+				return fmt.Errorf("count csv: row %d: no face value for denomination %s", row.row, row.Name)
+			}
+			if _, ok := updated[row.tender]; !ok {
+				tenderIDs = append(tenderIDs, row.tender)
+			}
+			previous[row.tender] = append(previous[row.tender], old)
+			updated[row.tender] = append(updated[row.tender], row.TenderInfo)
+		}
+
+		_, err := tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			c.touchSettlement(ctx, pipe, key)
+			markUnlogged(ctx, pipe, key)
+			var checksumDelta int64
+			for _, tenderID := range tenderIDs {
+				var delta Money
+				for i, denomination := range updated[tenderID] {
+					delta += denomination.Amount - previous[tenderID][i].Amount
+					setDenomination(ctx, pipe, key.DenominationKey(tillID, tenderID, denomination.Name), denomination)
+					pipe.SAdd(ctx, key.DenominationsSetKey(tillID, tenderID), denomination.Name)
+				}
+				pipe.IncrBy(ctx, key.TenderKey(tillID, tenderID), int64(delta))
+				pipe.SAdd(ctx, key.TendersSetKey(tillID), tenderID)
+				if len(c.ChecksumSecret) > 0 {
+					checksumDelta += c.tillChecksum(key, tillID, []Tender{{ID: tenderID, Amount: delta, TenderBreakdowns: updated[tenderID]}}) -
+						c.tillChecksum(key, tillID, []Tender{{ID: tenderID, TenderBreakdowns: previous[tenderID]}})
+				}
+			}
+			pipe.SAdd(ctx, key.TillsSetKey(), tillID)
+			if checksumDelta != 0 {
+				pipe.IncrBy(ctx, key.ChecksumKey(), checksumDelta)
+			}
+			return nil
+		})
+		return err
+	}, watched...)
+}
+
+// SetTenderCount replaces a till's tender with the given one: the total and every
+// denomination are set to the given absolute values and denominations not listed are
+// removed, in one WATCHed MULTI/EXEC. The tender is validated like a transaction's, so its
+// breakdowns must sum to its total. The keys keep any TTL they had, and with a
+// SettlementTTL the settlement's TTL is refreshed afterwards as by ProcessTransaction.
+func (c Client) SetTenderCount(ctx context.Context, key Key, tillID string, tender Tender) error {
+	done, err := c.begin()
+	if err != nil {
+		return err
+	}
+	defer done()
+	prepared, err := c.prepareTenders([]Tender{tender})
+	if err != nil {
+		return err
+	}
+	tender = prepared[0]
+	tenderID := tender.StoredID()
+	tenderKey := key.TenderKey(tillID, tenderID)
+	denominationsKey := key.DenominationsSetKey(tillID, tenderID)
+	err = c.Watch(ctx, func(tx *redis.Tx) error {
+		names, err := tx.SMembers(ctx, denominationsKey).Result()
+		if err != nil {
+			return err
+		}
+		denominationKeys := make([]string, len(names))
+		for i, name := range names {
+			denominationKeys[i] = key.DenominationKey(tillID, tenderID, name)
+		}
+		if len(denominationKeys) > 0 {
+			if err := tx.Watch(ctx, denominationKeys...).Err(); err != nil {
+				return err
+			}
+		}
+		// The set is deleted and recreated below, which would drop its TTL
+		ttl, err := tx.PTTL(ctx, denominationsKey).Result()
+		if err != nil {
+			return err
+		}
+		previous := tenderFromStoredID(tenderID)
+		raw, err := tx.Get(ctx, tenderKey).Result()
+		switch {
+		case errors.Is(err, redis.Nil):
+		case err != nil:
+			return err
+		default:
+			if previous.Amount, err = parseMoney(raw); err != nil {
+				return &ParseError{Key: tenderKey, Value: raw, Err: err}
+			}
+		}
+		if previous.TenderBreakdowns, err = c.getDenominations(ctx, key, tillID, tenderID, ReadOptions{}); err != nil {
+			return err
+		}
+
+		denominations := coalesceBreakdowns(tender)
+		kept := make(map[string]struct{}, len(denominations))
+		for _, denomination := range denominations {
+			kept[denomination.storedName(tender.Currency)] = struct{}{}
+		}
+		var stale []string
+		for i, name := range names {
+			if _, ok := kept[name]; !ok {
+				stale = append(stale, denominationKeys[i])
+			}
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Del(ctx, append(stale, denominationsKey)...)
+			c.touchSettlement(ctx, pipe, key)
+			markUnlogged(ctx, pipe, key)
+			for _, denomination := range denominations {
+				name := denomination.storedName(tender.Currency)
+				setDenomination(ctx, pipe, key.DenominationKey(tillID, tenderID, name), denomination)
+				pipe.SAdd(ctx, denominationsKey, name)
+			}
+			if ttl > 0 && len(denominations) > 0 {
+				pipe.PExpire(ctx, denominationsKey, ttl)
+			}
+			pipe.Set(ctx, tenderKey, tender.Amount, redis.KeepTTL)
+			pipe.SAdd(ctx, key.TendersSetKey(tillID), tenderID)
+			pipe.SAdd(ctx, key.TillsSetKey(), tillID)
+			if len(c.ChecksumSecret) > 0 {
+				tender.TenderBreakdowns = denominations
+				pipe.IncrBy(ctx, key.ChecksumKey(), c.tillChecksum(key, tillID, []Tender{tender})-c.tillChecksum(key, tillID, []Tender{previous}))
+			}
+			return nil
+		})
+		return err
+	}, tenderKey, denominationsKey)
+	if err != nil || c.SettlementTTL <= 0 {
+		return err
+	}
+	return c.setSettlementTTL(ctx, key, c.SettlementTTL)
+}
+
+// checkCountRows validates the stored tender IDs and denomination names of a count sheet
+// like prepareTenders validates a transaction's tenders.
+func (c Client) checkCountRows(rows []countRow) error {
+	for _, row := range rows {
+		tender := tenderFromStoredID(row.tender)
+		if err := checkKeyComponent(tender.ID); err != nil {
+			return fmt.Errorf("%w: count csv: row %d: tender ID %v", ErrInvalidTransaction, row.row, err)
+		}
+		if err := checkCurrency(tender.ID, tender.Currency); err != nil {
+			return fmt.Errorf("%w: count csv: row %d: tender %s: %v", ErrInvalidTransaction, row.row, row.tender, err)
+		}
+		denomination := denominationFromStoredName(row.Name, tender.Currency)
+		if err := checkKeyComponent(denomination.Name); err != nil {
+			return fmt.Errorf("%w: count csv: row %d: denomination name %v", ErrInvalidTransaction, row.row, err)
+		}
+		if err := checkCurrency(denomination.Name, denomination.Currency); err != nil {
+			return fmt.Errorf("%w: count csv: row %d: denomination %s: %v", ErrInvalidTransaction, row.row, row.Name, err)
+		}
+		if denomination.Currency != tender.Currency && !c.AllowMixedCurrencies {
+			return fmt.Errorf("%w: count csv: row %d: tender %s in %q has denomination %s in %q", ErrInvalidTransaction, row.row, row.tender, tender.Currency, row.Name, denomination.Currency)
+		}
+	}
+	return nil
+}
+
+func parseCountCSV(r io.Reader, faces map[string]Money) ([]countRow, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = len(countCSVHeader)
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if errors.Is(err, io.EOF) {
+		return nil, errors.New("count csv: missing header")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("count csv: header: %w", err)
+	}
+	for i, column := range countCSVHeader {
+		if !strings.EqualFold(strings.TrimSpace(header[i]), column) {
+			return nil, fmt.Errorf("count csv: header must be %s, got %s", strings.Join(countCSVHeader, ","), strings.Join(header, ","))
+		}
+	}
+
+	var rows []countRow
+	seen := make(map[[2]string]int)
+	for row := 2; ; row++ {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			return rows, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("count csv: row %d: %w", row, err)
+		}
+		tender, denomination := strings.TrimSpace(record[0]), strings.TrimSpace(record[1])
+		if tender == "" || denomination == "" {
+			return nil, fmt.Errorf("count csv: row %d: tender and denomination are required", row)
+		}
+		count, err := strconv.Atoi(strings.TrimSpace(record[2]))
+		if err != nil || count < 0 {
+			return nil, fmt.Errorf("count csv: row %d: invalid count %q", row, record[2])
+		}
+		face, ok := faces[denomination]
+		id := [2]string{tender, denomination}
+		if first, ok := seen[id]; ok {
+			return nil, fmt.Errorf("count csv: row %d: tender %s denomination %s already counted on row %d", row, tender, denomination, first)
+		}
+		seen[id] = row
+		rows = append(rows, countRow{
+			tender: tender,
+			row:    row,
+			TenderInfo: TenderInfo{
+				Name:      denomination,
+				Count:     count,
+				Amount:    Money(count) * face,
+				CountOnly: !ok,
+			},
+		})
+	}
+}
+
+// CompareAndSetDenomination sets a till's denomination, given by its stored name, to the
+// count and amount of new only if it currently holds those of expected, in one WATCHed
+// MULTI/EXEC; a missing denomination holds zero. With new.CountOnly set only the count is
+// stored, as for any count-only denomination. The tender's total moves by the same amount
+// so it still matches its breakdowns, and the checksum, if maintained, follows. It
+// returns false without writing if the current value differs or changes before the write
+// lands.
+func (c Client) CompareAndSetDenomination(ctx context.Context, key Key, tillID, tenderID, name string, expected, new TenderInfo) (bool, error) {
+	done, err := c.begin()
+	if err != nil {
+		return false, err
+	}
+	defer done()
+	if new.Count < 0 || new.Amount < 0 {
+		return false, fmt.Errorf("%w: denomination %s has negative count or amount", ErrInvalidTransaction, name)
+	}
+	if new.CountOnly && new.Amount != 0 {
+		return false, fmt.Errorf("%w: count-only denomination %s has amount %v", ErrInvalidTransaction, name, new.Amount)
+	}
+	denominationKey := key.DenominationKey(tillID, tenderID, name)
+	tender := tenderFromStoredID(tenderID)
+	swapped := false
+	err = c.Watch(ctx, func(tx *redis.Tx) error {
+		fields, err := tx.HGetAll(ctx, denominationKey).Result()
+		if err != nil {
+			return err
+		}
+		current := denominationFromStoredName(name, tender.Currency)
+		if len(fields) > 0 {
+			if current, err = parseDenomination(denominationKey, name, tender.Currency, fields, ReadOptions{}); err != nil {
+				return err
+			}
+		}
+		if current.Count != expected.Count || current.Amount != expected.Amount {
+			return nil
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			updated := current
+			updated.Count, updated.Amount, updated.CountOnly = new.Count, new.Amount, new.CountOnly
+			setDenomination(ctx, pipe, denominationKey, updated)
+			pipe.IncrBy(ctx, key.TenderKey(tillID, tenderID), int64(new.Amount-current.Amount))
+			c.touchSettlement(ctx, pipe, key)
+			markUnlogged(ctx, pipe, key)
+			pipe.SAdd(ctx, key.DenominationsSetKey(tillID, tenderID), name)
+			pipe.SAdd(ctx, key.TendersSetKey(tillID), tenderID)
+			pipe.SAdd(ctx, key.TillsSetKey(), tillID)
+			if len(c.ChecksumSecret) > 0 {
+				before, after := tender, tender
+				before.Amount, before.TenderBreakdowns = current.Amount, []TenderInfo{current}
+				after.Amount, after.TenderBreakdowns = new.Amount, []TenderInfo{updated}
+				pipe.IncrBy(ctx, key.ChecksumKey(), c.tillChecksum(key, tillID, []Tender{after})-c.tillChecksum(key, tillID, []Tender{before}))
+			}
+			return nil
+		})
+		if err == nil {
+			swapped = true
+		}
+		return err
+	}, denominationKey)
+	if errors.Is(err, redis.TxFailedErr) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return swapped, nil
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+func TestSetTenderCountKeepsTTL(t *testing.T) {
+	c, _ := newTestClient(t)
+	ctx := context.Background()
+	mustProcess(t, c, transfer(VaultTill, "till-1", Tender{ID: "cash", Amount: 15, TenderBreakdowns: []TenderInfo{{Name: "five", Count: 1, Amount: 5}, {Name: "ten", Count: 1, Amount: 10}}}))
+	if err := c.SetSettlementTTL(ctx, testKey, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SetTenderCount(ctx, testKey, "till-1", Tender{ID: "cash", Amount: 20, TenderBreakdowns: []TenderInfo{{Name: "ten", Count: 2, Amount: 20}}}); err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{testKey.TenderKey("till-1", "cash"), testKey.DenominationsSetKey("till-1", "cash"), testKey.DenominationKey("till-1", "cash", "ten")} {
+		ttl, err := c.PTTL(ctx, k).Result()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ttl <= 0 {
+			t.Errorf("%s TTL = %v after SetTenderCount, want it kept", k, ttl)
+		}
+	}
+	tender, err := c.GetTenderBreakdown(ctx, testKey, "till-1", "cash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tender.Amount != 20 || len(tender.TenderBreakdowns) != 1 || tender.TenderBreakdowns[0].Count != 2 {
+		t.Errorf("GetTenderBreakdown() = %+v, want 20 in two tens", tender)
+	}
+}
+
+func TestSetTenderCountSettlementTTL(t *testing.T) {
+	c, _ := newTestClient(t)
+	ctx := context.Background()
+	c.SettlementTTL = time.Hour
+	if err := c.SetTenderCount(ctx, testKey, "till-1", cash(3)); err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{testKey.TillsSetKey(), testKey.TenderKey("till-1", "cash"), testKey.DenominationsSetKey("till-1", "cash")} {
+		if ttl, err := c.PTTL(ctx, k).Result(); err != nil || ttl <= 0 {
+			t.Errorf("%s TTL = %v, %v, want the SettlementTTL", k, ttl, err)
+		}
+	}
+}
+
+// denominationFields returns the raw fields of a denomination hash of testKey.
+func denominationFields(t testing.TB, c Client, tillID, tenderID, name string) map[string]string {
+	t.Helper()
+	fields, err := c.HGetAll(context.Background(), testKey.DenominationKey(tillID, tenderID, name)).Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fields
+}
+
+func TestCountOnlyWriters(t *testing.T) {
+	stamps := func(count int) Tender {
+		return Tender{ID: "stamps", TenderBreakdowns: []TenderInfo{{Name: "stamp", Count: count, CountOnly: true}}}
+	}
+	tests := []struct {
+		name      string
+		write     func(ctx context.Context, c Client) error
+		wantCount string
+	}{
+		{
+			name:      "SetTenderCount",
+			write:     func(ctx context.Context, c Client) error { return c.SetTenderCount(ctx, testKey, "till-1", stamps(7)) },
+			wantCount: "7",
+		},
+		{
+			name: "CompareAndSetDenomination",
+			write: func(ctx context.Context, c Client) error {
+				swapped, err := c.CompareAndSetDenomination(ctx, testKey, "till-1", "stamps", "stamp", TenderInfo{Count: 4}, TenderInfo{Count: 9, CountOnly: true})
+				if err == nil && !swapped {
+					t.Error("CompareAndSetDenomination() didn't swap")
+				}
+				return err
+			},
+			wantCount: "9",
+		},
+		{
+			name: "ImportCountCSV",
+			write: func(ctx context.Context, c Client) error {
+				return c.ImportCountCSV(ctx, testKey, "till-1", strings.NewReader("tender,denomination,count\nstamps,stamp,2\n"), map[string]Money{"stamp": 50})
+			},
+			wantCount: "2",
+		},
+		{
+			name: "ConvertTender",
+			write: func(ctx context.Context, c Client) error {
+				if err := c.ProcessTransaction(ctx, transfer(VaultTill, "till-1", Tender{ID: "stamps", Amount: 10})); err != nil {
+					return err
+				}
+				return c.ConvertTender(ctx, testKey, "till-1", "stamps", "cash", 1)
+			},
+			wantCount: "0",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := newTestClient(t)
+			ctx := context.Background()
+			mustProcess(t, c, transfer(VaultTill, "till-1", stamps(4)))
+			if err := tt.write(ctx, c); err != nil {
+				t.Fatal(err)
+			}
+			fields := denominationFields(t, c, "till-1", "stamps", "stamp")
+			if fields["count"] != tt.wantCount {
+				t.Errorf("count = %q, want %s", fields["count"], tt.wantCount)
+			}
+			if amount, ok := fields["amount"]; ok {
+				t.Errorf("count-only denomination written with amount %q", amount)
+			}
+		})
+	}
+}
+
+func TestImportCountCSVCountOnly(t *testing.T) {
+	c, _ := newTestClient(t)
+	ctx := context.Background()
+	mustProcess(t, c, transfer(VaultTill, "till-1", cash(3)))
+	csv := "tender,denomination,count\ncash,bill,5\nstamps,stamp,8\n"
+	if err := c.ImportCountCSV(ctx, testKey, "till-1", strings.NewReader(csv), map[string]Money{}); err == nil {
+		t.Error("ImportCountCSV() succeeded without the face value of a denomination with an amount")
+	}
+	if err := c.ImportCountCSV(ctx, testKey, "till-1", strings.NewReader(csv), map[string]Money{"bill": 1}); err != nil {
+		t.Fatal(err)
+	}
+	if got := tenderAmount(t, c, "till-1", "cash"); got != 5 {
+		t.Errorf("cash total = %v, want 5", got)
+	}
+	fields := denominationFields(t, c, "till-1", "stamps", "stamp")
+	if _, ok := fields["amount"]; ok || fields["count"] != "8" {
+		t.Errorf("stamp = %v, want a count-only count of 8", fields)
+	}
+}
+
+func TestImportCountCSVValidation(t *testing.T) {
+	faces := map[string]Money{"bill": 1, "bill@USD": 1, "bill@x": 1}
+	tests := []struct {
+		name    string
+		tillID  string
+		csv     string
+		closed  bool
+		wantErr error
+	}{
+		{name: "valid", tillID: "till-1", csv: "tender,denomination,count\ncash@EUR,bill,1\n"},
+		{name: "missing till", csv: "tender,denomination,count\ncash,bill,1\n", wantErr: ErrInvalidTransaction},
+		{name: "invalid tender currency", tillID: "till-1", csv: "tender,denomination,count\ncash@eur,bill,1\n", wantErr: ErrInvalidTransaction},
+		{name: "invalid denomination currency", tillID: "till-1", csv: "tender,denomination,count\ncash,bill@x,1\n", wantErr: ErrInvalidTransaction},
+		{name: "mixed currencies", tillID: "till-1", csv: "tender,denomination,count\ncash@EUR,bill@USD,1\n", wantErr: ErrInvalidTransaction},
+		{name: "closed till", tillID: "till-1", csv: "tender,denomination,count\ncash,bill,1\n", closed: true, wantErr: ErrTillClosed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := newTestClient(t)
+			ctx := context.Background()
+			if tt.closed {
+				c.RejectClosedTills = true
+				if err := c.SAdd(ctx, testKey.ClosedTillsSetKey(), tt.tillID).Err(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			err := c.ImportCountCSV(ctx, testKey, tt.tillID, strings.NewReader(tt.csv), faces)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("ImportCountCSV() error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr == nil {
+				return
+			}
+			if n, err := c.Exists(ctx, testKey.TillsSetKey()).Result(); err != nil || n != 0 {
+				t.Errorf("tills set exists = %d, %v after a rejected import, want nothing written", n, err)
+			}
+		})
+	}
+}
+
+func TestCompareAndSetDenomination(t *testing.T) {
+	c, mr := newTestClient(t)
+	ctx := context.Background()
+	mustProcess(t, c, transfer(VaultTill, "till-2", cash(10)))
+
+	// A stale expected value writes nothing
+	swapped, err := c.CompareAndSetDenomination(ctx, testKey, "till-2", "cash", "bill", TenderInfo{Count: 9, Amount: 9}, TenderInfo{Count: 12, Amount: 12})
+	if err != nil || swapped {
+		t.Fatalf("CompareAndSetDenomination() with a stale value = %v, %v, want false", swapped, err)
+	}
+	swapped, err = c.CompareAndSetDenomination(ctx, testKey, "till-2", "cash", "bill", TenderInfo{Count: 10, Amount: 10}, TenderInfo{Count: 12, Amount: 12})
+	if err != nil || !swapped {
+		t.Fatalf("CompareAndSetDenomination() with the current value = %v, %v, want true", swapped, err)
+	}
+	// The total moves with its breakdown
+	if got := tenderAmount(t, c, "till-2", "cash"); got != 12 {
+		t.Errorf("till-2 total = %v, want 12", got)
+	}
+
+	// A write between WATCH and EXEC makes it give up rather than overwrite
+	other := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer other.Close()
+	var sent bool
+	c.AddHook(conflictingHook{other: other, sent: &sent})
+	swapped, err = c.CompareAndSetDenomination(ctx, testKey, "till-2", "cash", "bill", TenderInfo{Count: 12, Amount: 12}, TenderInfo{Count: 20, Amount: 20})
+	if err != nil || swapped {
+		t.Fatalf("CompareAndSetDenomination() with a concurrent write = %v, %v, want false", swapped, err)
+	}
+	if got := denominationFields(t, c, "till-2", "cash", "bill")["count"]; got != "13" {
+		t.Errorf("till-2 bill count = %s, want 13 from the concurrent write", got)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// A tender in a currency is stored under its ID qualified with the currency's ISO 4217
+// code, e.g. "cash@EUR", so the same tender held in two currencies gets separate keys.
+// Denominations are qualified the same way only when their currency differs from their
+// tender's. Tenders without a currency keep the unqualified layout.
+const currencySeparator = "@"
+
+// validCurrency reports whether code looks like an ISO 4217 alphabetic code.
+func validCurrency(code string) bool {
+	if len(code) != 3 {
+		return false
+	}
+	for _, r := range code {
+		if r < 'A' || r > 'Z' {
+			return false
+		}
+	}
+	return true
+}
+
+// StoredID is the ID the tender is stored under: its ID qualified with its currency, if
+// any. Methods taking a tender ID string expect this form.
+func (t Tender) StoredID() string {
+	return qualifyCurrency(t.ID, t.Currency)
+}
+
+// storedName is the name the denomination is stored under within a tender in tenderCurrency.
+func (d TenderInfo) storedName(tenderCurrency string) string {
+	if d.Currency == tenderCurrency {
+		return d.Name
+	}
+	return qualifyCurrency(d.Name, d.Currency)
+}
+
+func qualifyCurrency(name, currency string) string {
+	if currency == "" {
+		return name
+	}
+	return name + currencySeparator + currency
+}
+
+// splitCurrency inverts qualifyCurrency. A stored name without a valid currency suffix is
+// returned whole with an empty currency.
+func splitCurrency(stored string) (name, currency string) {
+	i := strings.LastIndex(stored, currencySeparator)
+	if i < 0 || !validCurrency(stored[i+len(currencySeparator):]) {
+		return stored, ""
+	}
+	return stored[:i], stored[i+len(currencySeparator):]
+}
+
+// tenderFromStoredID returns a Tender with the ID and currency encoded in storedID.
+func tenderFromStoredID(storedID string) Tender {
+	id, currency := splitCurrency(storedID)
+	return Tender{ID: id, Currency: currency}
+}
+
+// denominationFromStoredName returns a TenderInfo with the name and currency encoded in
+// storedName; an unqualified denomination is in its tender's currency.
+func denominationFromStoredName(storedName, tenderCurrency string) TenderInfo {
+	name, currency := splitCurrency(storedName)
+	if currency == "" {
+		currency = tenderCurrency
+	}
+	return TenderInfo{Name: name, Currency: currency}
+}
+
+// checkCurrency rejects a currency that isn't an ISO 4217 code, and a tender ID or
+// denomination name that would be mistaken for a qualified one.
+func checkCurrency(name, currency string) error {
+	if currency != "" && !validCurrency(currency) {
+		return fmt.Errorf("currency %q is not an ISO 4217 code", currency)
+	}
+	if strings.Contains(name, currencySeparator) {
+		return fmt.Errorf("%q contains %q", name, currencySeparator)
+	}
+	return nil
+}
+
+// minorUnits is the number of decimal places of the currencies whose minor unit isn't the
+// usual cent, per ISO 4217.
+var minorUnits = map[string]int{
+	"BHD": 3, "CLP": 0, "IQD": 3, "ISK": 0, "JOD": 3, "JPY": 0, "KRW": 0,
+	"KWD": 3, "LYD": 3, "OMR": 3, "PYG": 0, "TND": 3, "UGX": 0, "VND": 0,
+}
+
+var currencySymbols = map[string]string{
+	"USD": "$", "EUR": "€", "GBP": "£", "JPY": "¥", "INR": "₹", "KRW": "₩",
+}
+
+// FormatAmount renders an amount in currency's minor units with the currency's symbol, or
+// its code when it has no well-known symbol, and its number of decimal places, e.g.
+// "$12.50", "¥1250" or "CHF 12.50". Amounts without a currency are shown with two
+// decimals and no symbol.
+func FormatAmount(amount Money, currency string) string {
+	decimals, ok := minorUnits[currency]
+	if !ok {
+		decimals = 2
+	}
+	// The sign is split off the digits rather than negating amount, which would overflow
+	// for math.MinInt64
+	sign := ""
+	digits := strconv.FormatInt(int64(amount), 10)
+	if amount < 0 {
+		sign, digits = "-", digits[1:]
+	}
+	if decimals > 0 {
+		if len(digits) <= decimals {
+			digits = strings.Repeat("0", decimals-len(digits)+1) + digits
+		}
+		digits = digits[:len(digits)-decimals] + "." + digits[len(digits)-decimals:]
+	}
+	switch symbol, ok := currencySymbols[currency]; {
+	case ok:
+		return sign + symbol + digits
+	case currency != "":
+		return currency + " " + sign + digits
+	}
+	return sign + digits
+}
+
+// FormatAmount renders the tender's total with FormatAmount.
+func (t Tender) FormatAmount() string {
+	return FormatAmount(t.Amount, t.Currency)
+}
+
+// FormatAmount renders the denomination's amount with FormatAmount.
+func (d TenderInfo) FormatAmount() string {
+	return FormatAmount(d.Amount, d.Currency)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestMultiCurrency(t *testing.T) {
+	c, mr := newTestClient(t)
+	ctx := context.Background()
+	euros := Tender{ID: "cash", Currency: "EUR", Amount: 10, TenderBreakdowns: []TenderInfo{{Name: "bill", Count: 1, Amount: 10}}}
+	dollars := Tender{ID: "cash", Currency: "USD", Amount: 5, TenderBreakdowns: []TenderInfo{{Name: "bill", Count: 1, Amount: 5}}}
+	mustProcess(t, c, transfer(VaultTill, "till-1", euros, dollars, cash(1)))
+	for _, k := range []string{testKey.TenderKey("till-1", "cash@EUR"), testKey.TenderKey("till-1", "cash@USD"), testKey.TenderKey("till-1", "cash")} {
+		if !mr.Exists(k) {
+			t.Errorf("no tender total stored at %s", k)
+		}
+	}
+	till, err := c.GetTill(ctx, testKey, "till-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	euros.TenderBreakdowns[0].Currency, dollars.TenderBreakdowns[0].Currency = "EUR", "USD"
+	if want := []Tender{cash(1), euros, dollars}; !reflect.DeepEqual(till.Tenders, want) {
+		t.Errorf("till-1 tenders = %+v, want %+v", till.Tenders, want)
+	}
+
+	// A breakdown in another currency is stored under a qualified name, if allowed
+	mixed := Tender{ID: "cash", Currency: "EUR", Amount: 2, TenderBreakdowns: []TenderInfo{{Name: "coin", Currency: "CHF", Count: 1, Amount: 2}}}
+	for _, tt := range []struct {
+		name string
+		tx   Transaction
+	}{
+		{name: "invalid currency", tx: transfer(VaultTill, "till-1", Tender{ID: "cash", Currency: "euro", Amount: 1})},
+		{name: "qualified tender ID", tx: transfer(VaultTill, "till-1", Tender{ID: "cash@EUR", Amount: 1})},
+		{name: "mixed currencies", tx: transfer(VaultTill, "till-1", mixed)},
+	} {
+		if err := c.ProcessTransaction(ctx, tt.tx); !errors.Is(err, ErrInvalidTransaction) {
+			t.Errorf("%s: ProcessTransaction() error = %v, want %v", tt.name, err, ErrInvalidTransaction)
+		}
+	}
+	c.AllowMixedCurrencies = true
+	mustProcess(t, c, transfer(VaultTill, "till-2", mixed))
+	tender, err := c.GetTenderBreakdown(ctx, testKey, "till-2", "cash@EUR")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(tender, mixed) {
+		t.Errorf("till-2 cash@EUR = %+v, want %+v", tender, mixed)
+	}
+}
+
+func TestFormatAmountCurrencies(t *testing.T) {
+	tests := []struct {
+		amount   Money
+		currency string
+		want     string
+	}{
+		{1250, "CHF", "CHF 12.50"},
+		{-1250, "CHF", "CHF -12.50"},
+		{12345, "KWD", "KWD 12.345"},
+		{5, "KWD", "KWD 0.005"},
+		{1250, "KRW", "₩1250"},
+		{99, "GBP", "£0.99"},
+	}
+	for _, tt := range tests {
+		if got := FormatAmount(tt.amount, tt.currency); got != tt.want {
+			t.Errorf("FormatAmount(%d, %q) = %q, want %q", tt.amount, tt.currency, got, tt.want)
+		}
+	}
+
+	// The tender and denomination helpers format in their own currency
+	tender := Tender{ID: "cash", Currency: "JPY", Amount: 1500, TenderBreakdowns: []TenderInfo{{Name: "note-1000", Currency: "JPY", Count: 1, Amount: 1000}}}
+	if got := tender.FormatAmount(); got != "¥1500" {
+		t.Errorf("Tender.FormatAmount() = %q, want %q", got, "¥1500")
+	}
+	if got := tender.TenderBreakdowns[0].FormatAmount(); got != "¥1000" {
+		t.Errorf("TenderInfo.FormatAmount() = %q, want %q", got, "¥1000")
+	}
+}
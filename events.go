@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Event types, the "type" field of an events stream entry.
+const (
+	EventTransaction = "TRANSACTION" // ProcessTransaction and the other two-sided movements
+	EventAdjust      = "ADJUST"      // One-sided Adjust; the source is empty
+	EventOpen        = "OPEN"        // OpenTill crediting the opening float from VaultTill
+	EventClose       = "CLOSE"       // CloseTill sweeping the till into its destination
+	EventConvert     = "CONVERT"     // ConvertTender; the entry's rate field holds the rate
+)
+
+// writeEvent queues on pipe the XADD recording an applied movement in the settlement's
+// events stream. It runs in the movement's MULTI/EXEC, so an event is recorded exactly
+// when the balances it describes change. Tenders are listed by stored ID, which includes
+// the currency, with their amounts in the same order, so amounts in different currencies
+// are never added up. fields are appended to the entry.
+func (c Client) writeEvent(ctx context.Context, pipe redis.Pipeliner, key Key, eventType string, t Transaction, tenders []Tender, fields ...interface{}) {
+	tenderIDs := make([]string, len(tenders))
+	amounts := make([]string, len(tenders))
+	for i, tender := range tenders {
+		tenderIDs[i] = tender.StoredID()
+		amounts[i] = strconv.FormatInt(int64(tender.Amount), 10)
+	}
+	values := []interface{}{
+		"type", eventType,
+		"transaction_id", t.TransactionID,
+		"source", t.Source,
+		"destination", t.Destination,
+		"direction", string(t.Direction),
+		"tenders", strings.Join(tenderIDs, ","),
+		"amounts", strings.Join(amounts, ","),
+		"time", c.now().UTC().Format(time.RFC3339Nano),
+	}
+	pipe.XAdd(ctx, &redis.XAddArgs{
+		Stream: key.EventsStreamKey(),
+		Values: append(values, fields...),
+	})
+}
+
+// TillsChanged is the JSON message published on a settlement's TillsChannel.
+type TillsChanged struct {
+	Tills []string `json:"tills"`
+}
+
+// writeTillsChanged queues the PUBLISH announcing that the given tills changed. Like
+// writeEvent it runs in the transaction's MULTI/EXEC, so nothing is published for a
+// transaction that doesn't commit.
+func writeTillsChanged(ctx context.Context, pipe redis.Pipeliner, key Key, tillIDs ...string) error {
+	message, err := json.Marshal(TillsChanged{Tills: tillIDs})
+	if err != nil {
+		return err
+	}
+	pipe.Publish(ctx, key.TillsChannel(), message)
+	return nil
+}
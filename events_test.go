@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// events returns the fields of every entry of testKey's events stream, without the time.
+func events(t testing.TB, c Client) []map[string]interface{} {
+	t.Helper()
+	entries, err := c.XRange(context.Background(), testKey.EventsStreamKey(), "-", "+").Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := make([]map[string]interface{}, len(entries))
+	for i, entry := range entries {
+		if _, err := time.Parse(time.RFC3339Nano, entry.Values["time"].(string)); err != nil {
+			t.Errorf("event %s time: %v", entry.ID, err)
+		}
+		delete(entry.Values, "time")
+		values[i] = entry.Values
+	}
+	return values
+}
+
+func TestEvents(t *testing.T) {
+	c, _ := newTestClient(t)
+	ctx := context.Background()
+	c.EmitEvents = true
+	tx := transfer("till-1", "till-2", Tender{ID: "cash", Currency: "EUR", Amount: 10}, Tender{ID: "cash", Currency: "USD", Amount: 7})
+	tx.TransactionID = "tx-1"
+	mustProcess(t, c, tx)
+	if err := c.Adjust(ctx, testKey, "till-2", "cash@USD", -2, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []map[string]interface{}{
+		{
+			"type":           EventTransaction,
+			"transaction_id": "tx-1",
+			"source":         "till-1",
+			"destination":    "till-2",
+			"direction":      "credit",
+			"tenders":        "cash@EUR,cash@USD",
+			"amounts":        "10,7",
+		},
+		{
+			"type":           EventAdjust,
+			"transaction_id": "",
+			"source":         "",
+			"destination":    "till-2",
+			"direction":      "debit",
+			"tenders":        "cash@USD",
+			"amounts":        "2",
+		},
+	}
+	if got := events(t, c); !reflect.DeepEqual(got, want) {
+		t.Errorf("events = %v, want %v", got, want)
+	}
+}
+
+func TestEventsOnlyWhenCommitted(t *testing.T) {
+	c, _ := newTestClient(t)
+	c.EmitEvents = true
+	c.AddHook(failingHook{testKey.EventsStreamKey()})
+	if err := c.ProcessTransaction(context.Background(), transfer("till-1", "till-2", cash(1))); err == nil {
+		t.Fatal("ProcessTransaction() succeeded despite the injected failure")
+	}
+	if n, err := c.XLen(context.Background(), testKey.EventsStreamKey()).Result(); err != nil || n != 0 {
+		t.Errorf("events = %d, %v after failed transaction, want none", n, err)
+	}
+}
+
+func TestPublishTillChanges(t *testing.T) {
+	c, _ := newTestClient(t)
+	ctx := context.Background()
+	c.PublishTillChanges = true
+	sub := c.Subscribe(ctx, testKey.TillsChannel())
+	defer sub.Close()
+	if _, err := sub.Receive(ctx); err != nil {
+		t.Fatal(err)
+	}
+	messages := sub.Channel()
+
+	mustProcess(t, c, transfer(VaultTill, "till-1", cash(5)))
+	if err := c.ProcessTransaction(ctx, transfer("till-1", "till-2", Tender{ID: "card", Amount: -1})); err == nil {
+		t.Fatal("invalid transaction succeeded")
+	}
+	if err := c.Adjust(ctx, testKey, "till-1", "cash", -1, nil); err != nil {
+		t.Fatal(err)
+	}
+	// Nothing is published for the rejected transaction
+	for _, want := range []TillsChanged{{Tills: []string{VaultTill, "till-1"}}, {Tills: []string{"till-1"}}} {
+		select {
+		case msg := <-messages:
+			var got TillsChanged
+			if err := json.Unmarshal([]byte(msg.Payload), &got); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("published %+v, want %+v", got, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("no message published, want %+v", want)
+		}
+	}
+}
@@ -0,0 +1,552 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+var (
+	ErrTransactionNotFound  = errors.New("transaction not found")
+	ErrDuplicateTransaction = errors.New("duplicate transaction ID")
+	ErrImportConflict       = errors.New("conflicting stored transaction")
+	ErrUnloggedWrites       = errors.New("writes outside the transaction log")
+)
+
+// Transactions with a TransactionID are stored as JSON in the settlement's transactions
+// hash, keyed by ID, in the same MULTI/EXEC as their writes. Their IDs are also appended
+// to the transaction log stream, which orders them for ListTransactions, together with the
+// movement as it was applied, for ReplayTransactions, encoded as JSON. A correction's log
+// entry also records the transaction it corrects, see GetTransactionLog.
+
+// LogFormat is the encoding of the applied movement in transaction log entries, the
+// "format" field of an entry. Entries are written as LogFormatJSON, and entries without a
+// format are JSON; any other format fails to decode.
+type LogFormat string
+
+const LogFormatJSON LogFormat = "json"
+
+// appliedTransaction is a stored transaction's movement as it was applied: its tenders
+// validated and rewritten by prepareTenders under the client configuration of the time.
+type appliedTransaction struct {
+	Source      string
+	Destination string
+	Direction   int
+	Tenders     []Tender
+}
+
+// newTransactionCheck fails with ErrDuplicateTransaction if txID was already stored. Run it
+// under WATCH of the transactions hash so a concurrent duplicate can't also pass.
+func newTransactionCheck(ctx context.Context, key Key, txID string) func(*redis.Tx) error {
+	return func(tx *redis.Tx) error {
+		exists, err := tx.HExists(ctx, key.TransactionsKey(), txID).Result()
+		if err != nil {
+			return fmt.Errorf("read %s: %w", key.TransactionsKey(), err)
+		}
+		if exists {
+			return fmt.Errorf("%w: %s", ErrDuplicateTransaction, txID)
+		}
+		return nil
+	}
+}
+
+// storedTransactionCheck fails with ErrTransactionNotFound unless txID is stored. Run it
+// under WATCH of the transactions hash.
+func storedTransactionCheck(ctx context.Context, key Key, txID string) func(*redis.Tx) error {
+	return func(tx *redis.Tx) error {
+		exists, err := tx.HExists(ctx, key.TransactionsKey(), txID).Result()
+		if err != nil {
+			return fmt.Errorf("read %s: %w", key.TransactionsKey(), err)
+		}
+		if !exists {
+			return fmt.Errorf("%w: %s", ErrTransactionNotFound, txID)
+		}
+		return nil
+	}
+}
+
+// postBalancesCheck returns the tender keys a transaction moving tenders between source and
+// destination changes and a check, to run under WATCH of them, filling balances with the
+// totals the transaction leaves them at by till and stored tender ID.
+func postBalancesCheck(ctx context.Context, key Key, source, destination string, direction int, tenders []Tender, balances map[string]map[string]Money) ([]string, func(*redis.Tx) error) {
+	var deltas []DenomDelta
+	var tenderKeys []string
+	for _, delta := range transactionDeltas(source, destination, direction, tenders) {
+		if delta.Denomination == "" {
+			deltas = append(deltas, delta)
+			tenderKeys = append(tenderKeys, key.TenderKey(delta.Till, delta.Tender))
+		}
+	}
+	return tenderKeys, func(tx *redis.Tx) error {
+		totals, err := mgetTenderTotals(ctx, tx, tenderKeys, tenderKeys)
+		if err != nil {
+			return err
+		}
+		for tillID := range balances {
+			delete(balances, tillID)
+		}
+		for i, delta := range deltas {
+			if balances[delta.Till] == nil {
+				balances[delta.Till] = make(map[string]Money)
+			}
+			// A tender listed twice is moved twice
+			balance, ok := balances[delta.Till][delta.Tender]
+			if !ok {
+				balance = totals[tenderKeys[i]]
+			}
+			balances[delta.Till][delta.Tender] = balance + delta.Amount
+		}
+		return nil
+	}
+}
+
+// recordTransaction wraps write so it also stores t, applied with direction and the
+// prepared tenders, in the same MULTI/EXEC. Non-nil balances are recorded in the log entry
+// as the transaction's post-balances.
+func recordTransaction(ctx context.Context, key Key, t Transaction, direction int, tenders []Tender, balances map[string]map[string]Money, write func(redis.Pipeliner) error) func(redis.Pipeliner) error {
+	return func(pipe redis.Pipeliner) error {
+		data, err := json.Marshal(t)
+		if err != nil {
+			return fmt.Errorf("encode transaction %s: %w", t.TransactionID, err)
+		}
+		applied, err := json.Marshal(appliedTransaction{Source: t.Source, Destination: t.Destination, Direction: direction, Tenders: tenders})
+		if err != nil {
+			return fmt.Errorf("encode transaction %s: %w", t.TransactionID, err)
+		}
+		if err := write(pipe); err != nil {
+			return err
+		}
+		values := []interface{}{"id", t.TransactionID, "format", string(LogFormatJSON), "applied", applied}
+		if t.Corrects != "" {
+			values = append(values, "kind", LogCorrection, "ref", t.Corrects)
+		}
+		if balances != nil {
+			post, err := json.Marshal(balances)
+			if err != nil {
+				return fmt.Errorf("encode balances of transaction %s: %w", t.TransactionID, err)
+			}
+			values = append(values, "balances", post)
+		}
+		pipe.HSet(ctx, key.TransactionsKey(), t.TransactionID, data)
+		pipe.XAdd(ctx, &redis.XAddArgs{Stream: key.TransactionLogKey(), Values: values})
+		return nil
+	}
+}
+
+// GetTransaction returns the transaction stored under txID, exactly as it was passed to
+// ProcessTransaction. It fails with ErrTransactionNotFound if there is none.
+func (c Client) GetTransaction(ctx context.Context, key Key, txID string) (Transaction, error) {
+	return getTransaction(ctx, c.reader(ReadOptions{}), key, txID)
+}
+
+func getTransaction(ctx context.Context, cmd redis.Cmdable, key Key, txID string) (Transaction, error) {
+	data, err := cmd.HGet(ctx, key.TransactionsKey(), txID).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return Transaction{}, fmt.Errorf("%w: %s", ErrTransactionNotFound, txID)
+	}
+	if err != nil {
+		return Transaction{}, fmt.Errorf("read transaction %s: %w", txID, err)
+	}
+	var t Transaction
+	if err := json.Unmarshal(data, &t); err != nil {
+		return Transaction{}, &ParseError{Key: key.TransactionsKey(), Field: txID, Value: string(data), Err: err}
+	}
+	return t, nil
+}
+
+// ReverseTransactionByID reverses the stored transaction txID with ReverseTransaction. The
+// lookup goes to the primary, so a just-applied transaction is always found. The reversal
+// is stored alongside it, so a transaction can be reversed only once: a repeat, even a
+// concurrent one, fails with ErrAlreadyReversed.
+func (c Client) ReverseTransactionByID(ctx context.Context, key Key, txID string) error {
+	done, err := c.begin()
+	if err != nil {
+		return err
+	}
+	defer done()
+	t, err := getTransaction(ctx, c.Client, key, txID)
+	if err != nil {
+		return err
+	}
+	return c.reverseTransaction(ctx, t)
+}
+
+// CorrectTransaction applies correction as a correction of the stored transaction
+// originalRef: it's processed like any transaction with Corrects set to originalRef, and
+// its log entry links it to the original, see GetTransactionLog. The correction needs a
+// TransactionID of its own so it's stored and can be corrected in turn. It's applied as
+// given, on top of the original; to replace the original, reverse it with
+// ReverseTransactionByID as well. It fails with ErrTransactionNotFound if originalRef isn't
+// stored, checked under WATCH in the same MULTI/EXEC as the correction's writes.
+func (c Client) CorrectTransaction(ctx context.Context, originalRef string, correction Transaction) error {
+	if originalRef == "" {
+		return fmt.Errorf("%w: missing reference of the corrected transaction", ErrInvalidTransaction)
+	}
+	done, err := c.begin()
+	if err != nil {
+		return err
+	}
+	defer done()
+	correction.Corrects = originalRef
+	start := time.Now()
+	err = c.processWithRetry(ctx, correction)
+	c.observeTransaction("CorrectTransaction", start, correction, err)
+	return err
+}
+
+// Kinds of transaction log entries.
+const (
+	LogTransaction = "transaction"
+	LogCorrection  = "correction" // Ref is the TransactionID of the corrected transaction
+)
+
+// LogEntry is an entry of a settlement's transaction log: a stored transaction's movement
+// as it was applied.
+type LogEntry struct {
+	ID            string // Stream entry ID, the cursor of the next GetTransactionLog page
+	TransactionID string
+	Kind          string    // LogTransaction or LogCorrection
+	Ref           string    // TransactionID of the transaction a correction corrects
+	Format        LogFormat // Encoding of the entry's movement
+	Source        string
+	Destination   string
+	Direction     Direction
+	Tenders       []Tender // As prepared by prepareTenders when applied
+
+	// Tender totals the transaction left its tills at, by till and stored tender ID. Only
+	// recorded by a client with LogBalances set.
+	Balances map[string]map[string]Money
+}
+
+// GetTransactionLog returns up to limit entries of the transaction log in the order they
+// were applied, starting after cursor, plus the cursor of the next page, paged like
+// ListTransactions. Following Ref from entry to entry walks a chain of corrections back to
+// the original transaction.
+func (c Client) GetTransactionLog(ctx context.Context, key Key, cursor string, limit int) ([]LogEntry, string, error) {
+	if limit <= 0 {
+		return nil, "", fmt.Errorf("invalid page size %d", limit)
+	}
+	start := "-"
+	if cursor != "" {
+		start = "(" + cursor
+	}
+	entries, err := c.reader(ReadOptions{}).XRangeN(ctx, key.TransactionLogKey(), start, "+", int64(limit)+1).Result()
+	if err != nil {
+		return nil, "", fmt.Errorf("read transaction log of settlement %s: %w", key.SettlementDocID, err)
+	}
+	next := ""
+	if len(entries) > limit {
+		entries = entries[:limit]
+		next = entries[limit-1].ID
+	}
+	page := make([]LogEntry, 0, len(entries))
+	for _, entry := range entries {
+		e, err := c.logEntry(ctx, key, entry)
+		if err != nil {
+			return nil, "", err
+		}
+		page = append(page, e)
+	}
+	return page, next, nil
+}
+
+// TrimOldLog removes the transaction log entries older than TxLogMaxAge, by the clock, with
+// XTRIM MINID on their stream IDs, which the server assigns from its time when an entry is
+// added. It does nothing when TxLogMaxAge isn't set. The stored transactions are kept, but
+// with part of its log gone the settlement can no longer be replayed, see
+// ReplayTransactions.
+func (c Client) TrimOldLog(ctx context.Context, key Key) error {
+	done, err := c.begin()
+	if err != nil {
+		return err
+	}
+	defer done()
+	if c.TxLogMaxAge <= 0 {
+		return nil
+	}
+	cutoff := c.now().Add(-c.TxLogMaxAge).UnixMilli()
+	// Entries are only ever added after the last one, so once the oldest is recent enough
+	// there is nothing to trim
+	oldest, err := c.XRangeN(ctx, key.TransactionLogKey(), "-", strconv.FormatInt(cutoff-1, 10), 1).Result()
+	if err != nil {
+		return fmt.Errorf("read transaction log of settlement %s: %w", key.SettlementDocID, err)
+	}
+	if len(oldest) == 0 {
+		return nil
+	}
+	_, err = c.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.XTrimMinID(ctx, key.TransactionLogKey(), strconv.FormatInt(cutoff, 10))
+		markUnlogged(ctx, pipe, key)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("trim transaction log of settlement %s: %w", key.SettlementDocID, err)
+	}
+	return nil
+}
+
+// logEntry decodes a transaction log entry.
+func (c Client) logEntry(ctx context.Context, key Key, entry redis.XMessage) (LogEntry, error) {
+	a, err := c.loggedTransaction(ctx, key, entry)
+	if err != nil {
+		return LogEntry{}, err
+	}
+	e := LogEntry{ID: entry.ID, Kind: LogTransaction, Format: LogFormatJSON, Source: a.Source, Destination: a.Destination, Direction: DirectionCredit, Tenders: a.Tenders}
+	e.TransactionID, _ = entry.Values["id"].(string)
+	if a.Direction < 0 {
+		e.Direction = DirectionDebit
+	}
+	if format, ok := entry.Values["format"].(string); ok {
+		e.Format = LogFormat(format)
+	}
+	if kind, ok := entry.Values["kind"].(string); ok {
+		e.Kind = kind
+		e.Ref, _ = entry.Values["ref"].(string)
+	}
+	if raw, ok := entry.Values["balances"].(string); ok {
+		if err := json.Unmarshal([]byte(raw), &e.Balances); err != nil {
+			return LogEntry{}, &ParseError{Key: key.TransactionLogKey(), Field: entry.ID, Value: raw, Err: err}
+		}
+	}
+	return e, nil
+}
+
+// ListTransactions returns up to limit stored transactions in the order they were applied,
+// starting after cursor, plus the cursor of the next page. Pass an empty cursor for the
+// first page; an empty next cursor means there are no more transactions.
+func (c Client) ListTransactions(ctx context.Context, key Key, cursor string, limit int) ([]Transaction, string, error) {
+	if limit <= 0 {
+		return nil, "", fmt.Errorf("invalid page size %d", limit)
+	}
+	start := "-"
+	if cursor != "" {
+		start = "(" + cursor
+	}
+	r := c.reader(ReadOptions{})
+	entries, err := r.XRangeN(ctx, key.TransactionLogKey(), start, "+", int64(limit)+1).Result()
+	if err != nil {
+		return nil, "", fmt.Errorf("read transaction log of settlement %s: %w", key.SettlementDocID, err)
+	}
+	next := ""
+	if len(entries) > limit {
+		entries = entries[:limit]
+		next = entries[limit-1].ID
+	}
+	if len(entries) == 0 {
+		return nil, "", nil
+	}
+
+	ids := make([]string, len(entries))
+	for i, entry := range entries {
+		id, ok := entry.Values["id"].(string)
+		if !ok {
+			return nil, "", &ParseError{Key: key.TransactionLogKey(), Field: entry.ID, Value: fmt.Sprint(entry.Values), Err: errors.New("missing transaction ID")}
+		}
+		ids[i] = id
+	}
+	txs, err := storedTransactions(ctx, r, key, ids)
+	if err != nil {
+		return nil, "", err
+	}
+	return txs, next, nil
+}
+
+// storedTransactions returns the stored transactions ids, in that order, with one HMGET.
+func storedTransactions(ctx context.Context, cmd redis.Cmdable, key Key, ids []string) ([]Transaction, error) {
+	values, err := cmd.HMGet(ctx, key.TransactionsKey(), ids...).Result()
+	if err != nil {
+		return nil, fmt.Errorf("read transactions of settlement %s: %w", key.SettlementDocID, err)
+	}
+	txs := make([]Transaction, 0, len(values))
+	for i, value := range values {
+		data, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("%w: %s", ErrTransactionNotFound, ids[i])
+		}
+		var t Transaction
+		if err := json.Unmarshal([]byte(data), &t); err != nil {
+			return nil, &ParseError{Key: key.TransactionsKey(), Field: ids[i], Value: data, Err: err}
+		}
+		txs = append(txs, t)
+	}
+	return txs, nil
+}
+
+// ReplayTransactions rebuilds a cleared settlement's balances from its stored transactions,
+// re-applying each one's writes in log order, a page of transactionBatchSize per
+// MULTI/EXEC. The transactions themselves, their log and the idempotency keys are left as
+// they are, and nothing is recorded again. Each transaction is replayed as it was applied,
+// with the tenders prepareTenders produced at the time, so a change of rounding or merging
+// options since doesn't change the result; the window and closed-till checks aren't run
+// again. A reversal by ReverseTransactionByID is stored and replayed too, so a reversed
+// transaction nets out as it did live. Only transactions stored with a TransactionID are in
+// the log, so a settlement whose balances were ever written any other way, e.g. by OpenTill,
+// Adjust, a transaction without a TransactionID or a count, or whose log was trimmed by
+// TrimOldLog, can't be rebuilt from it and replaying fails with ErrUnloggedWrites. It fails with ErrSettlementExists if the
+// settlement still has tills.
+func (c Client) ReplayTransactions(ctx context.Context, key Key) error {
+	done, err := c.begin()
+	if err != nil {
+		return err
+	}
+	defer done()
+	n, err := c.SCard(ctx, key.TillsSetKey()).Result()
+	if err != nil {
+		return fmt.Errorf("count tills of settlement %s: %w", key.SettlementDocID, err)
+	}
+	if n > 0 {
+		return fmt.Errorf("%w: %s has %d tills, clear it before replaying", ErrSettlementExists, key.SettlementDocID, n)
+	}
+	unlogged, err := c.Get(ctx, key.UnloggedKey()).Int64()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return fmt.Errorf("read unlogged writes of settlement %s: %w", key.SettlementDocID, err)
+	}
+	if unlogged > 0 {
+		return fmt.Errorf("%w: %s has %d", ErrUnloggedWrites, key.SettlementDocID, unlogged)
+	}
+
+	// Read the log from the primary, which the replayed writes go to as well
+	start := "-"
+	for {
+		entries, err := c.XRangeN(ctx, key.TransactionLogKey(), start, "+", transactionBatchSize).Result()
+		if err != nil {
+			return fmt.Errorf("read transaction log of settlement %s: %w", key.SettlementDocID, err)
+		}
+		if len(entries) == 0 {
+			return nil
+		}
+		applied := make([]appliedTransaction, len(entries))
+		for i, entry := range entries {
+			if applied[i], err = c.loggedTransaction(ctx, key, entry); err != nil {
+				return fmt.Errorf("replay settlement %s: %w", key.SettlementDocID, err)
+			}
+		}
+		_, err = c.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			for _, a := range applied {
+				c.writeTransaction(ctx, pipe, key, a.Source, a.Destination, a.Direction, a.Tenders)
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("replay settlement %s: %w", key.SettlementDocID, err)
+		}
+		if len(entries) < transactionBatchSize {
+			return nil
+		}
+		start = "(" + entries[len(entries)-1].ID
+	}
+}
+
+// loggedTransaction returns the movement recorded by a transaction log entry. Entries
+// written before the log recorded the applied movement have their stored transaction
+// prepared again with the current configuration.
+func (c Client) loggedTransaction(ctx context.Context, key Key, entry redis.XMessage) (appliedTransaction, error) {
+	if raw, ok := entry.Values["applied"].(string); ok {
+		var a appliedTransaction
+		var err error
+		switch format, _ := entry.Values["format"].(string); LogFormat(format) {
+		case "", LogFormatJSON:
+			err = json.Unmarshal([]byte(raw), &a)
+		default:
+			err = fmt.Errorf("unknown transaction log format %q", format)
+		}
+		if err != nil {
+			return appliedTransaction{}, &ParseError{Key: key.TransactionLogKey(), Field: entry.ID, Value: raw, Err: err}
+		}
+		return a, nil
+	}
+	id, ok := entry.Values["id"].(string)
+	if !ok {
+		return appliedTransaction{}, &ParseError{Key: key.TransactionLogKey(), Field: entry.ID, Value: fmt.Sprint(entry.Values), Err: errors.New("missing transaction ID")}
+	}
+	t, err := getTransaction(ctx, c.Client, key, id)
+	if err != nil {
+		return appliedTransaction{}, err
+	}
+	direction, err := checkTransaction(t)
+	if err != nil {
+		return appliedTransaction{}, fmt.Errorf("replay transaction %s: %w", id, err)
+	}
+	tenders, err := c.prepareTenders(t.Tenders)
+	if err != nil {
+		return appliedTransaction{}, fmt.Errorf("replay transaction %s: %w", id, err)
+	}
+	return appliedTransaction{Source: t.Source, Destination: t.Destination, Direction: direction, Tenders: tenders}, nil
+}
+
+type ImportReport struct {
+	Applied   []string        // IDs of the transactions applied by this import
+	Skipped   []string        // IDs of the transactions already stored as given, e.g. by an earlier run
+	Conflicts []ImportFailure // Transactions whose ID or idempotency key is taken by a different transaction
+	Failed    []ImportFailure // Transactions rejected or failed while applied
+}
+
+type ImportFailure struct {
+	Index int    // Position in the imported batch
+	ID    string // TransactionID; empty when missing
+	Err   error
+}
+
+// ImportTransactions applies txs one by one with ProcessTransaction and reports the
+// outcome of each instead of stopping at the first failure. Every transaction needs a
+// TransactionID, which makes the import idempotent: a transaction already stored exactly
+// as given is skipped, so an interrupted import can simply be run again. One whose ID or
+// idempotency key belongs to a different stored transaction is reported in Conflicts with
+// an ErrImportConflict error, as it was never applied. The error is only non-nil
+// when the import itself had to stop, e.g. because ctx is done; the report then covers
+// the transactions processed so far.
+func (c Client) ImportTransactions(ctx context.Context, txs []Transaction) (ImportReport, error) {
+	var report ImportReport
+	for i, t := range txs {
+		if t.TransactionID == "" {
+			report.Failed = append(report.Failed, ImportFailure{Index: i, Err: fmt.Errorf("%w: missing transaction ID", ErrInvalidTransaction)})
+			continue
+		}
+		err := c.ProcessTransaction(ctx, t)
+		switch {
+		case err == nil:
+			report.Applied = append(report.Applied, t.TransactionID)
+		case errors.Is(err, ErrDuplicateTransaction) || errors.Is(err, ErrAlreadyApplied):
+			switch err := c.checkStoredAs(ctx, t); {
+			case err == nil:
+				report.Skipped = append(report.Skipped, t.TransactionID)
+			case errors.Is(err, ErrImportConflict):
+				report.Conflicts = append(report.Conflicts, ImportFailure{Index: i, ID: t.TransactionID, Err: err})
+			default:
+				report.Failed = append(report.Failed, ImportFailure{Index: i, ID: t.TransactionID, Err: err})
+			}
+		case ctx.Err() != nil || errors.Is(err, ErrClientClosed):
+			return report, fmt.Errorf("transaction %d: %w", i, err)
+		default:
+			report.Failed = append(report.Failed, ImportFailure{Index: i, ID: t.TransactionID, Err: err})
+		}
+	}
+	return report, nil
+}
+
+// checkStoredAs fails with ErrImportConflict unless t is stored under its TransactionID
+// exactly as given.
+func (c Client) checkStoredAs(ctx context.Context, t Transaction) error {
+	key := c.normalizeKey(c.NewKey(t.Org, t.EU, t.SettlementDocID))
+	stored, err := c.HGet(ctx, key.TransactionsKey(), t.TransactionID).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return fmt.Errorf("%w: transaction %s not stored under its ID", ErrImportConflict, t.TransactionID)
+	}
+	if err != nil {
+		return fmt.Errorf("read transaction %s: %w", t.TransactionID, err)
+	}
+	data, err := json.Marshal(t)
+	if err != nil {
+		return fmt.Errorf("encode transaction %s: %w", t.TransactionID, err)
+	}
+	if !bytes.Equal(stored, data) {
+		return fmt.Errorf("%w: transaction %s stored with a different payload", ErrImportConflict, t.TransactionID)
+	}
+	return nil
+}
@@ -0,0 +1,643 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// stored returns tx with the given TransactionID.
+func stored(id string, tx Transaction) Transaction {
+	tx.TransactionID = id
+	return tx
+}
+
+func TestReverseTransactionByID(t *testing.T) {
+	c, _ := newTestClient(t)
+	ctx := context.Background()
+	mustProcess(t, c, transfer(VaultTill, "till-1", cash(100)), stored("tx-1", transfer("till-1", "till-2", cash(30))))
+
+	if err := c.ReverseTransactionByID(ctx, testKey, "tx-missing"); !errors.Is(err, ErrTransactionNotFound) {
+		t.Errorf("ReverseTransactionByID() of a missing transaction error = %v, want %v", err, ErrTransactionNotFound)
+	}
+
+	const attempts = 5
+	errs := make([]error, attempts)
+	var wg sync.WaitGroup
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = c.ReverseTransactionByID(ctx, testKey, "tx-1")
+		}(i)
+	}
+	wg.Wait()
+	var reversed int
+	for _, err := range errs {
+		switch {
+		case err == nil:
+			reversed++
+		case !errors.Is(err, ErrAlreadyReversed):
+			t.Errorf("ReverseTransactionByID() error = %v, want nil or %v", err, ErrAlreadyReversed)
+		}
+	}
+	if reversed != 1 {
+		t.Errorf("transaction reversed %d times, want 1", reversed)
+	}
+	if got := tenderAmount(t, c, "till-1", "cash"); got != 100 {
+		t.Errorf("till-1 total = %v, want 100", got)
+	}
+	if got := tenderAmount(t, c, "till-2", "cash"); got != 0 {
+		t.Errorf("till-2 total = %v, want 0", got)
+	}
+	reversal, err := c.GetTransaction(ctx, testKey, "tx-1"+reversalSuffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reversal.Direction != DirectionDebit {
+		t.Errorf("reversal direction = %s, want %s", reversal.Direction, DirectionDebit)
+	}
+}
+
+func TestCorrectTransaction(t *testing.T) {
+	c, _ := newTestClient(t)
+	ctx := context.Background()
+	mustProcess(t, c, stored("tx-1", transfer(VaultTill, "till-1", cash(100))))
+	if err := c.CorrectTransaction(ctx, "tx-missing", stored("tx-2", transfer(VaultTill, "till-1", cash(5)))); !errors.Is(err, ErrTransactionNotFound) {
+		t.Errorf("CorrectTransaction() of a missing transaction error = %v, want %v", err, ErrTransactionNotFound)
+	}
+	if err := c.CorrectTransaction(ctx, "tx-1", transfer(VaultTill, "till-1", cash(5))); !errors.Is(err, ErrInvalidTransaction) {
+		t.Errorf("CorrectTransaction() without a TransactionID error = %v, want %v", err, ErrInvalidTransaction)
+	}
+	if err := c.CorrectTransaction(ctx, "tx-1", stored("tx-2", transfer("till-1", VaultTill, cash(10)))); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.CorrectTransaction(ctx, "tx-2", stored("tx-3", transfer(VaultTill, "till-1", cash(1)))); err != nil {
+		t.Fatal(err)
+	}
+	if got := tenderAmount(t, c, "till-1", "cash"); got != 91 {
+		t.Errorf("till-1 total = %v, want 91", got)
+	}
+
+	log, next, err := c.GetTransactionLog(ctx, testKey, "", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next != "" || len(log) != 3 {
+		t.Fatalf("GetTransactionLog() = %+v, %q, want 3 entries", log, next)
+	}
+	for i, want := range []struct{ id, kind, ref string }{
+		{"tx-1", LogTransaction, ""},
+		{"tx-2", LogCorrection, "tx-1"},
+		{"tx-3", LogCorrection, "tx-2"},
+	} {
+		if e := log[i]; e.TransactionID != want.id || e.Kind != want.kind || e.Ref != want.ref {
+			t.Errorf("entry %d = %s %s of %q, want %s %s of %q", i, e.TransactionID, e.Kind, e.Ref, want.id, want.kind, want.ref)
+		}
+	}
+	if e := log[1]; e.Source != "till-1" || e.Destination != VaultTill || e.Direction != DirectionCredit || !reflect.DeepEqual(e.Tenders, []Tender{cash(10)}) {
+		t.Errorf("correction entry = %+v, want 10 cash from till-1 to the vault", e)
+	}
+	correction, err := c.GetTransaction(ctx, testKey, "tx-2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if correction.Corrects != "tx-1" {
+		t.Errorf("stored correction corrects %q, want tx-1", correction.Corrects)
+	}
+
+	if err := c.ReverseTransactionByID(ctx, testKey, "tx-2"); err != nil {
+		t.Fatal(err)
+	}
+	page, _, err := c.GetTransactionLog(ctx, testKey, log[2].ID, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page) != 1 || page[0].Kind != LogTransaction || page[0].Ref != "" {
+		t.Errorf("log after reversing the correction = %+v, want one plain transaction", page)
+	}
+}
+
+func TestLogFormats(t *testing.T) {
+	c, _ := newTestClient(t)
+	ctx := context.Background()
+	mustProcess(t, c, stored("tx-1", transfer(VaultTill, "till-1", Tender{ID: "cash", Currency: "EUR", Amount: 4})))
+	// An entry from before the log recorded its format is JSON
+	applied, err := json.Marshal(appliedTransaction{Source: VaultTill, Destination: "till-1", Direction: 1, Tenders: []Tender{{ID: "cash", Currency: "EUR", Amount: 6}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.XAdd(ctx, &redis.XAddArgs{Stream: testKey.TransactionLogKey(), Values: []interface{}{"id", "tx-2", "applied", applied}}).Err(); err != nil {
+		t.Fatal(err)
+	}
+	log, _, err := c.GetTransactionLog(ctx, testKey, "", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(log) != 2 {
+		t.Fatalf("GetTransactionLog() = %d entries, want 2", len(log))
+	}
+	for i, want := range []Money{4, 6} {
+		if e := log[i]; e.TransactionID != fmt.Sprintf("tx-%d", i+1) || !reflect.DeepEqual(e.Tenders, []Tender{{ID: "cash", Currency: "EUR", Amount: want}}) {
+			t.Errorf("entry %d = %+v, want tx-%d moving %v", i, e, i+1, want)
+		}
+	}
+	if raw, err := c.XRange(ctx, testKey.TransactionLogKey(), "-", "+").Result(); err != nil || raw[0].Values["format"] != string(LogFormatJSON) {
+		t.Errorf("first entry = %+v, %v, want format %s", raw, err, LogFormatJSON)
+	}
+
+	if err := c.XAdd(ctx, &redis.XAddArgs{Stream: testKey.TransactionLogKey(), Values: []interface{}{"id", "tx-3", "format", "msgpack", "applied", applied}}).Err(); err != nil {
+		t.Fatal(err)
+	}
+	var parseErr *ParseError
+	if _, _, err := c.GetTransactionLog(ctx, testKey, "", 10); !errors.As(err, &parseErr) {
+		t.Errorf("GetTransactionLog() with an unknown format error = %v, want a ParseError", err)
+	}
+}
+
+func TestLogBalances(t *testing.T) {
+	c, _ := newTestClient(t)
+	ctx := context.Background()
+	mustProcess(t, c, stored("tx-1", transfer(VaultTill, "till-1", cash(100))))
+	c.LogBalances = true
+	mustProcess(t, c,
+		transfer("till-1", "till-3", cash(40)), // Not logged, but moves the balances tx-2 starts from
+		stored("tx-2", transfer("till-1", "till-2", cash(15), Tender{ID: "card", Amount: 3})),
+	)
+	if err := c.ProcessTransactions(ctx, []Transaction{stored("tx-3", transfer("till-2", VaultTill, cash(1)))}); err != nil {
+		t.Fatal(err)
+	}
+
+	log, _, err := c.GetTransactionLog(ctx, testKey, "", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(log) != 3 {
+		t.Fatalf("GetTransactionLog() = %d entries, want 3", len(log))
+	}
+	if log[0].Balances != nil {
+		t.Errorf("entry logged without LogBalances has balances %v", log[0].Balances)
+	}
+	wants := []map[string]map[string]Money{
+		{"till-1": {"cash": 45, "card": -3}, "till-2": {"cash": 15, "card": 3}},
+		{"till-2": {"cash": 14}, VaultTill: {"cash": -99}},
+	}
+	for i, want := range wants {
+		if got := log[i+1].Balances; !reflect.DeepEqual(got, want) {
+			t.Errorf("%s balances = %v, want %v", log[i+1].TransactionID, got, want)
+		}
+	}
+
+	// The last entry's balances are the current totals
+	tills, err := c.GetExpectedTenders(ctx, testKey, WithReservedTills())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, till := range tills {
+		for _, tender := range till.Tenders {
+			if want, ok := log[2].Balances[till.ID][tender.StoredID()]; ok && tender.Amount != want {
+				t.Errorf("%s %s total = %v, logged as %v", till.ID, tender.StoredID(), tender.Amount, want)
+			}
+		}
+	}
+}
+
+func TestReplayTransactions(t *testing.T) {
+	c, _ := newTestClient(t)
+	ctx := context.Background()
+	c.MergeDuplicateTenders = true
+	mustProcess(t, c,
+		stored("tx-1", transfer(VaultTill, "till-1", cash(100))),
+		stored("tx-2", transfer("till-1", "till-2", cash(30), cash(10))),
+		stored("tx-3", transfer("till-2", "till-3", Tender{ID: "card", Amount: 25})),
+	)
+	if err := c.ReverseTransactionByID(ctx, testKey, "tx-3"); err != nil {
+		t.Fatal(err)
+	}
+	want, err := c.GetExpectedTenders(ctx, testKey, WithReservedTills())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.ReplayTransactions(ctx, testKey); !errors.Is(err, ErrSettlementExists) {
+		t.Errorf("ReplayTransactions() over live tills error = %v, want %v", err, ErrSettlementExists)
+	}
+	for _, till := range []string{VaultTill, "till-1", "till-2", "till-3"} {
+		if err := c.ClearTill(ctx, testKey, till); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The stored tenders were merged when applied; replay must not prepare them again
+	c.MergeDuplicateTenders = false
+	if err := c.ReplayTransactions(ctx, testKey); err != nil {
+		t.Fatal(err)
+	}
+	got, err := c.GetExpectedTenders(ctx, testKey, WithReservedTills())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("replayed tills = %+v, want %+v", got, want)
+	}
+}
+
+func TestReplayTransactionsUnlogged(t *testing.T) {
+	tests := []struct {
+		name string
+		op   func(ctx context.Context, c Client) error
+	}{
+		{
+			name: "OpenTill",
+			op: func(ctx context.Context, c Client) error {
+				return c.OpenTill(ctx, testKey, "till-2", []Tender{cash(5)})
+			},
+		},
+		{
+			name: "Adjust",
+			op:   func(ctx context.Context, c Client) error { return c.Adjust(ctx, testKey, "till-1", "cash", -3, nil) },
+		},
+		{
+			name: "transaction without an ID",
+			op: func(ctx context.Context, c Client) error {
+				return c.ProcessTransaction(ctx, transfer("till-1", "till-2", cash(1)))
+			},
+		},
+		{
+			name: "scripted transaction",
+			op: func(ctx context.Context, c Client) error {
+				return c.TransferIfAvailable(ctx, testKey, "till-1", "till-2", []Tender{cash(1)})
+			},
+		},
+		{
+			name: "SetTenderCount",
+			op:   func(ctx context.Context, c Client) error { return c.SetTenderCount(ctx, testKey, "till-1", cash(7)) },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := newTestClient(t)
+			ctx := context.Background()
+			mustProcess(t, c, stored("tx-1", transfer(VaultTill, "till-1", cash(100))))
+			if err := tt.op(ctx, c); err != nil {
+				t.Fatal(err)
+			}
+			tills, err := c.ListTills(ctx, testKey, WithReservedTills())
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, till := range tills {
+				if err := c.ClearTill(ctx, testKey, till); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := c.ReplayTransactions(ctx, testKey); !errors.Is(err, ErrUnloggedWrites) {
+				t.Errorf("ReplayTransactions() error = %v, want %v", err, ErrUnloggedWrites)
+			}
+			if n, err := c.CountTills(ctx, testKey); err != nil || n != 0 {
+				t.Errorf("CountTills() after a refused replay = %d, %v, want 0", n, err)
+			}
+		})
+	}
+}
+
+func TestTrimOldLog(t *testing.T) {
+	c, mr := newTestClient(t)
+	ctx := context.Background()
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := &testClock{now: start.Add(72*time.Hour + time.Hour)}
+	c.Clock = clock.Now
+	// The log's stream IDs are assigned from the server's clock
+	for i := 0; i < 4; i++ {
+		mr.SetTime(start.Add(time.Duration(i) * 24 * time.Hour))
+		mustProcess(t, c, stored(fmt.Sprintf("tx-%d", i), transfer(VaultTill, "till-1", cash(1))))
+	}
+	logged := func() []string {
+		log, _, err := c.GetTransactionLog(ctx, testKey, "", 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []string
+		for _, e := range log {
+			ids = append(ids, e.TransactionID)
+		}
+		return ids
+	}
+
+	// Without a maximum age nothing is trimmed
+	if err := c.TrimOldLog(ctx, testKey); err != nil {
+		t.Fatal(err)
+	}
+	if got := logged(); len(got) != 4 {
+		t.Errorf("log without TxLogMaxAge = %v, want all 4 entries", got)
+	}
+	c.TxLogMaxAge = 96 * time.Hour
+	if err := c.TrimOldLog(ctx, testKey); err != nil {
+		t.Fatal(err)
+	}
+	if got := logged(); len(got) != 4 || mr.Exists(testKey.UnloggedKey()) {
+		t.Errorf("log with nothing old enough = %v, unlogged %v, want all 4 entries and none unlogged", got, mr.Exists(testKey.UnloggedKey()))
+	}
+
+	c.TxLogMaxAge = 48 * time.Hour
+	if err := c.TrimOldLog(ctx, testKey); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := logged(), []string{"tx-2", "tx-3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("log after TrimOldLog() = %v, want %v", got, want)
+	}
+	if _, err := c.GetTransaction(ctx, testKey, "tx-0"); err != nil {
+		t.Errorf("GetTransaction() of a trimmed transaction error = %v", err)
+	}
+	if err := c.ClearTill(ctx, testKey, "till-1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.ClearTill(ctx, testKey, VaultTill); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.ReplayTransactions(ctx, testKey); !errors.Is(err, ErrUnloggedWrites) {
+		t.Errorf("ReplayTransactions() of a trimmed log error = %v, want %v", err, ErrUnloggedWrites)
+	}
+}
+
+func TestListTransactions(t *testing.T) {
+	c, _ := newTestClient(t)
+	ctx := context.Background()
+	var want []Transaction
+	for i := 1; i <= 5; i++ {
+		tx := stored(fmt.Sprintf("tx-%d", i), transfer(VaultTill, "till-1", cash(Money(i))))
+		mustProcess(t, c, tx)
+		want = append(want, tx)
+	}
+
+	var got []Transaction
+	var pages []int
+	cursor := ""
+	for {
+		page, next, err := c.ListTransactions(ctx, testKey, cursor, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, page...)
+		pages = append(pages, len(page))
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	if !reflect.DeepEqual(pages, []int{2, 2, 1}) {
+		t.Errorf("page sizes = %v, want [2 2 1]", pages)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ListTransactions() pages = %+v, want %+v", got, want)
+	}
+
+	// A page ending on the last transaction has no next cursor
+	if page, next, err := c.ListTransactions(ctx, testKey, "", 5); err != nil || len(page) != 5 || next != "" {
+		t.Errorf("ListTransactions(limit 5) = %d transactions, next %q, %v, want all 5 and no next cursor", len(page), next, err)
+	}
+	if _, _, err := c.ListTransactions(ctx, testKey, "", 0); err == nil {
+		t.Error("ListTransactions() with a page size of 0 succeeded")
+	}
+}
+
+func TestProcessBatch(t *testing.T) {
+	c, _ := newTestClient(t)
+	ctx := context.Background()
+	batch := []Transaction{
+		transfer(VaultTill, "till-1", cash(100)),
+		stored("tx-1", transfer("till-1", "till-2", cash(30))),
+	}
+	if err := c.ProcessBatch(ctx, "batch-1", batch); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.ProcessBatch(ctx, "batch-1", batch); !errors.Is(err, ErrBatchAlreadyApplied) {
+		t.Errorf("second ProcessBatch() error = %v, want %v", err, ErrBatchAlreadyApplied)
+	}
+	if got := tenderAmount(t, c, "till-1", "cash"); got != 70 {
+		t.Errorf("till-1 total = %v, want 70", got)
+	}
+	if got := tenderAmount(t, c, "till-2", "cash"); got != 30 {
+		t.Errorf("till-2 total = %v, want 30", got)
+	}
+
+	c.RejectOverdrafts = true
+	overdraft := []Transaction{transfer("till-1", "till-3", cash(40)), transfer("till-1", "till-4", cash(40))}
+	if err := c.ProcessBatch(ctx, "batch-2", overdraft); !errors.Is(err, ErrInsufficientTender) {
+		t.Fatalf("ProcessBatch() overdrawing till-1 error = %v, want %v", err, ErrInsufficientTender)
+	}
+	if got := tenderAmount(t, c, "till-3", "cash"); got != 0 {
+		t.Errorf("till-3 total = %v after a rejected batch, want 0", got)
+	}
+	if err := c.ProcessBatch(ctx, "batch-2", overdraft[:1]); err != nil {
+		t.Errorf("ProcessBatch() retried after a rejection error = %v", err)
+	}
+
+	dup := []Transaction{stored("tx-2", transfer("till-2", "till-1", cash(1))), stored("tx-2", transfer("till-2", "till-1", cash(1)))}
+	if err := c.ProcessBatch(ctx, "batch-3", dup); !errors.Is(err, ErrInvalidTransaction) {
+		t.Errorf("ProcessBatch() with a repeated TransactionID error = %v, want %v", err, ErrInvalidTransaction)
+	}
+}
+
+// testClock is a settable Client.Clock.
+type testClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *testClock) Set(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = now
+}
+
+func TestIdempotencyKey(t *testing.T) {
+	c, mr := newTestClient(t)
+	ctx := context.Background()
+	keyed := func(idempotencyKey string, tx Transaction) Transaction {
+		tx.IdempotencyKey = idempotencyKey
+		return tx
+	}
+	tx := keyed("delivery-1", transfer(VaultTill, "till-1", cash(1)))
+	mustProcess(t, c, tx)
+	if err := c.ProcessTransaction(ctx, tx); !errors.Is(err, ErrAlreadyApplied) {
+		t.Errorf("redelivery error = %v, want %v", err, ErrAlreadyApplied)
+	}
+	// Keys are per settlement
+	mustProcess(t, c, inSettlement("settlement-2", tx))
+	// A key recorded in the legacy applied set is still honoured
+	mr.SAdd(testKey.AppliedSetKey(), "delivery-0")
+	if err := c.ProcessTransaction(ctx, keyed("delivery-0", tx)); !errors.Is(err, ErrAlreadyApplied) {
+		t.Errorf("redelivery of a legacy key error = %v, want %v", err, ErrAlreadyApplied)
+	}
+	// A repeat within a batch is rejected after the first is applied
+	repeat := keyed("delivery-2", transfer(VaultTill, "till-1", cash(5)))
+	if err := c.ProcessTransactions(ctx, []Transaction{repeat, repeat}); !errors.Is(err, ErrAlreadyApplied) {
+		t.Errorf("ProcessTransactions() with a repeated key error = %v, want %v", err, ErrAlreadyApplied)
+	}
+	if got := tenderAmount(t, c, "till-1", "cash"); got != 6 {
+		t.Errorf("till-1 total = %v, want 6", got)
+	}
+}
+
+func TestIdempotencyMarkerExpiry(t *testing.T) {
+	c, _ := newTestClient(t)
+	ctx := context.Background()
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := &testClock{now: start}
+	c.Clock, c.IdempotencyTTL = clock.Now, time.Hour
+	tx := transfer(VaultTill, "till-1", cash(1))
+	tx.IdempotencyKey = "delivery-1"
+	mustProcess(t, c, tx)
+	if err := c.ProcessTransaction(ctx, tx); !errors.Is(err, ErrAlreadyApplied) {
+		t.Fatalf("redelivery error = %v, want %v", err, ErrAlreadyApplied)
+	}
+	clock.Set(start.Add(time.Hour + time.Millisecond))
+	if err := c.ProcessTransaction(ctx, tx); err != nil {
+		t.Errorf("redelivery after the marker expired error = %v", err)
+	}
+	if got := tenderAmount(t, c, "till-1", "cash"); got != 2 {
+		t.Errorf("till-1 total = %v, want 2", got)
+	}
+}
+
+func TestMarkerJanitor(t *testing.T) {
+	c, _ := newTestClient(t)
+	ctx := context.Background()
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := &testClock{now: start}
+	c.Clock, c.IdempotencyTTL = clock.Now, time.Hour
+	for i, id := range []string{"old", "new"} {
+		clock.Set(start.Add(time.Duration(i) * 30 * time.Minute))
+		tx := transfer(VaultTill, "till-1", cash(1))
+		tx.IdempotencyKey = id
+		mustProcess(t, c, tx)
+		if err := c.ProcessBatch(ctx, "batch-"+id, []Transaction{transfer(VaultTill, "till-2", cash(1))}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	clock.Set(start.Add(70 * time.Minute))
+
+	if err := c.StartMarkerJanitor(time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.StartMarkerJanitor(time.Millisecond); !errors.Is(err, ErrJanitorRunning) {
+		t.Errorf("second StartMarkerJanitor() error = %v, want %v", err, ErrJanitorRunning)
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		applied, err := c.ZRange(ctx, testKey.AppliedKeysKey(), 0, -1).Result()
+		if err != nil {
+			t.Fatal(err)
+		}
+		batches, err := c.ZRange(ctx, testKey.BatchesKey(), 0, -1).Result()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reflect.DeepEqual(applied, []string{"new"}) && reflect.DeepEqual(batches, []string{"batch-new"}) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("markers left = %v and %v, want only the unexpired ones", applied, batches)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.StartMarkerJanitor(time.Millisecond); !errors.Is(err, ErrClientClosed) {
+		t.Errorf("StartMarkerJanitor() after Close error = %v, want %v", err, ErrClientClosed)
+	}
+}
+
+func TestImportTransactions(t *testing.T) {
+	c, _ := newTestClient(t)
+	ctx := context.Background()
+	keyed := stored("tx-3", transfer("till-1", "till-3", cash(1)))
+	keyed.IdempotencyKey = "sale-1"
+	first := []Transaction{
+		stored("tx-1", transfer(VaultTill, "till-1", cash(100))),
+		transfer("till-1", "till-2", cash(1)), // No TransactionID
+		stored("tx-2", transfer("till-1", "till-2", Tender{ID: "cash", Amount: -1})),
+		keyed,
+	}
+	report, err := c.ImportTransactions(ctx, first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(report.Applied, []string{"tx-1", "tx-3"}) || len(report.Skipped) != 0 || len(report.Conflicts) != 0 {
+		t.Errorf("first import = %+v, want tx-1 and tx-3 applied", report)
+	}
+	if len(report.Failed) != 2 || report.Failed[0].Index != 1 || report.Failed[1].ID != "tx-2" || !errors.Is(report.Failed[1].Err, ErrInvalidTransaction) {
+		t.Errorf("first import failures = %+v, want indexes 1 and 2", report.Failed)
+	}
+
+	changed := stored("tx-1", transfer(VaultTill, "till-1", cash(90)))
+	reused := stored("tx-4", transfer("till-1", "till-3", cash(1)))
+	reused.IdempotencyKey = "sale-1"
+	report, err = c.ImportTransactions(ctx, []Transaction{first[0], changed, keyed, reused, stored("tx-5", transfer("till-1", "till-2", cash(5)))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(report.Applied, []string{"tx-5"}) || !reflect.DeepEqual(report.Skipped, []string{"tx-1", "tx-3"}) || len(report.Failed) != 0 {
+		t.Errorf("second import = %+v, want tx-5 applied and the identical tx-1 and tx-3 skipped", report)
+	}
+	if len(report.Conflicts) != 2 {
+		t.Fatalf("second import conflicts = %+v, want the changed tx-1 and the reused idempotency key", report.Conflicts)
+	}
+	for i, want := range []ImportFailure{{Index: 1, ID: "tx-1"}, {Index: 3, ID: "tx-4"}} {
+		if got := report.Conflicts[i]; got.Index != want.Index || got.ID != want.ID || !errors.Is(got.Err, ErrImportConflict) {
+			t.Errorf("conflict %d = %+v, want %s at %d with %v", i, got, want.ID, want.Index, ErrImportConflict)
+		}
+	}
+	if got := tenderAmount(t, c, "till-1", "cash"); got != 94 {
+		t.Errorf("till-1 total = %v, want 94", got)
+	}
+}
+
+func TestImportTransactionsInterrupted(t *testing.T) {
+	c, _ := newTestClient(t)
+	txs := []Transaction{
+		stored("tx-1", transfer(VaultTill, "till-1", cash(10))),
+		stored("tx-2", transfer("till-1", "till-2", cash(4))),
+		stored("tx-3", transfer("till-2", "till-3", cash(1))),
+	}
+	if _, err := c.ImportTransactions(context.Background(), txs[:2]); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	report, err := c.ImportTransactions(ctx, txs)
+	if !errors.Is(err, context.Canceled) || !reflect.DeepEqual(report, ImportReport{}) {
+		t.Fatalf("ImportTransactions() with a done context = %+v, %v, want an empty report and %v", report, err, context.Canceled)
+	}
+
+	// Running the whole import again picks up where the earlier runs stopped
+	report, err = c.ImportTransactions(context.Background(), txs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := ImportReport{Applied: []string{"tx-3"}, Skipped: []string{"tx-1", "tx-2"}}
+	if !reflect.DeepEqual(report, want) {
+		t.Errorf("resumed import = %+v, want %+v", report, want)
+	}
+	for till, want := range map[string]Money{"till-1": 6, "till-2": 3, "till-3": 1} {
+		if got := tenderAmount(t, c, till, "cash"); got != want {
+			t.Errorf("%s total = %v, want %v", till, got, want)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+var (
+	ErrAlreadyApplied      = errors.New("transaction already applied")
+	ErrBatchAlreadyApplied = errors.New("batch already applied")
+)
+
+// DefaultIdempotencyTTL is used when Client.IdempotencyTTL is zero.
+const DefaultIdempotencyTTL = 24 * time.Hour
+
+// Applied idempotency keys are members of the settlement's applied keys sorted set, and
+// IDs of batches applied by ProcessBatch of its batches sorted set, each scored by when it
+// expires, IdempotencyTTL after it was recorded. A marker past its expiry no longer counts
+// and is removed by PruneExpiredMarkers; each set as a whole also expires IdempotencyTTL
+// after its latest marker, so a settlement no longer written cleans up without the janitor.
+
+func (c Client) idempotencyTTL() time.Duration {
+	if c.IdempotencyTTL > 0 {
+		return c.IdempotencyTTL
+	}
+	return DefaultIdempotencyTTL
+}
+
+// notAppliedCheck fails with ErrAlreadyApplied if idempotencyKey was already recorded. Run
+// it under WATCH of the applied keys and the legacy applied set so a concurrent duplicate
+// can't also pass.
+func (c Client) notAppliedCheck(ctx context.Context, key Key, idempotencyKey string) func(*redis.Tx) error {
+	return func(tx *redis.Tx) error {
+		applied, err := c.markerLive(ctx, tx, key.AppliedKeysKey(), idempotencyKey)
+		if err != nil {
+			return err
+		}
+		if !applied {
+			// Keys recorded before markers expired individually
+			if applied, err = tx.SIsMember(ctx, key.AppliedSetKey(), idempotencyKey).Result(); err != nil {
+				return fmt.Errorf("read %s: %w", key.AppliedSetKey(), err)
+			}
+		}
+		if applied {
+			return fmt.Errorf("%w: %s", ErrAlreadyApplied, idempotencyKey)
+		}
+		return nil
+	}
+}
+
+// recordApplied wraps write so it also records idempotencyKey in the same MULTI/EXEC.
+func (c Client) recordApplied(ctx context.Context, key Key, idempotencyKey string, write func(redis.Pipeliner) error) func(redis.Pipeliner) error {
+	return func(pipe redis.Pipeliner) error {
+		if err := write(pipe); err != nil {
+			return err
+		}
+		c.writeMarker(ctx, pipe, key.AppliedKeysKey(), idempotencyKey)
+		return nil
+	}
+}
+
+// writeMarker records member in the marker set markersKey, expiring IdempotencyTTL from now.
+func (c Client) writeMarker(ctx context.Context, pipe redis.Pipeliner, markersKey, member string) {
+	ttl := c.idempotencyTTL()
+	pipe.ZAdd(ctx, markersKey, redis.Z{Score: float64(c.now().Add(ttl).UnixMilli()), Member: member})
+	pipe.Expire(ctx, markersKey, ttl)
+}
+
+// markerLive reports whether member has a marker in markersKey that hasn't expired yet.
+func (c Client) markerLive(ctx context.Context, tx *redis.Tx, markersKey, member string) (bool, error) {
+	expires, err := tx.ZScore(ctx, markersKey, member).Result()
+	if errors.Is(err, redis.Nil) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("read %s: %w", markersKey, err)
+	}
+	return int64(expires) > c.now().UnixMilli(), nil
+}
+
+// ProcessBatch applies txs, all of one settlement, at most once per batchID: a batch whose
+// ID was applied within the last IdempotencyTTL is skipped whole and fails with
+// ErrBatchAlreadyApplied. Unlike ProcessTransactions, every transaction and the batch
+// marker are written in a single WATCHed MULTI/EXEC, so a batch retried after an error
+// has either been applied entirely or not at all. The transactions get the checks
+// ProcessTransaction gives them, run before anything of the batch is written; with
+// RejectOverdrafts each till must hold every debit of the batch beforehand, credits it
+// receives within the batch aside. IdempotencyKeys and TransactionIDs must be unique
+// within the batch.
+func (c Client) ProcessBatch(ctx context.Context, batchID string, txs []Transaction) error {
+	done, err := c.begin()
+	if err != nil {
+		return err
+	}
+	defer done()
+	if batchID == "" {
+		return fmt.Errorf("%w: batch ID is required", ErrInvalidTransaction)
+	}
+	if len(txs) == 0 {
+		return fmt.Errorf("%w: batch %s is empty", ErrInvalidTransaction, batchID)
+	}
+
+	batch := make([]preparedTransaction, len(txs))
+	idempotencyKeys := make(map[string]struct{})
+	transactionIDs := make(map[string]struct{})
+	for i, t := range txs {
+		key, direction, tenders, err := c.prepareTransaction(ctx, t)
+		if err != nil {
+			return fmt.Errorf("transaction %d: %w", i, err)
+		}
+		if i > 0 && key != batch[0].key {
+			return fmt.Errorf("%w: transaction %d: batch %s spans settlements %s and %s", ErrInvalidTransaction, i, batchID, batch[0].key.SettlementDocID, key.SettlementDocID)
+		}
+		for _, seen := range []struct {
+			ids map[string]struct{}
+			id  string
+		}{{idempotencyKeys, t.IdempotencyKey}, {transactionIDs, t.TransactionID}} {
+			if seen.id == "" {
+				continue
+			}
+			if _, ok := seen.ids[seen.id]; ok {
+				return fmt.Errorf("%w: transaction %d: %s repeated within batch %s", ErrInvalidTransaction, i, seen.id, batchID)
+			}
+			seen.ids[seen.id] = struct{}{}
+		}
+		batch[i] = preparedTransaction{key: key, direction: direction, tenders: tenders}
+	}
+	key := batch[0].key
+
+	if c.TillLockTTL > 0 {
+		unlock, err := c.lockBatch(ctx, txs, batch)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+
+	// Overdrafts are checked once per till against all of the batch's debits, rather than
+	// per transaction against a state the earlier ones have yet to change, and for the same
+	// reason post-balances aren't logged
+	unchecked := c
+	unchecked.RejectOverdrafts, unchecked.LogBalances = false, false
+	watched := []string{key.BatchesKey()}
+	checks := []func(*redis.Tx) error{c.batchNotAppliedCheck(ctx, key, batchID)}
+	writes := make([]func(redis.Pipeliner) error, len(txs))
+	debits := make(map[string][]Tender)
+	var debited []string
+	for i, p := range batch {
+		write, txChecks, txWatched := unchecked.transactionWrite(ctx, txs[i], key, p.direction, p.tenders)
+		writes[i] = write
+		checks = append(checks, txChecks...)
+		watched = append(watched, txWatched...)
+		till := txs[i].Source
+		if p.direction < 0 {
+			till = txs[i].Destination
+		}
+		if c.RejectOverdrafts && till != "" && !c.IsReservedTill(till) {
+			if _, ok := debits[till]; !ok {
+				debited = append(debited, till)
+			}
+			debits[till] = append(debits[till], p.tenders...)
+		}
+	}
+	for _, till := range debited {
+		keys, check := fundsCheck(ctx, key, till, debits[till])
+		watched = append(watched, keys...)
+		checks = append(checks, check)
+	}
+
+	err = c.applyChecked(ctx, func(pipe redis.Pipeliner) error {
+		for i, write := range writes {
+			if err := write(pipe); err != nil {
+				return fmt.Errorf("transaction %d: %w", i, err)
+			}
+		}
+		c.writeMarker(ctx, pipe, key.BatchesKey(), batchID)
+		return nil
+	}, checks, watched)
+	if err != nil {
+		return fmt.Errorf("batch %s: %w", batchID, err)
+	}
+	if c.SettlementTTL > 0 {
+		return c.setSettlementTTL(ctx, key, c.SettlementTTL)
+	}
+	return nil
+}
+
+// batchNotAppliedCheck fails with ErrBatchAlreadyApplied if batchID has a marker that
+// hasn't expired yet. Run it under WATCH of the batches key.
+func (c Client) batchNotAppliedCheck(ctx context.Context, key Key, batchID string) func(*redis.Tx) error {
+	return func(tx *redis.Tx) error {
+		applied, err := c.markerLive(ctx, tx, key.BatchesKey(), batchID)
+		if err != nil {
+			return err
+		}
+		if applied {
+			return fmt.Errorf("%w: %s", ErrBatchAlreadyApplied, batchID)
+		}
+		return nil
+	}
+}
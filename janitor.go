@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"time"
+)
+
+var ErrJanitorRunning = errors.New("marker janitor already running")
+
+// PruneExpiredMarkers removes the idempotency and batch markers past their expiry, per
+// Client.Clock, from every settlement in the client's KeyFormat. Settlements are found
+// with SCAN, so it is safe to run while transactions are applied. It returns how many
+// markers were removed.
+func (c Client) PruneExpiredMarkers(ctx context.Context) (int64, error) {
+	done, err := c.begin()
+	if err != nil {
+		return 0, err
+	}
+	defer done()
+	return c.pruneExpiredMarkers(ctx)
+}
+
+func (c Client) pruneExpiredMarkers(ctx context.Context) (int64, error) {
+	// "*" isn't escaped, so these match the marker sets of every org, EU and settlement;
+	// ParseKey then drops tenders or denominations that happen to share the suffix
+	every := Key{Organization: "*", EnterpriseUnit: "*", SettlementDocID: "*", Format: c.KeyFormat}
+	expired := strconv.FormatInt(c.now().UnixMilli(), 10)
+	var removed int64
+	for _, match := range []string{every.AppliedKeysKey(), every.BatchesKey()} {
+		var cursor uint64
+		for {
+			if err := ctx.Err(); err != nil {
+				return removed, err
+			}
+			keys, next, err := c.Scan(ctx, cursor, match, scanCount).Result()
+			if err != nil {
+				return removed, fmt.Errorf("scan marker sets: %w", err)
+			}
+			for _, k := range keys {
+				parts, err := c.KeyFormat.ParseKey(k)
+				if err != nil || parts.Till != "" {
+					continue
+				}
+				n, err := c.ZRemRangeByScore(ctx, k, "-inf", expired).Result()
+				if err != nil {
+					return removed, fmt.Errorf("prune %s: %w", k, err)
+				}
+				removed += n
+			}
+			if next == 0 {
+				break
+			}
+			cursor = next
+		}
+	}
+	return removed, nil
+}
+
+// StartMarkerJanitor runs PruneExpiredMarkers in the background about every interval until
+// the client is closed. Each wait is jittered to between half and one and a half interval,
+// so the janitors of many instances started together don't all scan at once. Failed runs
+// are reported to Client.Metrics and retried at the next one. It needs a client created by
+// NewClient, fails with ErrClientClosed once it is closed and with ErrJanitorRunning if
+// the janitor was already started.
+func (c Client) StartMarkerJanitor(interval time.Duration) error {
+	if interval <= 0 {
+		return fmt.Errorf("invalid janitor interval %v", interval)
+	}
+	if c.inflight == nil {
+		return errors.New("marker janitor needs a client created by NewClient")
+	}
+	c.inflight.mu.Lock()
+	defer c.inflight.mu.Unlock()
+	if c.inflight.closed {
+		return ErrClientClosed
+	}
+	if c.inflight.stopJanitor != nil {
+		return ErrJanitorRunning
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	c.inflight.stopJanitor = cancel
+	c.inflight.wg.Add(1)
+	go func() {
+		defer c.inflight.wg.Done()
+		for {
+			wait := interval/2 + time.Duration(rand.Int63n(int64(interval)+1))
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(wait):
+			}
+			n, err := c.pruneExpiredMarkers(ctx)
+			if ctx.Err() != nil {
+				return
+			}
+			c.metrics().IncCounter(MetricMarkersPruned, int(n), map[string]string{"result": resultLabel(err)})
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+var ErrMalformedKey = errors.New("malformed key")
+
+// KeyParts is a Redis key split back into its components. Till, Tender and Denomination
+// are only set when the key reaches that level.
+type KeyParts struct {
+	Key
+	Till         string
+	Tender       string
+	Denomination string
+	Suffix       string // Trailing key type: "tills", "closed-tills", "checksum", "applied", "applied-keys", "batches", "events", "transactions", "transaction-log", "version", "versions", "updated", "tenders", "lock", "denominations" or "meta"; empty for BaseKey, TenderKey and DenominationKey
+}
+
+// escape percent-encodes the characters of a key component that would make the key
+// ambiguous: "%" itself, every character of the separator and, with HashTag, the braces.
+// Components without them, which is all of them in keys written before escaping, are
+// returned unchanged.
+func (f *KeyFormat) escape(component string) string {
+	if f != nil && f.unescaped {
+		return component
+	}
+	special := "%" + f.separator()
+	if f != nil && f.HashTag {
+		special += "{}"
+	}
+	if !strings.ContainsAny(component, special) {
+		return component
+	}
+	var escaped strings.Builder
+	for i := 0; i < len(component); i++ {
+		if strings.IndexByte(special, component[i]) >= 0 {
+			fmt.Fprintf(&escaped, "%%%02X", component[i])
+		} else {
+			escaped.WriteByte(component[i])
+		}
+	}
+	return escaped.String()
+}
+
+// legacyFormat returns a copy of f naming keys the way they were written before their
+// components were escaped.
+func (f *KeyFormat) legacyFormat() *KeyFormat {
+	legacy := KeyFormat{unescaped: true}
+	if f != nil {
+		legacy = *f
+		legacy.unescaped = true
+	}
+	return &legacy
+}
+
+// unescape inverts escape.
+func (f *KeyFormat) unescape(component string) (string, error) {
+	if !strings.Contains(component, "%") {
+		return component, nil
+	}
+	return url.PathUnescape(component)
+}
+
+// ParseKey inverts BaseKey and the key formatters built on it for the default key
+// layout. Components are unescaped, so one containing a colon or any other character
+// escaped by the Key methods round-trips. Anything that doesn't match a known layout is
+// rejected.
+func ParseKey(raw string) (KeyParts, error) {
+	return (*KeyFormat)(nil).ParseKey(raw)
+}
+
+// ParseKey is the package-level ParseKey for keys in this format. The returned Key carries
+// the format.
+func (f *KeyFormat) ParseKey(raw string) (KeyParts, error) {
+	unprefixed := raw
+	if f != nil && f.Prefix != "" {
+		if !strings.HasPrefix(raw, f.Prefix+f.separator()) {
+			return KeyParts{}, fmt.Errorf("%w %q: missing prefix %s", ErrMalformedKey, raw, f.Prefix)
+		}
+		unprefixed = strings.TrimPrefix(raw, f.Prefix+f.separator())
+	}
+	segments := strings.Split(unprefixed, f.separator())
+	for _, segment := range segments {
+		if segment == "" {
+			return KeyParts{}, fmt.Errorf("%w %q: empty component", ErrMalformedKey, raw)
+		}
+	}
+	if len(segments) < 6 || segments[0] != "org" || segments[2] != "eu" || segments[4] != "settlement-id" {
+		return KeyParts{}, fmt.Errorf("%w %q: want org, eu and settlement-id components", ErrMalformedKey, raw)
+	}
+	if f != nil && f.HashTag {
+		if !strings.HasPrefix(segments[1], "{") || !strings.HasSuffix(segments[5], "}") {
+			return KeyParts{}, fmt.Errorf("%w %q: missing hash tag", ErrMalformedKey, raw)
+		}
+		segments[1], segments[5] = strings.TrimPrefix(segments[1], "{"), strings.TrimSuffix(segments[5], "}")
+		if segments[1] == "" || segments[5] == "" {
+			return KeyParts{}, fmt.Errorf("%w %q: empty component", ErrMalformedKey, raw)
+		}
+	}
+	for _, i := range []int{1, 3, 5} {
+		unescaped, err := f.unescape(segments[i])
+		if err != nil {
+			return KeyParts{}, fmt.Errorf("%w %q: %v", ErrMalformedKey, raw, err)
+		}
+		segments[i] = unescaped
+	}
+	parts := KeyParts{Key: Key{Organization: segments[1], EnterpriseUnit: segments[3], SettlementDocID: segments[5], Format: f}}
+
+	rest := segments[6:]
+	switch {
+	case len(rest) == 0:
+	case len(rest) == 1 && (rest[0] == "tills" || rest[0] == "closed-tills" || rest[0] == "checksum" || rest[0] == "applied" || rest[0] == "applied-keys" || rest[0] == "batches" || rest[0] == "events" || rest[0] == "transactions" || rest[0] == "transaction-log" || rest[0] == "version" || rest[0] == "versions" || rest[0] == "updated"):
+		parts.Suffix = rest[0]
+	case len(rest) == 3 && rest[0] == "till" && (rest[2] == "tenders" || rest[2] == "lock"):
+		parts.Till, parts.Suffix = rest[1], rest[2]
+	case len(rest) == 4 && rest[0] == "till" && rest[2] == "tender":
+		parts.Till, parts.Tender = rest[1], rest[3]
+	case len(rest) == 5 && rest[0] == "till" && rest[2] == "tender" && (rest[4] == "denominations" || rest[4] == "meta"):
+		parts.Till, parts.Tender, parts.Suffix = rest[1], rest[3], rest[4]
+	case len(rest) == 6 && rest[0] == "till" && rest[2] == "tender" && rest[4] == "denomination":
+		parts.Till, parts.Tender, parts.Denomination = rest[1], rest[3], rest[5]
+	default:
+		return KeyParts{}, fmt.Errorf("%w %q: unknown layout after settlement ID", ErrMalformedKey, raw)
+	}
+	for _, component := range []*string{&parts.Till, &parts.Tender, &parts.Denomination} {
+		unescaped, err := f.unescape(*component)
+		if err != nil {
+			return KeyParts{}, fmt.Errorf("%w %q: %v", ErrMalformedKey, raw, err)
+		}
+		*component = unescaped
+	}
+	return parts, nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestKeyFormat(t *testing.T) {
+	tests := []struct {
+		format     *KeyFormat
+		wantPrefix string
+	}{
+		{format: &KeyFormat{Prefix: "app", Separator: "::"}, wantPrefix: "app::org::test-org::eu::test-eu::settlement-id::settlement-1::"},
+		{format: &KeyFormat{Separator: "/"}, wantPrefix: "org/test-org/eu/test-eu/settlement-id/settlement-1/"},
+	}
+	for _, tt := range tests {
+		c, mr := newTestClient(t)
+		ctx := context.Background()
+		c.KeyFormat = tt.format
+		mustProcess(t, c, transfer(VaultTill, "till:1", cash(5)))
+		for _, k := range mr.Keys() {
+			if !strings.HasPrefix(k, tt.wantPrefix) {
+				t.Errorf("with %+v, key %q doesn't start with %q", *tt.format, k, tt.wantPrefix)
+			}
+		}
+
+		key := c.NewKey(testKey.Organization, testKey.EnterpriseUnit, testKey.SettlementDocID)
+		tills, err := c.GetExpectedTenders(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(tills) != 1 || tills[0].ID != "till:1" || tills[0].Tenders[0].Amount != 5 {
+			t.Errorf("with %+v, GetExpectedTenders() = %+v, want till:1 holding 5", *tt.format, tills)
+		}
+		if ids, err := c.ScanSettlements(ctx, testKey.Organization, testKey.EnterpriseUnit); err != nil || len(ids) != 1 || ids[0] != testKey.SettlementDocID {
+			t.Errorf("with %+v, ScanSettlements() = %v, %v, want %s", *tt.format, ids, err, testKey.SettlementDocID)
+		}
+		// The default layout names other keys
+		if _, err := c.GetExpectedTenders(ctx, testKey); !errors.Is(err, ErrSettlementNotFound) {
+			t.Errorf("with %+v, GetExpectedTenders() of a default-layout key error = %v, want %v", *tt.format, err, ErrSettlementNotFound)
+		}
+	}
+}
+
+func TestKeyFormatHashTag(t *testing.T) {
+	c, mr := newTestClient(t)
+	ctx := context.Background()
+	c.KeyFormat = &KeyFormat{HashTag: true}
+	c.EmitEvents, c.Versioning, c.ScriptTransactions = true, true, true
+	tx := transfer(VaultTill, "till-1", cash(5))
+	tx.TransactionID, tx.IdempotencyKey = "tx-1", "delivery-1"
+	mustProcess(t, c, tx, inSettlement("settlement-2", transfer(VaultTill, "till-1", cash(1))))
+
+	// Every key of a settlement hashes by the same tag, and each settlement has its own
+	tags := make(map[string]int)
+	for _, k := range mr.Keys() {
+		open, end := strings.Index(k, "{"), strings.Index(k, "}")
+		if open < 0 || end < open {
+			t.Errorf("key %q has no hash tag", k)
+			continue
+		}
+		tags[k[open:end+1]]++
+	}
+	if len(tags) != 2 || tags["{test-org:eu:test-eu:settlement-id:settlement-1}"] == 0 {
+		t.Errorf("hash tags = %v, want one per settlement", tags)
+	}
+	key := c.NewKey(testKey.Organization, testKey.EnterpriseUnit, testKey.SettlementDocID)
+	if got, err := c.GetTransaction(ctx, key, "tx-1"); err != nil || got.TransactionID != "tx-1" {
+		t.Errorf("GetTransaction() = %+v, %v", got, err)
+	}
+}
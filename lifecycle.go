@@ -0,0 +1,426 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+var (
+	ErrTillAlreadyOpen = errors.New("till already open")
+	ErrTillClosed      = errors.New("till closed")
+)
+
+// OpenTill registers a till and credits it with its opening float, drawn from VaultTill, in
+// one MULTI/EXEC, clearing any closed mark left by CloseTill. The opening is recorded as an
+// EventOpen entry of the settlement's events stream, whether or not the client has
+// EmitEvents set, and as a version with Versioning. It fails with ErrTillAlreadyOpen if the
+// till already holds a nonzero balance; use ForceOpenTill to top up such a till anyway.
+func (c Client) OpenTill(ctx context.Context, key Key, tillID string, openingFloat []Tender) error {
+	return c.openTill(ctx, key, tillID, openingFloat, false)
+}
+
+// ForceOpenTill is OpenTill without the existing-balance check.
+func (c Client) ForceOpenTill(ctx context.Context, key Key, tillID string, openingFloat []Tender) error {
+	return c.openTill(ctx, key, tillID, openingFloat, true)
+}
+
+func (c Client) openTill(ctx context.Context, key Key, tillID string, openingFloat []Tender, force bool) error {
+	done, err := c.begin()
+	if err != nil {
+		return err
+	}
+	defer done()
+	if c.IsReservedTill(tillID) {
+		return fmt.Errorf("cannot open the %s pseudo-till", tillID)
+	}
+	tenders, err := c.prepareTenders(openingFloat)
+	if err != nil {
+		return err
+	}
+	if c.TillLockTTL > 0 {
+		unlock, err := c.lockTills(ctx, key, tillID)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+
+	err = c.Watch(ctx, func(tx *redis.Tx) error {
+		if !force {
+			totals, err := watchTillTotals(ctx, tx, key, tillID)
+			if err != nil {
+				return err
+			}
+			for tenderID, amount := range totals {
+				if amount != 0 {
+					return fmt.Errorf("%w: till %s holds %v of tender %s", ErrTillAlreadyOpen, tillID, amount, tenderID)
+				}
+			}
+		}
+		_, err := tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.SRem(ctx, key.ClosedTillsSetKey(), tillID)
+			c.writeTransaction(ctx, pipe, key, VaultTill, tillID, 1, tenders)
+			markUnlogged(ctx, pipe, key)
+			c.writeEvent(ctx, pipe, key, EventOpen, Transaction{Source: VaultTill, Destination: tillID, Direction: DirectionCredit}, tenders)
+			if c.Versioning {
+				return writeVersion(ctx, pipe, key, transactionDeltas(VaultTill, tillID, 1, tenders))
+			}
+			return nil
+		})
+		return err
+	}, key.TendersSetKey(tillID))
+	if err != nil || c.SettlementTTL <= 0 {
+		return err
+	}
+	return c.setSettlementTTL(ctx, key, c.SettlementTTL)
+}
+
+// watchTillTotals WATCHes the till's tender keys and returns their totals by tender ID. The
+// caller must already be watching the till's tenders set so a tender added concurrently
+// invalidates the transaction. Missing totals read as zero.
+func watchTillTotals(ctx context.Context, tx *redis.Tx, key Key, tillID string) (map[string]Money, error) {
+	tenderIDs, err := tx.SMembers(ctx, key.TendersSetKey(tillID)).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(tenderIDs) == 0 {
+		return map[string]Money{}, nil
+	}
+	tenderKeys := make([]string, len(tenderIDs))
+	for i, tenderID := range tenderIDs {
+		tenderKeys[i] = key.TenderKey(tillID, tenderID)
+	}
+	if err := tx.Watch(ctx, tenderKeys...).Err(); err != nil {
+		return nil, err
+	}
+	return mgetTenderTotals(ctx, tx, tenderIDs, tenderKeys)
+}
+
+// tillTotals returns the till's tender totals by tender ID, like watchTillTotals but
+// without watching. Missing totals read as zero.
+func (c Client) tillTotals(ctx context.Context, key Key, tillID string) (map[string]Money, error) {
+	tenderIDs, err := c.SMembers(ctx, key.TendersSetKey(tillID)).Result()
+	if err != nil {
+		return nil, err
+	}
+	tenderKeys := make([]string, len(tenderIDs))
+	for i, tenderID := range tenderIDs {
+		tenderKeys[i] = key.TenderKey(tillID, tenderID)
+	}
+	return mgetTenderTotals(ctx, c.Client, tenderIDs, tenderKeys)
+}
+
+func mgetTenderTotals(ctx context.Context, cmd redis.Cmdable, tenderIDs, tenderKeys []string) (map[string]Money, error) {
+	totals := make(map[string]Money, len(tenderIDs))
+	if len(tenderKeys) == 0 {
+		return totals, nil
+	}
+	values, err := cmd.MGet(ctx, tenderKeys...).Result()
+	if err != nil {
+		return nil, err
+	}
+	for i, value := range values {
+		raw, ok := value.(string)
+		if !ok {
+			totals[tenderIDs[i]] = 0
+			continue
+		}
+		amount, err := parseMoney(raw)
+		if err != nil {
+			return nil, &ParseError{Key: tenderKeys[i], Value: raw, Err: err}
+		}
+		totals[tenderIDs[i]] = amount
+	}
+	return totals, nil
+}
+
+// CloseTill sweeps the till's entire balance, every tender total and denomination, to
+// destination in one WATCHed MULTI/EXEC, leaving the till at zero. The sweep is recorded
+// as an EventClose entry of the settlement's events stream, whether or not the client has
+// EmitEvents set, and as a version with Versioning. When the client has RejectClosedTills
+// set the till is also marked closed, so ProcessTransaction rejects further transactions
+// against it until it is opened again, and sweeping into a closed destination fails with
+// ErrTillClosed.
+func (c Client) CloseTill(ctx context.Context, key Key, tillID, destination string) error {
+	done, err := c.begin()
+	if err != nil {
+		return err
+	}
+	defer done()
+	if tillID == destination {
+		return fmt.Errorf("cannot sweep till %s into itself", tillID)
+	}
+	if c.TillLockTTL > 0 {
+		unlock, err := c.lockTills(ctx, key, tillID, destination)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+	watched := []string{key.TendersSetKey(tillID)}
+	if c.RejectClosedTills {
+		watched = append(watched, key.ClosedTillsSetKey())
+	}
+	err = c.Watch(ctx, func(tx *redis.Tx) error {
+		if c.RejectClosedTills {
+			closed, err := tx.SIsMember(ctx, key.ClosedTillsSetKey(), destination).Result()
+			if err != nil {
+				return err
+			}
+			if closed {
+				return fmt.Errorf("%w: %s", ErrTillClosed, destination)
+			}
+		}
+		till, err := c.watchTill(ctx, tx, key, tillID)
+		if err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			if len(till.Tenders) > 0 {
+				c.writeTransaction(ctx, pipe, key, tillID, destination, 1, till.Tenders)
+				markUnlogged(ctx, pipe, key)
+			} else {
+				c.touchSettlement(ctx, pipe, key)
+			}
+			c.writeEvent(ctx, pipe, key, EventClose, Transaction{Source: tillID, Destination: destination, Direction: DirectionCredit}, till.Tenders)
+			if c.RejectClosedTills {
+				pipe.SAdd(ctx, key.ClosedTillsSetKey(), tillID)
+			}
+			if c.Versioning {
+				return writeVersion(ctx, pipe, key, transactionDeltas(tillID, destination, 1, till.Tenders))
+			}
+			return nil
+		})
+		return err
+	}, watched...)
+	if err != nil || c.SettlementTTL <= 0 {
+		return err
+	}
+	return c.setSettlementTTL(ctx, key, c.SettlementTTL)
+}
+
+// ClearTill voids a till: its tender totals, denomination sets and hashes and its tenders
+// set are deleted and it is removed from the settlement's tills and closed-tills sets, in
+// one WATCHed MULTI/EXEC. Unlike CloseTill nothing is moved to another till, and the
+// checksum, if maintained, is adjusted for the removed values. Clearing a till that
+// doesn't exist does nothing.
+func (c Client) ClearTill(ctx context.Context, key Key, tillID string) error {
+	done, err := c.begin()
+	if err != nil {
+		return err
+	}
+	defer done()
+	return c.Watch(ctx, func(tx *redis.Tx) error {
+		till, err := c.watchTill(ctx, tx, key, tillID)
+		if err != nil {
+			return err
+		}
+		keys := []string{key.TendersSetKey(tillID)}
+		for _, tender := range till.Tenders {
+			tenderID := tender.StoredID()
+			keys = append(keys, key.TenderKey(tillID, tenderID), key.DenominationsSetKey(tillID, tenderID), key.TenderMetaKey(tillID, tenderID))
+			for _, denomination := range tender.TenderBreakdowns {
+				keys = append(keys, key.DenominationKey(tillID, tenderID, denomination.storedName(tender.Currency)))
+			}
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Del(ctx, keys...)
+			pipe.SRem(ctx, key.TillsSetKey(), tillID)
+			pipe.SRem(ctx, key.ClosedTillsSetKey(), tillID)
+			c.touchSettlement(ctx, pipe, key)
+			if len(c.ChecksumSecret) > 0 && len(till.Tenders) > 0 {
+				pipe.IncrBy(ctx, key.ChecksumKey(), -c.tillChecksum(key, tillID, till.Tenders))
+			}
+			return nil
+		})
+		return err
+	}, key.TendersSetKey(tillID))
+}
+
+// RemoveTender deletes one tender of a till, its total, denomination set and hashes, and
+// removes it from the till's tenders set in one WATCHed MULTI/EXEC. Like ClearTill it
+// voids whatever the tender holds, adjusting the checksum if maintained; use Vacuum to
+// remove only tenders that are already zero. Removing a tender the till doesn't hold does
+// nothing.
+func (c Client) RemoveTender(ctx context.Context, key Key, tillID, tenderID string) error {
+	done, err := c.begin()
+	if err != nil {
+		return err
+	}
+	defer done()
+	tenderKey := key.TenderKey(tillID, tenderID)
+	denominationsKey := key.DenominationsSetKey(tillID, tenderID)
+	return c.Watch(ctx, func(tx *redis.Tx) error {
+		names, err := tx.SMembers(ctx, denominationsKey).Result()
+		if err != nil {
+			return err
+		}
+		keys := []string{tenderKey, denominationsKey, key.TenderMetaKey(tillID, tenderID)}
+		for _, name := range names {
+			keys = append(keys, key.DenominationKey(tillID, tenderID, name))
+		}
+		if len(names) > 0 {
+			if err := tx.Watch(ctx, keys[3:]...).Err(); err != nil {
+				return err
+			}
+		}
+		tender := tenderFromStoredID(tenderID)
+		if len(c.ChecksumSecret) > 0 {
+			totals, err := mgetTenderTotals(ctx, tx, []string{tenderID}, []string{tenderKey})
+			if err != nil {
+				return err
+			}
+			tender.Amount = totals[tenderID]
+			if tender.TenderBreakdowns, err = c.getDenominations(ctx, key, tillID, tenderID, ReadOptions{}); err != nil {
+				return err
+			}
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Del(ctx, keys...)
+			pipe.SRem(ctx, key.TendersSetKey(tillID), tenderID)
+			c.touchSettlement(ctx, pipe, key)
+			markUnlogged(ctx, pipe, key)
+			if len(c.ChecksumSecret) > 0 {
+				pipe.IncrBy(ctx, key.ChecksumKey(), -c.tillChecksum(key, tillID, []Tender{tender}))
+			}
+			return nil
+		})
+		return err
+	}, key.TendersSetKey(tillID), tenderKey, denominationsKey)
+}
+
+// Adjust applies a signed delta to one tender of a single till, e.g. a write-off found
+// during reconciliation, without a counterparty till. tenderID is the stored ID. The
+// breakdowns, if any, carry signed counts and amounts that must sum to delta and agree
+// with its sign; a zero delta is rejected. The adjustment is a one-sided transaction:
+// apart from having no source it is validated, checked and recorded like one applied
+// with ProcessTransaction, so closed tills, RejectOverdrafts, versions, events, metadata,
+// locks and the settlement TTL all apply.
+func (c Client) Adjust(ctx context.Context, key Key, tillID, tenderID string, delta Money, breakdowns []TenderInfo) error {
+	done, err := c.begin()
+	if err != nil {
+		return err
+	}
+	defer done()
+	start := time.Now()
+	key = c.normalizeKey(key)
+	t, err := adjustment(key, tillID, tenderID, delta, breakdowns)
+	if err == nil {
+		err = c.processAdjustment(ctx, key, t)
+	}
+	c.observeTransaction("Adjust", start, t, err)
+	return err
+}
+
+// adjustment returns the one-sided transaction applying delta to the till's tender: a
+// credit or debit of the till, with an empty Source, moving the absolute values.
+func adjustment(key Key, tillID, tenderID string, delta Money, breakdowns []TenderInfo) (Transaction, error) {
+	if err := checkKeyComponent(tillID); err != nil {
+		return Transaction{}, fmt.Errorf("%w: till %v", ErrInvalidTransaction, err)
+	}
+	if delta == 0 {
+		return Transaction{}, fmt.Errorf("%w: zero adjustment of till %s tender %s", ErrInvalidTransaction, tillID, tenderID)
+	}
+	direction, sign := DirectionCredit, Money(1)
+	if delta < 0 {
+		direction, sign = DirectionDebit, -1
+	}
+	tender := tenderFromStoredID(tenderID)
+	tender.Amount = sign * delta
+	for _, denomination := range breakdowns {
+		if sign*denomination.Amount < 0 || int(sign)*denomination.Count < 0 {
+			return Transaction{}, fmt.Errorf("%w: tender %s denomination %s has a sign opposite to the adjustment %v", ErrInvalidTransaction, tenderID, denomination.Name, delta)
+		}
+		denomination.Count *= int(sign)
+		denomination.Amount *= sign
+		tender.TenderBreakdowns = append(tender.TenderBreakdowns, denomination)
+	}
+	return Transaction{
+		Org:             key.Organization,
+		EU:              key.EnterpriseUnit,
+		SettlementDocID: key.SettlementDocID,
+		Destination:     tillID,
+		Direction:       direction,
+		Tenders:         []Tender{tender},
+	}, nil
+}
+
+// processAdjustment runs the checks of prepareTransaction that apply to a one-sided
+// transaction and writes it.
+func (c Client) processAdjustment(ctx context.Context, key Key, t Transaction) error {
+	tenders, err := c.prepareTenders(t.Tenders)
+	if err != nil {
+		return err
+	}
+	if err := c.checkWindow(t); err != nil {
+		return err
+	}
+	if err := c.checkTillsOpen(ctx, key, t.Destination); err != nil {
+		return err
+	}
+	direction, err := t.Direction.sign()
+	if err != nil {
+		return err
+	}
+	return c.applyPrepared(ctx, t, key, direction, tenders)
+}
+
+// watchTill WATCHes every key of the till and reads it. As with watchTillTotals the caller
+// must already be watching the till's tenders set.
+func (c Client) watchTill(ctx context.Context, tx *redis.Tx, key Key, tillID string) (Till, error) {
+	totals, err := watchTillTotals(ctx, tx, key, tillID)
+	if err != nil {
+		return Till{}, err
+	}
+	till := Till{ID: tillID}
+	for _, tenderID := range sortedKeys(totals) {
+		denominationsKey := key.DenominationsSetKey(tillID, tenderID)
+		if err := tx.Watch(ctx, denominationsKey).Err(); err != nil {
+			return Till{}, err
+		}
+		names, err := tx.SMembers(ctx, denominationsKey).Result()
+		if err != nil {
+			return Till{}, err
+		}
+		if len(names) > 0 {
+			denominationKeys := make([]string, len(names))
+			for i, name := range names {
+				denominationKeys[i] = key.DenominationKey(tillID, tenderID, name)
+			}
+			if err := tx.Watch(ctx, denominationKeys...).Err(); err != nil {
+				return Till{}, err
+			}
+		}
+		denominations, err := c.getDenominations(ctx, key, tillID, tenderID, ReadOptions{})
+		if err != nil {
+			return Till{}, err
+		}
+		tender := tenderFromStoredID(tenderID)
+		tender.Amount = totals[tenderID]
+		tender.TenderBreakdowns = denominations
+		till.Tenders = append(till.Tenders, tender)
+	}
+	return till, nil
+}
+
+// checkTillsOpen rejects a transaction touching a till marked closed by CloseTill. It only
+// applies when the client has RejectClosedTills set.
+func (c Client) checkTillsOpen(ctx context.Context, key Key, tillIDs ...string) error {
+	if !c.RejectClosedTills {
+		return nil
+	}
+	for _, tillID := range tillIDs {
+		closed, err := c.SIsMember(ctx, key.ClosedTillsSetKey(), tillID).Result()
+		if err != nil {
+			return err
+		}
+		if closed {
+			return fmt.Errorf("%w: %s", ErrTillClosed, tillID)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,488 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestAdjust(t *testing.T) {
+	tests := []struct {
+		name       string
+		client     func(c *Client)
+		delta      Money
+		breakdowns []TenderInfo
+		wantErr    error
+		want       Money
+		wantCount  int
+	}{
+		{
+			name:       "write-off",
+			delta:      -20,
+			breakdowns: []TenderInfo{{Name: "bill", Count: -20, Amount: -20}},
+			want:       80,
+			wantCount:  80,
+		},
+		{
+			name:      "found money",
+			delta:     5,
+			want:      105,
+			wantCount: 100,
+		},
+		{
+			name:    "zero delta",
+			delta:   0,
+			wantErr: ErrInvalidTransaction,
+			want:    100, wantCount: 100,
+		},
+		{
+			name:       "breakdown sign disagrees",
+			delta:      -20,
+			breakdowns: []TenderInfo{{Name: "bill", Count: 20, Amount: -20}},
+			wantErr:    ErrInvalidTransaction,
+			want:       100, wantCount: 100,
+		},
+		{
+			name:       "breakdowns not summing to delta",
+			delta:      -20,
+			breakdowns: []TenderInfo{{Name: "bill", Count: -10, Amount: -10}},
+			wantErr:    ErrInvalidTransaction,
+			want:       100, wantCount: 100,
+		},
+		{
+			name:    "overdraft",
+			client:  func(c *Client) { c.RejectOverdrafts = true },
+			delta:   -101,
+			wantErr: ErrInsufficientTender,
+			want:    100, wantCount: 100,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := newTestClient(t)
+			ctx := context.Background()
+			mustProcess(t, c, transfer(VaultTill, "till-1", cash(100)))
+			if tt.client != nil {
+				tt.client(&c)
+			}
+			if err := c.Adjust(ctx, testKey, "till-1", "cash", tt.delta, tt.breakdowns); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Adjust() error = %v, want %v", err, tt.wantErr)
+			}
+			if got := tenderAmount(t, c, "till-1", "cash"); got != tt.want {
+				t.Errorf("total = %v, want %v", got, tt.want)
+			}
+			info, _, err := c.GetDenomination(ctx, testKey, "till-1", "cash", "bill")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Count != tt.wantCount {
+				t.Errorf("bill count = %d, want %d", info.Count, tt.wantCount)
+			}
+			tills, err := c.ListTills(ctx, testKey, WithReservedTills())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(tills) != 2 {
+				t.Errorf("tills = %v, want only the vault and till-1", tills)
+			}
+		})
+	}
+}
+
+func TestAdjustRecords(t *testing.T) {
+	c, _ := newTestClient(t)
+	ctx := context.Background()
+	c.Versioning, c.EmitEvents, c.ChecksumSecret = true, true, []byte("secret")
+	mustProcess(t, c, transfer(VaultTill, "till-1", cash(100)))
+	if err := c.Adjust(ctx, testKey, "till-1", "cash", -20, []TenderInfo{{Name: "bill", Count: -20, Amount: -20}}); err != nil {
+		t.Fatal(err)
+	}
+	if version, err := c.GetSettlementVersion(ctx, testKey); err != nil || version != 2 {
+		t.Errorf("GetSettlementVersion() = %d, %v, want 2", version, err)
+	}
+	if n, err := c.XLen(ctx, testKey.EventsStreamKey()).Result(); err != nil || n != 2 {
+		t.Errorf("events = %d, %v, want 2", n, err)
+	}
+	if ok, err := c.VerifyChecksum(ctx, testKey); err != nil || !ok {
+		t.Errorf("VerifyChecksum() = %v, %v, want true", ok, err)
+	}
+
+	c.RejectClosedTills = true
+	if err := c.CloseTill(ctx, testKey, "till-1", VaultTill); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Adjust(ctx, testKey, "till-1", "cash", 1, nil); !errors.Is(err, ErrTillClosed) {
+		t.Errorf("Adjust() of a closed till error = %v, want %v", err, ErrTillClosed)
+	}
+}
+
+func TestOpenTill(t *testing.T) {
+	c, _ := newTestClient(t)
+	ctx := context.Background()
+	if err := c.OpenTill(ctx, testKey, "till-1", []Tender{cash(50)}); err != nil {
+		t.Fatal(err)
+	}
+	if got := tenderAmount(t, c, "till-1", "cash"); got != 50 {
+		t.Errorf("till-1 total = %v, want 50", got)
+	}
+	if got := tenderAmount(t, c, VaultTill, "cash"); got != -50 {
+		t.Errorf("vault total = %v, want -50", got)
+	}
+	if err := c.OpenTill(ctx, testKey, "till-1", []Tender{cash(50)}); !errors.Is(err, ErrTillAlreadyOpen) {
+		t.Errorf("second OpenTill() error = %v, want %v", err, ErrTillAlreadyOpen)
+	}
+	if err := c.ForceOpenTill(ctx, testKey, "till-1", []Tender{cash(5)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.OpenTill(ctx, testKey, VaultTill, nil); err == nil {
+		t.Error("OpenTill() of the vault succeeded")
+	}
+
+	got := events(t, c)
+	if len(got) != 2 {
+		t.Fatalf("events = %v, want the two openings", got)
+	}
+	for i, amount := range []string{"50", "5"} {
+		if got[i]["type"] != EventOpen || got[i]["source"] != VaultTill || got[i]["destination"] != "till-1" || got[i]["amounts"] != amount {
+			t.Errorf("event %d = %v, want an %s of %s into till-1", i, got[i], EventOpen, amount)
+		}
+	}
+}
+
+func TestCloseTill(t *testing.T) {
+	c, _ := newTestClient(t)
+	ctx := context.Background()
+	c.RejectClosedTills = true
+	mustProcess(t, c, transfer(VaultTill, "till-1", cash(70)), transfer(VaultTill, "till-2", cash(5)))
+	if err := c.CloseTill(ctx, testKey, "till-1", "till-1"); err == nil {
+		t.Error("CloseTill() into itself succeeded")
+	}
+	if err := c.CloseTill(ctx, testKey, "till-1", "till-2"); err != nil {
+		t.Fatal(err)
+	}
+	if got := tenderAmount(t, c, "till-1", "cash"); got != 0 {
+		t.Errorf("till-1 total = %v, want 0", got)
+	}
+	if got := tenderAmount(t, c, "till-2", "cash"); got != 75 {
+		t.Errorf("till-2 total = %v, want 75", got)
+	}
+	if err := c.ProcessTransaction(ctx, transfer(VaultTill, "till-1", cash(1))); !errors.Is(err, ErrTillClosed) {
+		t.Errorf("ProcessTransaction() into a closed till error = %v, want %v", err, ErrTillClosed)
+	}
+	if err := c.CloseTill(ctx, testKey, "till-2", "till-1"); !errors.Is(err, ErrTillClosed) {
+		t.Errorf("CloseTill() into a closed till error = %v, want %v", err, ErrTillClosed)
+	}
+	if got := tenderAmount(t, c, "till-2", "cash"); got != 75 {
+		t.Errorf("till-2 total after rejected close = %v, want 75", got)
+	}
+
+	got := events(t, c)
+	if len(got) != 1 || got[0]["type"] != EventClose || got[0]["source"] != "till-1" || got[0]["destination"] != "till-2" || got[0]["amounts"] != "70" {
+		t.Errorf("events = %v, want one %s of 70 from till-1 to till-2", got, EventClose)
+	}
+}
+
+func TestClearTill(t *testing.T) {
+	c, mr := newTestClient(t)
+	ctx := context.Background()
+	mustProcess(t, c,
+		transfer(VaultTill, "till-1", cash(7), Tender{ID: "card", Amount: 3}),
+		transfer(VaultTill, "till-2", cash(5)),
+	)
+	before, err := c.GetTill(ctx, testKey, "till-2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.ClearTill(ctx, testKey, "till-1"); err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{
+		testKey.TendersSetKey("till-1"),
+		testKey.TenderKey("till-1", "cash"),
+		testKey.TenderKey("till-1", "card"),
+		testKey.DenominationsSetKey("till-1", "cash"),
+		testKey.DenominationKey("till-1", "cash", "bill"),
+	} {
+		if mr.Exists(k) {
+			t.Errorf("%s still exists", k)
+		}
+	}
+	if ok, _ := mr.SIsMember(testKey.TillsSetKey(), "till-1"); ok {
+		t.Error("till-1 still in the tills set")
+	}
+	after, err := c.GetTill(ctx, testKey, "till-2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(after, before) {
+		t.Errorf("till-2 after clearing till-1 = %+v, want %+v", after, before)
+	}
+	if err := c.ClearTill(ctx, testKey, "missing"); err != nil {
+		t.Errorf("ClearTill() of a missing till error = %v", err)
+	}
+}
+
+func TestRemoveTender(t *testing.T) {
+	c, mr := newTestClient(t)
+	ctx := context.Background()
+	mustProcess(t, c, transfer(VaultTill, "till-1", cash(6), Tender{ID: "card", Amount: 2}))
+	if err := c.RemoveTender(ctx, testKey, "till-1", "cash"); err != nil {
+		t.Fatal(err)
+	}
+	till, err := c.GetTill(ctx, testKey, "till-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []Tender{{ID: "card", Amount: 2}}; !reflect.DeepEqual(till.Tenders, want) {
+		t.Errorf("till-1 tenders after removing cash = %+v, want %+v", till.Tenders, want)
+	}
+	for _, k := range []string{testKey.TenderKey("till-1", "cash"), testKey.DenominationsSetKey("till-1", "cash"), testKey.DenominationKey("till-1", "cash", "bill")} {
+		if mr.Exists(k) {
+			t.Errorf("%s still exists", k)
+		}
+	}
+	if err := c.RemoveTender(ctx, testKey, "till-1", "cash"); err != nil {
+		t.Errorf("RemoveTender() of a removed tender error = %v", err)
+	}
+
+	// Zero tenders are left out of reads on request
+	mustProcess(t, c, transfer("till-1", VaultTill, Tender{ID: "card", Amount: 2}), transfer(VaultTill, "till-2", cash(1)))
+	tills, err := c.GetExpectedTenders(ctx, testKey, WithoutZeroTenders())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []Till{{ID: "till-1"}, {ID: "till-2", Tenders: []Tender{cash(1)}}}; !reflect.DeepEqual(tills, want) {
+		t.Errorf("GetExpectedTenders(WithoutZeroTenders()) = %+v, want %+v", tills, want)
+	}
+}
+
+func TestTillOperationLocks(t *testing.T) {
+	tests := []struct {
+		name   string
+		locked string
+		op     func(ctx context.Context, c Client) error
+	}{
+		{
+			name:   "OpenTill",
+			locked: "till-3",
+			op: func(ctx context.Context, c Client) error {
+				return c.OpenTill(ctx, testKey, "till-3", []Tender{cash(5)})
+			},
+		},
+		{
+			name:   "CloseTill",
+			locked: "till-2",
+			op: func(ctx context.Context, c Client) error {
+				return c.CloseTill(ctx, testKey, "till-1", "till-2")
+			},
+		},
+		{
+			name:   "MoveTender",
+			locked: "till-2",
+			op: func(ctx context.Context, c Client) error {
+				return c.MoveTender(ctx, testKey, "till-1", "till-2", "cash")
+			},
+		},
+		{
+			name:   "ConvertTender",
+			locked: "till-1",
+			op: func(ctx context.Context, c Client) error {
+				return c.ConvertTender(ctx, testKey, "till-1", "cash", "cash@EUR", 0.5)
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := newTestClient(t)
+			ctx := context.Background()
+			c.TillLockTTL, c.TillLockWait = time.Minute, 50*time.Millisecond
+			mustProcess(t, c, transfer(VaultTill, "till-1", cash(20)), transfer(VaultTill, "till-2", cash(5)))
+			before, err := c.GetExpectedTenders(ctx, testKey, WithReservedTills())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := c.Set(ctx, testKey.TillLockKey(tt.locked), "other", time.Minute).Err(); err != nil {
+				t.Fatal(err)
+			}
+			if err := tt.op(ctx, c); !errors.Is(err, ErrLockTimeout) {
+				t.Fatalf("%s() of a locked till error = %v, want %v", tt.name, err, ErrLockTimeout)
+			}
+			after, err := c.GetExpectedTenders(ctx, testKey, WithReservedTills())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(after, before) {
+				t.Errorf("tills after %s() of a locked till = %+v, want %+v", tt.name, after, before)
+			}
+
+			if err := c.Del(ctx, testKey.TillLockKey(tt.locked)).Err(); err != nil {
+				t.Fatal(err)
+			}
+			if err := tt.op(ctx, c); err != nil {
+				t.Fatal(err)
+			}
+			if n, err := c.Exists(ctx, testKey.TillLockKey("till-1"), testKey.TillLockKey("till-2"), testKey.TillLockKey("till-3")).Result(); err != nil || n != 0 {
+				t.Errorf("%d locks held after %s(), %v, want none", n, tt.name, err)
+			}
+		})
+	}
+}
+
+func TestTillOperationsSettlementTTL(t *testing.T) {
+	tests := []struct {
+		name    string
+		op      func(ctx context.Context, c Client) error
+		created string // A key the operation creates
+	}{
+		{
+			name: "OpenTill",
+			op: func(ctx context.Context, c Client) error {
+				return c.OpenTill(ctx, testKey, "till-3", []Tender{cash(5)})
+			},
+			created: testKey.TenderKey("till-3", "cash"),
+		},
+		{
+			name:    "CloseTill",
+			op:      func(ctx context.Context, c Client) error { return c.CloseTill(ctx, testKey, "till-1", "till-3") },
+			created: testKey.TenderKey("till-3", "cash"),
+		},
+		{
+			name: "MoveTender",
+			op: func(ctx context.Context, c Client) error {
+				return c.MoveTender(ctx, testKey, "till-1", "till-3", "cash")
+			},
+			created: testKey.TenderKey("till-3", "cash"),
+		},
+		{
+			name: "ConvertTender",
+			op: func(ctx context.Context, c Client) error {
+				return c.ConvertTender(ctx, testKey, "till-1", "cash", "cash@EUR", 0.5)
+			},
+			created: testKey.TenderKey("till-1", "cash@EUR"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := newTestClient(t)
+			ctx := context.Background()
+			mustProcess(t, c, transfer(VaultTill, "till-1", cash(20)))
+			c.SettlementTTL = time.Hour
+			if err := tt.op(ctx, c); err != nil {
+				t.Fatal(err)
+			}
+			for _, k := range []string{testKey.TillsSetKey(), tt.created} {
+				if ttl, err := c.PTTL(ctx, k).Result(); err != nil || ttl <= 0 {
+					t.Errorf("%s TTL = %v, %v, want the SettlementTTL", k, ttl, err)
+				}
+			}
+		})
+	}
+}
+
+func TestVacuumTenderMetadata(t *testing.T) {
+	c, _ := newTestClient(t)
+	ctx := context.Background()
+	c.TenderMetadata = true
+	mustProcess(t, c, transfer(VaultTill, "till-1", cash(5)), transfer("till-1", VaultTill, cash(5)))
+	metaKey := testKey.TenderMetaKey("till-1", "cash")
+	if n, err := c.Exists(ctx, metaKey).Result(); err != nil || n != 1 {
+		t.Fatalf("metadata exists = %d, %v, want 1", n, err)
+	}
+	if _, err := c.Vacuum(ctx, testKey); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := c.Exists(ctx, metaKey, testKey.TenderKey("till-1", "cash")).Result(); err != nil || n != 0 {
+		t.Errorf("%d keys of the vacuumed tender left, %v, want its total and metadata deleted", n, err)
+	}
+}
+
+func TestMigrateKeyEscaping(t *testing.T) {
+	c, _ := newTestClient(t)
+	ctx := context.Background()
+	c.ChecksumSecret = []byte("secret")
+	gift := Tender{ID: "gift%card", Amount: 7, TenderBreakdowns: []TenderInfo{{Name: "100%", Count: 7, Amount: 7}}}
+	c.KeyFormat = (*KeyFormat)(nil).legacyFormat()
+	mustProcess(t, c, transfer(VaultTill, "till%1", gift, cash(3)))
+	c.KeyFormat = nil
+
+	renamed, err := c.MigrateKeyEscaping(ctx, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The tender total, denominations set and denomination hash of each till's gift card,
+	// and till%1's tenders set and cash keys
+	if renamed != 10 {
+		t.Errorf("MigrateKeyEscaping() renamed %d keys, want 10", renamed)
+	}
+	if got := tenderAmount(t, c, "till%1", "gift%card"); got != 7 {
+		t.Errorf("gift card total = %v, want 7", got)
+	}
+	info, _, err := c.GetDenomination(ctx, testKey, "till%1", "gift%card", "100%")
+	if err != nil || info.Count != 7 {
+		t.Errorf("GetDenomination() = %+v, %v, want a count of 7", info, err)
+	}
+	if ok, err := c.VerifyChecksum(ctx, testKey); err != nil || !ok {
+		t.Errorf("VerifyChecksum() = %v, %v, want true", ok, err)
+	}
+	if renamed, err := c.MigrateKeyEscaping(ctx, testKey); err != nil || renamed != 0 {
+		t.Errorf("second MigrateKeyEscaping() = %d, %v, want nothing left to rename", renamed, err)
+	}
+}
+
+func TestDeleteSettlement(t *testing.T) {
+	c, _ := newTestClient(t)
+	ctx := context.Background()
+	mustProcess(t, c, transfer(VaultTill, "till-1", cash(10)))
+	if err := c.DeleteSettlement(ctx, testKey); err != nil {
+		t.Fatal(err)
+	}
+	if tills, err := c.GetExpectedTenders(ctx, testKey); !errors.Is(err, ErrSettlementNotFound) {
+		t.Errorf("GetExpectedTenders() after DeleteSettlement = %v, %v, want %v", tills, err, ErrSettlementNotFound)
+	}
+	if keys, err := c.Keys(ctx, testKey.BaseKey()+"*").Result(); err != nil || len(keys) != 0 {
+		t.Errorf("keys left = %v, %v, want none", keys, err)
+	}
+}
+
+func TestPurgeOldSettlements(t *testing.T) {
+	c, _ := newTestClient(t)
+	ctx := context.Background()
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := &testClock{now: start}
+	c.Clock = clock.Now
+	in := func(id string) Transaction {
+		tx := transfer(VaultTill, "till-1", cash(1))
+		tx.SettlementDocID = id
+		return tx
+	}
+	mustProcess(t, c, in("old-1"), in("old-2"))
+	clock.Set(start.Add(48 * time.Hour))
+	mustProcess(t, c, in("recent"))
+	if err := c.TransferIfAvailable(ctx, c.NewKey(testKey.Organization, testKey.EnterpriseUnit, "old-2"), VaultTill, "till-2", []Tender{cash(1)}); err != nil {
+		t.Fatal(err)
+	}
+	// Written before updated timestamps were kept
+	mustProcess(t, c, in("legacy"))
+	if err := c.Del(ctx, c.NewKey(testKey.Organization, testKey.EnterpriseUnit, "legacy").UpdatedKey()).Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := c.PurgeOldSettlements(cancelled, testKey.Organization, testKey.EnterpriseUnit, start.Add(time.Hour)); !errors.Is(err, context.Canceled) {
+		t.Errorf("PurgeOldSettlements() with a cancelled context error = %v, want %v", err, context.Canceled)
+	}
+	purged, err := c.PurgeOldSettlements(ctx, testKey.Organization, testKey.EnterpriseUnit, start.Add(time.Hour))
+	if err != nil || purged != 1 {
+		t.Fatalf("PurgeOldSettlements() = %d, %v, want 1", purged, err)
+	}
+	for id, want := range map[string]bool{"old-1": false, "old-2": true, "recent": true, "legacy": true} {
+		_, err := c.GetExpectedTenders(ctx, c.NewKey(testKey.Organization, testKey.EnterpriseUnit, id))
+		if exists := !errors.Is(err, ErrSettlementNotFound); exists != want {
+			t.Errorf("settlement %s exists = %v after the purge, want %v", id, exists, want)
+		}
+	}
+}
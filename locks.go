@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+var ErrLockTimeout = errors.New("lock timeout")
+
+const (
+	DefaultTillLockWait = 5 * time.Second
+	tillLockPoll        = 10 * time.Millisecond
+)
+
+// unlockScript deletes a lock only if it still holds the caller's token, so a lock that
+// expired and was taken by someone else is never released by its former holder.
+var unlockScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+// lockTills takes the lock of every given till that isn't a reserved pseudo-till, in ID
+// order so two callers locking overlapping tills can't deadlock, and returns the function
+// releasing them. Locks are SET NX with the client's TillLockTTL, so a crashed holder's
+// lock expires. Waiting longer than TillLockWait for a lock fails with ErrLockTimeout
+// after releasing those already taken.
+func (c Client) lockTills(ctx context.Context, key Key, tillIDs ...string) (func(), error) {
+	seen := make(map[string]struct{}, len(tillIDs))
+	for _, tillID := range tillIDs {
+		if tillID != "" && !c.IsReservedTill(tillID) {
+			seen[tillID] = struct{}{}
+		}
+	}
+	ids := sortedKeys(seen)
+	tokenBytes := make([]byte, 16)
+	if _, err := rand.Read(tokenBytes); err != nil {
+		return nil, fmt.Errorf("lock token: %w", err)
+	}
+	token := hex.EncodeToString(tokenBytes)
+
+	var held []string
+	unlock := func() {
+		// Released even if ctx is done, so a cancelled caller doesn't hold the tills until TTL
+		for _, lockKey := range held {
+			unlockScript.Run(context.Background(), c.Client, []string{lockKey}, token)
+		}
+	}
+	wait := c.TillLockWait
+	if wait <= 0 {
+		wait = DefaultTillLockWait
+	}
+	deadline := time.Now().Add(wait)
+	for _, tillID := range ids {
+		lockKey := key.TillLockKey(tillID)
+		for {
+			ok, err := c.SetNX(ctx, lockKey, token, c.TillLockTTL).Result()
+			if err != nil {
+				unlock()
+				return nil, fmt.Errorf("lock till %s: %w", tillID, err)
+			}
+			if ok {
+				held = append(held, lockKey)
+				break
+			}
+			if time.Now().After(deadline) {
+				unlock()
+				return nil, fmt.Errorf("%w: till %s still locked after %v", ErrLockTimeout, tillID, wait)
+			}
+			select {
+			case <-time.After(tillLockPoll):
+			case <-ctx.Done():
+				unlock()
+				return nil, ctx.Err()
+			}
+		}
+	}
+	return unlock, nil
+}
+
+// lockBatch takes the locks lockTills would for every transaction of a batch, settlement
+// by settlement in BaseKey order, and returns the function releasing all of them.
+func (c Client) lockBatch(ctx context.Context, txs []Transaction, batch []preparedTransaction) (func(), error) {
+	tills := make(map[Key][]string)
+	for i, p := range batch {
+		tills[p.key] = append(tills[p.key], txs[i].Source, txs[i].Destination)
+	}
+	keys := make([]Key, 0, len(tills))
+	for key := range tills {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].BaseKey() < keys[j].BaseKey() })
+
+	var unlocks []func()
+	unlock := func() {
+		for _, u := range unlocks {
+			u()
+		}
+	}
+	for _, key := range keys {
+		u, err := c.lockTills(ctx, key, tills[key]...)
+		if err != nil {
+			unlock()
+			return nil, err
+		}
+		unlocks = append(unlocks, u)
+	}
+	return unlock, nil
+}
@@ -2,8 +2,14 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
+	"os"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/redis/go-redis/v9"
 )
@@ -11,193 +17,1786 @@ import (
 type Key struct {
 	Organization    string
 	EnterpriseUnit  string
-	SettlementDocID string // Represents the settlement document business period this key is used for
+	SettlementDocID string     // Represents the settlement document business period this key is used for
+	Format          *KeyFormat // Layout of the Redis keys; nil means the default layout
 }
 
+// NewKey returns the key of a settlement in the client's KeyFormat, with its components
+// trimmed and lowercased when the client has NormalizeKeys set.
+func (c Client) NewKey(org, eu, settlementDocID string) Key {
+	if c.NormalizeKeys {
+		org, eu, settlementDocID = normalizeKeyComponent(org), normalizeKeyComponent(eu), normalizeKeyComponent(settlementDocID)
+	}
+	return Key{Organization: org, EnterpriseUnit: eu, SettlementDocID: settlementDocID, Format: c.KeyFormat}
+}
+
+// normalizeKey returns key with its components normalized like NewKey's when the client
+// has NormalizeKeys set. Its Format is kept.
+func (c Client) normalizeKey(key Key) Key {
+	if c.NormalizeKeys {
+		key.Organization, key.EnterpriseUnit, key.SettlementDocID = normalizeKeyComponent(key.Organization), normalizeKeyComponent(key.EnterpriseUnit), normalizeKeyComponent(key.SettlementDocID)
+	}
+	return key
+}
+
+func normalizeKeyComponent(s string) string {
+	return strings.ToLower(strings.TrimSpace(s))
+}
+
+// KeyFormat customizes the layout of the Redis keys. Its zero value, like a nil
+// *KeyFormat, gives the default org:<org>:eu:<eu>:settlement-id:<id> layout.
+type KeyFormat struct {
+	Prefix    string // Namespace put in front of every key, followed by the separator; none by default
+	Separator string // Between key components; ":" by default
+
+	// When set, everything after the leading "org" component of BaseKey is wrapped in a
+	// Redis Cluster hash tag, e.g. org:{acme:eu:store-1:settlement-id:s1}:tills, so all keys
+	// of a settlement hash to one slot and can be used together in MULTI/EXEC and scripts,
+	// while different settlements still spread across the cluster
+	HashTag bool
+
+	// Set on formats built by legacyFormat: components are used as given, the way keys were
+	// written before they were escaped
+	unescaped bool
+}
+
+func (f *KeyFormat) separator() string {
+	if f == nil || f.Separator == "" {
+		return ":"
+	}
+	return f.Separator
+}
+
+func (f *KeyFormat) join(components ...string) string {
+	joined := strings.Join(components, f.separator())
+	if f != nil && f.Prefix != "" {
+		return f.Prefix + f.separator() + joined
+	}
+	return joined
+}
+
+// BaseKey is the key every other key of the settlement starts with. The organization,
+// enterprise unit and settlement ID are escaped, see KeyFormat.escape, as are the till,
+// tender and denomination components of the other keys.
 func (k Key) BaseKey() string {
-	return fmt.Sprintf("org:%s:eu:%s:settlement-id:%s", k.Organization, k.EnterpriseUnit, k.SettlementDocID)
+	org, eu, id := k.Format.escape(k.Organization), k.Format.escape(k.EnterpriseUnit), k.Format.escape(k.SettlementDocID)
+	if k.Format != nil && k.Format.HashTag {
+		separator := k.Format.separator()
+		return k.Format.join("org", "{"+strings.Join([]string{org, "eu", eu, "settlement-id", id}, separator)+"}")
+	}
+	return k.Format.join("org", org, "eu", eu, "settlement-id", id)
+}
+
+// key returns the key made of BaseKey followed by the escaped components.
+func (k Key) key(components ...string) string {
+	escaped := make([]string, len(components))
+	for i, component := range components {
+		escaped[i] = k.Format.escape(component)
+	}
+	return k.BaseKey() + k.Format.separator() + strings.Join(escaped, k.Format.separator())
+}
+
+func (k Key) TillsSetKey() string {
+	return k.key("tills")
+}
+
+func (k Key) ClosedTillsSetKey() string {
+	return k.key("closed-tills")
+}
+
+// AppliedSetKey is the set idempotency keys were recorded in before AppliedKeysKey. It is
+// no longer written but still consulted until it expires.
+func (k Key) AppliedSetKey() string {
+	return k.key("applied")
+}
+
+// AppliedKeysKey is the sorted set of applied idempotency keys, scored by when each marker
+// expires in Unix milliseconds.
+func (k Key) AppliedKeysKey() string {
+	return k.key("applied-keys")
+}
+
+// UnloggedKey counts the writes to the settlement's balances that the transaction log
+// doesn't record, see ReplayTransactions.
+func (k Key) UnloggedKey() string {
+	return k.key("unlogged")
+}
+
+// BatchesKey is the sorted set of batches applied by ProcessBatch, scored by when each
+// marker expires in Unix milliseconds.
+func (k Key) BatchesKey() string {
+	return k.key("batches")
+}
+
+// UpdatedKey holds when the settlement's tills were last written, in Unix milliseconds of
+// Client.Clock, see PurgeOldSettlements.
+func (k Key) UpdatedKey() string {
+	return k.key("updated")
+}
+
+func (k Key) EventsStreamKey() string {
+	return k.key("events")
+}
+
+func (k Key) TransactionsKey() string {
+	return k.key("transactions")
+}
+
+func (k Key) TransactionLogKey() string {
+	return k.key("transaction-log")
+}
+
+func (k Key) VersionKey() string {
+	return k.key("version")
+}
+
+func (k Key) VersionsStreamKey() string {
+	return k.key("versions")
+}
+
+// TillsChannel is the pub/sub channel announcing till changes, see Client.PublishTillChanges.
+func (k Key) TillsChannel() string {
+	return k.Format.join("tills", k.Format.escape(k.Organization), k.Format.escape(k.EnterpriseUnit), k.Format.escape(k.SettlementDocID))
+}
+
+func (k Key) ChecksumKey() string {
+	return k.key("checksum")
+}
+
+func (k Key) TendersSetKey(till string) string {
+	return k.key("till", till, "tenders")
+}
+
+// TillLockKey is the lock ProcessTransaction takes on a till, see Client.TillLockTTL.
+func (k Key) TillLockKey(till string) string {
+	return k.key("till", till, "lock")
+}
+
+func (k Key) TenderKey(till, tender string) string {
+	return k.key("till", till, "tender", tender)
+}
+
+// TenderMetaKey is the hash of the tender's metadata, see Client.TenderMetadata.
+func (k Key) TenderMetaKey(till, tender string) string {
+	return k.key("till", till, "tender", tender, "meta")
+}
+
+func (k Key) DenominationsSetKey(till, tender string) string {
+	return k.key("till", till, "tender", tender, "denominations")
+}
+
+func (k Key) DenominationKey(till, tender, denomination string) string {
+	return k.key("till", till, "tender", tender, "denomination", denomination)
+}
+
+type Client struct {
+	*redis.Client
+
+	// When set, GetExpectedTenders and the other read-only reports read from this client,
+	// e.g. one connected to a replica, instead of the primary. Replication is asynchronous,
+	// so such reads can miss the latest writes; pass WithPrimary where that matters. Writes,
+	// and reads made to check a write, always go to the primary.
+	ReadClient *redis.Client
+
+	AllowedWindow *Window          // When set, ProcessTransaction rejects transactions outside this window
+	Clock         func() time.Time // Current time of AllowedWindow, idempotency marker expiry and TrimOldLog; defaults to time.Now
+
+	// When set, ProcessTransaction books the difference between a tender's amount and the
+	// sum of its breakdowns, up to RoundingCap, to this denomination
+	RoundingDenomination string
+	RoundingCap          Money
+
+	// When set, ProcessTransaction checks that each denomination's amount is its count times
+	// its unit value, see checkUnitValue. With StrictDenominations an unregistered
+	// denomination is rejected instead of passed through.
+	DenominationValues  map[string]Money
+	StrictDenominations bool
+
+	// Most tenders, and denomination entries across all tenders, a transaction may carry
+	// before it is rejected with ErrTransactionTooLarge; default to DefaultMaxTenders and
+	// DefaultMaxDenominations
+	MaxTenders       int
+	MaxDenominations int
+
+	// When set, ProcessTransaction merges tender entries with the same stored ID by summing
+	// their amounts and breakdowns; by default such a transaction is rejected
+	MergeDuplicateTenders bool
+
+	KeyFormat *KeyFormat // Layout of the keys of transactions and settlement scans; nil means the default layout
+
+	// When set, NewKey, ProcessTransaction and the org/EU scans trim and lowercase the
+	// organization, enterprise unit and settlement ID, so "Test-Org" and "test-org" name
+	// the same settlement. Keys built as Key literals are used as given.
+	NormalizeKeys bool
+
+	RejectClosedTills bool // CloseTill marks tills closed and ProcessTransaction rejects transactions against them
+
+	// When set, ProcessTransaction rejects with ErrInsufficientTender a transaction that would
+	// debit a real till below zero; reserved pseudo-tills are never checked
+	RejectOverdrafts bool
+
+	// When set, ProcessTransaction applies a transaction with a Lua script doing the
+	// overdraft check and every write in one atomic server-side call, instead of WATCH and
+	// MULTI/EXEC. Transactions with an IdempotencyKey or TransactionID, and clients with
+	// Versioning, EmitEvents, PublishTillChanges or TenderMetadata set, still take the
+	// MULTI/EXEC path.
+	ScriptTransactions bool
+
+	// When set, ProcessTransaction holds a lock on its source and destination, reserved
+	// pseudo-tills aside, for the duration of the transaction, so transactions touching the
+	// same till apply one at a time. OpenTill, CloseTill, MoveTender and ConvertTender lock
+	// the tills they write the same way. Locks expire after TillLockTTL if their holder dies;
+	// waiting longer than TillLockWait, DefaultTillLockWait by default, for one fails with
+	// ErrLockTimeout.
+	TillLockTTL  time.Duration
+	TillLockWait time.Duration
+
+	// When set, transactions stamp each tender they touch with the Redis server time and
+	// their SourceSystem, and reads return them in the Tender metadata fields
+	TenderMetadata bool
+
+	// When set, ProcessTransaction WATCHes every key a transaction writes and retries the
+	// transaction when a concurrent write touches one of them before it is applied
+	WatchTransactions bool
+
+	// When set, the transaction log entry of a stored transaction also records the tender
+	// totals it leaves its tills at, read under WATCH of them in the same MULTI/EXEC so no
+	// concurrent transaction can come in between; see LogEntry.Balances. ProcessBatch
+	// doesn't record them.
+	LogBalances bool
+
+	TxLogMaxAge time.Duration // When set, TrimOldLog drops transaction log entries older than this
+
+	// How ProcessTransaction resolves concurrent writes to the same tenders, see
+	// ConflictPolicy; empty means ConflictMerge
+	ConflictPolicy ConflictPolicy
+
+	// When above 1, ProcessTransactions applies groups of transactions sharing no till on
+	// up to this many workers at once
+	BatchWorkers int
+
+	// How often a WATCHed transaction is attempted before failing with ErrMaxRetriesExceeded;
+	// defaults to 3
+	MaxRetries int
+
+	// When set, ProcessTransaction accepts a tender whose breakdowns are in a currency other
+	// than the tender's; by default it rejects such a transaction
+	AllowMixedCurrencies bool
+
+	ChecksumSecret []byte // When set, writes maintain a running settlement checksum checked by VerifyChecksum
+
+	ReservedTills []string // Pseudo-till IDs, see IsReservedTill; nil means DefaultReservedTills
+
+	// When set, ProcessTransaction records every transaction it applies in the settlement's
+	// events stream, in the same MULTI/EXEC as its writes, with its type, TransactionID and
+	// the amount of each tender, see writeEvent
+	EmitEvents bool
+
+	// When set, ProcessTransaction publishes the IDs of the tills each transaction changed on
+	// the settlement's TillsChannel
+	PublishTillChanges bool
+
+	IdempotencyTTL time.Duration // How long idempotency keys and batch IDs are remembered; defaults to DefaultIdempotencyTTL
+
+	SScanCount int64 // COUNT hint per SSCAN page in GetExpectedTendersScan; defaults to 100
+
+	// When set, ProcessTransaction and the other writers moving balances, such as
+	// OpenTill, CloseTill, MoveTender and ConvertTender, refresh the whole settlement's
+	// expiry to this after every write, see SetSettlementTTL. Each refresh walks the
+	// settlement.
+	SettlementTTL time.Duration
+
+	Observer Observer // When set, receives the timings of transactions and reads
+	Metrics  Metrics  // When set, receives counters and durations of transactions and reads
+
+	// When set, transactions record versions of the settlement for
+	// GetExpectedTendersAtVersion
+	Versioning bool
+
+	// How often ProcessTransaction attempts a transaction with an IdempotencyKey that fails
+	// with a transient network error, see processWithRetry; 0 or 1 means no retries
+	RetryAttempts int
+	RetryBackoff  time.Duration // First delay between attempts, doubling after each; defaults to DefaultRetryBackoff
+
+	// Set on the copy of the client applying a reversal: transactions write balances and
+	// their records but leave set memberships alone, see ReverseTransaction
+	balancesOnly bool
+
+	inflight *inflight
+}
+
+// pingTimeout bounds the connection check made by NewClient.
+const pingTimeout = 2 * time.Second
+
+// NewClient connects to Redis and checks the connection with a PING, so a bad address or
+// password fails at startup rather than on the first transaction.
+func NewClient(opts *redis.Options) (Client, error) {
+	rdb := redis.NewClient(opts)
+	ctx, cancel := context.WithTimeout(context.Background(), pingTimeout)
+	defer cancel()
+	c := Client{Client: rdb, inflight: &inflight{}}
+	if err := c.Ping(ctx); err != nil {
+		rdb.Close()
+		return Client{}, err
+	}
+	return c, nil
+}
+
+// Ping checks that Redis, and the ReadClient if set, are reachable.
+func (c Client) Ping(ctx context.Context) error {
+	if err := c.Client.Ping(ctx).Err(); err != nil {
+		return fmt.Errorf("ping %s: %w", c.Options().Addr, err)
+	}
+	if c.ReadClient != nil {
+		if err := c.ReadClient.Ping(ctx).Err(); err != nil {
+			return fmt.Errorf("ping %s: %w", c.ReadClient.Options().Addr, err)
+		}
+	}
+	return nil
+}
+
+// Money is a monetary amount in the currency's minor unit, e.g. cents, so amounts add up
+// exactly. Redis stores it as an integer and it is only ever changed with INCRBY.
+type Money int64
+
+// MarshalBinary lets Money be passed directly as a Redis command argument.
+func (m Money) MarshalBinary() ([]byte, error) {
+	return strconv.AppendInt(nil, int64(m), 10), nil
+}
+
+// ParseError reports a stored value that couldn't be parsed.
+type ParseError struct {
+	Key   string // Redis key holding the value
+	Field string // Hash field holding the value; empty for a plain string key
+	Value string // Raw value as stored
+	Err   error
+}
+
+func (e *ParseError) Error() string {
+	if e.Field == "" {
+		return fmt.Sprintf("parse %s value %q: %v", e.Key, e.Value, e.Err)
+	}
+	return fmt.Sprintf("parse %s field %s value %q: %v", e.Key, e.Field, e.Value, e.Err)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+var ErrKeyTypeMismatch = errors.New("key type mismatch")
+
+// KeyTypeError reports a key holding a different Redis type than the one read from it,
+// e.g. a string SET by hand on a tills set. It matches ErrKeyTypeMismatch with errors.Is.
+type KeyTypeError struct {
+	Key      string
+	Expected string // Type the read expects: "set", "hash" or "string"
+	Actual   string // Type reported by TYPE, or "unknown" if that failed too
+}
+
+func (e *KeyTypeError) Error() string {
+	return fmt.Sprintf("%v: %s is a %s, want a %s", ErrKeyTypeMismatch, e.Key, e.Actual, e.Expected)
+}
+
+func (e *KeyTypeError) Unwrap() error {
+	return ErrKeyTypeMismatch
+}
+
+// wrapWrongType turns err into a KeyTypeError naming the key if it is a WRONGTYPE reply to
+// one of cmds, such as the commands of a pipeline err came from. Other errors are
+// returned unchanged.
+func wrapWrongType(ctx context.Context, r redis.Cmdable, err error, cmds ...redis.Cmder) error {
+	if !isWrongType(err) {
+		return err
+	}
+	for _, cmd := range cmds {
+		if !isWrongType(cmd.Err()) || len(cmd.Args()) < 2 {
+			continue
+		}
+		e := &KeyTypeError{Key: fmt.Sprint(cmd.Args()[1]), Expected: "string", Actual: "unknown"}
+		switch cmd.Name() {
+		case "smembers", "sscan", "sismember", "scard":
+			e.Expected = "set"
+		case "hgetall", "hscan", "hget":
+			e.Expected = "hash"
+		}
+		if actual, err := r.Type(ctx, e.Key).Result(); err == nil {
+			e.Actual = actual
+		}
+		return e
+	}
+	return err
+}
+
+func isWrongType(err error) bool {
+	var redisErr redis.Error
+	return errors.As(err, &redisErr) && strings.HasPrefix(redisErr.Error(), "WRONGTYPE")
+}
+
+func parseMoney(raw string) (Money, error) {
+	amount, err := strconv.ParseInt(raw, 10, 64)
+	return Money(amount), err
+}
+
+type TenderInfo struct {
+	Name     string // Denoination name
+	Currency string // ISO 4217 code; empty on write means the tender's currency
+	Count    int
+	Amount   Money
+
+	// When set the denomination tracks only its count, e.g. gift cards or stamps: Amount
+	// must be zero and no amount field is written. Reads set it for hashes without one.
+	CountOnly bool
+
+	// Raw values exactly as stored in Redis, only populated when reading WithRawValues
+	RawCount  string
+	RawAmount string
+}
+
+type Tender struct {
+	ID               string
+	Currency         string // ISO 4217 code; empty for tenders stored without a currency
+	Amount           Money
+	TenderBreakdowns []TenderInfo
+
+	RawAmount string // Raw tender total, only populated when reading WithRawValues
+
+	// Only populated when reading with a client with TenderMetadata set. The times are
+	// Redis server times of the first and latest transaction touching the tender in the till.
+	CreatedAt    time.Time
+	UpdatedAt    time.Time
+	SourceSystem string // Of the latest transaction that named one
+}
+
+// ReadOptions controls optional behaviour of the read methods.
+type ReadOptions struct {
+	IncludeReserved      bool
+	IncludeRaw           bool
+	DeriveMissingTotals  bool
+	PersistDerivedTotals bool
+	Primary              bool
+	HScanCount           int64
+	SkipZeroTenders      bool
+	Unsorted             bool
+	SkipEmptyTills       bool
+	TillPrefix           string
+	TillIDs              []string // Allowlist of till IDs; nil means every till
+	TenderIDs            []string // Allowlist of stored tender IDs; nil means every tender
+
+	timing *queryTiming // When set, accumulates the read's network and parse time
+}
+
+type ReadOption func(*ReadOptions)
+
+// WithReservedTills includes the client's pseudo-tills, which are left out by default.
+func WithReservedTills() ReadOption {
+	return func(o *ReadOptions) {
+		o.IncludeReserved = true
+	}
+}
+
+// WithPrimary reads from the primary even when the client has a ReadClient, for callers
+// that can't tolerate replication lag.
+func WithPrimary() ReadOption {
+	return func(o *ReadOptions) {
+		o.Primary = true
+	}
+}
+
+// WithoutZeroTenders leaves out tenders whose total and every denomination are zero, such
+// as those emptied during reconciliation, see also RemoveTender and Vacuum.
+func WithoutZeroTenders() ReadOption {
+	return func(o *ReadOptions) {
+		o.SkipZeroTenders = true
+	}
+}
+
+// WithTillPrefix reads only the tills whose ID starts with prefix, e.g. "reg-" for the
+// registers. Excluded tills are never read.
+func WithTillPrefix(prefix string) ReadOption {
+	return func(o *ReadOptions) {
+		o.TillPrefix = prefix
+	}
+}
+
+// WithTills reads only the given tills. Combined with WithTillPrefix a till must satisfy
+// both.
+func WithTills(tillIDs ...string) ReadOption {
+	return func(o *ReadOptions) {
+		o.TillIDs = tillIDs
+	}
+}
+
+// WithTenders reads only the given tenders, by stored ID, of each selected till; the
+// denominations of the others are never read.
+func WithTenders(tenderIDs ...string) ReadOption {
+	return func(o *ReadOptions) {
+		o.TenderIDs = tenderIDs
+	}
+}
+
+// selectsTill reports whether reads with o include the till.
+func (c Client) selectsTill(tillID string, o ReadOptions) bool {
+	if !o.IncludeReserved && c.IsReservedTill(tillID) {
+		return false
+	}
+	if !strings.HasPrefix(tillID, o.TillPrefix) {
+		return false
+	}
+	return o.TillIDs == nil || containsString(o.TillIDs, tillID)
+}
+
+// selectsTender reports whether reads with o include the tender.
+func (o ReadOptions) selectsTender(tenderID string) bool {
+	return o.TenderIDs == nil || containsString(o.TenderIDs, tenderID)
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// WithoutEmptyTills leaves out tills in the tills set that hold no tenders, such as the
+// empty shells a partial cleanup leaves behind, or tills left with none by
+// WithoutZeroTenders. By default they are returned with an empty Tenders.
+func WithoutEmptyTills() ReadOption {
+	return func(o *ReadOptions) {
+		o.SkipEmptyTills = true
+	}
+}
+
+// WithoutSorting returns tills, tenders and denominations in the arbitrary order Redis
+// returns set members in, skipping the sort reads do by default.
+func WithoutSorting() ReadOption {
+	return func(o *ReadOptions) {
+		o.Unsorted = true
+	}
+}
+
+// WithHScan reads denomination hashes with HSCAN, count fields per page, instead of one
+// HGETALL each, so a huge hash never blocks Redis for long. The hashes are then read one
+// after another rather than pipelined.
+func WithHScan(count int64) ReadOption {
+	return func(o *ReadOptions) {
+		o.HScanCount = count
+	}
+}
+
+// reader returns the connection reads with the given options go to.
+func (c Client) reader(o ReadOptions) redis.Cmdable {
+	if c.ReadClient != nil && !o.Primary {
+		return c.ReadClient
+	}
+	return c.Client
+}
+
+// WithRawValues populates the Raw* fields with the strings exactly as stored in Redis,
+// which helps when a parsed number looks suspicious.
+func WithRawValues() ReadOption {
+	return func(o *ReadOptions) {
+		o.IncludeRaw = true
+	}
+}
+
+// WithDerivedTotals computes a tender total that is missing from Redis (e.g. after a partial
+// write) from the sum of its denomination amounts instead of failing the read. When persist
+// is set the derived total is also written back, unless a total appeared in the meantime,
+// so subsequent reads are consistent.
+func WithDerivedTotals(persist bool) ReadOption {
+	return func(o *ReadOptions) {
+		o.DeriveMissingTotals = true
+		o.PersistDerivedTotals = persist
+	}
+}
+
+func newReadOptions(opts []ReadOption) ReadOptions {
+	var o ReadOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+type Till struct {
+	ID      string
+	Tenders []Tender
+}
+
+// GetExpectedTenders reads every till of the settlement with its tenders and
+// denominations, sorted by ID and name unless WithoutSorting is given. It fails with
+// ErrSettlementNotFound if the settlement has no tills set.
+func (c Client) GetExpectedTenders(ctx context.Context, key Key, opts ...ReadOption) ([]Till, error) {
+	start := time.Now()
+	o := newReadOptions(opts)
+	o.timing = &queryTiming{}
+	tills, err := c.getExpectedTenders(ctx, key, o)
+	c.observeQuery("GetExpectedTenders", start, tills, err)
+	c.observePhases("GetExpectedTenders", o.timing, err)
+	return tills, err
+}
+
+func (c Client) getExpectedTenders(ctx context.Context, key Key, o ReadOptions) ([]Till, error) {
+	ids, err := c.selectedTills(ctx, key, o)
+	if err != nil {
+		return nil, err
+	}
+	return c.readTills(ctx, key, ids, o)
+}
+
+// allTills reads every till of the settlement from the primary, reserved pseudo-tills
+// included, for the checks that treat a missing settlement as an empty one.
+func (c Client) allTills(ctx context.Context, key Key) ([]Till, error) {
+	tills, err := c.getExpectedTenders(ctx, key, ReadOptions{IncludeReserved: true, Primary: true})
+	if errors.Is(err, ErrSettlementNotFound) {
+		return nil, nil
+	}
+	return tills, err
+}
+
+// selectedTills returns the IDs of the settlement's tills selected by o. It fails with
+// ErrSettlementNotFound if the tills set doesn't exist; Redis deletes a set along with its
+// last member, so every existing settlement has at least one till.
+func (c Client) selectedTills(ctx context.Context, key Key, o ReadOptions) ([]string, error) {
+	start := time.Now()
+	cmd := c.reader(o).SMembers(ctx, key.TillsSetKey())
+	tillIDs, err := cmd.Result()
+	o.timing.addNetwork(start)
+	if err != nil {
+		return nil, fmt.Errorf("read tills of settlement %s: %w", key.SettlementDocID, wrapWrongType(ctx, c.reader(o), err, cmd))
+	}
+	if len(tillIDs) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrSettlementNotFound, key.SettlementDocID)
+	}
+	var ids []string
+	for _, tillID := range tillIDs {
+		if c.selectsTill(tillID, o) {
+			ids = append(ids, tillID)
+		}
+	}
+	return ids, nil
+}
+
+func (c Client) getTill(ctx context.Context, key Key, tillID string, o ReadOptions) (Till, error) {
+	tills, err := c.readTills(ctx, key, []string{tillID}, o)
+	if err != nil {
+		return Till{}, err
+	}
+	if len(tills) == 0 {
+		// Left out by WithoutEmptyTills
+		return Till{ID: tillID}, nil
+	}
+	return tills[0], nil
+}
+
+// GetExpectedTendersScan is GetExpectedTenders paging through the tills, tenders and
+// denomination sets with SSCAN instead of reading each with one SMEMBERS, so a very large
+// set never blocks Redis for long. Client.SScanCount sets the COUNT hint per page. Sets
+// changed while they are paged through may show members more than once, which are
+// collapsed, and may miss members added or removed meanwhile.
+func (c Client) GetExpectedTendersScan(ctx context.Context, key Key, opts ...ReadOption) ([]Till, error) {
+	start := time.Now()
+	tills, err := c.getExpectedTendersScan(ctx, key, newReadOptions(opts))
+	c.observeQuery("GetExpectedTendersScan", start, tills, err)
+	return tills, err
+}
+
+func (c Client) getExpectedTendersScan(ctx context.Context, key Key, o ReadOptions) ([]Till, error) {
+	r := c.reader(o)
+	tillIDs, err := sscanAll(ctx, r, key.TillsSetKey(), c.SScanCount)
+	if err != nil {
+		return nil, fmt.Errorf("read tills of settlement %s: %w", key.SettlementDocID, err)
+	}
+	if len(tillIDs) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrSettlementNotFound, key.SettlementDocID)
+	}
+	var ids []string
+	for _, tillID := range tillIDs {
+		if !c.selectsTill(tillID, o) {
+			continue
+		}
+		ids = append(ids, tillID)
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	var tenders []tenderRef
+	for i, tillID := range ids {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		tenderIDs, err := sscanAll(ctx, r, key.TendersSetKey(tillID), c.SScanCount)
+		if err != nil {
+			return nil, fmt.Errorf("read tenders of till %s: %w", tillID, err)
+		}
+		for _, tenderID := range tenderIDs {
+			if !o.selectsTender(tenderID) {
+				continue
+			}
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			names, err := sscanAll(ctx, r, key.DenominationsSetKey(tillID, tenderID), c.SScanCount)
+			if err != nil {
+				return nil, fmt.Errorf("read denominations of till %s tender %s: %w", tillID, tenderID, err)
+			}
+			tenders = append(tenders, tenderRef{till: i, tender: tenderID, denominations: names})
+		}
+	}
+	return c.readTenders(ctx, key, ids, tenders, o)
+}
+
+// sscanAll returns the distinct members of a set, paged through with SSCAN.
+func sscanAll(ctx context.Context, cmd redis.Cmdable, setKey string, count int64) ([]string, error) {
+	if count <= 0 {
+		count = scanCount
+	}
+	seen := make(map[string]struct{})
+	var members []string
+	var cursor uint64
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		scan := cmd.SScan(ctx, setKey, cursor, "", count)
+		page, next, err := scan.Result()
+		if err != nil {
+			return nil, wrapWrongType(ctx, cmd, err, scan)
+		}
+		for _, member := range page {
+			if _, ok := seen[member]; ok {
+				continue
+			}
+			seen[member] = struct{}{}
+			members = append(members, member)
+		}
+		if next == 0 {
+			return members, nil
+		}
+		cursor = next
+	}
+}
+
+// isZeroTender reports whether the tender's total and all its denominations are zero.
+func isZeroTender(tender Tender) bool {
+	if tender.Amount != 0 {
+		return false
+	}
+	for _, denomination := range tender.TenderBreakdowns {
+		if denomination.Count != 0 || denomination.Amount != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// hscanAll returns the fields of a hash, paged through with HSCAN.
+func hscanAll(ctx context.Context, cmd redis.Cmdable, hashKey string, count int64) (map[string]string, error) {
+	fields := make(map[string]string)
+	var cursor uint64
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		scan := cmd.HScan(ctx, hashKey, cursor, "", count)
+		page, next, err := scan.Result()
+		if err != nil {
+			return nil, wrapWrongType(ctx, cmd, err, scan)
+		}
+		for i := 0; i+1 < len(page); i += 2 {
+			fields[page[i]] = page[i+1]
+		}
+		if next == 0 {
+			return fields, nil
+		}
+		cursor = next
+	}
+}
+
+// tenderRef locates a tender by the index of its till and lists its denomination names.
+type tenderRef struct {
+	till          int
+	tender        string
+	denominations []string
+}
+
+// readTills reads the given tills level by level: one pipeline for their tenders sets, one
+// for the denomination sets and one for every denomination hash and tender total, so the
+// number of round trips doesn't grow with the size of the settlement.
+func (c Client) readTills(ctx context.Context, key Key, tillIDs []string, o ReadOptions) ([]Till, error) {
+	if len(tillIDs) == 0 {
+		return nil, nil
+	}
+	pipe := c.reader(o).Pipeline()
+	tenderCmds := make([]*redis.StringSliceCmd, len(tillIDs))
+	for i, tillID := range tillIDs {
+		tenderCmds[i] = pipe.SMembers(ctx, key.TendersSetKey(tillID))
+	}
+	start := time.Now()
+	cmds, err := pipe.Exec(ctx)
+	o.timing.addNetwork(start)
+	if err != nil {
+		return nil, fmt.Errorf("read tenders of settlement %s: %w", key.SettlementDocID, wrapWrongType(ctx, c.reader(o), err, cmds...))
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	var tenders []tenderRef
+	var denominationCmds []*redis.StringSliceCmd
+	for i, cmd := range tenderCmds {
+		for _, tenderID := range cmd.Val() {
+			if !o.selectsTender(tenderID) {
+				continue
+			}
+			tenders = append(tenders, tenderRef{till: i, tender: tenderID})
+			denominationCmds = append(denominationCmds, pipe.SMembers(ctx, key.DenominationsSetKey(tillIDs[i], tenderID)))
+		}
+	}
+	if len(tenders) > 0 {
+		start := time.Now()
+		cmds, err := pipe.Exec(ctx)
+		o.timing.addNetwork(start)
+		if err != nil {
+			return nil, fmt.Errorf("read denominations of settlement %s: %w", key.SettlementDocID, wrapWrongType(ctx, c.reader(o), err, cmds...))
+		}
+	}
+	for i, cmd := range denominationCmds {
+		tenders[i].denominations = cmd.Val()
+	}
+	return c.readTenders(ctx, key, tillIDs, tenders, o)
+}
+
+// readTenders reads every denomination hash and tender total of the given tenders in one
+// pipeline, the hashes separately when reading WithHScan, and assembles them into tills.
+func (c Client) readTenders(ctx context.Context, key Key, tillIDs []string, tenders []tenderRef, o ReadOptions) ([]Till, error) {
+	tills := make([]Till, len(tillIDs))
+	for i, tillID := range tillIDs {
+		tills[i].ID = tillID
+	}
+	if len(tenders) == 0 {
+		return finishTills(tills, o), nil
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	pipe := c.reader(o).Pipeline()
+	persist := c.Pipeline()
+	hashCmds := make([][]*redis.MapStringStringCmd, len(tenders))
+	totalCmds := make([]*redis.StringCmd, len(tenders))
+	metaCmds := make([]*redis.MapStringStringCmd, len(tenders))
+	for i, ref := range tenders {
+		tillID := tillIDs[ref.till]
+		if o.HScanCount <= 0 {
+			for _, name := range ref.denominations {
+				hashCmds[i] = append(hashCmds[i], pipe.HGetAll(ctx, key.DenominationKey(tillID, ref.tender, name)))
+			}
+		}
+		totalCmds[i] = pipe.Get(ctx, key.TenderKey(tillID, ref.tender))
+		if c.TenderMetadata {
+			metaCmds[i] = pipe.HGetAll(ctx, key.TenderMetaKey(tillID, ref.tender))
+		}
+	}
+	start := time.Now()
+	if cmds, err := pipe.Exec(ctx); err != nil && !errors.Is(err, redis.Nil) {
+		return nil, fmt.Errorf("read tenders of settlement %s: %w", key.SettlementDocID, wrapWrongType(ctx, c.reader(o), err, cmds...))
+	}
+	hashFields := make([][]map[string]string, len(tenders))
+	for i, ref := range tenders {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		tillID := tillIDs[ref.till]
+		for j, name := range ref.denominations {
+			var fields map[string]string
+			var err error
+			if o.HScanCount > 0 {
+				fields, err = hscanAll(ctx, c.reader(o), key.DenominationKey(tillID, ref.tender, name), o.HScanCount)
+			} else if fields, err = hashCmds[i][j].Result(); err != nil {
+				err = wrapWrongType(ctx, c.reader(o), err, hashCmds[i][j])
+			}
+			if err != nil {
+				return nil, fmt.Errorf("read denomination %s of till %s tender %s: %w", name, tillID, ref.tender, err)
+			}
+			hashFields[i] = append(hashFields[i], fields)
+		}
+	}
+	o.timing.addNetwork(start)
+
+	start = time.Now()
+	for i, ref := range tenders {
+		tillID := tillIDs[ref.till]
+		tender := tenderFromStoredID(ref.tender)
+		names := ref.denominations
+		var denominations []TenderInfo
+		for j, fields := range hashFields[i] {
+			info, err := parseDenomination(key.DenominationKey(tillID, ref.tender, names[j]), names[j], tender.Currency, fields, o)
+			if err != nil {
+				return nil, err
+			}
+			denominations = append(denominations, info)
+		}
+
+		tenderKey := key.TenderKey(tillID, ref.tender)
+		rawTenderAmount, err := totalCmds[i].Result()
+		var tenderAmount Money
+		switch {
+		case errors.Is(err, redis.Nil) && o.DeriveMissingTotals:
+			for _, denomination := range denominations {
+				tenderAmount += denomination.Amount
+			}
+			if o.PersistDerivedTotals {
+				persist.SetNX(ctx, tenderKey, tenderAmount, 0)
+			}
+		case err != nil:
+			return nil, fmt.Errorf("read total of till %s tender %s: %w", tillID, ref.tender, wrapWrongType(ctx, c.reader(o), err, totalCmds[i]))
+		default:
+			tenderAmount, err = parseMoney(rawTenderAmount)
+			if err != nil {
+				return nil, &ParseError{Key: tenderKey, Value: rawTenderAmount, Err: err}
+			}
+		}
+		tender.Amount = tenderAmount
+		tender.TenderBreakdowns = denominations
+		if o.SkipZeroTenders && isZeroTender(tender) {
+			continue
+		}
+		if o.IncludeRaw {
+			tender.RawAmount = rawTenderAmount
+		}
+		if metaCmds[i] != nil {
+			parseTenderMetadata(&tender, metaCmds[i].Val())
+		}
+		tills[ref.till].Tenders = append(tills[ref.till].Tenders, tender)
+	}
+	tills = finishTills(tills, o)
+	o.timing.addParse(start)
+
+	if persist.Len() > 0 {
+		if _, err := persist.Exec(ctx); err != nil {
+			return nil, fmt.Errorf("persist derived totals: %w", err)
+		}
+	}
+	return tills, nil
+}
+
+// finishTills applies the read options that act on the assembled tills.
+func finishTills(tills []Till, o ReadOptions) []Till {
+	if o.SkipEmptyTills {
+		kept := tills[:0]
+		for _, till := range tills {
+			if len(till.Tenders) > 0 {
+				kept = append(kept, till)
+			}
+		}
+		tills = kept
+	}
+	if !o.Unsorted {
+		sortTills(tills)
+	}
+	return tills
 }
 
-func (k Key) TillsSetKey() string {
-	return fmt.Sprintf("%s:tills", k.BaseKey())
+// sortTills orders tills by ID, their tenders by stored ID and each tender's denominations
+// by stored name, so the same state always reads back in the same order.
+func sortTills(tills []Till) {
+	sort.Slice(tills, func(i, j int) bool { return tills[i].ID < tills[j].ID })
+	for _, till := range tills {
+		sort.Slice(till.Tenders, func(i, j int) bool { return till.Tenders[i].StoredID() < till.Tenders[j].StoredID() })
+		for _, tender := range till.Tenders {
+			breakdowns := tender.TenderBreakdowns
+			sort.Slice(breakdowns, func(i, j int) bool {
+				return breakdowns[i].storedName(tender.Currency) < breakdowns[j].storedName(tender.Currency)
+			})
+		}
+	}
 }
 
-func (k Key) TendersSetKey(till string) string {
-	return fmt.Sprintf("%s:till:%s:tenders", k.BaseKey(), till)
+func (c Client) getDenominations(ctx context.Context, key Key, tillID, tenderID string, o ReadOptions) ([]TenderInfo, error) {
+	namesCmd := c.SMembers(ctx, key.DenominationsSetKey(tillID, tenderID))
+	denominationNames, err := namesCmd.Result()
+	if err != nil {
+		return nil, fmt.Errorf("read denominations of till %s tender %s: %w", tillID, tenderID, wrapWrongType(ctx, c.Client, err, namesCmd))
+	}
+	_, currency := splitCurrency(tenderID)
+	var denominations []TenderInfo
+	for _, denominationName := range denominationNames {
+		denominationKey := key.DenominationKey(tillID, tenderID, denominationName)
+		cmd := c.HGetAll(ctx, denominationKey)
+		denomination, err := cmd.Result()
+		if err != nil {
+			return nil, fmt.Errorf("read denomination %s of till %s tender %s: %w", denominationName, tillID, tenderID, wrapWrongType(ctx, c.Client, err, cmd))
+		}
+		info, err := parseDenomination(denominationKey, denominationName, currency, denomination, o)
+		if err != nil {
+			return nil, err
+		}
+		denominations = append(denominations, info)
+	}
+	return denominations, nil
 }
 
-func (k Key) TenderKey(till, tender string) string {
-	return fmt.Sprintf("%s:till:%s:tender:%s", k.BaseKey(), till, tender)
+// parseDenomination parses the hash of the denomination stored as storedName within a
+// tender in tenderCurrency.
+func parseDenomination(denominationKey, storedName, tenderCurrency string, denomination map[string]string, o ReadOptions) (TenderInfo, error) {
+	count, err := strconv.ParseInt(denomination["count"], 0, 0)
+	if err != nil {
+		return TenderInfo{}, &ParseError{Key: denominationKey, Field: "count", Value: denomination["count"], Err: err}
+	}
+	info := denominationFromStoredName(storedName, tenderCurrency)
+	info.Count = int(count)
+	if raw, ok := denomination["amount"]; ok {
+		amount, err := parseMoney(raw)
+		if err != nil {
+			return TenderInfo{}, &ParseError{Key: denominationKey, Field: "amount", Value: raw, Err: err}
+		}
+		info.Amount = amount
+	} else {
+		info.CountOnly = true
+	}
+	if o.IncludeRaw {
+		info.RawCount = denomination["count"]
+		info.RawAmount = denomination["amount"]
+	}
+	return info, nil
 }
 
-func (k Key) DenominationsSetKey(till, tender string) string {
-	return fmt.Sprintf("%s:till:%s:tender:%s:denominations", k.BaseKey(), till, tender)
+// Direction says which way a transaction moves its tenders. The legacy ">" and "<" are
+// accepted as DirectionCredit and DirectionDebit.
+type Direction string
+
+const (
+	DirectionCredit Direction = "credit" // From Source to Destination
+	DirectionDebit  Direction = "debit"  // From Destination to Source
+)
+
+// sign returns 1 for a credit and -1 for a debit.
+func (d Direction) sign() (int, error) {
+	switch d {
+	case DirectionCredit, ">":
+		return 1, nil
+	case DirectionDebit, "<":
+		return -1, nil
+	}
+	return 0, fmt.Errorf("%w: direction %q, want %s or %s", ErrInvalidTransaction, string(d), DirectionCredit, DirectionDebit)
 }
 
-func (k Key) DenominationKey(till, tender, denomination string) string {
-	return fmt.Sprintf("%s:till:%s:tender:%s:denomination:%s", k.BaseKey(), till, tender, denomination)
+type Transaction struct {
+	Org             string
+	EU              string
+	SettlementDocID string
+	Source          string
+	Destination     string
+	Direction       Direction
+	Tenders         []Tender
+	OverrideWindow  bool // Apply even outside the client's AllowedWindow
+
+	// When set, ProcessTransaction applies the transaction at most once per settlement for
+	// a given key, failing with ErrAlreadyApplied on a repeat, see IdempotencyTTL
+	IdempotencyKey string
+
+	// When set, ProcessTransaction stores the transaction under this ID, unique within the
+	// settlement, for GetTransaction and ReverseTransactionByID
+	TransactionID string
+
+	// When set, the TransactionID of the stored transaction this one corrects, recorded in
+	// the transaction log, see CorrectTransaction. It requires a TransactionID.
+	Corrects string
+
+	SourceSystem string // System posting the transaction, recorded with Client.TenderMetadata
 }
 
-type Client struct {
-	*redis.Client
+var (
+	ErrInvalidTransaction  = errors.New("invalid transaction")
+	ErrTransactionTooLarge = errors.New("transaction too large")
+)
+
+const (
+	DefaultMaxTenders       = 100
+	DefaultMaxDenominations = 1000
+)
+
+// checkSize rejects tenders exceeding the client's MaxTenders or MaxDenominations.
+func (c Client) checkSize(tenders []Tender) error {
+	maxTenders, maxDenominations := c.MaxTenders, c.MaxDenominations
+	if maxTenders <= 0 {
+		maxTenders = DefaultMaxTenders
+	}
+	if maxDenominations <= 0 {
+		maxDenominations = DefaultMaxDenominations
+	}
+	if len(tenders) > maxTenders {
+		return fmt.Errorf("%w: %d tenders, at most %d allowed", ErrTransactionTooLarge, len(tenders), maxTenders)
+	}
+	var denominations int
+	for _, tender := range tenders {
+		denominations += len(tender.TenderBreakdowns)
+	}
+	if denominations > maxDenominations {
+		return fmt.Errorf("%w: %d denominations, at most %d allowed", ErrTransactionTooLarge, denominations, maxDenominations)
+	}
+	return nil
 }
 
-type TenderInfo struct {
-	Name   string // Denoination name
-	Count  int
-	Amount float64
+func (c Client) ProcessTransaction(ctx context.Context, t Transaction) error {
+	done, err := c.begin()
+	if err != nil {
+		return err
+	}
+	defer done()
+	start := time.Now()
+	err = c.processWithRetry(ctx, t)
+	c.observeTransaction("ProcessTransaction", start, t, err)
+	return err
 }
 
-type Tender struct {
-	ID               string
-	Amount           float64
-	TenderBreakdowns []TenderInfo
+func (c Client) processTransaction(ctx context.Context, t Transaction) error {
+	key, direction, tenders, err := c.prepareTransaction(ctx, t)
+	if err != nil {
+		return err
+	}
+	return c.applyPrepared(ctx, t, key, direction, tenders)
 }
 
-type Till struct {
-	ID      string
-	Tenders []Tender
+// applyPrepared writes a transaction validated by prepareTransaction, holding its tills'
+// locks when the client has TillLockTTL set, and refreshes the settlement's TTL.
+func (c Client) applyPrepared(ctx context.Context, t Transaction, key Key, direction int, tenders []Tender) (err error) {
+	if c.TillLockTTL > 0 {
+		unlock, err := c.lockTills(ctx, key, t.Source, t.Destination)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+	if c.scriptable(t) {
+		err = c.processScripted(ctx, key, t, direction, tenders)
+	} else {
+		write, checks, watched := c.transactionWrite(ctx, t, key, direction, tenders)
+		err = c.applyChecked(ctx, write, checks, watched)
+	}
+	if err != nil || c.SettlementTTL <= 0 {
+		return err
+	}
+	return c.setSettlementTTL(ctx, key, c.SettlementTTL)
 }
 
-func (c Client) GetExpectedTenders(ctx context.Context, key Key) ([]Till, error) {
-	var tills []Till
-	tillIDs := c.SMembers(ctx, key.TillsSetKey()).Val()
-	for _, tillID := range tillIDs {
-		tenderIDs := c.SMembers(ctx, key.TendersSetKey(tillID)).Val()
-		var tenders []Tender
-		for _, tenderID := range tenderIDs {
-			denominationNames := c.SMembers(ctx, key.DenominationsSetKey(tillID, tenderID)).Val()
-			var denominations []TenderInfo
-			for _, denominationName := range denominationNames {
-				denomination := c.HGetAll(ctx, key.DenominationKey(tillID, tenderID, denominationName)).Val()
-				count, err := strconv.ParseInt(denomination["count"], 0, 0)
-				if err != nil {
-					return nil, err
-				}
-				amount, err := strconv.ParseFloat(denomination["amount"], 64)
-				if err != nil {
-					return nil, err
+// transactionBatchSize is the most transactions ProcessTransactions puts in one MULTI/EXEC.
+const transactionBatchSize = 100
+
+// ProcessTransactions applies txs in order, with the same effect as calling
+// ProcessTransaction for each but far fewer round trips. Every transaction is validated
+// before anything is written, so a batch containing an invalid transaction writes
+// nothing. The rest are written in MULTI/EXEC blocks of up to transactionBatchSize, so
+// each transaction still lands whole or not at all. Transactions needing WATCHed checks,
+// those with an IdempotencyKey or TransactionID or subject to RejectOverdrafts,
+// WatchTransactions or a watching ConflictPolicy, are applied on their own in sequence. If applying fails, the
+// transactions before the failing one stay applied and the error names the failing index.
+//
+// With BatchWorkers above 1 the transactions are split into groups, see
+// groupTransactions, that share no real till, idempotency key or transaction ID, and up
+// to BatchWorkers groups are applied at once, each in submission order. Since
+// transactions in different groups can't affect each other's checks and their writes
+// commute, the final balances are those of applying txs in order. A failure stops only
+// its own group; the error names the lowest failing index, but transactions of other
+// groups after it may have been applied.
+//
+// With TillLockTTL set, the locks of every till in the batch are taken before anything is
+// written and held until the whole batch is applied.
+func (c Client) ProcessTransactions(ctx context.Context, txs []Transaction) error {
+	done, err := c.begin()
+	if err != nil {
+		return err
+	}
+	defer done()
+	batch := make([]preparedTransaction, len(txs))
+	touched := make(map[Key]struct{})
+	for i, t := range txs {
+		key, direction, tenders, err := c.prepareTransaction(ctx, t)
+		if err != nil {
+			return fmt.Errorf("transaction %d: %w", i, err)
+		}
+		batch[i] = preparedTransaction{key: key, direction: direction, tenders: tenders}
+		touched[key] = struct{}{}
+	}
+
+	if c.TillLockTTL > 0 {
+		unlock, err := c.lockBatch(ctx, txs, batch)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+	if c.BatchWorkers > 1 {
+		err = c.applyGroups(ctx, txs, batch, c.groupTransactions(txs, batch))
+	} else {
+		indexes := make([]int, len(txs))
+		for i := range indexes {
+			indexes[i] = i
+		}
+		_, err = c.applyTransactions(ctx, txs, batch, indexes)
+	}
+	if err != nil {
+		return err
+	}
+
+	if c.SettlementTTL > 0 {
+		for key := range touched {
+			if err := c.setSettlementTTL(ctx, key, c.SettlementTTL); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// preparedTransaction is a transaction validated by prepareTransaction.
+type preparedTransaction struct {
+	key       Key
+	direction int
+	tenders   []Tender
+}
+
+// applyTransactions applies the transactions of txs at indexes, in that order, batching
+// those needing no checks. On failure it returns the index of the first transaction that
+// may not have been applied along with the error.
+func (c Client) applyTransactions(ctx context.Context, txs []Transaction, batch []preparedTransaction, indexes []int) (int, error) {
+	var pending []func(redis.Pipeliner) error
+	var first, last int
+	flush := func() error {
+		if len(pending) == 0 {
+			return nil
+		}
+		_, err := c.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			for _, write := range pending {
+				if err := write(pipe); err != nil {
+					return err
 				}
-				denominations = append(denominations, TenderInfo{
-					Name:   denominationName,
-					Count:  int(count),
-					Amount: amount,
-				})
 			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("transactions %d to %d: %w", first, last, err)
+		}
+		pending = pending[:0]
+		return nil
+	}
+	for _, i := range indexes {
+		p := batch[i]
+		write, checks, watched := c.transactionWrite(ctx, txs[i], p.key, p.direction, p.tenders)
+		if len(checks) > 0 || len(watched) > 0 {
+			if err := flush(); err != nil {
+				return first, err
+			}
+			if err := c.applyChecked(ctx, write, checks, watched); err != nil {
+				return i, fmt.Errorf("transaction %d: %w", i, err)
+			}
+			continue
+		}
+		if len(pending) == 0 {
+			first = i
+		}
+		last = i
+		pending = append(pending, write)
+		if len(pending) == transactionBatchSize {
+			if err := flush(); err != nil {
+				return first, err
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return first, err
+	}
+	return 0, nil
+}
 
-			tenderAmount, err := strconv.ParseFloat(c.Get(ctx, key.TenderKey(tillID, tenderID)).Val(), 64)
-			if err != nil {
-				return nil, err
+// transactionWrite returns the writes applying a prepared transaction, plus the checks
+// that must pass first and the keys to WATCH. Nothing is checked or watched unless the
+// transaction has an IdempotencyKey or TransactionID or the client has RejectOverdrafts or
+// WatchTransactions set or a ConflictPolicy of ConflictRetry or ConflictFail.
+func (c Client) transactionWrite(ctx context.Context, t Transaction, key Key, direction int, tenders []Tender) (func(redis.Pipeliner) error, []func(*redis.Tx) error, []string) {
+	write := func(pipe redis.Pipeliner) error {
+		c.writeTransaction(ctx, pipe, key, t.Source, t.Destination, direction, tenders)
+		if t.TransactionID == "" {
+			markUnlogged(ctx, pipe, key)
+		}
+		if c.Versioning {
+			if err := writeVersion(ctx, pipe, key, transactionDeltas(t.Source, t.Destination, direction, tenders)); err != nil {
+				return err
 			}
-			tenders = append(tenders, Tender{
-				ID:               tenderID,
-				Amount:           tenderAmount,
-				TenderBreakdowns: denominations,
-			})
 		}
-		tills = append(tills, Till{
-			ID:      tillID,
-			Tenders: tenders,
-		})
+		if c.EmitEvents {
+			eventType := EventTransaction
+			if t.Source == "" {
+				eventType = EventAdjust
+			}
+			c.writeEvent(ctx, pipe, key, eventType, t, tenders)
+		}
+		if c.TenderMetadata {
+			writeTenderMetadata(ctx, pipe, key, t.Source, t.Destination, tenders, t.SourceSystem)
+		}
+		if c.PublishTillChanges {
+			if t.Source == "" {
+				return writeTillsChanged(ctx, pipe, key, t.Destination)
+			}
+			return writeTillsChanged(ctx, pipe, key, t.Source, t.Destination)
+		}
+		return nil
+	}
+	var watched []string
+	var checks []func(*redis.Tx) error
+	if t.IdempotencyKey != "" {
+		watched = append(watched, key.AppliedKeysKey(), key.AppliedSetKey())
+		checks = append(checks, c.notAppliedCheck(ctx, key, t.IdempotencyKey))
+		write = c.recordApplied(ctx, key, t.IdempotencyKey, write)
+	}
+	if t.TransactionID != "" {
+		watched = append(watched, key.TransactionsKey())
+		checks = append(checks, newTransactionCheck(ctx, key, t.TransactionID))
+		var balances map[string]map[string]Money
+		if c.LogBalances {
+			balances = make(map[string]map[string]Money)
+			keys, check := postBalancesCheck(ctx, key, t.Source, t.Destination, direction, tenders, balances)
+			watched = append(watched, keys...)
+			checks = append(checks, check)
+		}
+		write = recordTransaction(ctx, key, t, direction, tenders, balances, write)
+		if t.Corrects != "" {
+			checks = append(checks, storedTransactionCheck(ctx, key, t.Corrects))
+		}
+	}
+	debited := t.Source
+	if direction < 0 {
+		debited = t.Destination
+	}
+	if c.RejectOverdrafts && debited != "" && !c.IsReservedTill(debited) {
+		keys, check := fundsCheck(ctx, key, debited, tenders)
+		watched = append(watched, keys...)
+		checks = append(checks, check)
+	}
+	if c.WatchTransactions || c.ConflictPolicy == ConflictRetry || c.ConflictPolicy == ConflictFail {
+		watched = append(watched, transactionKeys(key, t.Source, t.Destination, direction, tenders)...)
 	}
+	return write, checks, watched
+}
 
-	return tills, nil
+// transactionKeys returns every key writeTransaction writes for the given tenders.
+func transactionKeys(key Key, source, destination string, direction int, tenders []Tender) []string {
+	keys := []string{key.TillsSetKey(), key.TendersSetKey(destination)}
+	if source != "" {
+		keys = append(keys, key.TendersSetKey(source))
+	}
+	for _, delta := range transactionDeltas(source, destination, direction, tenders) {
+		if delta.Denomination == "" {
+			keys = append(keys, key.TenderKey(delta.Till, delta.Tender))
+			continue
+		}
+		keys = append(keys, key.DenominationKey(delta.Till, delta.Tender, delta.Denomination), key.DenominationsSetKey(delta.Till, delta.Tender))
+	}
+	return keys
 }
 
-type Transaction struct {
-	Org             string
-	EU              string
-	SettlementDocID string
-	Source          string
-	Destination     string
-	Direction       string
-	Tenders         []Tender
+// applyChecked runs write in a MULTI/EXEC so a failure can't leave money debited from the
+// source but not credited to the destination. Any checks run first under WATCH of
+// watched, so a concurrent write to what they read or to another watched key makes them
+// run again or fail, see watchConflicts.
+func (c Client) applyChecked(ctx context.Context, write func(redis.Pipeliner) error, checks []func(*redis.Tx) error, watched []string) error {
+	if len(checks) == 0 && len(watched) == 0 {
+		_, err := c.TxPipelined(ctx, write)
+		return err
+	}
+	return c.watchConflicts(ctx, func(tx *redis.Tx) error {
+		for _, check := range checks {
+			if err := check(tx); err != nil {
+				return err
+			}
+		}
+		_, err := tx.TxPipelined(ctx, write)
+		return err
+	}, watched...)
 }
 
-func (c Client) ProcessTransaction(t Transaction) error {
-	key := Key{
-		Organization:    t.Org,
-		EnterpriseUnit:  t.EU,
-		SettlementDocID: t.SettlementDocID,
+// ReverseTransaction undoes a transaction previously applied with ProcessTransaction by
+// applying its inverse, the same tenders moving the other way, as a transaction of its
+// own, so every balance it touched returns to its prior value. The inverse goes through
+// the same checks and records as any other transaction: RejectOverdrafts applies to the
+// till it now debits, and versions, events and the settlement TTL are written as usual.
+// If t has an IdempotencyKey the inverse gets that key with reversalSuffix appended, so a
+// retried reversal is applied at most once and fails with ErrAlreadyApplied. Likewise if t
+// has a TransactionID the inverse is stored under that ID with reversalSuffix appended, in
+// the same WATCHed MULTI/EXEC as its writes, and reversing t again fails with
+// ErrAlreadyReversed. Unlike a transaction, the inverse leaves set memberships alone: a
+// reversal never registers a till, tender or denomination again, even one removed since
+// the original was applied.
+func (c Client) ReverseTransaction(ctx context.Context, t Transaction) error {
+	done, err := c.begin()
+	if err != nil {
+		return err
 	}
-	ctx := context.Background()
+	defer done()
+	return c.reverseTransaction(ctx, t)
+}
 
-	direction := 1
-	switch t.Direction {
-	case ">":
-		direction = 1
-	case "<":
-		direction = -1
-	default:
-		return fmt.Errorf("invalid direction %s", t.Direction)
+func (c Client) reverseTransaction(ctx context.Context, t Transaction) error {
+	inverse, err := reversal(t)
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	c.balancesOnly = true
+	err = c.processWithRetry(ctx, inverse)
+	c.observeTransaction("ReverseTransaction", start, inverse, err)
+	if inverse.TransactionID != "" && errors.Is(err, ErrDuplicateTransaction) {
+		return fmt.Errorf("%w: %s", ErrAlreadyReversed, t.TransactionID)
 	}
+	return err
+}
 
-	var tenderIDs []interface{}
-	for _, tender := range t.Tenders {
-		var denominationNames []interface{}
-		for _, denomination := range tender.TenderBreakdowns {
-			denominationNames = append(denominationNames, denomination.Name)
-			if err := c.HIncrByFloat(ctx, key.DenominationKey(t.Destination, tender.ID, denomination.Name), "amount", float64(direction)*denomination.Amount).Err(); err != nil {
-				return err
+var ErrAlreadyReversed = errors.New("transaction already reversed")
+
+// reversalSuffix is appended to the IdempotencyKey and TransactionID of a transaction to
+// get its reversal's.
+const reversalSuffix = "/reversal"
+
+// reversal returns the transaction undoing t.
+func reversal(t Transaction) (Transaction, error) {
+	direction, err := t.Direction.sign()
+	if err != nil {
+		return Transaction{}, err
+	}
+	t.Direction = DirectionDebit
+	if direction < 0 {
+		t.Direction = DirectionCredit
+	}
+	if t.IdempotencyKey != "" {
+		t.IdempotencyKey += reversalSuffix
+	}
+	if t.TransactionID != "" {
+		t.TransactionID += reversalSuffix
+	}
+	t.Corrects = ""
+	return t, nil
+}
+
+// PreviewTransaction returns the changes ProcessTransaction would make for t without
+// writing anything: the signed change of every tender total and denomination, ordered like
+// DeltaSettlement. It runs the same checks, so a transaction ProcessTransaction would
+// reject fails the preview with the same error.
+func (c Client) PreviewTransaction(ctx context.Context, t Transaction) ([]DenomDelta, error) {
+	_, direction, tenders, err := c.prepareTransaction(ctx, t)
+	if err != nil {
+		return nil, err
+	}
+	type deltaKey struct{ till, tender, denomination string }
+	index := make(map[deltaKey]int)
+	var deltas []DenomDelta
+	for _, delta := range transactionDeltas(t.Source, t.Destination, direction, tenders) {
+		k := deltaKey{delta.Till, delta.Tender, delta.Denomination}
+		if i, ok := index[k]; ok {
+			deltas[i].Count += delta.Count
+			deltas[i].Amount += delta.Amount
+			continue
+		}
+		index[k] = len(deltas)
+		deltas = append(deltas, delta)
+	}
+	sortDenomDeltas(deltas)
+	return deltas, nil
+}
+
+// prepareTransaction runs every check that must pass before a transaction is written and
+// returns its key, signed direction and prepared tenders. Malformed transactions are
+// rejected with ErrInvalidTransaction before anything is read or written.
+func (c Client) prepareTransaction(ctx context.Context, t Transaction) (Key, int, []Tender, error) {
+	if c.NormalizeKeys {
+		t.Org, t.EU, t.SettlementDocID = normalizeKeyComponent(t.Org), normalizeKeyComponent(t.EU), normalizeKeyComponent(t.SettlementDocID)
+	}
+	direction, err := checkTransaction(t)
+	if err != nil {
+		return Key{}, 0, nil, err
+	}
+	tenders, err := c.prepareTenders(t.Tenders)
+	if err != nil {
+		return Key{}, 0, nil, err
+	}
+
+	if err := c.checkWindow(t); err != nil {
+		return Key{}, 0, nil, err
+	}
+	key := c.NewKey(t.Org, t.EU, t.SettlementDocID)
+	if err := c.checkTillsOpen(ctx, key, t.Source, t.Destination); err != nil {
+		return Key{}, 0, nil, err
+	}
+	return key, direction, tenders, nil
+}
+
+// checkTransaction validates the parts of t outside its tenders and returns its signed
+// direction. Every key component must be non-empty.
+func checkTransaction(t Transaction) (int, error) {
+	direction, err := t.Direction.sign()
+	if err != nil {
+		return 0, err
+	}
+	for _, component := range []struct{ name, value string }{
+		{"org", t.Org},
+		{"eu", t.EU},
+		{"settlement ID", t.SettlementDocID},
+		{"source", t.Source},
+		{"destination", t.Destination},
+	} {
+		if err := checkKeyComponent(component.value); err != nil {
+			return 0, fmt.Errorf("%w: %s %v", ErrInvalidTransaction, component.name, err)
+		}
+	}
+	if t.Source == t.Destination {
+		return 0, fmt.Errorf("%w: source and destination are both %s", ErrInvalidTransaction, t.Source)
+	}
+	if t.Corrects != "" && t.TransactionID == "" {
+		return 0, fmt.Errorf("%w: correction of %s without a transaction ID", ErrInvalidTransaction, t.Corrects)
+	}
+	if t.Corrects != "" && t.Corrects == t.TransactionID {
+		return 0, fmt.Errorf("%w: transaction %s corrects itself", ErrInvalidTransaction, t.TransactionID)
+	}
+	return direction, nil
+}
+
+// checkKeyComponent rejects a value that can't be a component of a key. Separators are
+// escaped, so only an empty value is rejected.
+func checkKeyComponent(value string) error {
+	if value == "" {
+		return errors.New("is required")
+	}
+	return nil
+}
+
+// prepareTenders applies the client's pre-write processing to a transaction's tenders,
+// failing before anything is written if any tender is rejected. Amounts and counts must be
+// non-negative, the direction says which way they move, and once rounding is absorbed the
+// breakdown amounts of a tender must sum to its total. Tenders without breakdowns move
+// only a total. Currencies must be ISO 4217 codes, and breakdowns without one take their
+// tender's; unless AllowMixedCurrencies is set, every breakdown must be in its tender's
+// currency.
+func (c Client) prepareTenders(in []Tender) ([]Tender, error) {
+	if err := c.checkSize(in); err != nil {
+		return nil, err
+	}
+	tenders := make([]Tender, 0, len(in))
+	for _, tender := range in {
+		if tender.Amount < 0 {
+			return nil, fmt.Errorf("%w: tender %s has negative amount %v", ErrInvalidTransaction, tender.ID, tender.Amount)
+		}
+		if err := checkKeyComponent(tender.ID); err != nil {
+			return nil, fmt.Errorf("%w: tender ID %v", ErrInvalidTransaction, err)
+		}
+		if err := checkCurrency(tender.ID, tender.Currency); err != nil {
+			return nil, fmt.Errorf("%w: tender %s: %v", ErrInvalidTransaction, tender.ID, err)
+		}
+		breakdowns := make([]TenderInfo, len(tender.TenderBreakdowns))
+		for i, denomination := range tender.TenderBreakdowns {
+			if denomination.Count < 0 || denomination.Amount < 0 {
+				return nil, fmt.Errorf("%w: tender %s denomination %s has negative count or amount", ErrInvalidTransaction, tender.ID, denomination.Name)
 			}
-			if err := c.HIncrBy(ctx, key.DenominationKey(t.Destination, tender.ID, denomination.Name), "count", int64(direction*denomination.Count)).Err(); err != nil {
-				return err
+			if err := checkKeyComponent(denomination.Name); err != nil {
+				return nil, fmt.Errorf("%w: tender %s denomination name %v", ErrInvalidTransaction, tender.ID, err)
 			}
-			if err := c.HIncrByFloat(ctx, key.DenominationKey(t.Source, tender.ID, denomination.Name), "amount", float64(direction)*-denomination.Amount).Err(); err != nil {
-				return err
+			if err := checkCurrency(denomination.Name, denomination.Currency); err != nil {
+				return nil, fmt.Errorf("%w: tender %s denomination %s: %v", ErrInvalidTransaction, tender.ID, denomination.Name, err)
 			}
-			if err := c.HIncrBy(ctx, key.DenominationKey(t.Source, tender.ID, denomination.Name), "count", int64(direction*-denomination.Count)).Err(); err != nil {
-				return err
+			if denomination.Currency == "" {
+				denomination.Currency = tender.Currency
 			}
-
+			if denomination.Currency != tender.Currency && !c.AllowMixedCurrencies {
+				return nil, fmt.Errorf("%w: tender %s in %q has denomination %s in %q", ErrInvalidTransaction, tender.ID, tender.Currency, denomination.Name, denomination.Currency)
+			}
+			if denomination.CountOnly {
+				if denomination.Amount != 0 {
+					return nil, fmt.Errorf("%w: tender %s count-only denomination %s has amount %v", ErrInvalidTransaction, tender.ID, denomination.Name, denomination.Amount)
+				}
+			} else if err := c.checkUnitValue(denomination); err != nil {
+				return nil, fmt.Errorf("%w: tender %s: %v", ErrInvalidTransaction, tender.ID, err)
+			}
+			breakdowns[i] = denomination
 		}
-		if len(denominationNames) > 0 {
-			if err := c.SAdd(ctx, key.DenominationsSetKey(t.Source, tender.ID), denominationNames...).Err(); err != nil {
-				return err
+		if tender.TenderBreakdowns != nil {
+			tender.TenderBreakdowns = breakdowns
+		}
+		tender, err := c.absorbRounding(tender)
+		if err != nil {
+			return nil, err
+		}
+		if len(tender.TenderBreakdowns) > 0 {
+			var sum Money
+			for _, denomination := range tender.TenderBreakdowns {
+				sum += denomination.Amount
 			}
-			if err := c.SAdd(ctx, key.DenominationsSetKey(t.Destination, tender.ID), denominationNames...).Err(); err != nil {
-				return err
+			if tender.Amount != sum {
+				return nil, fmt.Errorf("%w: tender %s amount %v doesn't match its breakdowns' %v", ErrInvalidTransaction, tender.ID, tender.Amount, sum)
 			}
 		}
+		tenders = append(tenders, tender)
+	}
+	return c.mergeDuplicateTenders(tenders)
+}
 
-		// Increment dest tender
-		if err := c.IncrByFloat(ctx, key.TenderKey(t.Destination, tender.ID), float64(direction)*tender.Amount).Err(); err != nil {
-			return err
+// mergeDuplicateTenders rejects tenders listing the same stored ID twice, or merges them
+// into the first entry when the client has MergeDuplicateTenders set.
+func (c Client) mergeDuplicateTenders(tenders []Tender) ([]Tender, error) {
+	index := make(map[string]int, len(tenders))
+	merged := make([]Tender, 0, len(tenders))
+	for _, tender := range tenders {
+		tenderID := tender.StoredID()
+		i, ok := index[tenderID]
+		if !ok {
+			index[tenderID] = len(merged)
+			merged = append(merged, tender)
+			continue
 		}
-		// Decrement source tender
-		if err := c.IncrByFloat(ctx, key.TenderKey(t.Source, tender.ID), float64(direction)*-tender.Amount).Err(); err != nil {
-			return err
+		if !c.MergeDuplicateTenders {
+			return nil, fmt.Errorf("%w: tender %s is listed more than once", ErrInvalidTransaction, tenderID)
+		}
+		merged[i].Amount += tender.Amount
+		if tender.TenderBreakdowns != nil {
+			breakdowns := make([]TenderInfo, 0, len(merged[i].TenderBreakdowns)+len(tender.TenderBreakdowns))
+			merged[i].TenderBreakdowns = append(append(breakdowns, merged[i].TenderBreakdowns...), tender.TenderBreakdowns...)
+		}
+	}
+	return merged, nil
+}
+
+// writeTransaction queues on pipe the writes moving tenders from source to destination, or
+// the other way round for a direction of -1. Callers run it inside a MULTI/EXEC so the
+// writes land together or not at all. It also marks the settlement updated. Set
+// memberships are registered unless the client has balancesOnly set.
+func (c Client) writeTransaction(ctx context.Context, pipe redis.Pipeliner, key Key, source, destination string, direction int, tenders []Tender) {
+	c.writeBalances(ctx, pipe, key, source, destination, direction, tenders)
+	if !c.balancesOnly {
+		writeMemberships(ctx, pipe, key, source, destination, tenders)
+	}
+	c.touchSettlement(ctx, pipe, key)
+}
+
+// writeBalances queues the increments of writeTransaction without touching set membership.
+func (c Client) writeBalances(ctx context.Context, pipe redis.Pipeliner, key Key, source, destination string, direction int, tenders []Tender) {
+	for _, delta := range transactionDeltas(source, destination, direction, tenders) {
+		if delta.Denomination == "" {
+			pipe.IncrBy(ctx, key.TenderKey(delta.Till, delta.Tender), int64(delta.Amount))
+			continue
+		}
+		if !delta.CountOnly {
+			pipe.HIncrBy(ctx, key.DenominationKey(delta.Till, delta.Tender, delta.Denomination), "amount", int64(delta.Amount))
+		}
+		pipe.HIncrBy(ctx, key.DenominationKey(delta.Till, delta.Tender, delta.Denomination), "count", int64(delta.Count))
+	}
+
+	if len(c.ChecksumSecret) > 0 {
+		pipe.IncrBy(ctx, key.ChecksumKey(), c.transactionChecksumDelta(key, source, destination, direction, tenders))
+	}
+}
+
+// setDenomination queues the HSET writing a denomination's absolute count and amount. A
+// count-only denomination gets its count only, and any amount field is removed.
+func setDenomination(ctx context.Context, pipe redis.Pipeliner, denominationKey string, denomination TenderInfo) {
+	if denomination.CountOnly {
+		pipe.HSet(ctx, denominationKey, "count", denomination.Count)
+		pipe.HDel(ctx, denominationKey, "amount")
+		return
+	}
+	pipe.HSet(ctx, denominationKey, "count", denomination.Count, "amount", denomination.Amount)
+}
+
+// transactionDeltas returns the increments moving tenders from source to destination, or
+// the other way round for a direction of -1: each denomination and then the tender total,
+// destination first. Entries with an empty Denomination are tender totals. An empty source
+// is a one-sided adjustment of destination, see Adjust, and gets no entries.
+func transactionDeltas(source, destination string, direction int, tenders []Tender) []DenomDelta {
+	sign := Money(direction)
+	var deltas []DenomDelta
+	for _, tender := range tenders {
+		tenderID := tender.StoredID()
+		for _, denomination := range coalesceBreakdowns(tender) {
+			name := denomination.storedName(tender.Currency)
+			deltas = append(deltas, DenomDelta{Till: destination, Tender: tenderID, Denomination: name, Count: direction * denomination.Count, Amount: sign * denomination.Amount, CountOnly: denomination.CountOnly})
+			if source != "" {
+				deltas = append(deltas, DenomDelta{Till: source, Tender: tenderID, Denomination: name, Count: -direction * denomination.Count, Amount: -sign * denomination.Amount, CountOnly: denomination.CountOnly})
+			}
+		}
+		deltas = append(deltas, DenomDelta{Till: destination, Tender: tenderID, Amount: sign * tender.Amount})
+		if source != "" {
+			deltas = append(deltas, DenomDelta{Till: source, Tender: tenderID, Amount: -sign * tender.Amount})
 		}
+	}
+	return deltas
+}
 
-		tenderIDs = append(tenderIDs, tender.ID)
+// writeMemberships queues the set additions registering tenders and their denominations
+// under both tills, and both tills under the settlement. An empty source isn't registered.
+func writeMemberships(ctx context.Context, pipe redis.Pipeliner, key Key, source, destination string, tenders []Tender) {
+	tillIDs := []string{source, destination}
+	if source == "" {
+		tillIDs = tillIDs[1:]
+	}
+	var tenderIDs []interface{}
+	for _, tender := range tenders {
+		tenderID := tender.StoredID()
+		var denominationNames []interface{}
+		for _, denomination := range coalesceBreakdowns(tender) {
+			denominationNames = append(denominationNames, denomination.storedName(tender.Currency))
+		}
+		if len(denominationNames) > 0 {
+			for _, tillID := range tillIDs {
+				pipe.SAdd(ctx, key.DenominationsSetKey(tillID, tenderID), denominationNames...)
+			}
+		}
+		tenderIDs = append(tenderIDs, tenderID)
 	}
 
 	if len(tenderIDs) > 0 {
 		// Add tenders to tenders set for both source and dest
-		if err := c.SAdd(ctx, key.TendersSetKey(t.Source), tenderIDs...).Err(); err != nil {
-			return err
-		}
-		if err := c.SAdd(ctx, key.TendersSetKey(t.Destination), tenderIDs...).Err(); err != nil {
-			return err
+		for _, tillID := range tillIDs {
+			pipe.SAdd(ctx, key.TendersSetKey(tillID), tenderIDs...)
 		}
 	}
 
 	// Add source and dest to tills set
-	if err := c.SAdd(ctx, key.TillsSetKey(), t.Source, t.Destination).Err(); err != nil {
-		return err
+	members := make([]interface{}, len(tillIDs))
+	for i, tillID := range tillIDs {
+		members[i] = tillID
 	}
+	pipe.SAdd(ctx, key.TillsSetKey(), members...)
+}
 
-	return nil
+// coalesceBreakdowns merges the tender's entries stored as the same denomination by summing
+// their counts and amounts, so each denomination is incremented once. First-seen order is
+// preserved.
+func coalesceBreakdowns(tender Tender) []TenderInfo {
+	index := make(map[string]int, len(tender.TenderBreakdowns))
+	coalesced := make([]TenderInfo, 0, len(tender.TenderBreakdowns))
+	for _, denomination := range tender.TenderBreakdowns {
+		name := denomination.storedName(tender.Currency)
+		if i, ok := index[name]; ok {
+			coalesced[i].Count += denomination.Count
+			coalesced[i].Amount += denomination.Amount
+			coalesced[i].CountOnly = coalesced[i].CountOnly && denomination.CountOnly
+			continue
+		}
+		index[name] = len(coalesced)
+		coalesced = append(coalesced, denomination)
+	}
+	return coalesced
 }
 
 func main() {
-	rdb := redis.NewClient(&redis.Options{
-		Addr:     "localhost:6379",
-		Password: "", // no password set
-		DB:       0,  // use default DB
-	})
-	client := Client{rdb}
+	if err := runCLI(context.Background(), os.Args[1:], os.Stdin, os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
 
+// demo applies two sample transactions and prints the resulting settlement.
+func demo(ctx context.Context, client Client, stdout io.Writer) error {
 	// HSET org:test-org:eu:test-eu:date:08-01-2023:till:till-1:tender:tender-1:denomination:$5 bill {"amount":,"count":}
 	// SADD org:test-org:eu:test-eu:date:08-01-2023:till:till-1:tender:tender-1:denominations "$5 bill" "$10 bill"
 	// SADD org:test-org:eu:test-eu:date:08-01-2023:tills till-1 till-2
@@ -216,21 +1815,21 @@ func main() {
 			SettlementDocID: k.SettlementDocID,
 			Source:          "till-1",
 			Destination:     "till-2",
-			Direction:       ">",
+			Direction:       DirectionCredit,
 			Tenders: []Tender{
 				{
 					ID:     "cash",
-					Amount: 1.5,
+					Amount: 150,
 					TenderBreakdowns: []TenderInfo{
 						{
 							Name:   "dollar bill",
 							Count:  1,
-							Amount: 1,
+							Amount: 100,
 						},
 						{
 							Name:   "quarter",
 							Count:  2,
-							Amount: 0.5,
+							Amount: 50,
 						},
 					},
 				},
@@ -242,21 +1841,21 @@ func main() {
 			SettlementDocID: k.SettlementDocID,
 			Source:          "till-2",
 			Destination:     "till-3",
-			Direction:       ">",
+			Direction:       DirectionCredit,
 			Tenders: []Tender{
 				{
 					ID:     "cash",
-					Amount: 1.5,
+					Amount: 150,
 					TenderBreakdowns: []TenderInfo{
 						{
 							Name:   "dollar bill",
 							Count:  1,
-							Amount: 1,
+							Amount: 100,
 						},
 						{
 							Name:   "quarter",
 							Count:  2,
-							Amount: 0.5,
+							Amount: 50,
 						},
 					},
 				},
@@ -264,15 +1863,14 @@ func main() {
 		},
 	}
 
-	for _, tx := range transactions {
-		if err := client.ProcessTransaction(tx); err != nil {
-			panic(err)
-		}
+	if err := client.ProcessTransactions(ctx, transactions); err != nil {
+		return err
 	}
 
-	tills, err := client.GetExpectedTenders(context.Background(), k)
+	tills, err := client.GetExpectedTenders(ctx, k)
 	if err != nil {
-		panic(err)
+		return err
 	}
-	fmt.Printf("%+v", tills)
+	_, err = fmt.Fprintf(stdout, "%+v\n", tills)
+	return err
 }
@@ -0,0 +1,1470 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+var testKey = Key{Organization: "test-org", EnterpriseUnit: "test-eu", SettlementDocID: "settlement-1"}
+
+// newTestClient returns a client created by NewClient against a fresh miniredis, closed
+// when the test ends.
+func newTestClient(t testing.TB) (Client, *miniredis.Miniredis) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	c, err := NewClient(&redis.Options{Addr: mr.Addr()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c, mr
+}
+
+// cash returns a cash tender of amount made of one-unit bills.
+func cash(amount Money) Tender {
+	return Tender{ID: "cash", Amount: amount, TenderBreakdowns: []TenderInfo{{Name: "bill", Count: int(amount), Amount: amount}}}
+}
+
+// transfer returns a credit transaction of testKey moving tenders from source to destination.
+func transfer(source, destination string, tenders ...Tender) Transaction {
+	return Transaction{
+		Org:             testKey.Organization,
+		EU:              testKey.EnterpriseUnit,
+		SettlementDocID: testKey.SettlementDocID,
+		Source:          source,
+		Destination:     destination,
+		Direction:       DirectionCredit,
+		Tenders:         tenders,
+	}
+}
+
+// inSettlement returns tx moved to the settlement id of testKey's org/EU.
+func inSettlement(id string, tx Transaction) Transaction {
+	tx.SettlementDocID = id
+	return tx
+}
+
+// mustProcess applies txs in order, failing the test on the first error.
+func mustProcess(t testing.TB, c Client, txs ...Transaction) {
+	t.Helper()
+	for _, tx := range txs {
+		if err := c.ProcessTransaction(context.Background(), tx); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// tenderAmount returns the stored total of a tender of testKey, 0 when missing.
+func tenderAmount(t testing.TB, c Client, tillID, tenderID string) Money {
+	t.Helper()
+	amount, _, err := c.GetTenderAmount(context.Background(), testKey, tillID, tenderID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return amount
+}
+
+func TestProcessTransaction(t *testing.T) {
+	tests := []struct {
+		name      string
+		tx        Transaction
+		wantErr   error
+		wantTills []Till
+	}{
+		{
+			name: "credit",
+			tx:   transfer("till-1", "till-2", cash(150)),
+			wantTills: []Till{
+				{ID: "till-1", Tenders: []Tender{{ID: "cash", Amount: -150, TenderBreakdowns: []TenderInfo{{Name: "bill", Count: -150, Amount: -150}}}}},
+				{ID: "till-2", Tenders: []Tender{{ID: "cash", Amount: 150, TenderBreakdowns: []TenderInfo{{Name: "bill", Count: 150, Amount: 150}}}}},
+			},
+		},
+		{
+			name: "debit",
+			tx: func() Transaction {
+				tx := transfer("till-1", "till-2", Tender{ID: "card", Amount: 20})
+				tx.Direction = DirectionDebit
+				return tx
+			}(),
+			wantTills: []Till{
+				{ID: "till-1", Tenders: []Tender{{ID: "card", Amount: 20}}},
+				{ID: "till-2", Tenders: []Tender{{ID: "card", Amount: -20}}},
+			},
+		},
+		{
+			name:    "same source and destination",
+			tx:      transfer("till-1", "till-1", cash(1)),
+			wantErr: ErrInvalidTransaction,
+		},
+		{
+			name:    "negative amount",
+			tx:      transfer("till-1", "till-2", Tender{ID: "card", Amount: -1}),
+			wantErr: ErrInvalidTransaction,
+		},
+		{
+			name:    "breakdowns not summing to the amount",
+			tx:      transfer("till-1", "till-2", Tender{ID: "cash", Amount: 5, TenderBreakdowns: []TenderInfo{{Name: "bill", Count: 1, Amount: 4}}}),
+			wantErr: ErrInvalidTransaction,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := newTestClient(t)
+			ctx := context.Background()
+			err := c.ProcessTransaction(ctx, tt.tx)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("ProcessTransaction() error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr != nil {
+				return
+			}
+			tills, err := c.GetExpectedTenders(ctx, testKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(tills, tt.wantTills) {
+				t.Errorf("GetExpectedTenders() = %+v, want %+v", tills, tt.wantTills)
+			}
+		})
+	}
+}
+
+// failingHook fails every MULTI/EXEC pipeline that writes key before anything is sent,
+// as a crash between building and sending the transaction would.
+type failingHook struct{ key string }
+
+func (failingHook) DialHook(next redis.DialHook) redis.DialHook { return next }
+
+func (failingHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook { return next }
+
+func (h failingHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		for _, cmd := range cmds {
+			for _, arg := range cmd.Args() {
+				if arg == h.key {
+					return errors.New("injected failure")
+				}
+			}
+		}
+		return next(ctx, cmds)
+	}
+}
+
+// countingHook counts the MULTI/EXEC pipelines sent.
+type countingHook struct{ transactions *int }
+
+func (countingHook) DialHook(next redis.DialHook) redis.DialHook { return next }
+
+func (countingHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook { return next }
+
+func (h countingHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		if len(cmds) > 0 && strings.EqualFold(cmds[0].Name(), "multi") {
+			*h.transactions++
+		}
+		return next(ctx, cmds)
+	}
+}
+
+func TestProcessTransactionAtomic(t *testing.T) {
+	c, _ := newTestClient(t)
+	ctx := context.Background()
+	mustProcess(t, c, transfer(VaultTill, "till-1", cash(100)))
+
+	var transactions int
+	c.AddHook(countingHook{&transactions})
+	mustProcess(t, c, transfer("till-1", "till-2", cash(40)))
+	if transactions != 1 {
+		t.Errorf("transaction sent in %d MULTI/EXEC blocks, want 1", transactions)
+	}
+
+	// Fail the transaction on the destination's denomination, written after the source's
+	c.AddHook(failingHook{testKey.DenominationKey("till-3", "cash", "bill")})
+	if err := c.ProcessTransaction(ctx, transfer("till-1", "till-3", cash(10))); err == nil {
+		t.Fatal("ProcessTransaction() succeeded despite the injected failure")
+	}
+	if got := tenderAmount(t, c, "till-1", "cash"); got != 60 {
+		t.Errorf("source total = %v after failed transaction, want 60", got)
+	}
+	if _, found, err := c.GetTenderAmount(ctx, testKey, "till-3", "cash"); err != nil || found {
+		t.Errorf("destination total found = %v, err = %v after failed transaction, want none", found, err)
+	}
+	info, found, err := c.GetDenomination(ctx, testKey, "till-1", "cash", "bill")
+	if err != nil || !found || info.Count != 60 {
+		t.Errorf("source denomination = %+v, %v, %v after failed transaction, want count 60", info, found, err)
+	}
+}
+
+func TestNewClientUnreachable(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	if _, err := NewClient(&redis.Options{Addr: addr, MaxRetries: -1}); err == nil {
+		t.Error("NewClient() succeeded against a closed port")
+	}
+}
+
+func TestPing(t *testing.T) {
+	c, mr := newTestClient(t)
+	ctx := context.Background()
+	if err := c.Ping(ctx); err != nil {
+		t.Fatalf("Ping() error = %v", err)
+	}
+	replica := miniredis.RunT(t)
+	replicaAddr := replica.Addr()
+	c.ReadClient = redis.NewClient(&redis.Options{Addr: replicaAddr, MaxRetries: -1})
+	defer c.ReadClient.Close()
+	if err := c.Ping(ctx); err != nil {
+		t.Fatalf("Ping() with a ReadClient error = %v", err)
+	}
+	replica.Close()
+	if err := c.Ping(ctx); err == nil || !strings.Contains(err.Error(), replicaAddr) {
+		t.Errorf("Ping() with the ReadClient down error = %v, want one naming %s", err, replicaAddr)
+	}
+	c.ReadClient = nil
+	mr.SetError("ERR password required")
+	if err := c.Ping(ctx); err == nil {
+		t.Error("Ping() of a failing primary succeeded")
+	}
+}
+
+// setMembers returns the members of every set in mr by key.
+func setMembers(t *testing.T, mr *miniredis.Miniredis) map[string][]string {
+	t.Helper()
+	sets := make(map[string][]string)
+	for _, key := range mr.Keys() {
+		if mr.Type(key) != "set" {
+			continue
+		}
+		members, err := mr.Members(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sets[key] = members
+	}
+	return sets
+}
+
+func TestReverseTransaction(t *testing.T) {
+	tests := []struct {
+		name        string
+		client      func(c *Client)
+		tx          Transaction
+		spend       Money // Moved out of the destination before the reversal
+		close       bool  // Mark the destination closed before the reversal
+		forget      bool  // Remove the destination from the tills set before the reversal
+		wantErr     error
+		wantBalance Money // Destination balance after the reversal
+	}{
+		{
+			name: "restores balances",
+			tx:   transfer("till-1", "till-2", cash(30)),
+		},
+		{
+			name: "debit",
+			tx: func() Transaction {
+				tx := transfer("till-2", "till-1", cash(30))
+				tx.Direction = DirectionDebit
+				return tx
+			}(),
+		},
+		{
+			name:   "removed till stays removed",
+			tx:     transfer("till-1", "till-2", cash(30)),
+			forget: true,
+		},
+		{
+			name:        "overdraft rejected",
+			client:      func(c *Client) { c.RejectOverdrafts = true },
+			tx:          transfer("till-1", "till-2", cash(30)),
+			spend:       20,
+			wantErr:     ErrInsufficientTender,
+			wantBalance: 10,
+		},
+		{
+			name:        "closed till rejected",
+			client:      func(c *Client) { c.RejectClosedTills = true },
+			tx:          transfer("till-1", "till-2", cash(30)),
+			close:       true,
+			wantErr:     ErrTillClosed,
+			wantBalance: 30,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, mr := newTestClient(t)
+			ctx := context.Background()
+			if tt.client != nil {
+				tt.client(&c)
+			}
+			mustProcess(t, c, transfer(VaultTill, "till-1", cash(100)), tt.tx)
+			if tt.spend > 0 {
+				mustProcess(t, c, transfer("till-2", "till-3", cash(tt.spend)))
+			}
+			if tt.close {
+				if err := c.SAdd(ctx, testKey.ClosedTillsSetKey(), "till-2").Err(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.forget {
+				if err := c.SRem(ctx, testKey.TillsSetKey(), "till-2").Err(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			before := setMembers(t, mr)
+			if err := c.ReverseTransaction(ctx, tt.tx); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("ReverseTransaction() error = %v, want %v", err, tt.wantErr)
+			}
+			if got := tenderAmount(t, c, "till-2", "cash"); got != tt.wantBalance {
+				t.Errorf("till-2 total = %v, want %v", got, tt.wantBalance)
+			}
+			if got := setMembers(t, mr); !reflect.DeepEqual(got, before) {
+				t.Errorf("sets after the reversal = %v, want %v", got, before)
+			}
+			if tt.wantErr != nil {
+				return
+			}
+			if got := tenderAmount(t, c, "till-1", "cash"); got != 100 {
+				t.Errorf("till-1 total = %v, want 100", got)
+			}
+
+			// Applying the inverse by hand over the same memberships gives the same state
+			want, _ := newTestClient(t)
+			inverse, err := reversal(tt.tx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			mustProcess(t, want, transfer(VaultTill, "till-1", cash(100)), tt.tx, inverse)
+			if tt.forget {
+				if err := want.SRem(ctx, testKey.TillsSetKey(), "till-2").Err(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			got, err := c.GetExpectedTenders(ctx, testKey, WithReservedTills())
+			if err != nil {
+				t.Fatal(err)
+			}
+			wantTills, err := want.GetExpectedTenders(ctx, testKey, WithReservedTills())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, wantTills) {
+				t.Errorf("GetExpectedTenders() after the reversal = %+v, want %+v", got, wantTills)
+			}
+		})
+	}
+}
+
+func TestReverseTransactionRecords(t *testing.T) {
+	c, _ := newTestClient(t)
+	ctx := context.Background()
+	c.Versioning, c.EmitEvents = true, true
+	tx := transfer("till-1", "till-2", cash(30))
+	tx.IdempotencyKey = "sale-1"
+	mustProcess(t, c, tx)
+	if err := c.ReverseTransaction(ctx, tx); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.ReverseTransaction(ctx, tx); !errors.Is(err, ErrAlreadyApplied) {
+		t.Errorf("repeated ReverseTransaction() error = %v, want %v", err, ErrAlreadyApplied)
+	}
+	if version, err := c.GetSettlementVersion(ctx, testKey); err != nil || version != 2 {
+		t.Errorf("GetSettlementVersion() = %d, %v, want 2", version, err)
+	}
+	if n, err := c.XLen(ctx, testKey.EventsStreamKey()).Result(); err != nil || n != 2 {
+		t.Errorf("events = %d, %v, want 2", n, err)
+	}
+}
+
+func TestCountTills(t *testing.T) {
+	c, _ := newTestClient(t)
+	ctx := context.Background()
+	if n, err := c.CountTills(ctx, testKey); err != nil || n != 0 {
+		t.Errorf("CountTills() of a missing settlement = %d, %v, want 0", n, err)
+	}
+	mustProcess(t, c, transfer(VaultTill, "till-1", cash(10)), transfer("till-1", "till-2", cash(4)))
+	n, err := c.CountTills(ctx, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tills, err := c.ListTills(ctx, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 || int(n) != len(tills) {
+		t.Errorf("CountTills() = %d, want 2 like ListTills() %v", n, tills)
+	}
+}
+
+func TestGetTillSnapshot(t *testing.T) {
+	c, _ := newTestClient(t)
+	ctx := context.Background()
+	mustProcess(t, c,
+		transfer(VaultTill, "till-1", Tender{ID: "gift:card", Amount: 30, TenderBreakdowns: []TenderInfo{{Name: "b:10", Count: 1, Amount: 10}, {Name: "a:20", Count: 1, Amount: 20}}}),
+		transfer(VaultTill, "till-1", cash(5), Tender{ID: "stamps", TenderBreakdowns: []TenderInfo{{Name: "stamp", Count: 2, CountOnly: true}}}),
+	)
+	got, err := c.GetTillSnapshot(ctx, testKey, "till-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := c.GetTill(ctx, testKey, "till-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("GetTillSnapshot() = %+v, want %+v", got, want)
+	}
+
+	// A tender without a total reads as zero
+	if err := c.Del(ctx, testKey.TenderKey("till-1", "cash")).Err(); err != nil {
+		t.Fatal(err)
+	}
+	if got, err = c.GetTillSnapshot(ctx, testKey, "till-1"); err != nil {
+		t.Fatal(err)
+	}
+	for i := range want.Tenders {
+		if want.Tenders[i].ID == "cash" {
+			want.Tenders[i].Amount = 0
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("GetTillSnapshot() without a cash total = %+v, want %+v", got, want)
+	}
+}
+
+func TestProcessTransactionsLocks(t *testing.T) {
+	c, _ := newTestClient(t)
+	ctx := context.Background()
+	c.TillLockTTL, c.TillLockWait = time.Minute, 50*time.Millisecond
+	batch := []Transaction{transfer(VaultTill, "till-1", cash(10)), transfer("till-1", "till-2", cash(4))}
+	if err := c.Set(ctx, testKey.TillLockKey("till-2"), "other", time.Minute).Err(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.ProcessTransactions(ctx, batch); !errors.Is(err, ErrLockTimeout) {
+		t.Fatalf("ProcessTransactions() of a locked till error = %v, want %v", err, ErrLockTimeout)
+	}
+	if n, err := c.Exists(ctx, testKey.TillsSetKey(), testKey.TillLockKey("till-1")).Result(); err != nil || n != 0 {
+		t.Errorf("%d keys exist after a rejected batch, %v, want nothing written and till-1 unlocked", n, err)
+	}
+
+	if err := c.Del(ctx, testKey.TillLockKey("till-2")).Err(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.ProcessTransactions(ctx, batch); err != nil {
+		t.Fatal(err)
+	}
+	if got := tenderAmount(t, c, "till-2", "cash"); got != 4 {
+		t.Errorf("till-2 total = %v, want 4", got)
+	}
+	if n, err := c.Exists(ctx, testKey.TillLockKey("till-1"), testKey.TillLockKey("till-2")).Result(); err != nil || n != 0 {
+		t.Errorf("%d locks held after the batch, %v, want none", n, err)
+	}
+}
+
+func TestReconcilePerCurrency(t *testing.T) {
+	c, _ := newTestClient(t)
+	ctx := context.Background()
+	mustProcess(t, c, transfer(VaultTill, "till-1", Tender{ID: "cash", Currency: "EUR", Amount: 100}, Tender{ID: "cash", Currency: "JPY", Amount: 500}, cash(10)))
+	result, err := c.Reconcile(ctx, testKey, "till-1", []Tender{
+		{ID: "cash", Currency: "EUR", Amount: 103},
+		{ID: "cash", Currency: "JPY", Amount: 400},
+		cash(10),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]Money{"EUR": 3}; !reflect.DeepEqual(result.Over, want) {
+		t.Errorf("Over = %v, want %v", result.Over, want)
+	}
+	if want := map[string]Money{"JPY": 100}; !reflect.DeepEqual(result.Short, want) {
+		t.Errorf("Short = %v, want %v", result.Short, want)
+	}
+}
+
+func TestWithRawValues(t *testing.T) {
+	c, mr := newTestClient(t)
+	ctx := context.Background()
+	mustProcess(t, c, transfer(VaultTill, "till-1", cash(5)))
+	// A count written by hand with a leading zero still parses, but reads back as given
+	mr.HSet(testKey.DenominationKey("till-1", "cash", "bill"), "count", "05")
+
+	tills, err := c.GetExpectedTenders(ctx, testKey, WithRawValues())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Till{{ID: "till-1", Tenders: []Tender{{ID: "cash", Amount: 5, RawAmount: "5", TenderBreakdowns: []TenderInfo{{Name: "bill", Count: 5, Amount: 5, RawCount: "05", RawAmount: "5"}}}}}}
+	if !reflect.DeepEqual(tills, want) {
+		t.Errorf("GetExpectedTenders(WithRawValues) = %+v, want %+v", tills, want)
+	}
+	tills, err = c.GetExpectedTenders(ctx, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tender := tills[0].Tenders[0]; tender.RawAmount != "" || tender.TenderBreakdowns[0].RawCount != "" {
+		t.Errorf("GetExpectedTenders() without WithRawValues = %+v, want no raw values", tender)
+	}
+}
+
+func TestCoalesceBreakdowns(t *testing.T) {
+	c, _ := newTestClient(t)
+	ctx := context.Background()
+	repeated := Tender{ID: "cash", Amount: 9, TenderBreakdowns: []TenderInfo{
+		{Name: "bill", Count: 3, Amount: 3},
+		{Name: "coin", Count: 2, Amount: 2},
+		{Name: "bill", Count: 4, Amount: 4},
+	}}
+	if got, want := coalesceBreakdowns(repeated), []TenderInfo{{Name: "bill", Count: 7, Amount: 7}, {Name: "coin", Count: 2, Amount: 2}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("coalesceBreakdowns() = %+v, want %+v", got, want)
+	}
+
+	mustProcess(t, c, transfer(VaultTill, "till-1", repeated))
+	tender, err := c.GetTenderBreakdown(ctx, testKey, "till-1", "cash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []TenderInfo{{Name: "bill", Count: 7, Amount: 7}, {Name: "coin", Count: 2, Amount: 2}}
+	if tender.Amount != 9 || !reflect.DeepEqual(tender.TenderBreakdowns, want) {
+		t.Errorf("till-1 cash = %+v, want 9 in %+v", tender, want)
+	}
+}
+
+func TestWithDerivedTotals(t *testing.T) {
+	c, mr := newTestClient(t)
+	ctx := context.Background()
+	mustProcess(t, c, transfer(VaultTill, "till-1", cash(12)))
+	tenderKey := testKey.TenderKey("till-1", "cash")
+	// A partial write that left the denominations but not the total
+	mr.Del(tenderKey)
+
+	if _, err := c.GetExpectedTenders(ctx, testKey); err == nil {
+		t.Error("GetExpectedTenders() with a missing total succeeded")
+	}
+	for _, persist := range []bool{false, true} {
+		tills, err := c.GetExpectedTenders(ctx, testKey, WithDerivedTotals(persist))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := tills[0].Tenders[0].Amount; got != 12 {
+			t.Errorf("derived total with persist %v = %v, want 12", persist, got)
+		}
+		if got, err := mr.Get(tenderKey); persist != (err == nil) || (persist && got != "12") {
+			t.Errorf("stored total after reading with persist %v = %q, %v", persist, got, err)
+		}
+	}
+	// A stored total always wins over the denominations
+	mr.Set(tenderKey, "20")
+	tills, err := c.GetExpectedTenders(ctx, testKey, WithDerivedTotals(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := tills[0].Tenders[0].Amount; got != 20 {
+		t.Errorf("total read WithDerivedTotals = %v, want the stored 20", got)
+	}
+}
+
+func TestGetExpectedTendersReadErrors(t *testing.T) {
+	c, mr := newTestClient(t)
+	ctx := context.Background()
+	mustProcess(t, c, transfer(VaultTill, "till-1", cash(5)))
+	mr.SetError("LOADING server is loading")
+	tills, err := c.GetExpectedTenders(ctx, testKey)
+	if err == nil || !strings.Contains(err.Error(), "LOADING") || tills != nil {
+		t.Errorf("GetExpectedTenders() with failing reads = %+v, %v, want the LOADING error", tills, err)
+	}
+	mr.SetError("")
+
+	// A tender in the set without a total is an error, not a zero
+	mr.Del(testKey.TenderKey("till-1", "cash"))
+	if _, err := c.GetExpectedTenders(ctx, testKey); err == nil {
+		t.Error("GetExpectedTenders() with a missing total succeeded")
+	}
+}
+
+func TestValidationBeforeWrites(t *testing.T) {
+	valid := cash(5)
+	tests := []struct {
+		name string
+		tx   Transaction
+	}{
+		{name: "unknown direction", tx: func() Transaction {
+			tx := transfer("till-1", "till-2", valid)
+			tx.Direction = "sideways"
+			return tx
+		}()},
+		{name: "negative denomination count", tx: transfer("till-1", "till-2", valid, Tender{ID: "coins", Amount: 1, TenderBreakdowns: []TenderInfo{{Name: "coin", Count: -1, Amount: 1}}})},
+		{name: "negative amount after a valid tender", tx: transfer("till-1", "till-2", valid, Tender{ID: "card", Amount: -3})},
+		{name: "mismatched breakdowns after a valid tender", tx: transfer("till-1", "till-2", valid, Tender{ID: "coins", Amount: 2, TenderBreakdowns: []TenderInfo{{Name: "coin", Count: 1, Amount: 1}}})},
+		{name: "missing tender ID", tx: transfer("till-1", "till-2", Tender{Amount: 1})},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, mr := newTestClient(t)
+			ctx := context.Background()
+			if err := c.ProcessTransaction(ctx, tt.tx); !errors.Is(err, ErrInvalidTransaction) {
+				t.Errorf("ProcessTransaction() error = %v, want %v", err, ErrInvalidTransaction)
+			}
+			// A batch is validated whole, so its valid transactions aren't written either
+			if err := c.ProcessTransactions(ctx, []Transaction{transfer("till-1", "till-2", valid), tt.tx}); !errors.Is(err, ErrInvalidTransaction) {
+				t.Errorf("ProcessTransactions() error = %v, want %v", err, ErrInvalidTransaction)
+			}
+			if keys := mr.Keys(); len(keys) != 0 {
+				t.Errorf("rejected transactions wrote %v", keys)
+			}
+		})
+	}
+}
+
+func TestEmptyKeyComponents(t *testing.T) {
+	tests := []struct {
+		name string
+		edit func(tx *Transaction)
+	}{
+		{name: "org", edit: func(tx *Transaction) { tx.Org = "" }},
+		{name: "eu", edit: func(tx *Transaction) { tx.EU = "" }},
+		{name: "settlement ID", edit: func(tx *Transaction) { tx.SettlementDocID = "" }},
+		{name: "source", edit: func(tx *Transaction) { tx.Source = "" }},
+		{name: "destination", edit: func(tx *Transaction) { tx.Destination = "" }},
+		{name: "tender ID", edit: func(tx *Transaction) { tx.Tenders[0].ID = "" }},
+		{name: "denomination name", edit: func(tx *Transaction) { tx.Tenders[0].TenderBreakdowns[0].Name = "" }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, mr := newTestClient(t)
+			tx := transfer(VaultTill, "till-1", cash(2))
+			tt.edit(&tx)
+			if err := c.ProcessTransaction(context.Background(), tx); !errors.Is(err, ErrInvalidTransaction) || !strings.Contains(err.Error(), tt.name) {
+				t.Errorf("ProcessTransaction() error = %v, want %v naming the %s", err, ErrInvalidTransaction, tt.name)
+			}
+			if keys := mr.Keys(); len(keys) != 0 {
+				t.Errorf("rejected transaction wrote %v", keys)
+			}
+		})
+	}
+
+	// Separators are escaped, so IDs containing them are stored and read back intact
+	c, _ := newTestClient(t)
+	ctx := context.Background()
+	odd := Tender{ID: "gift:card", Amount: 3, TenderBreakdowns: []TenderInfo{{Name: "voucher:5", Count: 1, Amount: 3}}}
+	mustProcess(t, c, transfer(VaultTill, "till:1", odd))
+	till, err := c.GetTill(ctx, testKey, "till:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []Tender{odd}; !reflect.DeepEqual(till.Tenders, want) {
+		t.Errorf("till:1 tenders = %+v, want %+v", till.Tenders, want)
+	}
+}
+
+func TestTransactionSizeLimits(t *testing.T) {
+	tenders := func(n int) []Tender {
+		out := make([]Tender, n)
+		for i := range out {
+			out[i] = Tender{ID: fmt.Sprintf("tender-%d", i), Amount: 1}
+		}
+		return out
+	}
+	breakdown := func(n int) Tender {
+		tender := Tender{ID: "cash", Amount: Money(n)}
+		for i := 0; i < n; i++ {
+			tender.TenderBreakdowns = append(tender.TenderBreakdowns, TenderInfo{Name: fmt.Sprintf("d-%d", i), Count: 1, Amount: 1})
+		}
+		return tender
+	}
+	tests := []struct {
+		name                         string
+		maxTenders, maxDenominations int
+		tenders                      []Tender
+		wantErr                      error
+	}{
+		{name: "default tenders", tenders: tenders(DefaultMaxTenders)},
+		{name: "over default tenders", tenders: tenders(DefaultMaxTenders + 1), wantErr: ErrTransactionTooLarge},
+		{name: "over default denominations", tenders: []Tender{breakdown(DefaultMaxDenominations + 1)}, wantErr: ErrTransactionTooLarge},
+		{name: "configured tenders", maxTenders: 2, tenders: tenders(2)},
+		{name: "over configured tenders", maxTenders: 2, tenders: tenders(3), wantErr: ErrTransactionTooLarge},
+		// The limit is on denominations across the transaction's tenders
+		{name: "over configured denominations", maxDenominations: 3, tenders: []Tender{breakdown(2), {ID: "coins", Amount: 2, TenderBreakdowns: breakdown(2).TenderBreakdowns}}, wantErr: ErrTransactionTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, mr := newTestClient(t)
+			c.MaxTenders, c.MaxDenominations = tt.maxTenders, tt.maxDenominations
+			err := c.ProcessTransaction(context.Background(), transfer(VaultTill, "till-1", tt.tenders...))
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("ProcessTransaction() error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr != nil && len(mr.Keys()) != 0 {
+				t.Errorf("oversized transaction wrote %d keys", len(mr.Keys()))
+			}
+		})
+	}
+}
+
+func TestDuplicateTenders(t *testing.T) {
+	c, mr := newTestClient(t)
+	ctx := context.Background()
+	tx := transfer(VaultTill, "till-1", cash(3), Tender{ID: "card", Amount: 1}, cash(2))
+	err := c.ProcessTransaction(ctx, tx)
+	if !errors.Is(err, ErrInvalidTransaction) || !strings.Contains(err.Error(), "cash") {
+		t.Fatalf("ProcessTransaction() with a duplicate tender error = %v, want %v naming cash", err, ErrInvalidTransaction)
+	}
+	if keys := mr.Keys(); len(keys) != 0 {
+		t.Errorf("rejected transaction wrote %v", keys)
+	}
+	// The same tender in different currencies isn't a duplicate
+	mustProcess(t, c, transfer(VaultTill, "till-1", cash(1), Tender{ID: "cash", Currency: "EUR", Amount: 1}))
+
+	c.MergeDuplicateTenders = true
+	mustProcess(t, c, tx)
+	tender, err := c.GetTenderBreakdown(ctx, testKey, "till-1", "cash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := cash(6); !reflect.DeepEqual(tender, want) {
+		t.Errorf("till-1 cash after merging = %+v, want %+v", tender, want)
+	}
+}
+
+func TestRejectOverdrafts(t *testing.T) {
+	c, _ := newTestClient(t)
+	ctx := context.Background()
+	c.RejectOverdrafts = true
+	// Reserved pseudo-tills are never checked
+	mustProcess(t, c, transfer(VaultTill, "till-1", cash(10)))
+
+	debit := transfer("till-2", "till-1", cash(11))
+	debit.Direction = DirectionDebit // Draws on till-1
+	for _, tx := range []Transaction{transfer("till-1", "till-2", cash(11)), debit} {
+		if err := c.ProcessTransaction(ctx, tx); !errors.Is(err, ErrInsufficientTender) {
+			t.Errorf("ProcessTransaction() overdrawing till-1 error = %v, want %v", err, ErrInsufficientTender)
+		}
+		if err := c.ProcessTransactions(ctx, []Transaction{tx}); !errors.Is(err, ErrInsufficientTender) {
+			t.Errorf("ProcessTransactions() overdrawing till-1 error = %v, want %v", err, ErrInsufficientTender)
+		}
+	}
+	if err := c.ProcessTransaction(ctx, transfer("till-1", "till-2", Tender{ID: "card", Amount: 1})); !errors.Is(err, ErrInsufficientTender) {
+		t.Errorf("ProcessTransaction() of a tender till-1 doesn't hold error = %v, want %v", err, ErrInsufficientTender)
+	}
+	if got := tenderAmount(t, c, "till-1", "cash"); got != 10 {
+		t.Fatalf("till-1 cash after rejected overdrafts = %v, want 10", got)
+	}
+	// Emptying the till exactly is fine
+	mustProcess(t, c, transfer("till-1", "till-2", cash(10)))
+	if got := tenderAmount(t, c, "till-1", "cash"); got != 0 {
+		t.Errorf("till-1 cash = %v, want 0", got)
+	}
+}
+
+func TestGetExpectedTendersScan(t *testing.T) {
+	c, _ := newTestClient(t)
+	ctx := context.Background()
+	c.SScanCount = 7
+	if _, err := c.GetExpectedTendersScan(ctx, testKey); !errors.Is(err, ErrSettlementNotFound) {
+		t.Errorf("GetExpectedTendersScan() of a missing settlement error = %v, want %v", err, ErrSettlementNotFound)
+	}
+	wide := Tender{ID: "cash"}
+	for i := 0; i < 60; i++ {
+		wide.TenderBreakdowns = append(wide.TenderBreakdowns, TenderInfo{Name: fmt.Sprintf("d%02d", i), Count: 1, Amount: Money(i)})
+		wide.Amount += Money(i)
+	}
+	txs := []Transaction{transfer(VaultTill, "till-0", wide, Tender{ID: "card", Amount: 3})}
+	for i := 1; i < 40; i++ {
+		txs = append(txs, transfer(VaultTill, fmt.Sprintf("till-%d", i), cash(Money(i))))
+	}
+	if err := c.ProcessTransactions(ctx, txs); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, opts := range [][]ReadOption{nil, {WithReservedTills()}} {
+		want, err := c.GetExpectedTenders(ctx, testKey, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := c.GetExpectedTendersScan(ctx, testKey, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("GetExpectedTendersScan() = %+v, want %+v", got, want)
+		}
+	}
+}
+
+func TestParseError(t *testing.T) {
+	tests := []struct {
+		name    string
+		corrupt func(mr *miniredis.Miniredis)
+		want    ParseError
+	}{
+		{
+			name:    "tender total",
+			corrupt: func(mr *miniredis.Miniredis) { mr.Set(testKey.TenderKey("till-1", "cash"), "five") },
+			want:    ParseError{Key: testKey.TenderKey("till-1", "cash"), Value: "five"},
+		},
+		{
+			name: "denomination count",
+			corrupt: func(mr *miniredis.Miniredis) {
+				mr.HSet(testKey.DenominationKey("till-1", "cash", "bill"), "count", "1.5")
+			},
+			want: ParseError{Key: testKey.DenominationKey("till-1", "cash", "bill"), Field: "count", Value: "1.5"},
+		},
+		{
+			name: "denomination amount",
+			corrupt: func(mr *miniredis.Miniredis) {
+				mr.HSet(testKey.DenominationKey("till-1", "cash", "bill"), "amount", "")
+			},
+			want: ParseError{Key: testKey.DenominationKey("till-1", "cash", "bill"), Field: "amount"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, mr := newTestClient(t)
+			ctx := context.Background()
+			mustProcess(t, c, transfer(VaultTill, "till-1", cash(5)))
+			tt.corrupt(mr)
+			_, err := c.GetExpectedTenders(ctx, testKey)
+			var parseErr *ParseError
+			if !errors.As(err, &parseErr) {
+				t.Fatalf("GetExpectedTenders() error = %v, want a ParseError", err)
+			}
+			if parseErr.Key != tt.want.Key || parseErr.Field != tt.want.Field || parseErr.Value != tt.want.Value {
+				t.Errorf("ParseError = %+v, want %+v", *parseErr, tt.want)
+			}
+			if !errors.Is(err, strconv.ErrSyntax) {
+				t.Errorf("ParseError %v doesn't unwrap to %v", err, strconv.ErrSyntax)
+			}
+		})
+	}
+}
+
+func TestReadClient(t *testing.T) {
+	c, _ := newTestClient(t)
+	ctx := context.Background()
+	// A replica that hasn't caught up yet
+	replica := redis.NewClient(&redis.Options{Addr: miniredis.RunT(t).Addr()})
+	defer replica.Close()
+	c.ReadClient = replica
+	mustProcess(t, c, transfer(VaultTill, "till-1", cash(5)))
+
+	if _, err := c.GetExpectedTenders(ctx, testKey); !errors.Is(err, ErrSettlementNotFound) {
+		t.Errorf("GetExpectedTenders() from the lagging replica error = %v, want %v", err, ErrSettlementNotFound)
+	}
+	tills, err := c.GetExpectedTenders(ctx, testKey, WithPrimary())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tills) != 1 || tills[0].Tenders[0].Amount != 5 {
+		t.Errorf("GetExpectedTenders(WithPrimary) = %+v, want till-1 holding 5", tills)
+	}
+	// Checks made for a write read the primary
+	c.RejectOverdrafts = true
+	mustProcess(t, c, transfer("till-1", "till-2", cash(5)))
+}
+
+func TestPreviewTransaction(t *testing.T) {
+	c, mr := newTestClient(t)
+	ctx := context.Background()
+	tx := transfer("till-1", "till-2", cash(7), Tender{ID: "card", Amount: 3})
+	preview, err := c.PreviewTransaction(ctx, tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys := mr.Keys(); len(keys) != 0 {
+		t.Fatalf("PreviewTransaction() wrote %v", keys)
+	}
+	// The preview is exactly what applying the transaction changes
+	mustProcess(t, c, tx)
+	after, err := c.GetExpectedTenders(ctx, testKey, WithReservedTills())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := DeltaSettlement(nil, after); !reflect.DeepEqual(preview, want) {
+		t.Errorf("PreviewTransaction() = %+v, want %+v", preview, want)
+	}
+	if _, err := c.PreviewTransaction(ctx, transfer("till-1", "till-1", cash(1))); !errors.Is(err, ErrInvalidTransaction) {
+		t.Errorf("PreviewTransaction() of an invalid transaction error = %v, want %v", err, ErrInvalidTransaction)
+	}
+}
+
+func TestWithHScan(t *testing.T) {
+	for _, protocol := range []int{2, 3} {
+		t.Run(fmt.Sprintf("RESP%d", protocol), func(t *testing.T) {
+			mr := miniredis.RunT(t)
+			c, err := Connect(mr.Addr(), WithProtocol(protocol))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			ctx := context.Background()
+			coins := Tender{ID: "cash", Amount: 7, TenderBreakdowns: []TenderInfo{{Name: "bill", Count: 5, Amount: 5}, {Name: "coin", Count: 4, Amount: 2}}}
+			mustProcess(t, c, transfer(VaultTill, "till-1", coins), transfer(VaultTill, "till-2", cash(3)))
+
+			want, err := c.GetExpectedTenders(ctx, testKey, WithReservedTills())
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := c.GetExpectedTenders(ctx, testKey, WithReservedTills(), WithHScan(1))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("GetExpectedTenders(WithHScan(1)) = %+v, want %+v", got, want)
+			}
+			info, found, err := c.GetDenomination(ctx, testKey, "till-1", "cash", "coin")
+			if err != nil || !found || info != (TenderInfo{Name: "coin", Count: 4, Amount: 2}) {
+				t.Errorf("GetDenomination() = %+v, %v, %v, want 4 coins of 2", info, found, err)
+			}
+		})
+	}
+}
+
+func TestDirection(t *testing.T) {
+	c, _ := newTestClient(t)
+	ctx := context.Background()
+	for _, tt := range []struct {
+		typed, legacy Direction
+		wantTill      Money
+	}{
+		{typed: DirectionCredit, legacy: ">", wantTill: 14},
+		{typed: DirectionDebit, legacy: "<", wantTill: 6},
+	} {
+		var results [][]Till
+		for _, direction := range []Direction{tt.typed, tt.legacy} {
+			id := "settlement-" + string(direction)
+			tx := inSettlement(id, transfer(VaultTill, "till-1", cash(4)))
+			tx.Direction = direction
+			mustProcess(t, c, inSettlement(id, transfer(VaultTill, "till-1", cash(10))), tx)
+			key := testKey
+			key.SettlementDocID = id
+			tills, err := c.GetExpectedTenders(ctx, key, WithReservedTills())
+			if err != nil {
+				t.Fatal(err)
+			}
+			results = append(results, tills)
+			if got := tills[0].Tenders[0].Amount; tills[0].ID != "till-1" || got != tt.wantTill {
+				t.Errorf("%q: till-1 total = %v, want %v", direction, got, tt.wantTill)
+			}
+		}
+		if !reflect.DeepEqual(results[0], results[1]) {
+			t.Errorf("%q gave %+v, %q gave %+v", tt.typed, results[0], tt.legacy, results[1])
+		}
+	}
+
+	for _, direction := range []Direction{"", "sideways", ">>"} {
+		tx := transfer(VaultTill, "till-1", cash(1))
+		tx.Direction = direction
+		if err := c.ProcessTransaction(ctx, tx); !errors.Is(err, ErrInvalidTransaction) {
+			t.Errorf("ProcessTransaction() with direction %q error = %v, want %v", direction, err, ErrInvalidTransaction)
+		}
+	}
+	if _, err := c.GetExpectedTenders(ctx, testKey); !errors.Is(err, ErrSettlementNotFound) {
+		t.Errorf("GetExpectedTenders() after rejected directions error = %v, want %v", err, ErrSettlementNotFound)
+	}
+}
+
+// cancelHook cancels a context once the first command named name has been sent, counting
+// how many are.
+type cancelHook struct {
+	name   string
+	cancel context.CancelFunc
+	sent   *int
+}
+
+func (cancelHook) DialHook(next redis.DialHook) redis.DialHook { return next }
+
+func (h cancelHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		err := next(ctx, cmd)
+		if strings.EqualFold(cmd.Name(), h.name) {
+			*h.sent++
+			h.cancel()
+		}
+		return err
+	}
+}
+
+func (cancelHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return next
+}
+
+func TestGetExpectedTendersCancel(t *testing.T) {
+	c, _ := newTestClient(t)
+	for i := 0; i < 50; i++ {
+		mustProcess(t, c, transfer(VaultTill, fmt.Sprintf("till-%02d", i), cash(2)))
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var sent int
+	c.AddHook(cancelHook{name: "hscan", cancel: cancel, sent: &sent})
+
+	// Cancelled while reading the first till's hashes, the read stops issuing HSCANs
+	if _, err := c.GetExpectedTenders(ctx, testKey, WithReservedTills(), WithHScan(10)); !errors.Is(err, context.Canceled) {
+		t.Fatalf("GetExpectedTenders() error = %v, want %v", err, context.Canceled)
+	}
+	if sent != 1 {
+		t.Errorf("%d HSCANs sent, want 1 before the cancellation was noticed", sent)
+	}
+}
+
+func TestKeyTypeMismatch(t *testing.T) {
+	tests := []struct {
+		name string
+		key  string
+		set  func(mr *miniredis.Miniredis, key string)
+		want KeyTypeError
+	}{
+		{
+			name: "tills set",
+			key:  testKey.TillsSetKey(),
+			set:  func(mr *miniredis.Miniredis, key string) { mr.Set(key, "till-1") },
+			want: KeyTypeError{Expected: "set", Actual: "string"},
+		},
+		{
+			name: "denomination hash",
+			key:  testKey.DenominationKey("till-1", "cash", "bill"),
+			set:  func(mr *miniredis.Miniredis, key string) { mr.SAdd(key, "1") },
+			want: KeyTypeError{Expected: "hash", Actual: "set"},
+		},
+		{
+			name: "tender total",
+			key:  testKey.TenderKey("till-1", "cash"),
+			set:  func(mr *miniredis.Miniredis, key string) { mr.HSet(key, "amount", "1") },
+			want: KeyTypeError{Expected: "string", Actual: "hash"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, mr := newTestClient(t)
+			mustProcess(t, c, transfer(VaultTill, "till-1", cash(2)))
+			mr.Del(tt.key)
+			tt.set(mr, tt.key)
+			_, err := c.GetExpectedTenders(context.Background(), testKey)
+			var typeErr *KeyTypeError
+			if !errors.Is(err, ErrKeyTypeMismatch) || !errors.As(err, &typeErr) {
+				t.Fatalf("GetExpectedTenders() error = %v, want a *KeyTypeError", err)
+			}
+			tt.want.Key = tt.key
+			if *typeErr != tt.want {
+				t.Errorf("GetExpectedTenders() error = %+v, want %+v", *typeErr, tt.want)
+			}
+		})
+	}
+}
+
+func TestSortedReads(t *testing.T) {
+	c, _ := newTestClient(t)
+	ctx := context.Background()
+	mixed := Tender{ID: "cash", Amount: 6, TenderBreakdowns: []TenderInfo{{Name: "quarter", Count: 4, Amount: 1}, {Name: "five", Count: 1, Amount: 5}}}
+	for _, tillID := range []string{"till-c", "till-a", "till-b"} {
+		mustProcess(t, c, transfer(VaultTill, tillID, Tender{ID: "gift", Amount: 2}, mixed, Tender{ID: "card", Amount: 1}))
+	}
+	sorted := Tender{ID: "cash", Amount: 6, TenderBreakdowns: []TenderInfo{{Name: "five", Count: 1, Amount: 5}, {Name: "quarter", Count: 4, Amount: 1}}}
+	tenders := []Tender{{ID: "card", Amount: 1}, sorted, {ID: "gift", Amount: 2}}
+	want := []Till{{ID: "till-a", Tenders: tenders}, {ID: "till-b", Tenders: tenders}, {ID: "till-c", Tenders: tenders}}
+	got, err := c.GetExpectedTenders(ctx, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("GetExpectedTenders() = %+v, want %+v", got, want)
+	}
+
+	// Unsorted reads hold the same tills in whatever order Redis gives
+	if got, err = c.GetExpectedTenders(ctx, testKey, WithoutSorting()); err != nil {
+		t.Fatal(err)
+	}
+	sortTills(got)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("GetExpectedTenders(WithoutSorting()) sorted = %+v, want %+v", got, want)
+	}
+}
+
+func TestWithoutEmptyTills(t *testing.T) {
+	c, mr := newTestClient(t)
+	ctx := context.Background()
+	mustProcess(t, c, transfer(VaultTill, "till-1", cash(3)))
+	// A till left in the tills set after its tenders were cleaned up
+	mr.SAdd(testKey.TillsSetKey(), "till-shell")
+
+	got, err := c.GetExpectedTenders(ctx, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []Till{{ID: "till-1", Tenders: []Tender{cash(3)}}, {ID: "till-shell"}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("GetExpectedTenders() = %+v, want %+v", got, want)
+	}
+	if got, err = c.GetExpectedTenders(ctx, testKey, WithoutEmptyTills()); err != nil {
+		t.Fatal(err)
+	}
+	if want := []Till{{ID: "till-1", Tenders: []Tender{cash(3)}}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("GetExpectedTenders(WithoutEmptyTills()) = %+v, want %+v", got, want)
+	}
+}
+
+func TestReadFilters(t *testing.T) {
+	c, mr := newTestClient(t)
+	ctx := context.Background()
+	for _, tillID := range []string{"reg-1", "reg-2", "safe-1"} {
+		mustProcess(t, c, transfer(VaultTill, tillID, cash(4), Tender{ID: "card", Amount: 1}))
+	}
+	both := []Tender{{ID: "card", Amount: 1}, cash(4)}
+	tests := []struct {
+		name string
+		opts []ReadOption
+		want []Till
+		// Keys the read must not touch
+		untouched []string
+	}{
+		{
+			name:      "till prefix",
+			opts:      []ReadOption{WithTillPrefix("reg-")},
+			want:      []Till{{ID: "reg-1", Tenders: both}, {ID: "reg-2", Tenders: both}},
+			untouched: []string{testKey.TendersSetKey("safe-1")},
+		},
+		{
+			name:      "till allowlist",
+			opts:      []ReadOption{WithTills("safe-1", "reg-2", "missing")},
+			want:      []Till{{ID: "reg-2", Tenders: both}, {ID: "safe-1", Tenders: both}},
+			untouched: []string{testKey.TendersSetKey("reg-1")},
+		},
+		{
+			name: "prefix and allowlist",
+			opts: []ReadOption{WithTillPrefix("reg-"), WithTills("reg-2", "safe-1")},
+			want: []Till{{ID: "reg-2", Tenders: both}},
+		},
+		{
+			name:      "tenders",
+			opts:      []ReadOption{WithTills("reg-1"), WithTenders("cash")},
+			want:      []Till{{ID: "reg-1", Tenders: []Tender{cash(4)}}},
+			untouched: []string{testKey.TenderKey("reg-1", "card")},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var keys []string
+			c := c
+			c.Client = redis.NewClient(&redis.Options{Addr: mr.Addr()})
+			defer c.Client.Close()
+			c.AddHook(keysHook{keys: &keys})
+			got, err := c.GetExpectedTenders(ctx, testKey, tt.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("GetExpectedTenders() = %+v, want %+v", got, tt.want)
+			}
+			if len(keys) == 0 {
+				t.Fatal("no commands recorded")
+			}
+			for _, k := range tt.untouched {
+				for _, read := range keys {
+					if read == k {
+						t.Errorf("read %s of an excluded till or tender", k)
+					}
+				}
+			}
+		})
+	}
+}
+
+// keysHook records the first key of every command sent, pipelined or not.
+type keysHook struct{ keys *[]string }
+
+func (keysHook) DialHook(next redis.DialHook) redis.DialHook { return next }
+
+func (h keysHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		h.record(cmd)
+		return next(ctx, cmd)
+	}
+}
+
+func (h keysHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		for _, cmd := range cmds {
+			h.record(cmd)
+		}
+		return next(ctx, cmds)
+	}
+}
+
+func (h keysHook) record(cmd redis.Cmder) {
+	if args := cmd.Args(); len(args) > 1 {
+		*h.keys = append(*h.keys, fmt.Sprint(args[1]))
+	}
+}
+
+func TestNormalizeKeys(t *testing.T) {
+	c, _ := newTestClient(t)
+	ctx := context.Background()
+	c.NormalizeKeys = true
+
+	shouted := transfer(VaultTill, "till-1", cash(10))
+	shouted.Org, shouted.EU, shouted.SettlementDocID = " Test-Org", "TEST-EU ", "Settlement-1"
+	mustProcess(t, c, shouted, transfer(VaultTill, "till-1", cash(5)))
+	key := c.NewKey("TEST-ORG ", " Test-EU", "SETTLEMENT-1")
+	if key != testKey {
+		t.Errorf("NewKey() = %+v, want %+v", key, testKey)
+	}
+	if err := c.Adjust(ctx, Key{Organization: "Test-Org", EnterpriseUnit: "Test-EU", SettlementDocID: "Settlement-1"}, "till-1", "cash", 1, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := tenderAmount(t, c, "till-1", "cash"); got != 16 {
+		t.Errorf("till-1 cash = %d, want all three writes in one settlement", got)
+	}
+	if ids, err := c.ScanSettlements(ctx, "Test-Org", "Test-EU"); err != nil || !reflect.DeepEqual(ids, []string{"settlement-1"}) {
+		t.Errorf("ScanSettlements() = %v, %v, want [settlement-1]", ids, err)
+	}
+
+	// Key literals are used as given, and without NormalizeKeys nothing is folded
+	literal := Key{Organization: "Test-Org", EnterpriseUnit: "test-eu", SettlementDocID: "settlement-1"}
+	if _, err := c.GetExpectedTenders(ctx, literal); !errors.Is(err, ErrSettlementNotFound) {
+		t.Errorf("GetExpectedTenders(%+v) error = %v, want %v", literal, err, ErrSettlementNotFound)
+	}
+	c.NormalizeKeys = false
+	if key := c.NewKey("Test-Org", "test-eu", "settlement-1"); key != literal {
+		t.Errorf("NewKey() without NormalizeKeys = %+v, want %+v", key, literal)
+	}
+	mustProcess(t, c, shouted)
+	if ids, err := c.ScanSettlements(ctx, " Test-Org", "TEST-EU "); err != nil || !reflect.DeepEqual(ids, []string{"Settlement-1"}) {
+		t.Errorf("ScanSettlements() without NormalizeKeys = %v, %v, want [Settlement-1]", ids, err)
+	}
+}
+
+func FuzzKeyRoundTrip(f *testing.F) {
+	f.Add("test-org", "test-eu", "settlement-1", "till-1", "cash@EUR", "bill")
+	f.Add("a:b", "100%", "{s}", "till:1", "ca%3Ash", "")
+	f.Add("", "eu", "s", "till", "tender", "denomination")
+	formats := []*KeyFormat{nil, {HashTag: true}, {Prefix: "app", Separator: "::"}}
+	f.Fuzz(func(t *testing.T, org, eu, settlement, till, tender, denomination string) {
+		for _, format := range formats {
+			key := Key{Organization: org, EnterpriseUnit: eu, SettlementDocID: settlement, Format: format}
+			valid := org != "" && eu != "" && settlement != ""
+			for _, tt := range []struct {
+				raw  string
+				want KeyParts
+				ok   bool
+			}{
+				{key.BaseKey(), KeyParts{Key: key}, valid},
+				{key.TillsSetKey(), KeyParts{Key: key, Suffix: "tills"}, valid},
+				{key.TendersSetKey(till), KeyParts{Key: key, Till: till, Suffix: "tenders"}, valid && till != ""},
+				{key.TenderKey(till, tender), KeyParts{Key: key, Till: till, Tender: tender}, valid && till != "" && tender != ""},
+				{key.DenominationKey(till, tender, denomination), KeyParts{Key: key, Till: till, Tender: tender, Denomination: denomination}, valid && till != "" && tender != "" && denomination != ""},
+			} {
+				got, err := format.ParseKey(tt.raw)
+				if !tt.ok {
+					if !errors.Is(err, ErrMalformedKey) {
+						t.Errorf("ParseKey(%q) with an empty component = %+v, %v, want %v", tt.raw, got, err, ErrMalformedKey)
+					}
+					continue
+				}
+				if err != nil {
+					t.Errorf("ParseKey(%q) error = %v", tt.raw, err)
+				} else if !reflect.DeepEqual(got, tt.want) {
+					t.Errorf("ParseKey(%q) = %+v, want %+v", tt.raw, got, tt.want)
+				}
+			}
+		}
+	})
+}
+
+// roundTripHook counts the commands and pipelines sent, each one round trip.
+type roundTripHook struct{ roundTrips *int64 }
+
+func (roundTripHook) DialHook(next redis.DialHook) redis.DialHook { return next }
+
+func (h roundTripHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		*h.roundTrips++
+		return next(ctx, cmd)
+	}
+}
+
+func (h roundTripHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		*h.roundTrips++
+		return next(ctx, cmds)
+	}
+}
+
+// benchTender returns a tender of n denominations of one unit each.
+func benchTender(id string, n int) Tender {
+	tender := Tender{ID: id, Amount: Money(n)}
+	for i := 0; i < n; i++ {
+		tender.TenderBreakdowns = append(tender.TenderBreakdowns, TenderInfo{Name: fmt.Sprintf("d%d", i), Count: 1, Amount: 1})
+	}
+	return tender
+}
+
+// sequentialExpectedTenders reads the settlement like GetExpectedTenders did before it was
+// pipelined: one round trip per set, denomination hash and tender total.
+func sequentialExpectedTenders(ctx context.Context, c Client, key Key) ([]Till, error) {
+	tillIDs, err := c.selectedTills(ctx, key, ReadOptions{})
+	if err != nil {
+		return nil, err
+	}
+	tills := make([]Till, len(tillIDs))
+	for i, tillID := range tillIDs {
+		tills[i].ID = tillID
+		tenderIDs, err := c.SMembers(ctx, key.TendersSetKey(tillID)).Result()
+		if err != nil {
+			return nil, err
+		}
+		for _, tenderID := range tenderIDs {
+			tender, err := sequentialTender(ctx, c, key, tillID, tenderID)
+			if err != nil {
+				return nil, err
+			}
+			tills[i].Tenders = append(tills[i].Tenders, tender)
+		}
+	}
+	return finishTills(tills, ReadOptions{}), nil
+}
+
+// sequentialTender reads a tender with one HGETALL per denomination.
+func sequentialTender(ctx context.Context, c Client, key Key, tillID, tenderID string) (Tender, error) {
+	tender := tenderFromStoredID(tenderID)
+	names, err := c.SMembers(ctx, key.DenominationsSetKey(tillID, tenderID)).Result()
+	if err != nil {
+		return Tender{}, err
+	}
+	for _, name := range names {
+		denominationKey := key.DenominationKey(tillID, tenderID, name)
+		fields, err := c.HGetAll(ctx, denominationKey).Result()
+		if err != nil {
+			return Tender{}, err
+		}
+		info, err := parseDenomination(denominationKey, name, tender.Currency, fields, ReadOptions{})
+		if err != nil {
+			return Tender{}, err
+		}
+		tender.TenderBreakdowns = append(tender.TenderBreakdowns, info)
+	}
+	raw, err := c.Get(ctx, key.TenderKey(tillID, tenderID)).Result()
+	if err != nil {
+		return Tender{}, err
+	}
+	if tender.Amount, err = parseMoney(raw); err != nil {
+		return Tender{}, err
+	}
+	return tender, nil
+}
+
+// benchRead runs read b.N times, reporting its round trips per call.
+func benchRead(b *testing.B, c Client, read func() error) {
+	var roundTrips int64
+	c.AddHook(roundTripHook{&roundTrips})
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := read(); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(roundTrips)/float64(b.N), "round-trips/op")
+}
+
+func BenchmarkGetExpectedTenders(b *testing.B) {
+	ctx := context.Background()
+	setup := func(b *testing.B) Client {
+		c, _ := newTestClient(b)
+		var txs []Transaction
+		for i := 0; i < 30; i++ {
+			var tenders []Tender
+			for j := 0; j < 5; j++ {
+				tenders = append(tenders, benchTender(fmt.Sprintf("tender-%d", j), 8))
+			}
+			txs = append(txs, transfer(VaultTill, fmt.Sprintf("till-%d", i), tenders...))
+		}
+		if err := c.ProcessTransactions(ctx, txs); err != nil {
+			b.Fatal(err)
+		}
+		want, err := sequentialExpectedTenders(ctx, c, testKey)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if got, err := c.GetExpectedTenders(ctx, testKey); err != nil || !reflect.DeepEqual(got, want) {
+			b.Fatalf("GetExpectedTenders() = %+v, %v, want the sequential read %+v", got, err, want)
+		}
+		return c
+	}
+	b.Run("sequential", func(b *testing.B) {
+		c := setup(b)
+		benchRead(b, c, func() error {
+			_, err := sequentialExpectedTenders(ctx, c, testKey)
+			return err
+		})
+	})
+	b.Run("pipelined", func(b *testing.B) {
+		c := setup(b)
+		benchRead(b, c, func() error {
+			_, err := c.GetExpectedTenders(ctx, testKey)
+			return err
+		})
+	})
+}
+
+func BenchmarkDenominationReads(b *testing.B) {
+	ctx := context.Background()
+	c, _ := newTestClient(b)
+	mustProcess(b, c, transfer(VaultTill, "till-1", benchTender("cash", 20)))
+	want, err := sequentialTender(ctx, c, testKey, "till-1", "cash")
+	if err != nil {
+		b.Fatal(err)
+	}
+	sortTills([]Till{{Tenders: []Tender{want}}})
+	if got, err := c.GetTenderBreakdown(ctx, testKey, "till-1", "cash"); err != nil || !reflect.DeepEqual(got, want) {
+		b.Fatalf("GetTenderBreakdown() = %+v, %v, want the sequential read %+v", got, err, want)
+	}
+	b.Run("sequential", func(b *testing.B) {
+		benchRead(b, c, func() error {
+			_, err := sequentialTender(ctx, c, testKey, "till-1", "cash")
+			return err
+		})
+	})
+	b.Run("pipelined", func(b *testing.B) {
+		benchRead(b, c, func() error {
+			_, err := c.GetTenderBreakdown(ctx, testKey, "till-1", "cash")
+			return err
+		})
+	})
+}
+
+func BenchmarkProcessTransactions(b *testing.B) {
+	ctx := context.Background()
+	txs := make([]Transaction, 500)
+	for i := range txs {
+		txs[i] = transfer(VaultTill, fmt.Sprintf("till-%d", i%30), cash(Money(i+1)))
+	}
+	b.Run("loop", func(b *testing.B) {
+		c, _ := newTestClient(b)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			for _, tx := range txs {
+				if err := c.ProcessTransaction(ctx, tx); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+	b.Run("batch", func(b *testing.B) {
+		c, _ := newTestClient(b)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if err := c.ProcessTransactions(ctx, txs); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,646 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// forEachDenomination walks the settlement's set structure and calls fn for every
+// (till, tender, denomination) it references, without reading the denomination hashes.
+func (c Client) forEachDenomination(ctx context.Context, key Key, fn func(tillID, tenderID, name string) error) error {
+	tillIDs, err := c.SMembers(ctx, key.TillsSetKey()).Result()
+	if err != nil {
+		return err
+	}
+	for _, tillID := range tillIDs {
+		tenderIDs, err := c.SMembers(ctx, key.TendersSetKey(tillID)).Result()
+		if err != nil {
+			return err
+		}
+		for _, tenderID := range tenderIDs {
+			names, err := c.SMembers(ctx, key.DenominationsSetKey(tillID, tenderID)).Result()
+			if err != nil {
+				return err
+			}
+			for _, name := range names {
+				if err := fn(tillID, tenderID, name); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+type PartialDenom struct {
+	Key          string
+	Till         string
+	Tender       string
+	Denomination string
+	Missing      []string // Required fields absent from the hash: "count"
+}
+
+// FindPartialDenominations reports denomination hashes missing their count field, e.g.
+// left behind by a partial write. A missing amount is that of a count-only denomination,
+// see TenderInfo.CountOnly, and isn't reported.
+func (c Client) FindPartialDenominations(ctx context.Context, key Key) ([]PartialDenom, error) {
+	var partial []PartialDenom
+	err := c.forEachDenomination(ctx, key, func(tillID, tenderID, name string) error {
+		denominationKey := key.DenominationKey(tillID, tenderID, name)
+		fields, err := c.HGetAll(ctx, denominationKey).Result()
+		if err != nil {
+			return err
+		}
+		var missing []string
+		for _, field := range []string{"count"} {
+			if _, ok := fields[field]; !ok {
+				missing = append(missing, field)
+			}
+		}
+		if len(missing) > 0 {
+			partial = append(partial, PartialDenom{
+				Key:          denominationKey,
+				Till:         tillID,
+				Tender:       tenderID,
+				Denomination: name,
+				Missing:      missing,
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return partial, nil
+}
+
+type Discrepancy struct {
+	Till     string
+	Tender   string
+	Expected Money // Sum of the tender's denomination amounts
+	Actual   Money // Stored tender total
+	Delta    Money // Actual - Expected
+}
+
+// VerifyTenderConsistency reports every tender, reserved pseudo-tills included, whose
+// stored total differs from the sum of its denomination amounts. Tenders without
+// denominations, such as card tenders, only have a total and are never reported.
+func (c Client) VerifyTenderConsistency(ctx context.Context, key Key) ([]Discrepancy, error) {
+	tills, err := c.allTills(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	var discrepancies []Discrepancy
+	for _, till := range tills {
+		for _, tender := range till.Tenders {
+			if len(tender.TenderBreakdowns) == 0 {
+				continue
+			}
+			var expected Money
+			for _, denomination := range tender.TenderBreakdowns {
+				expected += denomination.Amount
+			}
+			if tender.Amount != expected {
+				discrepancies = append(discrepancies, Discrepancy{
+					Till:     till.ID,
+					Tender:   tender.StoredID(),
+					Expected: expected,
+					Actual:   tender.Amount,
+					Delta:    tender.Amount - expected,
+				})
+			}
+		}
+	}
+	return discrepancies, nil
+}
+
+// RepairTenderTotals rewrites the total of every tender reported by
+// VerifyTenderConsistency to the sum of its denomination amounts, which are taken as the
+// source of truth. Each tender is re-read and rewritten in its own WATCHed MULTI/EXEC, so
+// a concurrent transaction can't be lost, and the checksum, if maintained, is adjusted
+// for the rewritten total. It returns how many totals were rewritten.
+func (c Client) RepairTenderTotals(ctx context.Context, key Key) (int, error) {
+	done, err := c.begin()
+	if err != nil {
+		return 0, err
+	}
+	defer done()
+	discrepancies, err := c.VerifyTenderConsistency(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+	var repaired int
+	for _, d := range discrepancies {
+		ok, err := c.repairTenderTotal(ctx, key, d.Till, d.Tender)
+		if err != nil {
+			return repaired, fmt.Errorf("repair till %s tender %s: %w", d.Till, d.Tender, err)
+		}
+		if ok {
+			repaired++
+		}
+	}
+	return repaired, nil
+}
+
+// repairTenderTotal sets the tender's total to the sum of its denominations, reporting
+// whether it had to be changed.
+func (c Client) repairTenderTotal(ctx context.Context, key Key, tillID, tenderID string) (bool, error) {
+	tenderKey := key.TenderKey(tillID, tenderID)
+	denominationsKey := key.DenominationsSetKey(tillID, tenderID)
+	var repaired bool
+	err := c.watchRetry(ctx, func(tx *redis.Tx) error {
+		repaired = false
+		names, err := tx.SMembers(ctx, denominationsKey).Result()
+		if err != nil || len(names) == 0 {
+			return err
+		}
+		denominationKeys := make([]string, len(names))
+		for i, name := range names {
+			denominationKeys[i] = key.DenominationKey(tillID, tenderID, name)
+		}
+		if err := tx.Watch(ctx, denominationKeys...).Err(); err != nil {
+			return err
+		}
+		_, currency := splitCurrency(tenderID)
+		var sum Money
+		for i, denominationKey := range denominationKeys {
+			fields, err := tx.HGetAll(ctx, denominationKey).Result()
+			if err != nil {
+				return err
+			}
+			denomination, err := parseDenomination(denominationKey, names[i], currency, fields, ReadOptions{})
+			if err != nil {
+				return err
+			}
+			sum += denomination.Amount
+		}
+
+		var total Money
+		raw, err := tx.Get(ctx, tenderKey).Result()
+		switch {
+		case errors.Is(err, redis.Nil):
+		case err != nil:
+			return err
+		default:
+			if total, err = parseMoney(raw); err != nil {
+				return &ParseError{Key: tenderKey, Value: raw, Err: err}
+			}
+		}
+		if total == sum {
+			return nil
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, tenderKey, sum, redis.KeepTTL)
+			if len(c.ChecksumSecret) > 0 {
+				pipe.IncrBy(ctx, key.ChecksumKey(), c.checksumCoefficient(tenderKey, "")*int64(sum-total))
+			}
+			return nil
+		})
+		repaired = err == nil
+		return err
+	}, tenderKey, denominationsKey)
+	return repaired, err
+}
+
+// Vacuum removes denomination hashes whose count and amount are both zero, then tenders
+// left with a zero total and no denominations, along with their metadata, then tills left
+// with no tenders. Set memberships are removed along with the keys. Each tender is vacuumed in its own
+// WATCHed MULTI/EXEC so a concurrent transaction can't be lost; on conflict
+// redis.TxFailedErr is returned and Vacuum can simply be run again. removed counts the
+// keys deleted.
+func (c Client) Vacuum(ctx context.Context, key Key) (removed int64, err error) {
+	done, err := c.begin()
+	if err != nil {
+		return 0, err
+	}
+	defer done()
+	tillIDs, err := c.SMembers(ctx, key.TillsSetKey()).Result()
+	if err != nil {
+		return 0, err
+	}
+	for _, tillID := range tillIDs {
+		tenderIDs, err := c.SMembers(ctx, key.TendersSetKey(tillID)).Result()
+		if err != nil {
+			return removed, err
+		}
+		for _, tenderID := range tenderIDs {
+			n, err := c.vacuumTender(ctx, key, tillID, tenderID)
+			removed += n
+			if err != nil {
+				return removed, err
+			}
+		}
+
+		tendersKey := key.TendersSetKey(tillID)
+		err = c.Watch(ctx, func(tx *redis.Tx) error {
+			n, err := tx.SCard(ctx, tendersKey).Result()
+			if err != nil || n > 0 {
+				return err
+			}
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				pipe.SRem(ctx, key.TillsSetKey(), tillID)
+				return nil
+			})
+			return err
+		}, tendersKey)
+		if err != nil {
+			return removed, err
+		}
+	}
+	return removed, nil
+}
+
+func (c Client) vacuumTender(ctx context.Context, key Key, tillID, tenderID string) (int64, error) {
+	tenderKey := key.TenderKey(tillID, tenderID)
+	denominationsKey := key.DenominationsSetKey(tillID, tenderID)
+	var deleted []*redis.IntCmd
+	err := c.Watch(ctx, func(tx *redis.Tx) error {
+		names, err := tx.SMembers(ctx, denominationsKey).Result()
+		if err != nil {
+			return err
+		}
+		denominationKeys := make([]string, len(names))
+		for i, name := range names {
+			denominationKeys[i] = key.DenominationKey(tillID, tenderID, name)
+		}
+		if len(denominationKeys) > 0 {
+			if err := tx.Watch(ctx, denominationKeys...).Err(); err != nil {
+				return err
+			}
+		}
+
+		var zeroed []int
+		for i, denominationKey := range denominationKeys {
+			fields, err := tx.HGetAll(ctx, denominationKey).Result()
+			if err != nil {
+				return err
+			}
+			if isZeroDenomination(fields) {
+				zeroed = append(zeroed, i)
+			}
+		}
+
+		emptyTender := len(zeroed) == len(names)
+		if emptyTender {
+			raw, err := tx.Get(ctx, tenderKey).Result()
+			switch {
+			case errors.Is(err, redis.Nil):
+			case err != nil:
+				return err
+			default:
+				amount, err := parseMoney(raw)
+				emptyTender = err == nil && amount == 0
+			}
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			deleted = deleted[:0]
+			for _, i := range zeroed {
+				deleted = append(deleted, pipe.Del(ctx, denominationKeys[i]))
+				pipe.SRem(ctx, denominationsKey, names[i])
+			}
+			if emptyTender {
+				deleted = append(deleted, pipe.Del(ctx, tenderKey, denominationsKey, key.TenderMetaKey(tillID, tenderID)))
+				pipe.SRem(ctx, key.TendersSetKey(tillID), tenderID)
+			}
+			return nil
+		})
+		return err
+	}, tenderKey, denominationsKey)
+	if err != nil {
+		return 0, err
+	}
+
+	var removed int64
+	for _, cmd := range deleted {
+		removed += cmd.Val()
+	}
+	return removed, nil
+}
+
+// isZeroDenomination reports whether a denomination hash holds a zero count and amount,
+// a missing amount counting as zero. Hashes with a missing count or unparseable fields
+// are never considered zero.
+func isZeroDenomination(fields map[string]string) bool {
+	count, err := strconv.ParseInt(fields["count"], 10, 64)
+	if err != nil || count != 0 {
+		return false
+	}
+	raw, ok := fields["amount"]
+	if !ok {
+		return true
+	}
+	amount, err := parseMoney(raw)
+	return err == nil && amount == 0
+}
+
+// MigrateToMinorUnits converts a settlement written when amounts were stored as decimals
+// in major units, e.g. "12.34", to integer minor units of a currency with places decimal
+// digits, e.g. "1234" for places 2. Every tender total and denomination amount is
+// rewritten, since a legacy "12" means 12.00 and can't be told apart from a converted
+// value, so migrate each legacy settlement exactly once and while nothing else writes to
+// it. The running checksum, if kept, is recomputed afterwards. It returns how many values
+// were rewritten.
+func (c Client) MigrateToMinorUnits(ctx context.Context, key Key, places int) (int, error) {
+	done, err := c.begin()
+	if err != nil {
+		return 0, err
+	}
+	defer done()
+	scale := math.Pow10(places)
+	pipe := c.Pipeline()
+	convert := func(redisKey, field, raw string) (int64, error) {
+		value, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return 0, &ParseError{Key: redisKey, Field: field, Value: raw, Err: err}
+		}
+		return int64(math.Round(value * scale)), nil
+	}
+
+	tillIDs, err := c.SMembers(ctx, key.TillsSetKey()).Result()
+	if err != nil {
+		return 0, err
+	}
+	for _, tillID := range tillIDs {
+		tenderIDs, err := c.SMembers(ctx, key.TendersSetKey(tillID)).Result()
+		if err != nil {
+			return 0, err
+		}
+		for _, tenderID := range tenderIDs {
+			tenderKey := key.TenderKey(tillID, tenderID)
+			raw, err := c.Get(ctx, tenderKey).Result()
+			if errors.Is(err, redis.Nil) {
+				continue
+			}
+			if err != nil {
+				return 0, err
+			}
+			amount, err := convert(tenderKey, "", raw)
+			if err != nil {
+				return 0, err
+			}
+			pipe.Set(ctx, tenderKey, amount, redis.KeepTTL)
+		}
+	}
+	err = c.forEachDenomination(ctx, key, func(tillID, tenderID, name string) error {
+		denominationKey := key.DenominationKey(tillID, tenderID, name)
+		raw, err := c.HGet(ctx, denominationKey, "amount").Result()
+		if errors.Is(err, redis.Nil) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		amount, err := convert(denominationKey, "amount", raw)
+		if err != nil {
+			return err
+		}
+		pipe.HSet(ctx, denominationKey, "amount", amount)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	migrated := pipe.Len()
+	if migrated > 0 {
+		if _, err := pipe.Exec(ctx); err != nil {
+			return 0, err
+		}
+	}
+	if len(c.ChecksumSecret) > 0 {
+		if err := c.recomputeChecksum(ctx, key); err != nil {
+			return migrated, err
+		}
+	}
+	return migrated, nil
+}
+
+// recomputeChecksum rewrites the settlement's running checksum from its current tills.
+func (c Client) recomputeChecksum(ctx context.Context, key Key) error {
+	tills, err := c.allTills(ctx, key)
+	if err != nil {
+		return err
+	}
+	var checksum int64
+	for _, till := range tills {
+		checksum += c.tillChecksum(key, till.ID, till.Tenders)
+	}
+	return c.Set(ctx, key.ChecksumKey(), checksum, redis.KeepTTL).Err()
+}
+
+// MigrateKeyEscaping renames the keys of a settlement written before key components were
+// escaped, see KeyFormat.escape, to their escaped names. Only keys with a component
+// containing "%", the separator or, with HashTag, a brace are affected; every other key
+// already has its escaped name. Until a settlement is migrated, reads and writes of it miss
+// those keys. Keys are moved with RENAMENX, failing without overwriting if the escaped name
+// is taken, so migrate each settlement once and while nothing else writes to it. On a
+// cluster the old and new names must hash to one slot, which they don't when an escaped
+// character is in the organization, enterprise unit or settlement ID. The running checksum,
+// if kept, is recomputed afterwards. It returns how many keys were renamed.
+func (c Client) MigrateKeyEscaping(ctx context.Context, key Key) (int, error) {
+	done, err := c.begin()
+	if err != nil {
+		return 0, err
+	}
+	defer done()
+	legacy := key
+	legacy.Format = key.Format.legacyFormat()
+	names, err := c.settlementKeysAs(ctx, legacy, legacy, key)
+	if err != nil {
+		return 0, err
+	}
+
+	var from, to []string
+	for i, old := range names[0] {
+		if old != names[1][i] {
+			from, to = append(from, old), append(to, names[1][i])
+		}
+	}
+	if len(from) == 0 {
+		return 0, nil
+	}
+	exists := make([]*redis.IntCmd, len(from))
+	if _, err := c.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, old := range from {
+			exists[i] = pipe.Exists(ctx, old)
+		}
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+	var renamed int
+	for i, old := range from {
+		if exists[i].Val() == 0 {
+			continue
+		}
+		ok, err := c.RenameNX(ctx, old, to[i]).Result()
+		if err != nil {
+			return renamed, fmt.Errorf("rename %s: %w", old, err)
+		}
+		if !ok {
+			return renamed, fmt.Errorf("rename %s: %s already exists", old, to[i])
+		}
+		renamed++
+	}
+	if renamed > 0 && len(c.ChecksumSecret) > 0 {
+		// The checksum weighs every value by its key's name
+		if err := c.recomputeChecksum(ctx, key); err != nil {
+			return renamed, err
+		}
+	}
+	return renamed, nil
+}
+
+// danglingMember is a set member naming a key that doesn't exist.
+type danglingMember struct {
+	set, member, key string
+}
+
+// findOrphans scans the settlement's keys and cross-checks them against its set
+// structure. orphans are till-level keys no set references; dangling are tender and
+// denomination set members whose tender total or denomination hash doesn't exist. The
+// children of a dangling tender are reported as orphans.
+func (c Client) findOrphans(ctx context.Context, key Key) (orphans []string, dangling []danglingMember, err error) {
+	existing := make(map[string]struct{})
+	match := globEscaper.Replace(key.BaseKey()+key.Format.separator()) + "*"
+	var cursor uint64
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, nil, err
+		}
+		keys, next, err := c.Scan(ctx, cursor, match, scanCount).Result()
+		if err != nil {
+			return nil, nil, fmt.Errorf("scan settlement %s: %w", key.SettlementDocID, err)
+		}
+		for _, k := range keys {
+			existing[k] = struct{}{}
+		}
+		if next == 0 {
+			break
+		}
+		cursor = next
+	}
+
+	referenced := make(map[string]struct{})
+	tillIDs, err := c.SMembers(ctx, key.TillsSetKey()).Result()
+	if err != nil {
+		return nil, nil, fmt.Errorf("read tills of settlement %s: %w", key.SettlementDocID, err)
+	}
+	pipe := c.Pipeline()
+	tenderCmds := make([]*redis.StringSliceCmd, len(tillIDs))
+	for i, tillID := range tillIDs {
+		referenced[key.TendersSetKey(tillID)] = struct{}{}
+		tenderCmds[i] = pipe.SMembers(ctx, key.TendersSetKey(tillID))
+	}
+	if len(tenderCmds) > 0 {
+		if _, err := pipe.Exec(ctx); err != nil {
+			return nil, nil, fmt.Errorf("read tenders of settlement %s: %w", key.SettlementDocID, err)
+		}
+	}
+
+	var owners, tenderIDs []string
+	var denominationCmds []*redis.StringSliceCmd
+	for i, cmd := range tenderCmds {
+		tillID := tillIDs[i]
+		for _, tenderID := range cmd.Val() {
+			tenderKey := key.TenderKey(tillID, tenderID)
+			if _, ok := existing[tenderKey]; !ok {
+				dangling = append(dangling, danglingMember{set: key.TendersSetKey(tillID), member: tenderID, key: tenderKey})
+				continue
+			}
+			referenced[tenderKey] = struct{}{}
+			referenced[key.DenominationsSetKey(tillID, tenderID)] = struct{}{}
+			referenced[key.TenderMetaKey(tillID, tenderID)] = struct{}{}
+			owners = append(owners, tillID)
+			tenderIDs = append(tenderIDs, tenderID)
+			denominationCmds = append(denominationCmds, pipe.SMembers(ctx, key.DenominationsSetKey(tillID, tenderID)))
+		}
+	}
+	if len(denominationCmds) > 0 {
+		if _, err := pipe.Exec(ctx); err != nil {
+			return nil, nil, fmt.Errorf("read denominations of settlement %s: %w", key.SettlementDocID, err)
+		}
+	}
+	for i, cmd := range denominationCmds {
+		for _, name := range cmd.Val() {
+			denominationKey := key.DenominationKey(owners[i], tenderIDs[i], name)
+			if _, ok := existing[denominationKey]; !ok {
+				dangling = append(dangling, danglingMember{set: key.DenominationsSetKey(owners[i], tenderIDs[i]), member: name, key: denominationKey})
+				continue
+			}
+			referenced[denominationKey] = struct{}{}
+		}
+	}
+
+	for k := range existing {
+		parts, err := key.Format.ParseKey(k)
+		if err != nil || parts.Till == "" || parts.Suffix == "lock" {
+			// Settlement-level keys, till locks and keys of other layouts are never orphans
+			continue
+		}
+		if _, ok := referenced[k]; !ok {
+			orphans = append(orphans, k)
+		}
+	}
+	sort.Strings(orphans)
+	return orphans, dangling, nil
+}
+
+// FindOrphans reports the settlement's orphaned keys, e.g. left by a partial write: tenders
+// sets, tender totals, denomination sets and hashes no set references, and, for a tender
+// or denomination set member whose total or hash doesn't exist, the key it refers to.
+// Keys are found with SCAN. Like DeleteSettlement it isn't atomic, so a transaction
+// applied while it runs may be reported.
+func (c Client) FindOrphans(ctx context.Context, key Key) ([]string, error) {
+	orphans, dangling, err := c.findOrphans(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	for _, member := range dangling {
+		orphans = append(orphans, member.key)
+	}
+	sort.Strings(orphans)
+	return orphans, nil
+}
+
+// CleanOrphans deletes the orphaned keys FindOrphans reports and removes dangling members
+// from their sets, returning how many keys and members were removed. Run it only while the
+// settlement isn't taking transactions: a key created during the scan could be mistaken
+// for an orphan.
+func (c Client) CleanOrphans(ctx context.Context, key Key) (removed int64, err error) {
+	done, err := c.begin()
+	if err != nil {
+		return 0, err
+	}
+	defer done()
+	orphans, dangling, err := c.findOrphans(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+	if len(orphans) == 0 && len(dangling) == 0 {
+		return 0, nil
+	}
+	pipe := c.Pipeline()
+	var cmds []*redis.IntCmd
+	if len(orphans) > 0 {
+		cmds = append(cmds, pipe.Del(ctx, orphans...))
+	}
+	for _, member := range dangling {
+		cmds = append(cmds, pipe.SRem(ctx, member.set, member.member))
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return 0, fmt.Errorf("clean orphans of settlement %s: %w", key.SettlementDocID, err)
+	}
+	for _, cmd := range cmds {
+		removed += cmd.Val()
+	}
+	return removed, nil
+}
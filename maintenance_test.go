@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sort"
+	"strconv"
+	"testing"
+)
+
+func TestFindPartialDenominations(t *testing.T) {
+	c, mr := newTestClient(t)
+	ctx := context.Background()
+	mustProcess(t, c, transfer("till-2", "till-1", cash(5), Tender{ID: "stamps", TenderBreakdowns: []TenderInfo{{Name: "stamp", Count: 2, CountOnly: true}}}))
+	if got, err := c.FindPartialDenominations(ctx, testKey); err != nil || len(got) != 0 {
+		t.Errorf("FindPartialDenominations() = %+v, %v, want none; count-only denominations have no amount", got, err)
+	}
+
+	// A partial write that left only the amount
+	denominationKey := testKey.DenominationKey("till-1", "cash", "bill")
+	mr.HDel(denominationKey, "count")
+	got, err := c.FindPartialDenominations(ctx, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []PartialDenom{{Key: denominationKey, Till: "till-1", Tender: "cash", Denomination: "bill", Missing: []string{"count"}}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("FindPartialDenominations() = %+v, want %+v", got, want)
+	}
+}
+
+func TestFloatDrift(t *testing.T) {
+	c, mr := newTestClient(t)
+	ctx := context.Background()
+	mustProcess(t, c, transfer(VaultTill, "till-1", cash(1)))
+	// Legacy HINCRBYFLOAT values in major units, drifted
+	tenderKey, denominationKey := testKey.TenderKey("till-1", "cash"), testKey.DenominationKey("till-1", "cash", "bill")
+	mr.Set(tenderKey, "12.340000000001")
+	mr.HSet(denominationKey, "amount", "12.339999999999")
+	// Amounts are integer minor units, so drift is never read as a near-miss amount
+	var parseErr *ParseError
+	if _, err := c.GetExpectedTenders(ctx, testKey); !errors.As(err, &parseErr) {
+		t.Fatalf("GetExpectedTenders() of a drifted amount error = %v, want a ParseError", err)
+	}
+
+	if _, err := c.MigrateToMinorUnits(ctx, testKey, 2); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := mr.Get(tenderKey); got != "1234" {
+		t.Errorf("migrated tender total = %q, want 1234", got)
+	}
+	if got := mr.HGet(denominationKey, "amount"); got != "1234" {
+		t.Errorf("migrated denomination amount = %q, want 1234", got)
+	}
+}
+
+func TestVerifyTenderConsistency(t *testing.T) {
+	c, mr := newTestClient(t)
+	ctx := context.Background()
+	mustProcess(t, c, transfer(VaultTill, "till-1", cash(50), Tender{ID: "card", Amount: 8}))
+	if got, err := c.VerifyTenderConsistency(ctx, testKey); err != nil || len(got) != 0 {
+		t.Errorf("VerifyTenderConsistency() = %+v, %v, want none", got, err)
+	}
+	mr.Set(testKey.TenderKey("till-1", "cash"), "48")
+	mr.Set(testKey.TenderKey("till-1", "card"), "1") // Only a total, nothing to check it against
+	mr.Set(testKey.TenderKey(VaultTill, "cash"), "-51")
+
+	got, err := c.VerifyTenderConsistency(ctx, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Discrepancy{
+		{Till: "till-1", Tender: "cash", Expected: 50, Actual: 48, Delta: -2},
+		{Till: VaultTill, Tender: "cash", Expected: -50, Actual: -51, Delta: -1},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("VerifyTenderConsistency() = %+v, want %+v", got, want)
+	}
+}
+
+func TestFindOrphans(t *testing.T) {
+	c, mr := newTestClient(t)
+	ctx := context.Background()
+	mustProcess(t, c, transfer(VaultTill, "till-1", cash(5)))
+	if orphans, err := c.FindOrphans(ctx, testKey); err != nil || len(orphans) != 0 {
+		t.Fatalf("FindOrphans() of a consistent settlement = %v, %v, want none", orphans, err)
+	}
+
+	// A hash no denomination set lists, and a tender listed without its total
+	orphan := testKey.DenominationKey("till-1", "cash", "coin")
+	mr.HSet(orphan, "count", "1", "amount", "1")
+	mr.SAdd(testKey.TendersSetKey("till-1"), "card")
+	orphans, err := c.FindOrphans(ctx, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{orphan, testKey.TenderKey("till-1", "card")}
+	sort.Strings(want)
+	if !reflect.DeepEqual(orphans, want) {
+		t.Errorf("FindOrphans() = %v, want %v", orphans, want)
+	}
+
+	removed, err := c.CleanOrphans(ctx, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 2 {
+		t.Errorf("CleanOrphans() removed %d, want the hash and the tenders set member", removed)
+	}
+	if orphans, err := c.FindOrphans(ctx, testKey); err != nil || len(orphans) != 0 {
+		t.Errorf("FindOrphans() after CleanOrphans() = %v, %v, want none", orphans, err)
+	}
+	till, err := c.GetTill(ctx, testKey, "till-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tenders := []Tender{cash(5)}; !reflect.DeepEqual(till.Tenders, tenders) {
+		t.Errorf("till-1 tenders after CleanOrphans() = %+v, want %+v", till.Tenders, tenders)
+	}
+}
+
+func TestRepairTenderTotals(t *testing.T) {
+	c, mr := newTestClient(t)
+	ctx := context.Background()
+	c.ChecksumSecret = []byte("secret")
+	mustProcess(t, c, transfer(VaultTill, "till-1", cash(50), Tender{ID: "card", Amount: 8}))
+	if n, err := c.RepairTenderTotals(ctx, testKey); err != nil || n != 0 {
+		t.Errorf("RepairTenderTotals() of a consistent settlement = %d, %v, want 0", n, err)
+	}
+
+	// Corrupt two cash totals in a way the checksum tracked, as a buggy writer would
+	checksum, err := c.Get(ctx, testKey.ChecksumKey()).Int64()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for tenderKey, delta := range map[string]Money{
+		testKey.TenderKey("till-1", "cash"):  -2,
+		testKey.TenderKey(VaultTill, "cash"): -1,
+		testKey.TenderKey("till-1", "card"):  -7, // Only a total, nothing to repair it from
+	} {
+		if err := c.IncrBy(ctx, tenderKey, int64(delta)).Err(); err != nil {
+			t.Fatal(err)
+		}
+		checksum += c.checksumCoefficient(tenderKey, "") * int64(delta)
+	}
+	mr.Set(testKey.ChecksumKey(), strconv.FormatInt(checksum, 10))
+
+	n, err := c.RepairTenderTotals(ctx, testKey)
+	if err != nil || n != 2 {
+		t.Fatalf("RepairTenderTotals() = %d, %v, want 2", n, err)
+	}
+	for till, want := range map[string]string{"till-1": "50", VaultTill: "-50"} {
+		if got, _ := mr.Get(testKey.TenderKey(till, "cash")); got != want {
+			t.Errorf("%s cash total = %s, want %s", till, got, want)
+		}
+	}
+	if got, _ := mr.Get(testKey.TenderKey("till-1", "card")); got != "1" {
+		t.Errorf("card total = %s, want it left alone", got)
+	}
+	if got, err := c.VerifyTenderConsistency(ctx, testKey); err != nil || len(got) != 0 {
+		t.Errorf("VerifyTenderConsistency() after repair = %+v, %v, want none", got, err)
+	}
+	if ok, err := c.VerifyChecksum(ctx, testKey); err != nil || !ok {
+		t.Errorf("VerifyChecksum() after repair = %t, %v, want true", ok, err)
+	}
+
+	missing := testKey
+	missing.SettlementDocID = "missing"
+	if n, err := c.RepairTenderTotals(ctx, missing); err != nil || n != 0 {
+		t.Errorf("RepairTenderTotals() of a missing settlement = %d, %v, want 0", n, err)
+	}
+}
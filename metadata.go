@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// stampTendersScript records when tenders were written using the server's clock, so app
+// instances with skewed clocks still agree on the order of movements.
+//
+// KEYS: the tender metadata hashes. ARGV: the source system, empty to leave it unchanged.
+var stampTendersScript = redis.NewScript(`
+local t = redis.call('TIME')
+local now = t[1] * 1000 + math.floor(t[2] / 1000)
+for _, k in ipairs(KEYS) do
+	redis.call('HSETNX', k, 'created_at', now)
+	redis.call('HSET', k, 'updated_at', now)
+	if ARGV[1] ~= '' then
+		redis.call('HSET', k, 'source_system', ARGV[1])
+	end
+end
+return 0
+`)
+
+// writeTenderMetadata queues on pipe the stamping of every tender's metadata on both
+// tills. The script is sent in full rather than by SHA, since inside MULTI/EXEC a NOSCRIPT
+// reply couldn't be retried.
+func writeTenderMetadata(ctx context.Context, pipe redis.Pipeliner, key Key, source, destination string, tenders []Tender, sourceSystem string) {
+	var keys []string
+	for _, tender := range tenders {
+		tenderID := tender.StoredID()
+		keys = append(keys, key.TenderMetaKey(destination, tenderID))
+		if source != "" {
+			keys = append(keys, key.TenderMetaKey(source, tenderID))
+		}
+	}
+	if len(keys) > 0 {
+		stampTendersScript.Eval(ctx, pipe, keys, sourceSystem)
+	}
+}
+
+// parseTenderMetadata fills the metadata fields of tender from its metadata hash. Fields
+// that are missing or unparsable are left zero, since metadata is informational only.
+func parseTenderMetadata(tender *Tender, fields map[string]string) {
+	if ms, err := strconv.ParseInt(fields["created_at"], 10, 64); err == nil {
+		tender.CreatedAt = time.UnixMilli(ms)
+	}
+	if ms, err := strconv.ParseInt(fields["updated_at"], 10, 64); err == nil {
+		tender.UpdatedAt = time.UnixMilli(ms)
+	}
+	tender.SourceSystem = fields["source_system"]
+}
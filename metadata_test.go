@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestTenderMetadata(t *testing.T) {
+	c, mr := newTestClient(t)
+	ctx := context.Background()
+	c.TenderMetadata = true
+	start := time.Date(2026, 3, 2, 9, 0, 0, 0, time.UTC)
+	mr.SetTime(start)
+	first := transfer(VaultTill, "till-1", cash(5))
+	first.SourceSystem = "pos"
+	mustProcess(t, c, first)
+
+	// Timestamps come from the server's clock, and a transaction without a source system
+	// leaves the last one in place
+	later := start.Add(time.Minute)
+	mr.SetTime(later)
+	mustProcess(t, c, transfer(VaultTill, "till-1", cash(2)))
+
+	tender, err := c.GetTenderBreakdown(ctx, testKey, "till-1", "cash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !tender.CreatedAt.Equal(start) || !tender.UpdatedAt.Equal(later) || tender.SourceSystem != "pos" {
+		t.Errorf("till-1 cash metadata = created %v, updated %v, source %q, want %v, %v, %q", tender.CreatedAt, tender.UpdatedAt, tender.SourceSystem, start, later, "pos")
+	}
+	tills, err := c.GetExpectedTenders(ctx, testKey, WithReservedTills())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, till := range tills {
+		if got := till.Tenders[0]; !got.UpdatedAt.Equal(later) {
+			t.Errorf("%s cash updated %v, want %v", till.ID, got.UpdatedAt, later)
+		}
+	}
+
+	// Without the option nothing is stamped or read
+	c.TenderMetadata = false
+	mustProcess(t, c, transfer(VaultTill, "till-2", cash(1)))
+	if tender, err = c.GetTenderBreakdown(ctx, testKey, "till-2", "cash"); err != nil {
+		t.Fatal(err)
+	}
+	if !tender.CreatedAt.IsZero() || !tender.UpdatedAt.IsZero() {
+		t.Errorf("till-2 cash metadata = created %v, updated %v, want none", tender.CreatedAt, tender.UpdatedAt)
+	}
+}
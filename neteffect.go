@@ -0,0 +1,67 @@
+package main
+
+import "fmt"
+
+// ComputeNetEffect returns the tills that applying txs in order to an empty settlement
+// would produce, computed in memory with the same validation and deltas as
+// ProcessTransaction on a default client. Like the sets ProcessTransaction maintains, every
+// till, tender and denomination a transaction touches is listed even if it nets to zero.
+// Tills, tenders and denominations are sorted by their stored IDs and names.
+func ComputeNetEffect(txs []Transaction) ([]Till, error) {
+	type tenderTotals struct {
+		amount        Money
+		denominations map[string]*TenderInfo
+	}
+	balances := make(map[string]map[string]*tenderTotals)
+	for i, t := range txs {
+		direction, err := checkTransaction(t)
+		if err != nil {
+			return nil, fmt.Errorf("transaction %d: %w", i, err)
+		}
+		tenders, err := (Client{}).prepareTenders(t.Tenders)
+		if err != nil {
+			return nil, fmt.Errorf("transaction %d: %w", i, err)
+		}
+		for _, tillID := range []string{t.Source, t.Destination} {
+			if balances[tillID] == nil {
+				balances[tillID] = make(map[string]*tenderTotals)
+			}
+		}
+		for _, delta := range transactionDeltas(t.Source, t.Destination, direction, tenders) {
+			totals, ok := balances[delta.Till][delta.Tender]
+			if !ok {
+				totals = &tenderTotals{denominations: make(map[string]*TenderInfo)}
+				balances[delta.Till][delta.Tender] = totals
+			}
+			if delta.Denomination == "" {
+				totals.amount += delta.Amount
+				continue
+			}
+			denomination, ok := totals.denominations[delta.Denomination]
+			if !ok {
+				_, currency := splitCurrency(delta.Tender)
+				info := denominationFromStoredName(delta.Denomination, currency)
+				denomination = &info
+				totals.denominations[delta.Denomination] = denomination
+			}
+			denomination.Count += delta.Count
+			denomination.Amount += delta.Amount
+		}
+	}
+
+	tills := make([]Till, 0, len(balances))
+	for _, tillID := range sortedKeys(balances) {
+		till := Till{ID: tillID}
+		for _, tenderID := range sortedKeys(balances[tillID]) {
+			totals := balances[tillID][tenderID]
+			tender := tenderFromStoredID(tenderID)
+			tender.Amount = totals.amount
+			for _, name := range sortedKeys(totals.denominations) {
+				tender.TenderBreakdowns = append(tender.TenderBreakdowns, *totals.denominations[name])
+			}
+			till.Tenders = append(till.Tenders, tender)
+		}
+		tills = append(tills, till)
+	}
+	return tills, nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import "time"
+
+// Observer receives timings of the client's operations, e.g. to feed metrics or tracing.
+// Callbacks run synchronously on the calling goroutine, so they should be quick.
+type Observer interface {
+	// OnTransaction is called after ProcessTransaction with how long it took and its result.
+	OnTransaction(duration time.Duration, err error)
+	// OnQuery is called after GetExpectedTenders and GetExpectedTendersScan with the number of
+	// keys read, how long the read took and its result. keyCount is 0 when the read failed.
+	OnQuery(keyCount int, duration time.Duration, err error)
+}
+
+// PhaseObserver may be implemented by an Observer to also learn how the time of
+// GetExpectedTenders splits between waiting on Redis and parsing and assembling the
+// replies. OnQueryPhases is called right after OnQuery.
+type PhaseObserver interface {
+	OnQueryPhases(network, parse time.Duration, err error)
+}
+
+type noopObserver struct{}
+
+func (noopObserver) OnTransaction(time.Duration, error) {}
+func (noopObserver) OnQuery(int, time.Duration, error)  {}
+
+func (c Client) observer() Observer {
+	if c.Observer != nil {
+		return c.Observer
+	}
+	return noopObserver{}
+}
+
+// Metrics receives counters and durations, e.g. to export to Prometheus. Labels are
+// passed as a map of label name to value; the names used are "operation", the method
+// name, and "result", "success" or "failure".
+type Metrics interface {
+	IncCounter(name string, value int, labels map[string]string)
+	ObserveDuration(name string, d time.Duration, labels map[string]string)
+}
+
+// Metric names reported to Client.Metrics.
+const (
+	MetricTransactions         = "transactions_total"             // Labels operation, result
+	MetricDenominationsWritten = "denominations_written_total"    // Labels operation; counts the hashes a transaction's breakdowns increment
+	MetricTransactionDuration  = "transaction_duration_seconds"   // Labels operation, result
+	MetricQueryDuration        = "query_duration_seconds"         // Labels operation, result
+	MetricQueryNetworkDuration = "query_network_duration_seconds" // Labels operation, result; time spent waiting on Redis
+	MetricQueryParseDuration   = "query_parse_duration_seconds"   // Labels operation, result; time spent parsing replies
+	MetricMarkersPruned        = "markers_pruned_total"           // Labels result; expired markers removed by the marker janitor
+)
+
+type noopMetrics struct{}
+
+func (noopMetrics) IncCounter(string, int, map[string]string)                {}
+func (noopMetrics) ObserveDuration(string, time.Duration, map[string]string) {}
+
+func (c Client) metrics() Metrics {
+	if c.Metrics != nil {
+		return c.Metrics
+	}
+	return noopMetrics{}
+}
+
+func resultLabel(err error) string {
+	if err != nil {
+		return "failure"
+	}
+	return "success"
+}
+
+// observeTransaction reports a transaction started at start to the observer and metrics.
+func (c Client) observeTransaction(operation string, start time.Time, t Transaction, err error) {
+	d := time.Since(start)
+	c.observer().OnTransaction(d, err)
+	labels := map[string]string{"operation": operation, "result": resultLabel(err)}
+	m := c.metrics()
+	m.IncCounter(MetricTransactions, 1, labels)
+	m.ObserveDuration(MetricTransactionDuration, d, labels)
+	if err == nil {
+		var written int
+		for _, tender := range t.Tenders {
+			written += 2 * len(coalesceBreakdowns(tender))
+		}
+		m.IncCounter(MetricDenominationsWritten, written, map[string]string{"operation": operation})
+	}
+}
+
+// observeQuery reports a read of tills started at start to the observer and metrics.
+func (c Client) observeQuery(operation string, start time.Time, tills []Till, err error) {
+	d := time.Since(start)
+	keyCount := 0
+	if err == nil {
+		keyCount = tillsKeyCount(tills)
+	}
+	c.observer().OnQuery(keyCount, d, err)
+	c.metrics().ObserveDuration(MetricQueryDuration, d, map[string]string{"operation": operation, "result": resultLabel(err)})
+}
+
+// tillsKeyCount is the number of keys read to assemble tills: the settlement's tills set,
+// plus each till's tenders set and each tender's total, denominations set and hashes.
+func tillsKeyCount(tills []Till) int {
+	n := 1
+	for _, till := range tills {
+		n++
+		for _, tender := range till.Tenders {
+			n += 2 + len(tender.TenderBreakdowns)
+		}
+	}
+	return n
+}
+
+// queryTiming accumulates the network and parse time of a read. Its methods do nothing on
+// a nil queryTiming, so reads not being timed pass none.
+type queryTiming struct {
+	network, parse time.Duration
+}
+
+func (t *queryTiming) addNetwork(start time.Time) {
+	if t != nil {
+		t.network += time.Since(start)
+	}
+}
+
+func (t *queryTiming) addParse(start time.Time) {
+	if t != nil {
+		t.parse += time.Since(start)
+	}
+}
+
+// observePhases reports the phases of a timed read to a PhaseObserver and the metrics.
+func (c Client) observePhases(operation string, t *queryTiming, err error) {
+	if o, ok := c.observer().(PhaseObserver); ok {
+		o.OnQueryPhases(t.network, t.parse, err)
+	}
+	labels := map[string]string{"operation": operation, "result": resultLabel(err)}
+	m := c.metrics()
+	m.ObserveDuration(MetricQueryNetworkDuration, t.network, labels)
+	m.ObserveDuration(MetricQueryParseDuration, t.parse, labels)
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type observedCall struct {
+	keyCount int
+	err      error
+}
+
+// recordingObserver records every callback, timings included.
+type recordingObserver struct {
+	transactions, queries []observedCall
+	durations             []time.Duration
+}
+
+func (o *recordingObserver) OnTransaction(d time.Duration, err error) {
+	o.transactions = append(o.transactions, observedCall{err: err})
+	o.durations = append(o.durations, d)
+}
+
+func (o *recordingObserver) OnQuery(keyCount int, d time.Duration, err error) {
+	o.queries = append(o.queries, observedCall{keyCount: keyCount, err: err})
+	o.durations = append(o.durations, d)
+}
+
+func TestObserver(t *testing.T) {
+	c, _ := newTestClient(t)
+	ctx := context.Background()
+	o := &recordingObserver{}
+	c.Observer = o
+
+	mustProcess(t, c, transfer(VaultTill, "till-1", cash(3)))
+	invalid := transfer(VaultTill, "", cash(1))
+	if err := c.ProcessTransaction(ctx, invalid); !errors.Is(err, ErrInvalidTransaction) {
+		t.Fatalf("ProcessTransaction() error = %v, want %v", err, ErrInvalidTransaction)
+	}
+	if _, err := c.GetExpectedTenders(ctx, testKey); err != nil {
+		t.Fatal(err)
+	}
+	missing := testKey
+	missing.SettlementDocID = "missing"
+	if _, err := c.GetExpectedTenders(ctx, missing); !errors.Is(err, ErrSettlementNotFound) {
+		t.Fatalf("GetExpectedTenders() error = %v, want %v", err, ErrSettlementNotFound)
+	}
+
+	if len(o.transactions) != 2 || o.transactions[0].err != nil || !errors.Is(o.transactions[1].err, ErrInvalidTransaction) {
+		t.Errorf("OnTransaction calls = %+v, want a success then %v", o.transactions, ErrInvalidTransaction)
+	}
+	// The tills set, till-1's tenders set, and its cash total, denominations set and bill hash
+	if len(o.queries) != 2 || o.queries[0] != (observedCall{keyCount: 5}) || o.queries[1].keyCount != 0 || !errors.Is(o.queries[1].err, ErrSettlementNotFound) {
+		t.Errorf("OnQuery calls = %+v, want 5 keys then %v", o.queries, ErrSettlementNotFound)
+	}
+	for _, d := range o.durations {
+		if d <= 0 || d > time.Minute {
+			t.Errorf("observed duration %v", d)
+		}
+	}
+}
+
+type observedPhases struct {
+	network, parse, query time.Duration
+	err                   error
+}
+
+// phaseObserver is a recordingObserver that also records OnQueryPhases alongside the
+// duration of the OnQuery call before it.
+type phaseObserver struct {
+	recordingObserver
+	phases []observedPhases
+}
+
+func (o *phaseObserver) OnQueryPhases(network, parse time.Duration, err error) {
+	p := observedPhases{network: network, parse: parse, err: err}
+	if len(o.queries) == len(o.phases)+1 {
+		p.query = o.durations[len(o.durations)-1]
+	}
+	o.phases = append(o.phases, p)
+}
+
+func TestPhaseObserver(t *testing.T) {
+	c, _ := newTestClient(t)
+	ctx := context.Background()
+	o := &phaseObserver{}
+	c.Observer = o
+
+	mustProcess(t, c, transfer(VaultTill, "till-1", cash(3)), transfer(VaultTill, "till-2", cash(4)))
+	if _, err := c.GetExpectedTenders(ctx, testKey); err != nil {
+		t.Fatal(err)
+	}
+	missing := testKey
+	missing.SettlementDocID = "missing"
+	if _, err := c.GetExpectedTenders(ctx, missing); !errors.Is(err, ErrSettlementNotFound) {
+		t.Fatalf("GetExpectedTenders() error = %v, want %v", err, ErrSettlementNotFound)
+	}
+
+	if len(o.phases) != 2 {
+		t.Fatalf("OnQueryPhases calls = %+v, want one per read", o.phases)
+	}
+	for i, p := range o.phases {
+		if p.query == 0 {
+			t.Errorf("OnQueryPhases call %d didn't follow its OnQuery", i)
+		}
+		if p.network <= 0 || p.parse < 0 || p.network+p.parse > p.query {
+			t.Errorf("OnQueryPhases call %d: network %v, parse %v for a %v read", i, p.network, p.parse, p.query)
+		}
+	}
+	if o.phases[0].err != nil || !errors.Is(o.phases[1].err, ErrSettlementNotFound) {
+		t.Errorf("OnQueryPhases errors = %v, %v, want nil then %v", o.phases[0].err, o.phases[1].err, ErrSettlementNotFound)
+	}
+}
+
+// recordingMetrics sums counters and counts durations by name and labels.
+type recordingMetrics struct {
+	counters, durations map[string]int
+}
+
+func metricKey(name string, labels map[string]string) string {
+	return name + fmt.Sprint(labels)
+}
+
+func (m *recordingMetrics) IncCounter(name string, value int, labels map[string]string) {
+	m.counters[metricKey(name, labels)] += value
+}
+
+func (m *recordingMetrics) ObserveDuration(name string, d time.Duration, labels map[string]string) {
+	m.durations[metricKey(name, labels)]++
+}
+
+func TestMetrics(t *testing.T) {
+	c, _ := newTestClient(t)
+	ctx := context.Background()
+	m := &recordingMetrics{counters: make(map[string]int), durations: make(map[string]int)}
+	c.Metrics = m
+
+	coins := Tender{ID: "coins", Amount: 3, TenderBreakdowns: []TenderInfo{{Name: "penny", Count: 1, Amount: 1}, {Name: "nickel", Count: 1, Amount: 2}}}
+	mustProcess(t, c, transfer(VaultTill, "till-1", cash(5)), transfer(VaultTill, "till-1", coins))
+	if err := c.ProcessTransaction(ctx, transfer(VaultTill, "till-1", Tender{ID: "card", Amount: -1})); err == nil {
+		t.Fatal("ProcessTransaction() of a negative amount succeeded")
+	}
+	if _, err := c.GetExpectedTenders(ctx, testKey); err != nil {
+		t.Fatal(err)
+	}
+
+	success := map[string]string{"operation": "ProcessTransaction", "result": "success"}
+	failure := map[string]string{"operation": "ProcessTransaction", "result": "failure"}
+	read := map[string]string{"operation": "GetExpectedTenders", "result": "success"}
+	wantCounters := map[string]int{
+		metricKey(MetricTransactions, success): 2,
+		metricKey(MetricTransactions, failure): 1,
+		// A count and an amount for each of the three denominations
+		metricKey(MetricDenominationsWritten, map[string]string{"operation": "ProcessTransaction"}): 6,
+	}
+	if !reflect.DeepEqual(m.counters, wantCounters) {
+		t.Errorf("counters = %v, want %v", m.counters, wantCounters)
+	}
+	wantDurations := map[string]int{
+		metricKey(MetricTransactionDuration, success): 2,
+		metricKey(MetricTransactionDuration, failure): 1,
+		metricKey(MetricQueryDuration, read):          1,
+		metricKey(MetricQueryNetworkDuration, read):   1,
+		metricKey(MetricQueryParseDuration, read):     1,
+	}
+	if !reflect.DeepEqual(m.durations, wantDurations) {
+		t.Errorf("durations = %v, want %v", m.durations, wantDurations)
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// GetExpectedTendersParallel is GetExpectedTenders reading each till on its own, with up
+// to workers tills in flight at once, for deployments such as a cluster where one pipeline
+// can't span the settlement. Tills are returned sorted by ID. The first error cancels the
+// reads still outstanding and is returned.
+func (c Client) GetExpectedTendersParallel(ctx context.Context, key Key, workers int, opts ...ReadOption) ([]Till, error) {
+	if workers <= 0 {
+		return nil, fmt.Errorf("invalid worker count %d", workers)
+	}
+	o := newReadOptions(opts)
+	ids, err := c.selectedTills(ctx, key, o)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(ids)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	tills := make([]Till, len(ids))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	var once sync.Once
+	var firstErr error
+	for w := 0; w < workers && w < len(ids); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				till, err := c.getTill(ctx, key, ids[i], o)
+				if err != nil {
+					once.Do(func() {
+						firstErr = fmt.Errorf("read till %s: %w", ids[i], err)
+						cancel()
+					})
+					continue
+				}
+				tills[i] = till
+			}
+		}()
+	}
+feed:
+	for i := range ids {
+		select {
+		case jobs <- i:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return finishTills(tills, o), nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestGetExpectedTendersParallel(t *testing.T) {
+	c, mr := newTestClient(t)
+	ctx := context.Background()
+	const tills = 40
+	for i := 0; i < tills; i++ {
+		mustProcess(t, c, transfer(VaultTill, fmt.Sprintf("till-%02d", i), cash(Money(i+1)), Tender{ID: "card", Amount: 2}))
+	}
+	want, err := c.GetExpectedTenders(ctx, testKey, WithReservedTills())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sequential int // Commands of a read on one worker
+	for _, workers := range []int{1, 4, 100} {
+		before := mr.CommandCount()
+		got, err := c.GetExpectedTendersParallel(ctx, testKey, workers, WithReservedTills())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if workers == 1 {
+			sequential = mr.CommandCount() - before
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("GetExpectedTendersParallel(%d workers) = %+v, want %+v", workers, got, want)
+		}
+	}
+
+	// The first till failing cancels the reads of the others
+	mr.Set(testKey.TenderKey("till-00", "cash"), "not a number")
+	before := mr.CommandCount()
+	var parseErr *ParseError
+	if _, err := c.GetExpectedTendersParallel(ctx, testKey, 1); !errors.As(err, &parseErr) {
+		t.Errorf("GetExpectedTendersParallel() of a corrupt total error = %v, want a *ParseError", err)
+	}
+	if n := mr.CommandCount() - before; n > sequential/4 {
+		t.Errorf("failed read ran %d commands, a full one %d", n, sequential)
+	}
+	if _, err := c.GetExpectedTendersParallel(ctx, testKey, 0); err == nil {
+		t.Error("GetExpectedTendersParallel() with 0 workers succeeded")
+	}
+}
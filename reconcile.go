@@ -0,0 +1,363 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/redis/go-redis/v9"
+)
+
+type tenderState struct {
+	amount        Money
+	denominations map[string]TenderInfo
+}
+
+// indexTills maps till ID -> stored tender ID -> tender state, with denominations keyed by
+// stored name, rejecting duplicates which would make the deltas ambiguous.
+func indexTills(tills []Till) (map[string]map[string]tenderState, error) {
+	index := make(map[string]map[string]tenderState, len(tills))
+	for _, till := range tills {
+		if _, ok := index[till.ID]; ok {
+			return nil, fmt.Errorf("duplicate till %s", till.ID)
+		}
+		tenders := make(map[string]tenderState, len(till.Tenders))
+		for _, tender := range till.Tenders {
+			tenderID := tender.StoredID()
+			if _, ok := tenders[tenderID]; ok {
+				return nil, fmt.Errorf("duplicate tender %s in till %s", tenderID, till.ID)
+			}
+			state := tenderState{
+				amount:        tender.Amount,
+				denominations: make(map[string]TenderInfo, len(tender.TenderBreakdowns)),
+			}
+			for _, denomination := range tender.TenderBreakdowns {
+				name := denomination.storedName(tender.Currency)
+				if _, ok := state.denominations[name]; ok {
+					return nil, fmt.Errorf("duplicate denomination %s in till %s tender %s", name, till.ID, tenderID)
+				}
+				state.denominations[name] = denomination
+			}
+			tenders[tenderID] = state
+		}
+		index[till.ID] = tenders
+	}
+	return index, nil
+}
+
+// ReconcilePlan computes the transactions that turn current into desired, using
+// AdjustmentTill as the counterparty. At most two transactions are emitted per till: one
+// crediting what the till is missing and one debiting what it holds in excess, so every
+// count and amount in the plan is non-negative. The returned transactions carry no Org,
+// EU or SettlementDocID; callers set those before processing them.
+func ReconcilePlan(current, desired []Till) ([]Transaction, error) {
+	cur, err := indexTills(current)
+	if err != nil {
+		return nil, fmt.Errorf("current: %w", err)
+	}
+	want, err := indexTills(desired)
+	if err != nil {
+		return nil, fmt.Errorf("desired: %w", err)
+	}
+
+	var plan []Transaction
+	for _, tillID := range unionKeys(cur, want) {
+		if tillID == AdjustmentTill {
+			continue
+		}
+		var credits, debits []Tender
+		for _, tenderID := range unionKeys(cur[tillID], want[tillID]) {
+			credit, debit := tenderDelta(tenderID, cur[tillID][tenderID], want[tillID][tenderID])
+			credits = append(credits, credit...)
+			debits = append(debits, debit...)
+		}
+		if len(credits) > 0 {
+			plan = append(plan, Transaction{
+				Source:      AdjustmentTill,
+				Destination: tillID,
+				Direction:   DirectionCredit,
+				Tenders:     credits,
+			})
+		}
+		if len(debits) > 0 {
+			plan = append(plan, Transaction{
+				Source:      tillID,
+				Destination: AdjustmentTill,
+				Direction:   DirectionCredit,
+				Tenders:     debits,
+			})
+		}
+	}
+	return plan, nil
+}
+
+// tenderDelta splits the difference between two tender states into the part the till
+// must receive and the part it must give away. Any part of the total not explained by the
+// denominations is moved as a separate tender entry without breakdowns, so each entry's
+// breakdowns sum to its amount. Either result is nil when empty.
+func tenderDelta(tenderID string, current, desired tenderState) (credit, debit []Tender) {
+	tender := tenderFromStoredID(tenderID)
+	in, out := tender, tender
+	var denominationNet Money
+	for _, name := range unionKeys(current.denominations, desired.denominations) {
+		count := desired.denominations[name].Count - current.denominations[name].Count
+		amount := desired.denominations[name].Amount - current.denominations[name].Amount
+		if count == 0 && amount == 0 {
+			continue
+		}
+		denominationNet += amount
+		denomination := denominationFromStoredName(name, tender.Currency)
+		if amount > 0 || (amount == 0 && count > 0) {
+			denomination.Count, denomination.Amount = count, amount
+			in.Amount += amount
+			in.TenderBreakdowns = append(in.TenderBreakdowns, denomination)
+		} else {
+			denomination.Count, denomination.Amount = -count, -amount
+			out.Amount -= amount
+			out.TenderBreakdowns = append(out.TenderBreakdowns, denomination)
+		}
+	}
+
+	if len(in.TenderBreakdowns) > 0 {
+		credit = append(credit, in)
+	}
+	if len(out.TenderBreakdowns) > 0 {
+		debit = append(debit, out)
+	}
+	remainder := desired.amount - current.amount - denominationNet
+	if remainder > 0 {
+		tender.Amount = remainder
+		credit = append(credit, tender)
+	} else if remainder < 0 {
+		tender.Amount = -remainder
+		debit = append(debit, tender)
+	}
+	return credit, debit
+}
+
+type DenomDelta struct {
+	Till         string
+	Tender       string // Stored tender ID, see Tender.StoredID
+	Denomination string // Stored denomination name; empty for the tender total
+	Count        int
+	Amount       Money
+	CountOnly    bool // The denomination tracks only its count, see TenderInfo.CountOnly
+}
+
+// DeltaSettlement returns the signed change (after minus before) of every tender total and
+// denomination that differs between two snapshots, ordered by till, tender, then
+// denomination with each tender's total first. Entries repeated within a snapshot are
+// summed.
+func DeltaSettlement(before, after []Till) []DenomDelta {
+	type deltaKey struct{ till, tender, denomination string }
+	deltas := make(map[deltaKey]*DenomDelta)
+	accumulate := func(tills []Till, sign int) {
+		add := func(k deltaKey, count int, amount Money) {
+			d, ok := deltas[k]
+			if !ok {
+				d = &DenomDelta{Till: k.till, Tender: k.tender, Denomination: k.denomination}
+				deltas[k] = d
+			}
+			d.Count += sign * count
+			d.Amount += Money(sign) * amount
+		}
+		for _, till := range tills {
+			for _, tender := range till.Tenders {
+				tenderID := tender.StoredID()
+				add(deltaKey{till.ID, tenderID, ""}, 0, tender.Amount)
+				for _, denomination := range tender.TenderBreakdowns {
+					add(deltaKey{till.ID, tenderID, denomination.storedName(tender.Currency)}, denomination.Count, denomination.Amount)
+				}
+			}
+		}
+	}
+	accumulate(after, 1)
+	accumulate(before, -1)
+
+	var out []DenomDelta
+	for _, d := range deltas {
+		if d.Count != 0 || d.Amount != 0 {
+			out = append(out, *d)
+		}
+	}
+	sortDenomDeltas(out)
+	return out
+}
+
+// sortDenomDeltas orders deltas by till, tender, then denomination, each tender's total first.
+func sortDenomDeltas(deltas []DenomDelta) {
+	sort.Slice(deltas, func(i, j int) bool {
+		a, b := deltas[i], deltas[j]
+		if a.Till != b.Till {
+			return a.Till < b.Till
+		}
+		if a.Tender != b.Tender {
+			return a.Tender < b.Tender
+		}
+		return a.Denomination < b.Denomination
+	})
+}
+
+// sortedKeys returns the sorted keys of m.
+func sortedKeys[V any](m map[string]V) []string {
+	return unionKeys(m, nil)
+}
+
+// unionKeys returns the sorted union of the keys of a and b.
+func unionKeys[V any](a, b map[string]V) []string {
+	seen := make(map[string]struct{}, len(a)+len(b))
+	for k := range a {
+		seen[k] = struct{}{}
+	}
+	for k := range b {
+		seen[k] = struct{}{}
+	}
+	keys := make([]string, 0, len(seen))
+	for k := range seen {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+type Variance struct {
+	Expected Money // Total recorded in Redis
+	Actual   Money // Total reported externally
+	Delta    Money // Actual - Expected
+}
+
+// Matches reports whether the expected and actual totals agree.
+func (v Variance) Matches() bool {
+	return v.Delta == 0
+}
+
+// ReconcileCard compares a till's recorded total for a denomination-less tender, such as a
+// card tender, against the total from the processor's settlement file. A tender with no
+// recorded total is expected to be zero.
+func (c Client) ReconcileCard(ctx context.Context, key Key, tillID, tenderID string, processorTotal Money) (Variance, error) {
+	tenderKey := key.TenderKey(tillID, tenderID)
+	var expected Money
+	raw, err := c.Get(ctx, tenderKey).Result()
+	switch {
+	case errors.Is(err, redis.Nil):
+	case err != nil:
+		return Variance{}, fmt.Errorf("get %s: %w", tenderKey, err)
+	default:
+		if expected, err = parseMoney(raw); err != nil {
+			return Variance{}, &ParseError{Key: tenderKey, Value: raw, Err: err}
+		}
+	}
+	return Variance{
+		Expected: expected,
+		Actual:   processorTotal,
+		Delta:    processorTotal - expected,
+	}, nil
+}
+
+// ReconcileTillTotal is the quick drawer check: it compares a counted grand total against
+// the sum of the till's tender totals, without looking at denominations. Exactly one of
+// over and short is positive when the count is off; both are zero when it matches.
+func (c Client) ReconcileTillTotal(ctx context.Context, key Key, tillID string, countedTotal Money) (over Money, short Money, err error) {
+	totals, err := c.tillTotals(ctx, key, tillID)
+	if err != nil {
+		return 0, 0, err
+	}
+	var expected Money
+	for _, amount := range totals {
+		expected += amount
+	}
+	switch delta := countedTotal - expected; {
+	case delta > 0:
+		return delta, 0, nil
+	case delta < 0:
+		return 0, -delta, nil
+	}
+	return 0, 0, nil
+}
+
+type DenominationVariance struct {
+	Denomination  string // Stored denomination name
+	ExpectedCount int
+	CountedCount  int
+	Variance
+}
+
+type TenderVariance struct {
+	Tender        string // Stored tender ID, see Tender.StoredID
+	Variance             // Of the tender totals
+	Denominations []DenominationVariance
+}
+
+type ReconcileResult struct {
+	Tenders []TenderVariance // Sorted by tender, each one's denominations by name
+	Over    map[string]Money // Per currency, "" for tenders without one: sum of the positive tender deltas
+	Short   map[string]Money // Per currency, "" for tenders without one: sum of the negative tender deltas, as a positive amount
+}
+
+// Balanced reports whether every tender total and denomination matched the count.
+func (r ReconcileResult) Balanced() bool {
+	for _, tender := range r.Tenders {
+		if !tender.Matches() {
+			return false
+		}
+		for _, denomination := range tender.Denominations {
+			if !denomination.Matches() || denomination.ExpectedCount != denomination.CountedCount {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Reconcile compares a till's expected tenders against a physical count of it. Every
+// tender and denomination on either side is reported, with Delta the counted minus the
+// expected amount, so a positive delta is over and a negative one short; a side missing
+// a tender or denomination counts it as zero. counted uses the same tender IDs and
+// currencies as the transactions that filled the till. Over and Short are summed per
+// currency and only list currencies with a tender over or short respectively.
+func (c Client) Reconcile(ctx context.Context, key Key, tillID string, counted []Tender) (ReconcileResult, error) {
+	till, err := c.getTill(ctx, key, tillID, ReadOptions{})
+	if err != nil {
+		return ReconcileResult{}, err
+	}
+	expected, err := indexTills([]Till{till})
+	if err != nil {
+		return ReconcileResult{}, fmt.Errorf("expected: %w", err)
+	}
+	actual, err := indexTills([]Till{{ID: tillID, Tenders: counted}})
+	if err != nil {
+		return ReconcileResult{}, fmt.Errorf("counted: %w", err)
+	}
+
+	result := ReconcileResult{Over: make(map[string]Money), Short: make(map[string]Money)}
+	want, got := expected[tillID], actual[tillID]
+	for _, tenderID := range unionKeys(want, got) {
+		variance := TenderVariance{
+			Tender: tenderID,
+			Variance: Variance{
+				Expected: want[tenderID].amount,
+				Actual:   got[tenderID].amount,
+				Delta:    got[tenderID].amount - want[tenderID].amount,
+			},
+		}
+		for _, name := range unionKeys(want[tenderID].denominations, got[tenderID].denominations) {
+			e, a := want[tenderID].denominations[name], got[tenderID].denominations[name]
+			variance.Denominations = append(variance.Denominations, DenominationVariance{
+				Denomination:  name,
+				ExpectedCount: e.Count,
+				CountedCount:  a.Count,
+				Variance:      Variance{Expected: e.Amount, Actual: a.Amount, Delta: a.Amount - e.Amount},
+			})
+		}
+		// Amounts in different currencies don't add up, so each is summed on its own
+		_, currency := splitCurrency(tenderID)
+		if variance.Delta > 0 {
+			result.Over[currency] += variance.Delta
+		} else if variance.Delta < 0 {
+			result.Short[currency] -= variance.Delta
+		}
+		result.Tenders = append(result.Tenders, variance)
+	}
+	return result, nil
+}
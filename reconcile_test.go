@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestReconcilePlan(t *testing.T) {
+	c, _ := newTestClient(t)
+	ctx := context.Background()
+	desiredKey := testKey
+	desiredKey.SettlementDocID = "settlement-2"
+	inDesired := func(tx Transaction) Transaction {
+		tx.SettlementDocID = desiredKey.SettlementDocID
+		return tx
+	}
+	mixed := Tender{ID: "cash", Amount: 35, TenderBreakdowns: []TenderInfo{{Name: "bill", Count: 30, Amount: 30}, {Name: "coin", Count: 5, Amount: 5}}}
+	mustProcess(t, c,
+		transfer(VaultTill, "till-1", cash(50), Tender{ID: "card", Amount: 20}),
+		transfer(VaultTill, "till-2", cash(10)),
+		inDesired(transfer(VaultTill, "till-1", mixed)),
+		inDesired(transfer(VaultTill, "till-3", Tender{ID: "card", Amount: 7})),
+	)
+	current, err := c.GetExpectedTenders(ctx, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	desired, err := c.GetExpectedTenders(ctx, desiredKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plan, err := ReconcilePlan(current, desired)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tx := range plan {
+		if tx.Source != AdjustmentTill && tx.Destination != AdjustmentTill {
+			t.Errorf("plan moves %s to %s, not against %s", tx.Source, tx.Destination, AdjustmentTill)
+		}
+		for _, tender := range tx.Tenders {
+			if tender.Amount < 0 {
+				t.Errorf("plan moves a negative amount: %+v", tender)
+			}
+		}
+		tx.Org, tx.EU, tx.SettlementDocID = testKey.Organization, testKey.EnterpriseUnit, testKey.SettlementDocID
+		mustProcess(t, c, tx)
+	}
+	// Applying the plan leaves the current settlement holding what the desired one does
+	got, err := c.GetExpectedTenders(ctx, testKey, WithoutZeroTenders(), WithoutEmptyTills())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, desired) {
+		t.Errorf("settlement after the plan = %+v, want %+v", got, desired)
+	}
+
+	if plan, err := ReconcilePlan(desired, desired); err != nil || len(plan) != 0 {
+		t.Errorf("ReconcilePlan() of equal settlements = %+v, %v, want none", plan, err)
+	}
+}
+
+func TestReconcileCard(t *testing.T) {
+	c, mr := newTestClient(t)
+	ctx := context.Background()
+	mustProcess(t, c, transfer(VaultTill, "till-1", Tender{ID: "card", Amount: 120}))
+
+	tests := []struct {
+		tillID, tenderID string
+		processorTotal   Money
+		want             Variance
+	}{
+		{tillID: "till-1", tenderID: "card", processorTotal: 120, want: Variance{Expected: 120, Actual: 120}},
+		{tillID: "till-1", tenderID: "card", processorTotal: 100, want: Variance{Expected: 120, Actual: 100, Delta: -20}},
+		// Nothing recorded is expected to be zero
+		{tillID: "till-2", tenderID: "card", processorTotal: 15, want: Variance{Actual: 15, Delta: 15}},
+	}
+	for _, tt := range tests {
+		got, err := c.ReconcileCard(ctx, testKey, tt.tillID, tt.tenderID, tt.processorTotal)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want || got.Matches() != (tt.want.Delta == 0) {
+			t.Errorf("ReconcileCard(%s, %v) = %+v, want %+v", tt.tillID, tt.processorTotal, got, tt.want)
+		}
+	}
+
+	mr.Set(testKey.TenderKey("till-1", "card"), "1.20")
+	var parseErr *ParseError
+	if _, err := c.ReconcileCard(ctx, testKey, "till-1", "card", 120); !errors.As(err, &parseErr) {
+		t.Errorf("ReconcileCard() of a corrupt total error = %v, want a ParseError", err)
+	}
+}
+
+func TestDeltaSettlement(t *testing.T) {
+	c, _ := newTestClient(t)
+	ctx := context.Background()
+	mustProcess(t, c, transfer(VaultTill, "till-1", cash(50), Tender{ID: "card", Amount: 8}))
+	before, err := c.GetExpectedTenders(ctx, testKey, WithReservedTills())
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustProcess(t, c,
+		transfer("till-1", "till-2", cash(20)),
+		transfer("till-2", "till-1", Tender{ID: "cash", Amount: 20, TenderBreakdowns: []TenderInfo{{Name: "coin", Count: 20, Amount: 20}}}),
+	)
+	after, err := c.GetExpectedTenders(ctx, testKey, WithReservedTills())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// till-1's cash total is back where it was, only its denominations moved
+	want := []DenomDelta{
+		{Till: "till-1", Tender: "cash", Denomination: "bill", Count: -20, Amount: -20},
+		{Till: "till-1", Tender: "cash", Denomination: "coin", Count: 20, Amount: 20},
+		{Till: "till-2", Tender: "cash", Denomination: "bill", Count: 20, Amount: 20},
+		{Till: "till-2", Tender: "cash", Denomination: "coin", Count: -20, Amount: -20},
+	}
+	if got := DeltaSettlement(before, after); !reflect.DeepEqual(got, want) {
+		t.Errorf("DeltaSettlement() = %+v, want %+v", got, want)
+	}
+	if got := DeltaSettlement(after, after); len(got) != 0 {
+		t.Errorf("DeltaSettlement() of a snapshot with itself = %+v, want none", got)
+	}
+	// Entries repeated within a snapshot are summed
+	split := []Till{{ID: "till-1", Tenders: []Tender{{ID: "card", Amount: 5}}}, {ID: "till-1", Tenders: []Tender{{ID: "card", Amount: 3}}}}
+	if got := DeltaSettlement(split, []Till{{ID: "till-1", Tenders: []Tender{{ID: "card", Amount: 8}}}}); len(got) != 0 {
+		t.Errorf("DeltaSettlement() of a split snapshot = %+v, want none", got)
+	}
+}
+
+func TestReconcileTillTotal(t *testing.T) {
+	c, _ := newTestClient(t)
+	ctx := context.Background()
+	mustProcess(t, c, transfer(VaultTill, "till-1", cash(50), Tender{ID: "card", Amount: 8}))
+	tests := []struct {
+		tillID              string
+		counted             Money
+		wantOver, wantShort Money
+	}{
+		{tillID: "till-1", counted: 58},
+		{tillID: "till-1", counted: 60, wantOver: 2},
+		{tillID: "till-1", counted: 55, wantShort: 3},
+		{tillID: "till-2", counted: 4, wantOver: 4},
+	}
+	for _, tt := range tests {
+		over, short, err := c.ReconcileTillTotal(ctx, testKey, tt.tillID, tt.counted)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if over != tt.wantOver || short != tt.wantShort {
+			t.Errorf("ReconcileTillTotal(%s, %v) = %v over, %v short, want %v, %v", tt.tillID, tt.counted, over, short, tt.wantOver, tt.wantShort)
+		}
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	c, _ := newTestClient(t)
+	ctx := context.Background()
+	drawer := Tender{ID: "cash", Amount: 15, TenderBreakdowns: []TenderInfo{{Name: "five", Count: 1, Amount: 5}, {Name: "one", Count: 10, Amount: 10}}}
+	mustProcess(t, c, transfer(VaultTill, "till-1", drawer, Tender{ID: "card", Amount: 4}))
+
+	matched, err := c.Reconcile(ctx, testKey, "till-1", []Tender{drawer, {ID: "card", Amount: 4}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !matched.Balanced() || len(matched.Over) != 0 || len(matched.Short) != 0 {
+		t.Errorf("Reconcile() of an exact count = %+v, want balanced", matched)
+	}
+
+	// A single missing one and an unexpected check
+	counted := Tender{ID: "cash", Amount: 14, TenderBreakdowns: []TenderInfo{{Name: "five", Count: 1, Amount: 5}, {Name: "one", Count: 9, Amount: 9}}}
+	result, err := c.Reconcile(ctx, testKey, "till-1", []Tender{counted, {ID: "card", Amount: 4}, {ID: "check", Amount: 2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := ReconcileResult{
+		Tenders: []TenderVariance{
+			{Tender: "card", Variance: Variance{Expected: 4, Actual: 4}},
+			{Tender: "cash", Variance: Variance{Expected: 15, Actual: 14, Delta: -1}, Denominations: []DenominationVariance{
+				{Denomination: "five", ExpectedCount: 1, CountedCount: 1, Variance: Variance{Expected: 5, Actual: 5}},
+				{Denomination: "one", ExpectedCount: 10, CountedCount: 9, Variance: Variance{Expected: 10, Actual: 9, Delta: -1}},
+			}},
+			{Tender: "check", Variance: Variance{Actual: 2, Delta: 2}},
+		},
+		Over:  map[string]Money{"": 2},
+		Short: map[string]Money{"": 1},
+	}
+	if !reflect.DeepEqual(result, want) {
+		t.Errorf("Reconcile() = %+v, want %+v", result, want)
+	}
+	if result.Balanced() {
+		t.Error("Balanced() of a short count = true")
+	}
+}
@@ -0,0 +1,26 @@
+package main
+
+// Pseudo-tills stand in for the other side of movements that don't involve a real till.
+// They can go negative without limit and are left out of till reports unless asked for.
+const (
+	BankTill       = "bank"       // Deposits and withdrawals
+	VaultTill      = "vault"      // Opening floats are drawn from here
+	AdjustmentTill = "adjustment" // Counterparty for reconciliation adjustments
+	RoundingTill   = "rounding"   // Sub-unit rounding differences
+)
+
+// DefaultReservedTills is the registry used when Client.ReservedTills is nil.
+var DefaultReservedTills = []string{BankTill, VaultTill, AdjustmentTill, RoundingTill}
+
+// IsReservedTill reports whether tillID is one of the client's pseudo-tills.
+func (c Client) IsReservedTill(tillID string) bool {
+	return containsString(c.reservedTills(), tillID)
+}
+
+// reservedTills returns the client's pseudo-till IDs.
+func (c Client) reservedTills() []string {
+	if c.ReservedTills == nil {
+		return DefaultReservedTills
+	}
+	return c.ReservedTills
+}
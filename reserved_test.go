@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestReservedTills(t *testing.T) {
+	c, _ := newTestClient(t)
+	ctx := context.Background()
+	mustProcess(t, c, transfer(VaultTill, "till-1", cash(10)), transfer("safe", "till-1", cash(5)))
+	tillIDs := func(opts ...ReadOption) []string {
+		tills, err := c.GetExpectedTenders(ctx, testKey, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []string
+		for _, till := range tills {
+			ids = append(ids, till.ID)
+		}
+		return ids
+	}
+
+	tests := []struct {
+		reserved             []string
+		isReserved           map[string]bool
+		ids, withReservedIDs []string
+	}{
+		{
+			isReserved:      map[string]bool{VaultTill: true, BankTill: true, "safe": false, "till-1": false},
+			ids:             []string{"safe", "till-1"},
+			withReservedIDs: []string{"safe", "till-1", VaultTill},
+		},
+		{
+			reserved:        []string{"safe"},
+			isReserved:      map[string]bool{VaultTill: false, BankTill: false, "safe": true, "till-1": false},
+			ids:             []string{"till-1", VaultTill},
+			withReservedIDs: []string{"safe", "till-1", VaultTill},
+		},
+	}
+	for _, tt := range tests {
+		c.ReservedTills = tt.reserved
+		for tillID, want := range tt.isReserved {
+			if got := c.IsReservedTill(tillID); got != want {
+				t.Errorf("with ReservedTills %v, IsReservedTill(%s) = %v, want %v", tt.reserved, tillID, got, want)
+			}
+		}
+		if got := tillIDs(); !reflect.DeepEqual(got, tt.ids) {
+			t.Errorf("with ReservedTills %v, GetExpectedTenders() tills = %v, want %v", tt.reserved, got, tt.ids)
+		}
+		if got := tillIDs(WithReservedTills()); !reflect.DeepEqual(got, tt.withReservedIDs) {
+			t.Errorf("with ReservedTills %v, GetExpectedTenders(WithReservedTills) tills = %v, want %v", tt.reserved, got, tt.withReservedIDs)
+		}
+	}
+
+	// Only real tills are held to RejectOverdrafts
+	c.RejectOverdrafts = true
+	mustProcess(t, c, transfer("safe", "till-1", cash(100)))
+	c.ReservedTills = nil
+	if err := c.ProcessTransaction(ctx, transfer("safe", "till-1", cash(100))); !errors.Is(err, ErrInsufficientTender) {
+		t.Errorf("overdrawing safe as a real till error = %v, want %v", err, ErrInsufficientTender)
+	}
+}
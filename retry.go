@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"syscall"
+	"time"
+)
+
+// Defaults for Client.RetryBackoff and the cap on the delay between retries.
+const (
+	DefaultRetryBackoff = 50 * time.Millisecond
+	maxRetryBackoff     = 2 * time.Second
+)
+
+// isTransient reports whether err is a network failure worth retrying, as opposed to a
+// reply from Redis or a rejection by this package.
+func isTransient(err error) bool {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return false
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF),
+		errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.ECONNREFUSED), errors.Is(err, syscall.EPIPE):
+		return true
+	case errors.As(err, &netErr):
+		return netErr.Timeout()
+	}
+	return false
+}
+
+// retryBackoff returns the delay before retry number attempt (1 for the first retry):
+// exponential from RetryBackoff, capped at maxRetryBackoff, with full jitter.
+func (c Client) retryBackoff(attempt int) time.Duration {
+	backoff := c.RetryBackoff
+	if backoff <= 0 {
+		backoff = DefaultRetryBackoff
+	}
+	for i := 1; i < attempt && backoff < maxRetryBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxRetryBackoff {
+		backoff = maxRetryBackoff
+	}
+	return time.Duration(rand.Int63n(int64(backoff) + 1))
+}
+
+// processWithRetry runs ProcessTransaction's work, retrying transient failures up to
+// RetryAttempts in total. A failure can be reported after EXEC already applied the
+// transaction, so only transactions with an IdempotencyKey are retried: if an earlier
+// attempt did land, the retry finds the key recorded and the transaction counts as
+// applied instead of being applied twice.
+func (c Client) processWithRetry(ctx context.Context, t Transaction) error {
+	for attempt := 1; ; attempt++ {
+		err := c.processTransaction(ctx, t)
+		if attempt > 1 && errors.Is(err, ErrAlreadyApplied) {
+			return nil
+		}
+		if t.IdempotencyKey == "" || attempt >= c.RetryAttempts || !isTransient(err) {
+			return err
+		}
+		timer := time.NewTimer(c.retryBackoff(attempt))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+}
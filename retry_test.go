@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// flakyHook fails the first failures MULTI/EXEC pipelines with err, counting every one in
+// attempts. With afterExec the pipeline is sent first, as when the reply is lost.
+type flakyHook struct {
+	err       error
+	failures  int
+	afterExec bool
+	attempts  *int
+}
+
+func (flakyHook) DialHook(next redis.DialHook) redis.DialHook { return next }
+
+func (flakyHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook { return next }
+
+func (h flakyHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		if len(cmds) == 0 || !strings.EqualFold(cmds[0].Name(), "multi") {
+			return next(ctx, cmds)
+		}
+		*h.attempts++
+		if *h.attempts > h.failures {
+			return next(ctx, cmds)
+		}
+		if h.afterExec {
+			if err := next(ctx, cmds); err != nil {
+				return err
+			}
+		}
+		return h.err
+	}
+}
+
+func TestRetryAttempts(t *testing.T) {
+	reset := fmt.Errorf("read tcp: %w", syscall.ECONNRESET)
+	tests := []struct {
+		name         string
+		hook         flakyHook
+		key          string
+		wantErr      string // Empty for success
+		wantAttempts int
+		wantAmount   Money
+	}{
+		{name: "fails twice", hook: flakyHook{err: reset, failures: 2}, key: "k", wantAttempts: 3, wantAmount: 10},
+		// The retry finds the idempotency key recorded and sends nothing more
+		{name: "reply lost", hook: flakyHook{err: reset, failures: 1, afterExec: true}, key: "k", wantAttempts: 1, wantAmount: 10},
+		{name: "too flaky", hook: flakyHook{err: reset, failures: 3}, key: "k", wantErr: "connection reset", wantAttempts: 3},
+		{name: "no idempotency key", hook: flakyHook{err: reset, failures: 1}, wantErr: "connection reset", wantAttempts: 1},
+		{name: "not transient", hook: flakyHook{err: errors.New("injected failure"), failures: 1}, key: "k", wantErr: "injected failure", wantAttempts: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := newTestClient(t)
+			c.RetryAttempts = 3
+			c.RetryBackoff = time.Millisecond
+			var attempts int
+			tt.hook.attempts = &attempts
+			c.AddHook(tt.hook)
+			tx := transfer(VaultTill, "till-1", cash(10))
+			tx.IdempotencyKey = tt.key
+			err := c.ProcessTransaction(context.Background(), tx)
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("ProcessTransaction() error = %v, want %q", err, tt.wantErr)
+			}
+			if attempts != tt.wantAttempts {
+				t.Errorf("%d MULTI/EXEC attempts, want %d", attempts, tt.wantAttempts)
+			}
+			if got := tenderAmount(t, c, "till-1", "cash"); got != tt.wantAmount {
+				t.Errorf("till-1 total = %v, want %v", got, tt.wantAmount)
+			}
+		})
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+import "fmt"
+
+// absorbRounding makes a tender's denomination amounts sum exactly to its total by adding
+// the remainder to the client's RoundingDenomination.
+//
+// The remainder is tender.Amount minus the sum of the breakdown amounts. Remainders larger
+// in magnitude than RoundingCap are not rounding at all but a real mismatch, and are
+// rejected rather than hidden in the bucket. Tenders without breakdowns and clients
+// without a RoundingDenomination are returned unchanged.
+func (c Client) absorbRounding(tender Tender) (Tender, error) {
+	if c.RoundingDenomination == "" || len(tender.TenderBreakdowns) == 0 {
+		return tender, nil
+	}
+	var sum Money
+	for _, denomination := range tender.TenderBreakdowns {
+		sum += denomination.Amount
+	}
+	remainder := tender.Amount - sum
+	if remainder == 0 {
+		return tender, nil
+	}
+	if remainder > c.RoundingCap || -remainder > c.RoundingCap {
+		return Tender{}, fmt.Errorf("tender %s: remainder %v exceeds rounding cap %v", tender.ID, remainder, c.RoundingCap)
+	}
+
+	breakdowns := make([]TenderInfo, len(tender.TenderBreakdowns), len(tender.TenderBreakdowns)+1)
+	copy(breakdowns, tender.TenderBreakdowns)
+	tender.TenderBreakdowns = append(breakdowns, TenderInfo{Name: c.RoundingDenomination, Amount: remainder})
+	return tender, nil
+}
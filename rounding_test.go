@@ -0,0 +1,32 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestRoundingDenomination(t *testing.T) {
+	c, _ := newTestClient(t)
+	ctx := context.Background()
+	c.RoundingDenomination, c.RoundingCap = "rounding", 2
+	bills := func(amount Money, count int) Tender {
+		return Tender{ID: "cash", Amount: amount, TenderBreakdowns: []TenderInfo{{Name: "bill", Count: count, Amount: Money(count)}}}
+	}
+
+	mustProcess(t, c, transfer(VaultTill, "till-1", bills(10, 9)), transfer(VaultTill, "till-1", bills(19, 20)), transfer(VaultTill, "till-1", bills(5, 5)))
+	tender, err := c.GetTenderBreakdown(ctx, testKey, "till-1", "cash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Tender{ID: "cash", Amount: 34, TenderBreakdowns: []TenderInfo{{Name: "bill", Count: 34, Amount: 34}, {Name: "rounding", Amount: 0}}}
+	if !reflect.DeepEqual(tender, want) {
+		t.Errorf("till-1 cash = %+v, want %+v", tender, want)
+	}
+	if err := c.ProcessTransaction(ctx, transfer(VaultTill, "till-1", bills(13, 10))); err == nil {
+		t.Error("ProcessTransaction() with a remainder over RoundingCap succeeded")
+	}
+	if got := tenderAmount(t, c, "till-1", "cash"); got != 34 {
+		t.Errorf("till-1 cash after a rejected remainder = %v, want 34", got)
+	}
+}
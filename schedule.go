@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// groupTransactions splits the indexes of txs into groups such that two transactions
+// sharing a real till of the same settlement, an IdempotencyKey or a TransactionID end up
+// in the same group. Reserved pseudo-tills don't join groups: they are never checked, so
+// the order of their writes doesn't matter. Each group lists its indexes in submission
+// order and the groups are ordered by their first index.
+func (c Client) groupTransactions(txs []Transaction, batch []preparedTransaction) [][]int {
+	parent := make([]int, len(txs))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+
+	type resource struct {
+		key  Key
+		kind string
+		id   string
+	}
+	owners := make(map[resource]int)
+	claim := func(i int, r resource) {
+		owner, ok := owners[r]
+		if !ok {
+			owners[r] = i
+			return
+		}
+		a, b := find(owner), find(i)
+		if a > b {
+			a, b = b, a
+		}
+		parent[b] = a
+	}
+	for i, t := range txs {
+		key := batch[i].key
+		for _, tillID := range []string{t.Source, t.Destination} {
+			if !c.IsReservedTill(tillID) {
+				claim(i, resource{key: key, kind: "till", id: tillID})
+			}
+		}
+		if t.IdempotencyKey != "" {
+			claim(i, resource{key: key, kind: "idempotency", id: t.IdempotencyKey})
+		}
+		if t.TransactionID != "" {
+			claim(i, resource{key: key, kind: "transaction", id: t.TransactionID})
+		}
+	}
+
+	var groups [][]int
+	group := make(map[int]int)
+	for i := range txs {
+		root := find(i)
+		g, ok := group[root]
+		if !ok {
+			g = len(groups)
+			group[root] = g
+			groups = append(groups, nil)
+		}
+		groups[g] = append(groups[g], i)
+	}
+	return groups
+}
+
+// applyGroups applies each group with applyTransactions, up to BatchWorkers groups at
+// once, and returns the error of the lowest failing index.
+func (c Client) applyGroups(ctx context.Context, txs []Transaction, batch []preparedTransaction, groups [][]int) error {
+	jobs := make(chan []int)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	failed := -1
+	var firstErr error
+	for w := 0; w < c.BatchWorkers && w < len(groups); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for indexes := range jobs {
+				i, err := c.applyTransactions(ctx, txs, batch, indexes)
+				if err == nil {
+					continue
+				}
+				mu.Lock()
+				if failed < 0 || i < failed {
+					failed, firstErr = i, err
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, indexes := range groups {
+		jobs <- indexes
+	}
+	close(jobs)
+	wg.Wait()
+	return firstErr
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestGroupTransactions(t *testing.T) {
+	c := Client{}
+	idempotent := transfer(VaultTill, "till-5", cash(1))
+	idempotent.IdempotencyKey = "k"
+	again := transfer(VaultTill, "till-6", cash(1))
+	again.IdempotencyKey = "k"
+	txs := []Transaction{
+		transfer(VaultTill, "till-1", cash(1)), // 0
+		transfer(VaultTill, "till-2", cash(1)), // 1: shares only the vault with 0
+		transfer("till-1", "till-3", cash(1)),  // 2: joins 0 through till-1
+		transfer("till-3", "till-2", cash(1)),  // 3: joins 0 and 1 through till-3 and till-2
+		transfer(VaultTill, "till-4", cash(1)), // 4
+		idempotent,                             // 5
+		again,                                  // 6: joins 5 through the idempotency key
+		inSettlement("settlement-2", transfer(VaultTill, "till-4", cash(1))), // 7: another settlement's till-4
+	}
+	batch := make([]preparedTransaction, len(txs))
+	for i, tx := range txs {
+		batch[i].key = Key{Organization: tx.Org, EnterpriseUnit: tx.EU, SettlementDocID: tx.SettlementDocID}
+	}
+	want := [][]int{{0, 1, 2, 3}, {4}, {5, 6}, {7}}
+	if got := c.groupTransactions(txs, batch); !reflect.DeepEqual(got, want) {
+		t.Errorf("groupTransactions() = %v, want %v", got, want)
+	}
+}
+
+func TestBatchWorkers(t *testing.T) {
+	// Each chain only succeeds with overdrafts rejected if applied in submission order
+	var txs []Transaction
+	for chain := 0; chain < 5; chain++ {
+		till := func(n int) string { return fmt.Sprintf("till-%d-%d", chain, n) }
+		txs = append(txs,
+			transfer(VaultTill, till(0), cash(10)),
+			transfer(till(0), till(1), cash(10)),
+			transfer(till(1), till(2), cash(4)),
+			transfer(till(2), till(0), cash(4)),
+		)
+	}
+	var reads [][]Till
+	for _, workers := range []int{0, 4} {
+		c, _ := newTestClient(t)
+		ctx := context.Background()
+		c.BatchWorkers, c.RejectOverdrafts = workers, true
+		if err := c.ProcessTransactions(ctx, txs); err != nil {
+			t.Fatalf("ProcessTransactions() with %d workers error = %v", workers, err)
+		}
+		tills, err := c.GetExpectedTenders(ctx, testKey, WithReservedTills())
+		if err != nil {
+			t.Fatal(err)
+		}
+		reads = append(reads, tills)
+	}
+	if !reflect.DeepEqual(reads[1], reads[0]) {
+		t.Errorf("BatchWorkers 4 left %+v, sequential %+v", reads[1], reads[0])
+	}
+}
@@ -0,0 +1,473 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const scanCount = 100
+
+// globEscaper escapes the characters SCAN MATCH treats as glob syntax.
+var globEscaper = strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`, `]`, `\]`)
+
+// scanSettlements walks the settlement IDs of an org/EU with SCAN, calling fn once per
+// page so callers can batch follow-up reads. Candidates whose ID contains a separator are
+// skipped: those are nested keys (e.g. a denomination named "tills") rather than a
+// settlement's tills set, since an ID's own separators are escaped. IDs are de-duplicated since SCAN may return a key more than once.
+func (c Client) scanSettlements(ctx context.Context, org, eu string, fn func(ids []string) error) error {
+	// Split a tills set key around its settlement ID, which is followed by the closing
+	// brace of the hash tag when the format has one
+	if c.NormalizeKeys {
+		org, eu = normalizeKeyComponent(org), normalizeKeyComponent(eu)
+	}
+	const placeholder = "\x00"
+	prefix, suffix, _ := strings.Cut(Key{Organization: org, EnterpriseUnit: eu, SettlementDocID: placeholder, Format: c.KeyFormat}.TillsSetKey(), placeholder)
+	separator := c.KeyFormat.separator()
+	match := globEscaper.Replace(prefix) + "*" + globEscaper.Replace(suffix)
+
+	seen := make(map[string]struct{})
+	var cursor uint64
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		keys, next, err := c.reader(ReadOptions{}).Scan(ctx, cursor, match, scanCount).Result()
+		if err != nil {
+			return err
+		}
+		var ids []string
+		for _, k := range keys {
+			id := strings.TrimSuffix(strings.TrimPrefix(k, prefix), suffix)
+			if id == "" || strings.Contains(id, separator) {
+				continue
+			}
+			id, err := c.KeyFormat.unescape(id)
+			if err != nil {
+				continue
+			}
+			if _, ok := seen[id]; ok {
+				continue
+			}
+			seen[id] = struct{}{}
+			ids = append(ids, id)
+		}
+		if len(ids) > 0 {
+			if err := fn(ids); err != nil {
+				return err
+			}
+		}
+		if next == 0 {
+			return nil
+		}
+		cursor = next
+	}
+}
+
+// ScanSettlements returns the sorted IDs of every settlement of the org/EU that has a tills
+// set, discovered with SCAN so it is safe to run against a large keyspace.
+func (c Client) ScanSettlements(ctx context.Context, org, eu string) ([]string, error) {
+	var ids []string
+	err := c.scanSettlements(ctx, org, eu, func(page []string) error {
+		ids = append(ids, page...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+type Stats struct {
+	Settlements        int
+	AverageTills       float64
+	LargestSettlement  string // SettlementDocID with the most tills
+	LargestSettlementN int64  // Number of tills in LargestSettlement
+}
+
+// SettlementStats aggregates settlement sizes for an org/EU using only SCAN and SCARD, so
+// it stays cheap regardless of how much tender data each settlement holds.
+func (c Client) SettlementStats(ctx context.Context, org, eu string) (Stats, error) {
+	var stats Stats
+	var totalTills int64
+	err := c.scanSettlements(ctx, org, eu, func(ids []string) error {
+		pipe := c.reader(ReadOptions{}).Pipeline()
+		cmds := make([]*redis.IntCmd, len(ids))
+		for i, id := range ids {
+			cmds[i] = pipe.SCard(ctx, c.NewKey(org, eu, id).TillsSetKey())
+		}
+		if _, err := pipe.Exec(ctx); err != nil {
+			return err
+		}
+		for i, cmd := range cmds {
+			n := cmd.Val()
+			stats.Settlements++
+			totalTills += n
+			if n > stats.LargestSettlementN || stats.LargestSettlement == "" {
+				stats.LargestSettlement = ids[i]
+				stats.LargestSettlementN = n
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return Stats{}, err
+	}
+	if stats.Settlements > 0 {
+		stats.AverageTills = float64(totalTills) / float64(stats.Settlements)
+	}
+	return stats, nil
+}
+
+// ListNonZeroSettlements returns the sorted IDs of the org/EU's settlements in which any
+// real till, i.e. not a reserved pseudo-till, has a nonzero tender total. Only the tills and tenders sets and the tender totals are read,
+// batched per SCAN page; denomination data is never touched.
+func (c Client) ListNonZeroSettlements(ctx context.Context, org, eu string) ([]string, error) {
+	var nonZero []string
+	err := c.scanSettlements(ctx, org, eu, func(ids []string) error {
+		keys := make([]Key, len(ids))
+		tillCmds := make([]*redis.StringSliceCmd, len(ids))
+		pipe := c.reader(ReadOptions{}).Pipeline()
+		for i, id := range ids {
+			keys[i] = c.NewKey(org, eu, id)
+			tillCmds[i] = pipe.SMembers(ctx, keys[i].TillsSetKey())
+		}
+		if _, err := pipe.Exec(ctx); err != nil {
+			return err
+		}
+
+		type tillRef struct {
+			settlement int
+			till       string
+		}
+		var tills []tillRef
+		var tenderCmds []*redis.StringSliceCmd
+		for i, cmd := range tillCmds {
+			for _, tillID := range cmd.Val() {
+				if c.IsReservedTill(tillID) {
+					continue
+				}
+				tills = append(tills, tillRef{settlement: i, till: tillID})
+				tenderCmds = append(tenderCmds, pipe.SMembers(ctx, keys[i].TendersSetKey(tillID)))
+			}
+		}
+		if len(tenderCmds) == 0 {
+			return nil
+		}
+		if _, err := pipe.Exec(ctx); err != nil {
+			return err
+		}
+
+		var owners []int
+		var totalCmds []*redis.StringCmd
+		for i, cmd := range tenderCmds {
+			ref := tills[i]
+			for _, tenderID := range cmd.Val() {
+				owners = append(owners, ref.settlement)
+				totalCmds = append(totalCmds, pipe.Get(ctx, keys[ref.settlement].TenderKey(ref.till, tenderID)))
+			}
+		}
+		if len(totalCmds) == 0 {
+			return nil
+		}
+		if _, err := pipe.Exec(ctx); err != nil && !errors.Is(err, redis.Nil) {
+			return err
+		}
+
+		found := make([]bool, len(ids))
+		for i, cmd := range totalCmds {
+			raw, err := cmd.Result()
+			if errors.Is(err, redis.Nil) {
+				continue
+			}
+			amount, err := parseMoney(raw)
+			if err != nil {
+				return &ParseError{Key: fmt.Sprint(cmd.Args()[1]), Value: raw, Err: err}
+			}
+			if amount != 0 {
+				found[owners[i]] = true
+			}
+		}
+		for i, ok := range found {
+			if ok {
+				nonZero = append(nonZero, ids[i])
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(nonZero)
+	return nonZero, nil
+}
+
+// GetExpectedTendersMulti is GetExpectedTenders for several settlements, e.g. consecutive
+// business periods, returning each one's tills by SettlementDocID. The tills sets of all
+// settlements are read in one pipeline before the tills of each. The first failure is
+// returned naming its settlement, along with no results.
+func (c Client) GetExpectedTendersMulti(ctx context.Context, keys []Key, opts ...ReadOption) (map[string][]Till, error) {
+	o := newReadOptions(opts)
+	seen := make(map[string]struct{}, len(keys))
+	for _, key := range keys {
+		if _, ok := seen[key.SettlementDocID]; ok {
+			return nil, fmt.Errorf("duplicate settlement %s", key.SettlementDocID)
+		}
+		seen[key.SettlementDocID] = struct{}{}
+	}
+	results := make(map[string][]Till, len(keys))
+	if len(keys) == 0 {
+		return results, nil
+	}
+
+	pipe := c.reader(o).Pipeline()
+	tillCmds := make([]*redis.StringSliceCmd, len(keys))
+	for i, key := range keys {
+		tillCmds[i] = pipe.SMembers(ctx, key.TillsSetKey())
+	}
+	// Exec reports only the first failure, so find it per command
+	_, _ = pipe.Exec(ctx)
+	for i, key := range keys {
+		tillIDs, err := tillCmds[i].Result()
+		if err != nil {
+			return nil, fmt.Errorf("read tills of settlement %s: %w", key.SettlementDocID, wrapWrongType(ctx, c.reader(o), err, tillCmds[i]))
+		}
+		if len(tillIDs) == 0 {
+			return nil, fmt.Errorf("%w: %s", ErrSettlementNotFound, key.SettlementDocID)
+		}
+		var ids []string
+		for _, tillID := range tillIDs {
+			if !c.selectsTill(tillID, o) {
+				continue
+			}
+			ids = append(ids, tillID)
+		}
+		tills, err := c.readTills(ctx, key, ids, o)
+		if err != nil {
+			return nil, fmt.Errorf("settlement %s: %w", key.SettlementDocID, err)
+		}
+		results[key.SettlementDocID] = tills
+	}
+	return results, nil
+}
+
+// settlementKeys walks the settlement's set structure and returns every key belonging to
+// it: the settlement-level sets, checksum and updated timestamp, and each till's tenders set, tender totals
+// and metadata, denomination sets and denomination hashes. Reserved pseudo-tills are included.
+func (c Client) settlementKeys(ctx context.Context, key Key) ([]string, error) {
+	keys, err := c.settlementKeysAs(ctx, key, key)
+	if err != nil {
+		return nil, err
+	}
+	return keys[0], nil
+}
+
+// settlementKeysAs is settlementKeys walking key's sets but naming every key it finds as
+// each of as would, in the same order, so the names of one key can be mapped to another's.
+func (c Client) settlementKeysAs(ctx context.Context, key Key, as ...Key) ([][]string, error) {
+	keys := make([][]string, len(as))
+	add := func(name func(k Key) string) {
+		for i, k := range as {
+			keys[i] = append(keys[i], name(k))
+		}
+	}
+	add(Key.TillsSetKey)
+	add(Key.ClosedTillsSetKey)
+	add(Key.ChecksumKey)
+	add(Key.AppliedSetKey)
+	add(Key.AppliedKeysKey)
+	add(Key.BatchesKey)
+	add(Key.EventsStreamKey)
+	add(Key.TransactionsKey)
+	add(Key.TransactionLogKey)
+	add(Key.VersionKey)
+	add(Key.VersionsStreamKey)
+	add(Key.UpdatedKey)
+	add(Key.UnloggedKey)
+	tillIDs, err := c.SMembers(ctx, key.TillsSetKey()).Result()
+	if err != nil {
+		return nil, fmt.Errorf("read tills of settlement %s: %w", key.SettlementDocID, err)
+	}
+	if len(tillIDs) == 0 {
+		return keys, nil
+	}
+
+	pipe := c.Pipeline()
+	tenderCmds := make([]*redis.StringSliceCmd, len(tillIDs))
+	for i, tillID := range tillIDs {
+		add(func(k Key) string { return k.TendersSetKey(tillID) })
+		tenderCmds[i] = pipe.SMembers(ctx, key.TendersSetKey(tillID))
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, fmt.Errorf("read tenders of settlement %s: %w", key.SettlementDocID, err)
+	}
+
+	var owners []string
+	var tenderIDs []string
+	var denominationCmds []*redis.StringSliceCmd
+	for i, cmd := range tenderCmds {
+		tillID := tillIDs[i]
+		for _, tenderID := range cmd.Val() {
+			owners = append(owners, tillID)
+			tenderIDs = append(tenderIDs, tenderID)
+			add(func(k Key) string { return k.TenderKey(tillID, tenderID) })
+			add(func(k Key) string { return k.DenominationsSetKey(tillID, tenderID) })
+			add(func(k Key) string { return k.TenderMetaKey(tillID, tenderID) })
+			denominationCmds = append(denominationCmds, pipe.SMembers(ctx, key.DenominationsSetKey(tillID, tenderID)))
+		}
+	}
+	if len(denominationCmds) == 0 {
+		return keys, nil
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, fmt.Errorf("read denominations of settlement %s: %w", key.SettlementDocID, err)
+	}
+	for i, cmd := range denominationCmds {
+		for _, name := range cmd.Val() {
+			add(func(k Key) string { return k.DenominationKey(owners[i], tenderIDs[i], name) })
+		}
+	}
+	return keys, nil
+}
+
+// SetSettlementTTL sets every key of the settlement to expire after d, so a period that
+// is no longer needed cleans itself up. Calling it again refreshes the deadline. Keys
+// created after the call, e.g. by a transaction adding a new tender, don't expire until
+// it is called again; see Client.SettlementTTL to do that on every ProcessTransaction.
+func (c Client) SetSettlementTTL(ctx context.Context, key Key, d time.Duration) error {
+	done, err := c.begin()
+	if err != nil {
+		return err
+	}
+	defer done()
+	return c.setSettlementTTL(ctx, key, d)
+}
+
+// setSettlementTTL is SetSettlementTTL for writers already registered with begin.
+func (c Client) setSettlementTTL(ctx context.Context, key Key, d time.Duration) error {
+	if d <= 0 {
+		return fmt.Errorf("invalid settlement TTL %v", d)
+	}
+	keys, err := c.settlementKeys(ctx, key)
+	if err != nil {
+		return err
+	}
+	pipe := c.Pipeline()
+	for _, k := range keys {
+		pipe.Expire(ctx, k, d)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("expire settlement %s: %w", key.SettlementDocID, err)
+	}
+	return nil
+}
+
+// DeleteSettlement removes every key of the settlement. Keys are found with SCAN rather
+// than by walking the sets, so hashes and totals no longer referenced by any set are
+// removed too. It isn't atomic: a transaction applied while it runs may leave keys behind.
+// Afterwards the settlement reads like one never written, so GetExpectedTenders and the
+// other reads fail with ErrSettlementNotFound rather than returning no tills. Keys are
+// removed with UNLINK, so Redis frees large hashes and streams in the background.
+func (c Client) DeleteSettlement(ctx context.Context, key Key) error {
+	done, err := c.begin()
+	if err != nil {
+		return err
+	}
+	defer done()
+	return c.deleteSettlement(ctx, key)
+}
+
+func (c Client) deleteSettlement(ctx context.Context, key Key) error {
+	match := globEscaper.Replace(key.BaseKey()+key.Format.separator()) + "*"
+	var cursor uint64
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		keys, next, err := c.Scan(ctx, cursor, match, scanCount).Result()
+		if err != nil {
+			return fmt.Errorf("scan settlement %s: %w", key.SettlementDocID, err)
+		}
+		if len(keys) > 0 {
+			if err := c.Unlink(ctx, keys...).Err(); err != nil {
+				return fmt.Errorf("delete settlement %s: %w", key.SettlementDocID, err)
+			}
+		}
+		if next == 0 {
+			return nil
+		}
+		cursor = next
+	}
+}
+
+// touchSettlement queues on pipe the write marking the settlement updated now, see
+// UpdatedKey. Maintenance that leaves balances as they were, such as Vacuum and the
+// repairs and migrations, doesn't touch it.
+func (c Client) touchSettlement(ctx context.Context, pipe redis.Pipeliner, key Key) {
+	pipe.Set(ctx, key.UpdatedKey(), c.now().UnixMilli(), redis.KeepTTL)
+}
+
+// markUnlogged counts a write to the settlement's balances that the transaction log
+// doesn't record, so ReplayTransactions knows it can't rebuild them.
+func markUnlogged(ctx context.Context, pipe redis.Pipeliner, key Key) {
+	pipe.Incr(ctx, key.UnloggedKey())
+}
+
+// PurgeOldSettlements deletes, like DeleteSettlement, every settlement of the org/EU last
+// updated before olderThan, see UpdatedKey, and returns how many it deleted. Settlements
+// without an updated timestamp, last written before it was kept, are left alone. A
+// settlement written between its timestamp being read and its deletion is deleted anyway,
+// so purge periods that are no longer written to. It stops with ctx's error once ctx is
+// done, having purged the settlements counted.
+func (c Client) PurgeOldSettlements(ctx context.Context, org, eu string, olderThan time.Time) (purged int, err error) {
+	done, err := c.begin()
+	if err != nil {
+		return 0, err
+	}
+	defer done()
+	cutoff := olderThan.UnixMilli()
+	var old []Key
+	err = c.scanSettlements(ctx, org, eu, func(ids []string) error {
+		keys := make([]Key, len(ids))
+		updatedKeys := make([]string, len(ids))
+		for i, id := range ids {
+			keys[i] = c.NewKey(org, eu, id)
+			updatedKeys[i] = keys[i].UpdatedKey()
+		}
+		values, err := c.MGet(ctx, updatedKeys...).Result()
+		if err != nil {
+			return fmt.Errorf("read updated timestamps of %s/%s: %w", org, eu, err)
+		}
+		for i, value := range values {
+			raw, ok := value.(string)
+			if !ok {
+				continue
+			}
+			updated, err := strconv.ParseInt(raw, 10, 64)
+			if err != nil {
+				return &ParseError{Key: updatedKeys[i], Value: raw, Err: err}
+			}
+			if updated < cutoff {
+				old = append(old, keys[i])
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	for _, key := range old {
+		if err := c.deleteSettlement(ctx, key); err != nil {
+			return purged, err
+		}
+		purged++
+	}
+	return purged, nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSettlementStats(t *testing.T) {
+	c, _ := newTestClient(t)
+	ctx := context.Background()
+	if stats, err := c.SettlementStats(ctx, testKey.Organization, testKey.EnterpriseUnit); err != nil || stats != (Stats{}) {
+		t.Errorf("SettlementStats() of no settlements = %+v, %v, want zero", stats, err)
+	}
+	other := transfer(VaultTill, "till-9", cash(1))
+	other.Org = "other-org"
+	mustProcess(t, c,
+		transfer(VaultTill, "till-1", cash(10)),
+		transfer(VaultTill, "till-2", cash(10)),
+		inSettlement("settlement-2", transfer(VaultTill, "till-1", cash(5))),
+		other,
+	)
+
+	stats, err := c.SettlementStats(ctx, testKey.Organization, testKey.EnterpriseUnit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The vault is one of each settlement's tills
+	want := Stats{Settlements: 2, AverageTills: 2.5, LargestSettlement: testKey.SettlementDocID, LargestSettlementN: 3}
+	if stats != want {
+		t.Errorf("SettlementStats() = %+v, want %+v", stats, want)
+	}
+}
+
+func TestListNonZeroSettlements(t *testing.T) {
+	c, _ := newTestClient(t)
+	ctx := context.Background()
+	mustProcess(t, c,
+		transfer(VaultTill, "till-1", cash(10)),
+		// Only the vault, a reserved pseudo-till, is left nonzero
+		inSettlement("settlement-2", transfer(VaultTill, "till-1", cash(5))),
+		inSettlement("settlement-2", transfer("till-1", VaultTill, cash(5))),
+		inSettlement("settlement-3", transfer("till-1", "till-2", Tender{ID: "card", Amount: 1})),
+	)
+	got, err := c.ListNonZeroSettlements(ctx, testKey.Organization, testKey.EnterpriseUnit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{testKey.SettlementDocID, "settlement-3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ListNonZeroSettlements() = %v, want %v", got, want)
+	}
+}
+
+func TestScanSettlements(t *testing.T) {
+	c, _ := newTestClient(t)
+	ctx := context.Background()
+	if ids, err := c.ScanSettlements(ctx, testKey.Organization, testKey.EnterpriseUnit); err != nil || len(ids) != 0 {
+		t.Errorf("ScanSettlements() of no settlements = %v, %v, want none", ids, err)
+	}
+	other := transfer(VaultTill, "till-1", cash(1))
+	other.EU = "other-eu"
+	mustProcess(t, c,
+		transfer(VaultTill, "till-1", cash(1)),
+		// A denomination named like the tills set isn't a settlement
+		transfer(VaultTill, "till-1", Tender{ID: "cash", Amount: 1, TenderBreakdowns: []TenderInfo{{Name: "tills", Count: 1, Amount: 1}}}),
+		inSettlement("2026:03:02", transfer(VaultTill, "till-1", cash(1))),
+		inSettlement("settlement-*", transfer(VaultTill, "till-1", cash(1))),
+		other,
+	)
+	got, err := c.ScanSettlements(ctx, testKey.Organization, testKey.EnterpriseUnit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"2026:03:02", "settlement-*", testKey.SettlementDocID}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ScanSettlements() = %v, want %v", got, want)
+	}
+}
+
+func TestGetExpectedTendersMulti(t *testing.T) {
+	c, _ := newTestClient(t)
+	ctx := context.Background()
+	var keys []Key
+	for i := 1; i <= 3; i++ {
+		id := fmt.Sprintf("period-%d", i)
+		mustProcess(t, c, inSettlement(id, transfer(VaultTill, "till-1", cash(Money(i)))), inSettlement(id, transfer(VaultTill, fmt.Sprintf("till-%d", i+1), cash(1))))
+		key := testKey
+		key.SettlementDocID = id
+		keys = append(keys, key)
+	}
+
+	got, err := c.GetExpectedTendersMulti(ctx, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(keys) {
+		t.Errorf("GetExpectedTendersMulti() returned %d settlements, want %d", len(got), len(keys))
+	}
+	for _, key := range keys {
+		want, err := c.GetExpectedTenders(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got[key.SettlementDocID], want) {
+			t.Errorf("%s = %+v, want %+v", key.SettlementDocID, got[key.SettlementDocID], want)
+		}
+	}
+
+	missing := testKey
+	missing.SettlementDocID = "period-9"
+	if _, err := c.GetExpectedTendersMulti(ctx, append(keys, missing)); !errors.Is(err, ErrSettlementNotFound) || !strings.Contains(err.Error(), "period-9") {
+		t.Errorf("GetExpectedTendersMulti() with a missing settlement error = %v, want %v naming period-9", err, ErrSettlementNotFound)
+	}
+	if _, err := c.GetExpectedTendersMulti(ctx, []Key{keys[0], keys[0]}); err == nil {
+		t.Error("GetExpectedTendersMulti() of a duplicate settlement succeeded")
+	}
+}
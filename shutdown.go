@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+var ErrClientClosed = errors.New("client closed")
+
+// inflight tracks the writes in progress on a client created by NewClient, so Shutdown can
+// wait for them.
+type inflight struct {
+	mu          sync.Mutex
+	closed      bool
+	wg          sync.WaitGroup
+	stopJanitor context.CancelFunc // Set while the marker janitor runs, see StartMarkerJanitor
+}
+
+// begin registers a write and returns the func to call when it is done. It fails with
+// ErrClientClosed once Shutdown has started. Clients not created by NewClient aren't
+// tracked.
+func (c Client) begin() (func(), error) {
+	if c.inflight == nil {
+		return func() {}, nil
+	}
+	c.inflight.mu.Lock()
+	defer c.inflight.mu.Unlock()
+	if c.inflight.closed {
+		return nil, ErrClientClosed
+	}
+	c.inflight.wg.Add(1)
+	return c.inflight.wg.Done, nil
+}
+
+// Shutdown stops the client accepting new transactions, which fail with ErrClientClosed,
+// stops the marker janitor, waits for the transactions in progress to finish and then
+// closes the connections, the ReadClient's included. If ctx ends first the connections
+// are closed anyway and ctx's error is returned, possibly cutting off a transaction before
+// its EXEC; one already sent lands whole or not at all.
+func (c Client) Shutdown(ctx context.Context) error {
+	var waitErr error
+	if c.inflight != nil {
+		c.inflight.mu.Lock()
+		c.inflight.closed = true
+		if c.inflight.stopJanitor != nil {
+			c.inflight.stopJanitor()
+		}
+		c.inflight.mu.Unlock()
+		done := make(chan struct{})
+		go func() {
+			c.inflight.wg.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-ctx.Done():
+			waitErr = ctx.Err()
+		}
+	}
+	if c.ReadClient != nil {
+		if err := c.ReadClient.Close(); err != nil && waitErr == nil {
+			waitErr = err
+		}
+	}
+	if err := c.Client.Close(); err != nil && waitErr == nil {
+		waitErr = err
+	}
+	return waitErr
+}
+
+// Close is Shutdown without a deadline.
+func (c Client) Close() error {
+	return c.Shutdown(context.Background())
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWritesAfterShutdown(t *testing.T) {
+	c, _ := newTestClient(t)
+	ctx := context.Background()
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	float := []Tender{cash(10)}
+	writes := map[string]func() error{
+		"ProcessTransaction":  func() error { return c.ProcessTransaction(ctx, transfer("till-1", "till-2", cash(1))) },
+		"ProcessTransactions": func() error { return c.ProcessTransactions(ctx, []Transaction{transfer("till-1", "till-2", cash(1))}) },
+		"ProcessBatch": func() error {
+			return c.ProcessBatch(ctx, "batch-1", []Transaction{transfer("till-1", "till-2", cash(1))})
+		},
+		"ReverseTransaction": func() error { return c.ReverseTransaction(ctx, transfer("till-1", "till-2", cash(1))) },
+		"ReverseTransactionByID": func() error {
+			return c.ReverseTransactionByID(ctx, testKey, "tx-1")
+		},
+		"CorrectTransaction": func() error {
+			return c.CorrectTransaction(ctx, "tx-1", stored("tx-2", transfer("till-1", "till-2", cash(1))))
+		},
+		"ReplayTransactions":  func() error { return c.ReplayTransactions(ctx, testKey) },
+		"TrimOldLog":          func() error { return c.TrimOldLog(ctx, testKey) },
+		"OpenTill":            func() error { return c.OpenTill(ctx, testKey, "till-1", float) },
+		"ForceOpenTill":       func() error { return c.ForceOpenTill(ctx, testKey, "till-1", float) },
+		"CloseTill":           func() error { return c.CloseTill(ctx, testKey, "till-1", VaultTill) },
+		"ClearTill":           func() error { return c.ClearTill(ctx, testKey, "till-1") },
+		"RemoveTender":        func() error { return c.RemoveTender(ctx, testKey, "till-1", "cash") },
+		"Adjust":              func() error { return c.Adjust(ctx, testKey, "till-1", "cash", -1, nil) },
+		"TransferIfAvailable": func() error { return c.TransferIfAvailable(ctx, testKey, "till-1", "till-2", float) },
+		"Transfer": func() error {
+			_, _, err := c.Transfer(ctx, testKey, "till-1", "till-2", float)
+			return err
+		},
+		"ConvertTender":  func() error { return c.ConvertTender(ctx, testKey, "till-1", "cash@EUR", "cash@USD", 1.1) },
+		"MoveTender":     func() error { return c.MoveTender(ctx, testKey, "till-1", "till-2", "cash") },
+		"SetTenderCount": func() error { return c.SetTenderCount(ctx, testKey, "till-1", cash(5)) },
+		"CompareAndSetDenomination": func() error {
+			_, err := c.CompareAndSetDenomination(ctx, testKey, "till-1", "cash", "bill", TenderInfo{}, TenderInfo{Count: 1, Amount: 1})
+			return err
+		},
+		"ImportCountCSV": func() error {
+			return c.ImportCountCSV(ctx, testKey, "till-1", strings.NewReader("tender,denomination,count\ncash,bill,1\n"), map[string]Money{"bill": 1})
+		},
+		"ImportSettlement":      func() error { return c.ImportSettlement(ctx, []byte("{}")) },
+		"ForceImportSettlement": func() error { return c.ForceImportSettlement(ctx, []byte("{}")) },
+		"CopySettlement": func() error {
+			return c.CopySettlement(ctx, testKey, Key{Organization: "o", EnterpriseUnit: "e", SettlementDocID: "s"})
+		},
+		"RestoreSettlement": func() error {
+			return c.RestoreSettlement(ctx, map[string][]byte{"k": nil}, true)
+		},
+		"SetSettlementTTL": func() error { return c.SetSettlementTTL(ctx, testKey, time.Hour) },
+		"DeleteSettlement": func() error { return c.DeleteSettlement(ctx, testKey) },
+		"PurgeOldSettlements": func() error {
+			_, err := c.PurgeOldSettlements(ctx, testKey.Organization, testKey.EnterpriseUnit, time.Now())
+			return err
+		},
+		"RepairTenderTotals": func() error {
+			_, err := c.RepairTenderTotals(ctx, testKey)
+			return err
+		},
+		"Vacuum": func() error {
+			_, err := c.Vacuum(ctx, testKey)
+			return err
+		},
+		"CleanOrphans": func() error {
+			_, err := c.CleanOrphans(ctx, testKey)
+			return err
+		},
+		"MigrateToMinorUnits": func() error {
+			_, err := c.MigrateToMinorUnits(ctx, testKey, 2)
+			return err
+		},
+		"PruneExpiredMarkers": func() error {
+			_, err := c.PruneExpiredMarkers(ctx)
+			return err
+		},
+		"MigrateKeyEscaping": func() error {
+			_, err := c.MigrateKeyEscaping(ctx, testKey)
+			return err
+		},
+	}
+	for name, write := range writes {
+		t.Run(name, func(t *testing.T) {
+			if err := write(); !errors.Is(err, ErrClientClosed) {
+				t.Errorf("%s() after Close error = %v, want %v", name, err, ErrClientClosed)
+			}
+		})
+	}
+}
+
+func TestShutdownWaitsForWrites(t *testing.T) {
+	c, _ := newTestClient(t)
+	done, err := c.begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := c.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Shutdown() with a write in progress error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	done()
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// SnapshotSettlement DUMPs every key of the settlement, found with SCAN like
+// DeleteSettlement does, and returns the serialized values by key for RestoreSettlement.
+// The keys are read one page at a time, so a transaction applied meanwhile may be only
+// partly captured; take snapshots of settlements no longer written to. Expiries aren't
+// captured.
+func (c Client) SnapshotSettlement(ctx context.Context, key Key) (map[string][]byte, error) {
+	match := globEscaper.Replace(key.BaseKey()+key.Format.separator()) + "*"
+	snapshot := make(map[string][]byte)
+	var cursor uint64
+	for {
+		keys, next, err := c.Scan(ctx, cursor, match, scanCount).Result()
+		if err != nil {
+			return nil, fmt.Errorf("scan settlement %s: %w", key.SettlementDocID, err)
+		}
+		if len(keys) > 0 {
+			pipe := c.Pipeline()
+			cmds := make([]*redis.StringCmd, len(keys))
+			for i, k := range keys {
+				cmds[i] = pipe.Dump(ctx, k)
+			}
+			if _, err := pipe.Exec(ctx); err != nil && !errors.Is(err, redis.Nil) {
+				return nil, fmt.Errorf("dump settlement %s: %w", key.SettlementDocID, err)
+			}
+			for i, cmd := range cmds {
+				data, err := cmd.Result()
+				if errors.Is(err, redis.Nil) {
+					continue // deleted since the scan
+				}
+				snapshot[keys[i]] = []byte(data)
+			}
+		}
+		if next == 0 {
+			return snapshot, nil
+		}
+		cursor = next
+	}
+}
+
+// RestoreSettlement RESTOREs a snapshot taken with SnapshotSettlement in one MULTI/EXEC.
+// Unless replace is set it fails with ErrSettlementExists, restoring nothing, if any of
+// the keys already exists; a key created concurrently after that check is left as it is
+// and reported the same way once the rest are restored.
+func (c Client) RestoreSettlement(ctx context.Context, snapshot map[string][]byte, replace bool) error {
+	done, err := c.begin()
+	if err != nil {
+		return err
+	}
+	defer done()
+	if len(snapshot) == 0 {
+		return nil
+	}
+	keys := sortedKeys(snapshot)
+	if !replace {
+		existing, err := c.Exists(ctx, keys...).Result()
+		if err != nil {
+			return fmt.Errorf("check snapshot keys: %w", err)
+		}
+		if existing > 0 {
+			return fmt.Errorf("%w: %d of the snapshot's keys already exist", ErrSettlementExists, existing)
+		}
+	}
+	cmds := make([]*redis.StatusCmd, len(keys))
+	_, err = c.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, k := range keys {
+			if replace {
+				cmds[i] = pipe.RestoreReplace(ctx, k, 0, string(snapshot[k]))
+			} else {
+				cmds[i] = pipe.Restore(ctx, k, 0, string(snapshot[k]))
+			}
+		}
+		return nil
+	})
+	for i, cmd := range cmds {
+		if cmd != nil && cmd.Err() != nil && strings.HasPrefix(cmd.Err().Error(), "BUSYKEY") {
+			return fmt.Errorf("%w: %s", ErrSettlementExists, keys[i])
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("restore snapshot: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+// miniredis has no DUMP or RESTORE, so only what SnapshotSettlement and RestoreSettlement
+// decide before sending either is tested here.
+func TestRestoreSettlementExisting(t *testing.T) {
+	c, mr := newTestClient(t)
+	ctx := context.Background()
+	empty, err := c.SnapshotSettlement(ctx, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(empty) != 0 {
+		t.Errorf("SnapshotSettlement() of an empty settlement = %v, want no keys", empty)
+	}
+	if err := c.RestoreSettlement(ctx, empty, false); err != nil {
+		t.Errorf("RestoreSettlement() of an empty snapshot error = %v", err)
+	}
+
+	mustProcess(t, c, transfer(VaultTill, "till-1", cash(5)))
+	snapshot := map[string][]byte{
+		testKey.TenderKey("till-1", "cash"): []byte("dump"),
+		testKey.TenderKey("till-2", "cash"): []byte("dump"),
+	}
+	if err := c.RestoreSettlement(ctx, snapshot, false); !errors.Is(err, ErrSettlementExists) {
+		t.Fatalf("RestoreSettlement() over an existing key error = %v, want %v", err, ErrSettlementExists)
+	}
+	if mr.Exists(testKey.TenderKey("till-2", "cash")) {
+		t.Error("RestoreSettlement() restored a key despite the conflict")
+	}
+	if got := tenderAmount(t, c, "till-1", "cash"); got != 5 {
+		t.Errorf("till-1 total = %v, want 5", got)
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"sort"
+)
+
+// streamBatchSize is how many tills StreamTills reads per batch of pipelines.
+const streamBatchSize = 100
+
+// StreamTills is GetExpectedTenders calling fn with each till as it is read instead of
+// returning them all, so only streamBatchSize tills are held in memory at a time. Tills
+// come sorted by ID. The first error from fn stops the read and is returned as is.
+func (c Client) StreamTills(ctx context.Context, key Key, fn func(Till) error, opts ...ReadOption) error {
+	o := newReadOptions(opts)
+	ids, err := c.selectedTills(ctx, key, o)
+	if err != nil {
+		return err
+	}
+	sort.Strings(ids)
+
+	for start := 0; start < len(ids); start += streamBatchSize {
+		end := start + streamBatchSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+		tills, err := c.readTills(ctx, key, ids[start:end], o)
+		if err != nil {
+			return err
+		}
+		for _, till := range tills {
+			if err := fn(till); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestStreamTills(t *testing.T) {
+	c, mr := newTestClient(t)
+	ctx := context.Background()
+	const tills = 2*streamBatchSize + 10
+	for i := 0; i < tills; i++ {
+		mustProcess(t, c, transfer(VaultTill, fmt.Sprintf("till-%03d", i), cash(1)))
+	}
+	want, err := c.GetExpectedTenders(ctx, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []Till
+	before := mr.CommandCount()
+	if err := c.StreamTills(ctx, testKey, func(till Till) error {
+		got = append(got, till)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	full := mr.CommandCount() - before
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("StreamTills() passed %d tills, want the %d GetExpectedTenders returns in order", len(got), len(want))
+	}
+
+	// Stopping in the second batch leaves the third unread
+	errStop := errors.New("stop")
+	calls := 0
+	before = mr.CommandCount()
+	err = c.StreamTills(ctx, testKey, func(Till) error {
+		calls++
+		if calls == streamBatchSize+1 {
+			return errStop
+		}
+		return nil
+	})
+	if err != errStop {
+		t.Errorf("StreamTills() error = %v, want the callback's %v", err, errStop)
+	}
+	if calls != streamBatchSize+1 {
+		t.Errorf("callback called %d times, want %d", calls, streamBatchSize+1)
+	}
+	if n := mr.CommandCount() - before; n >= full {
+		t.Errorf("stopped stream ran %d commands, a full one %d", n, full)
+	}
+}
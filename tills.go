@@ -0,0 +1,484 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/redis/go-redis/v9"
+)
+
+var (
+	ErrSettlementNotFound = errors.New("settlement not found")
+	ErrTillNotFound       = errors.New("till not found")
+	ErrTenderNotFound     = errors.New("tender not found")
+)
+
+// GetTill reads a single till the way GetExpectedTenders reads every till of the
+// settlement. It fails with ErrTillNotFound if the till isn't in the settlement's tills
+// set, which a till with no tenders still is, and with ErrSettlementNotFound if there is
+// no such set.
+func (c Client) GetTill(ctx context.Context, key Key, tillID string, opts ...ReadOption) (Till, error) {
+	o := newReadOptions(opts)
+	pipe := c.reader(o).Pipeline()
+	member := pipe.SIsMember(ctx, key.TillsSetKey(), tillID)
+	exists := pipe.Exists(ctx, key.TillsSetKey())
+	if _, err := pipe.Exec(ctx); err != nil {
+		return Till{}, fmt.Errorf("read tills of settlement %s: %w", key.SettlementDocID, err)
+	}
+	if exists.Val() == 0 {
+		return Till{}, fmt.Errorf("%w: %s", ErrSettlementNotFound, key.SettlementDocID)
+	}
+	if !member.Val() {
+		return Till{}, fmt.Errorf("%w: %s", ErrTillNotFound, tillID)
+	}
+	return c.getTill(ctx, key, tillID, o)
+}
+
+// GetTenderBreakdown reads a single tender of a till with its denominations, touching only
+// that tender's keys. tenderID is the stored ID, see Tender.StoredID. It fails with
+// ErrTenderNotFound if the tender isn't in the till's tenders set.
+func (c Client) GetTenderBreakdown(ctx context.Context, key Key, tillID, tenderID string) (Tender, error) {
+	pipe := c.reader(ReadOptions{}).Pipeline()
+	held := pipe.SIsMember(ctx, key.TendersSetKey(tillID), tenderID)
+	names := pipe.SMembers(ctx, key.DenominationsSetKey(tillID, tenderID))
+	if _, err := pipe.Exec(ctx); err != nil {
+		return Tender{}, fmt.Errorf("read till %s tender %s: %w", tillID, tenderID, err)
+	}
+	if !held.Val() {
+		return Tender{}, fmt.Errorf("%w: till %s tender %s", ErrTenderNotFound, tillID, tenderID)
+	}
+	tills, err := c.readTenders(ctx, key, []string{tillID}, []tenderRef{{tender: tenderID, denominations: names.Val()}}, ReadOptions{})
+	if err != nil {
+		return Tender{}, err
+	}
+	return tills[0].Tenders[0], nil
+}
+
+// GetDenomination reads a single denomination hash. tenderID and denomination are the
+// stored ID and name. found is false, with no error, if the hash doesn't exist; a hash
+// whose count or amount doesn't parse fails with a *ParseError.
+func (c Client) GetDenomination(ctx context.Context, key Key, tillID, tenderID, denomination string) (info TenderInfo, found bool, err error) {
+	denominationKey := key.DenominationKey(tillID, tenderID, denomination)
+	fields, err := c.reader(ReadOptions{}).HGetAll(ctx, denominationKey).Result()
+	if err != nil {
+		return TenderInfo{}, false, fmt.Errorf("read %s: %w", denominationKey, err)
+	}
+	if len(fields) == 0 {
+		return TenderInfo{}, false, nil
+	}
+	_, currency := splitCurrency(tenderID)
+	info, err = parseDenomination(denominationKey, denomination, currency, fields, ReadOptions{})
+	if err != nil {
+		return TenderInfo{}, false, err
+	}
+	return info, true, nil
+}
+
+// GetTenderAmount reads a single tender total with one GET, without touching the till's
+// sets or denominations. tenderID is the stored ID. found is false, with no error, if the
+// total doesn't exist; a total that doesn't parse fails with a *ParseError.
+func (c Client) GetTenderAmount(ctx context.Context, key Key, tillID, tenderID string) (amount Money, found bool, err error) {
+	tenderKey := key.TenderKey(tillID, tenderID)
+	raw, err := c.reader(ReadOptions{}).Get(ctx, tenderKey).Result()
+	if errors.Is(err, redis.Nil) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, fmt.Errorf("read %s: %w", tenderKey, err)
+	}
+	amount, err = parseMoney(raw)
+	if err != nil {
+		return 0, false, &ParseError{Key: tenderKey, Value: raw, Err: err}
+	}
+	return amount, true, nil
+}
+
+// GetTillBalances returns each till's expected total across all of its tenders, summed
+// from the tender totals without reading any denominations. Missing totals count as zero.
+// Reserved pseudo-tills are left out unless WithReservedTills is given.
+func (c Client) GetTillBalances(ctx context.Context, key Key, opts ...ReadOption) (map[string]Money, error) {
+	totals, err := c.readTenderTotals(ctx, key, newReadOptions(opts))
+	if err != nil {
+		return nil, err
+	}
+	balances := make(map[string]Money, len(totals))
+	for tillID, tenders := range totals {
+		balances[tillID] = 0
+		for _, amount := range tenders {
+			balances[tillID] += amount
+		}
+	}
+	return balances, nil
+}
+
+// GetTenderTotals returns each tender's expected total summed across every till of the
+// settlement, keyed by stored tender ID, without reading any denominations. Missing totals
+// count as zero. Reserved pseudo-tills are left out unless WithReservedTills is given, so
+// by default the totals are what the real tills hold.
+func (c Client) GetTenderTotals(ctx context.Context, key Key, opts ...ReadOption) (map[string]Money, error) {
+	totals, err := c.readTenderTotals(ctx, key, newReadOptions(opts))
+	if err != nil {
+		return nil, err
+	}
+	sums := make(map[string]Money)
+	for _, tenders := range totals {
+		for tenderID, amount := range tenders {
+			sums[tenderID] += amount
+		}
+	}
+	return sums, nil
+}
+
+type Summary struct {
+	TillCount    int
+	TillIDs      []string         // Sorted
+	TenderTotals map[string]Money // By stored tender ID, summed across tills
+	GrandTotal   Money            // Sum of TenderTotals
+}
+
+// GetSettlementSummary returns the settlement's tills and its tender and grand totals for
+// a dashboard, in the three round trips readTenderTotals makes, without reading any
+// denominations. Reserved pseudo-tills are left out unless WithReservedTills is given.
+func (c Client) GetSettlementSummary(ctx context.Context, key Key, opts ...ReadOption) (Summary, error) {
+	totals, err := c.readTenderTotals(ctx, key, newReadOptions(opts))
+	if err != nil {
+		return Summary{}, err
+	}
+	summary := Summary{
+		TillCount:    len(totals),
+		TillIDs:      sortedKeys(totals),
+		TenderTotals: make(map[string]Money),
+	}
+	for _, tenders := range totals {
+		for tenderID, amount := range tenders {
+			summary.TenderTotals[tenderID] += amount
+			summary.GrandTotal += amount
+		}
+	}
+	return summary, nil
+}
+
+// readTenderTotals returns till ID -> tender ID -> tender total, in one MGET after one
+// pipeline of tenders sets. Every selected till is present, even without tenders.
+func (c Client) readTenderTotals(ctx context.Context, key Key, o ReadOptions) (map[string]map[string]Money, error) {
+	r := c.reader(o)
+	cmd := r.SMembers(ctx, key.TillsSetKey())
+	tillIDs, err := cmd.Result()
+	if err != nil {
+		return nil, fmt.Errorf("read tills of settlement %s: %w", key.SettlementDocID, wrapWrongType(ctx, r, err, cmd))
+	}
+	if len(tillIDs) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrSettlementNotFound, key.SettlementDocID)
+	}
+	totals := make(map[string]map[string]Money, len(tillIDs))
+	pipe := r.Pipeline()
+	var ids []string
+	var tenderCmds []*redis.StringSliceCmd
+	for _, tillID := range tillIDs {
+		if !c.selectsTill(tillID, o) {
+			continue
+		}
+		totals[tillID] = make(map[string]Money)
+		ids = append(ids, tillID)
+		tenderCmds = append(tenderCmds, pipe.SMembers(ctx, key.TendersSetKey(tillID)))
+	}
+	if len(ids) == 0 {
+		return totals, nil
+	}
+	if cmds, err := pipe.Exec(ctx); err != nil {
+		return nil, fmt.Errorf("read tenders of settlement %s: %w", key.SettlementDocID, wrapWrongType(ctx, r, err, cmds...))
+	}
+
+	var owners, tenderIDs, tenderKeys []string
+	for i, cmd := range tenderCmds {
+		for _, tenderID := range cmd.Val() {
+			if !o.selectsTender(tenderID) {
+				continue
+			}
+			owners = append(owners, ids[i])
+			tenderIDs = append(tenderIDs, tenderID)
+			tenderKeys = append(tenderKeys, key.TenderKey(ids[i], tenderID))
+		}
+	}
+	amounts, err := mgetTenderTotals(ctx, r, tenderKeys, tenderKeys)
+	if err != nil {
+		return nil, err
+	}
+	for i, tenderKey := range tenderKeys {
+		totals[owners[i]][tenderIDs[i]] = amounts[tenderKey]
+	}
+	return totals, nil
+}
+
+// CountTills returns the number of tills in the settlement, leaving out reserved
+// pseudo-tills like ListTills does, with one SCARD pipelined with an SISMEMBER per
+// pseudo-till. A settlement without a tills set has none.
+func (c Client) CountTills(ctx context.Context, key Key) (int64, error) {
+	reserved := c.reservedTills()
+	var card *redis.IntCmd
+	memberCmds := make([]*redis.BoolCmd, len(reserved))
+	_, err := c.reader(ReadOptions{}).Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		card = pipe.SCard(ctx, key.TillsSetKey())
+		for i, tillID := range reserved {
+			memberCmds[i] = pipe.SIsMember(ctx, key.TillsSetKey(), tillID)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("count tills of settlement %s: %w", key.SettlementDocID, err)
+	}
+	n := card.Val()
+	for _, cmd := range memberCmds {
+		if cmd.Val() {
+			n--
+		}
+	}
+	return n, nil
+}
+
+// ListTills returns the sorted IDs of the settlement's tills, an empty slice if it has
+// none, without reading any tenders. Selection follows the read options, so reserved
+// pseudo-tills are left out unless WithReservedTills is given.
+func (c Client) ListTills(ctx context.Context, key Key, opts ...ReadOption) ([]string, error) {
+	o := newReadOptions(opts)
+	cmd := c.reader(o).SMembers(ctx, key.TillsSetKey())
+	tillIDs, err := cmd.Result()
+	if err != nil {
+		return nil, fmt.Errorf("read tills of settlement %s: %w", key.SettlementDocID, wrapWrongType(ctx, c.reader(o), err, cmd))
+	}
+	ids := []string{}
+	for _, tillID := range tillIDs {
+		if c.selectsTill(tillID, o) {
+			ids = append(ids, tillID)
+		}
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// CountTenders returns the number of tenders the till holds with one SCARD. A till without
+// a tenders set has none.
+func (c Client) CountTenders(ctx context.Context, key Key, tillID string) (int64, error) {
+	n, err := c.reader(ReadOptions{}).SCard(ctx, key.TendersSetKey(tillID)).Result()
+	if err != nil {
+		return 0, fmt.Errorf("count tenders of till %s: %w", tillID, err)
+	}
+	return n, nil
+}
+
+type CapacityBreach struct {
+	Tender       string
+	Denomination string
+	Count        int
+	Capacity     int64
+}
+
+// CheckCapacity reports every denomination in the till whose count exceeds its drawer
+// slot capacity. capacity is keyed by denomination name; denominations without an entry
+// are unbounded. Breaches are ordered by tender then denomination.
+func (c Client) CheckCapacity(ctx context.Context, key Key, tillID string, capacity map[string]int64) ([]CapacityBreach, error) {
+	till, err := c.getTill(ctx, key, tillID, ReadOptions{})
+	if err != nil {
+		return nil, err
+	}
+	var breaches []CapacityBreach
+	for _, tender := range till.Tenders {
+		for _, denomination := range tender.TenderBreakdowns {
+			limit, ok := capacity[denomination.Name]
+			if !ok || int64(denomination.Count) <= limit {
+				continue
+			}
+			breaches = append(breaches, CapacityBreach{
+				Tender:       tender.StoredID(),
+				Denomination: denomination.Name,
+				Count:        denomination.Count,
+				Capacity:     limit,
+			})
+		}
+	}
+	sort.Slice(breaches, func(i, j int) bool {
+		if breaches[i].Tender != breaches[j].Tender {
+			return breaches[i].Tender < breaches[j].Tender
+		}
+		return breaches[i].Denomination < breaches[j].Denomination
+	})
+	return breaches, nil
+}
+
+type CountSheetLine struct {
+	Tender        string
+	Denomination  string
+	FaceValue     Money // Per-unit value, derived as amount / count rounded down; 0 when the count is 0
+	ExpectedCount int
+}
+
+// CountSheetTemplate lists every denomination expected in the till, one line per
+// (tender, denomination), for cashiers to fill in during a physical recount. Lines are
+// ordered by tender, then by face value descending.
+func (c Client) CountSheetTemplate(ctx context.Context, key Key, tillID string) ([]CountSheetLine, error) {
+	till, err := c.getTill(ctx, key, tillID, ReadOptions{})
+	if err != nil {
+		return nil, err
+	}
+	var lines []CountSheetLine
+	for _, tender := range till.Tenders {
+		for _, denomination := range tender.TenderBreakdowns {
+			var face Money
+			if denomination.Count != 0 {
+				face = denomination.Amount / Money(denomination.Count)
+			}
+			lines = append(lines, CountSheetLine{
+				Tender:        tender.StoredID(),
+				Denomination:  denomination.Name,
+				FaceValue:     face,
+				ExpectedCount: denomination.Count,
+			})
+		}
+	}
+	sort.Slice(lines, func(i, j int) bool {
+		if lines[i].Tender != lines[j].Tender {
+			return lines[i].Tender < lines[j].Tender
+		}
+		if lines[i].FaceValue != lines[j].FaceValue {
+			return lines[i].FaceValue > lines[j].FaceValue
+		}
+		return lines[i].Denomination < lines[j].Denomination
+	})
+	return lines, nil
+}
+
+// AverageDenominationValue returns the tender's average value per physical unit, its total
+// denomination amount divided by its total denomination count, in minor units. A tender
+// with no counted units averages 0.
+func (c Client) AverageDenominationValue(ctx context.Context, key Key, tillID, tenderID string) (float64, error) {
+	denominations, err := c.getDenominations(ctx, key, tillID, tenderID, ReadOptions{})
+	if err != nil {
+		return 0, err
+	}
+	var amount Money
+	var count int
+	for _, denomination := range denominations {
+		amount += denomination.Amount
+		count += denomination.Count
+	}
+	if count == 0 {
+		return 0, nil
+	}
+	return float64(amount) / float64(count), nil
+}
+
+// GetTillSnapshot reads a till like GetExpectedTenders does, but from the primary under
+// WATCH: every key is watched before it is read and the read only stands if an empty
+// MULTI/EXEC confirms none of them changed, so the result reflects one point in time even
+// while transactions are being applied to the till. A read torn by a concurrent write is
+// retried up to Client.MaxRetries times before failing with ErrMaxRetriesExceeded. Use it
+// where a torn read would show up as a false variance, e.g. during reconciliation. A tender
+// in the till's tenders set without a total reads as zero.
+func (c Client) GetTillSnapshot(ctx context.Context, key Key, tillID string) (Till, error) {
+	var till Till
+	err := c.watchRetry(ctx, func(tx *redis.Tx) error {
+		tenderIDs, err := tx.SMembers(ctx, key.TendersSetKey(tillID)).Result()
+		if err != nil {
+			return fmt.Errorf("read tenders of till %s: %w", tillID, err)
+		}
+		var watched []string
+		for _, tenderID := range tenderIDs {
+			watched = append(watched, key.TenderKey(tillID, tenderID), key.DenominationsSetKey(tillID, tenderID))
+		}
+		if len(watched) > 0 {
+			if err := tx.Watch(ctx, watched...).Err(); err != nil {
+				return err
+			}
+		}
+		nameCmds := make([]*redis.StringSliceCmd, len(tenderIDs))
+		if _, err := tx.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for i, tenderID := range tenderIDs {
+				nameCmds[i] = pipe.SMembers(ctx, key.DenominationsSetKey(tillID, tenderID))
+			}
+			return nil
+		}); err != nil {
+			return fmt.Errorf("read denominations of till %s: %w", tillID, err)
+		}
+
+		watched = watched[:0]
+		for i, tenderID := range tenderIDs {
+			for _, name := range nameCmds[i].Val() {
+				watched = append(watched, key.DenominationKey(tillID, tenderID, name))
+			}
+		}
+		if len(watched) > 0 {
+			if err := tx.Watch(ctx, watched...).Err(); err != nil {
+				return err
+			}
+		}
+		totalCmds := make([]*redis.StringCmd, len(tenderIDs))
+		hashCmds := make([][]*redis.MapStringStringCmd, len(tenderIDs))
+		if _, err := tx.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for i, tenderID := range tenderIDs {
+				totalCmds[i] = pipe.Get(ctx, key.TenderKey(tillID, tenderID))
+				for _, name := range nameCmds[i].Val() {
+					hashCmds[i] = append(hashCmds[i], pipe.HGetAll(ctx, key.DenominationKey(tillID, tenderID, name)))
+				}
+			}
+			return nil
+		}); err != nil && !errors.Is(err, redis.Nil) {
+			return fmt.Errorf("read tenders of till %s: %w", tillID, err)
+		}
+
+		till = Till{ID: tillID}
+		for i, tenderID := range tenderIDs {
+			tenderKey := key.TenderKey(tillID, tenderID)
+			var total Money
+			rawTotal, err := totalCmds[i].Result()
+			switch {
+			case errors.Is(err, redis.Nil):
+			case err != nil:
+				return fmt.Errorf("read %s: %w", tenderKey, err)
+			default:
+				if total, err = parseMoney(rawTotal); err != nil {
+					return &ParseError{Key: tenderKey, Value: rawTotal, Err: err}
+				}
+			}
+			tender := tenderFromStoredID(tenderID)
+			tender.Amount = total
+			for j, name := range nameCmds[i].Val() {
+				info, err := parseDenomination(key.DenominationKey(tillID, tenderID, name), name, tender.Currency, hashCmds[i][j].Val(), ReadOptions{})
+				if err != nil {
+					return err
+				}
+				tender.TenderBreakdowns = append(tender.TenderBreakdowns, info)
+			}
+			till.Tenders = append(till.Tenders, tender)
+		}
+
+		// Nothing to write: EXEC only confirms that no watched key changed while read
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Ping(ctx)
+			return nil
+		})
+		return err
+	}, key.TendersSetKey(tillID))
+	if err != nil {
+		return Till{}, err
+	}
+	sortTills([]Till{till})
+	return till, nil
+}
+
+// CommonDenominations returns the sorted stored names of the denominations both tills hold
+// of the tender, with one SINTER of their denomination sets, and an empty slice when they
+// share none or either set is missing. On a cluster both sets must hash to one slot, as
+// they do with KeyFormat.HashTag.
+func (c Client) CommonDenominations(ctx context.Context, key Key, tillA, tillB, tenderID string) ([]string, error) {
+	names, err := c.reader(ReadOptions{}).SInter(ctx, key.DenominationsSetKey(tillA, tenderID), key.DenominationsSetKey(tillB, tenderID)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("intersect denominations of tills %s and %s tender %s: %w", tillA, tillB, tenderID, err)
+	}
+	if names == nil {
+		names = []string{}
+	}
+	sort.Strings(names)
+	return names, nil
+}
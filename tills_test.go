@@ -0,0 +1,337 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestCheckCapacity(t *testing.T) {
+	c, _ := newTestClient(t)
+	ctx := context.Background()
+	mustProcess(t, c, transfer(VaultTill, "till-1",
+		Tender{ID: "cash", Amount: 130, TenderBreakdowns: []TenderInfo{{Name: "bill", Count: 101, Amount: 101}, {Name: "coin", Count: 29, Amount: 29}}},
+		Tender{ID: "cash", Currency: "EUR", Amount: 50, TenderBreakdowns: []TenderInfo{{Name: "bill", Count: 50, Amount: 50}}},
+	))
+
+	got, err := c.CheckCapacity(ctx, testKey, "till-1", map[string]int64{"bill": 40, "coin": 30})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []CapacityBreach{
+		{Tender: "cash", Denomination: "bill", Count: 101, Capacity: 40},
+		{Tender: "cash@EUR", Denomination: "bill", Count: 50, Capacity: 40},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("CheckCapacity() = %+v, want %+v", got, want)
+	}
+	// Denominations without a capacity are unbounded, and filling a slot exactly is fine
+	if got, err := c.CheckCapacity(ctx, testKey, "till-1", map[string]int64{"coin": 29}); err != nil || len(got) != 0 {
+		t.Errorf("CheckCapacity() within capacity = %+v, %v, want none", got, err)
+	}
+}
+
+func TestCountSheetTemplate(t *testing.T) {
+	c, _ := newTestClient(t)
+	ctx := context.Background()
+	mustProcess(t, c, transfer(VaultTill, "till-1",
+		Tender{ID: "cash", Amount: 230, TenderBreakdowns: []TenderInfo{{Name: "five", Count: 2, Amount: 10}, {Name: "hundred", Count: 2, Amount: 200}, {Name: "twenty", Count: 1, Amount: 20}}},
+		Tender{ID: "check", Amount: 7, TenderBreakdowns: []TenderInfo{{Name: "stub", Count: 3, Amount: 7}}},
+	))
+	// Counted out to zero, so its face value is unknown
+	mustProcess(t, c, transfer("till-1", VaultTill, Tender{ID: "cash", Amount: 20, TenderBreakdowns: []TenderInfo{{Name: "twenty", Count: 1, Amount: 20}}}))
+
+	got, err := c.CountSheetTemplate(ctx, testKey, "till-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []CountSheetLine{
+		{Tender: "cash", Denomination: "hundred", FaceValue: 100, ExpectedCount: 2},
+		{Tender: "cash", Denomination: "five", FaceValue: 5, ExpectedCount: 2},
+		{Tender: "cash", Denomination: "twenty"},
+		{Tender: "check", Denomination: "stub", FaceValue: 2, ExpectedCount: 3}, // Rounded down
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("CountSheetTemplate() = %+v, want %+v", got, want)
+	}
+}
+
+func TestAverageDenominationValue(t *testing.T) {
+	c, _ := newTestClient(t)
+	ctx := context.Background()
+	mustProcess(t, c, transfer(VaultTill, "till-1",
+		Tender{ID: "cash", Amount: 250, TenderBreakdowns: []TenderInfo{{Name: "hundred", Count: 2, Amount: 200}, {Name: "ten", Count: 5, Amount: 50}}},
+		Tender{ID: "card", Amount: 9},
+	))
+	tests := []struct {
+		tillID, tenderID string
+		want             float64
+	}{
+		{tillID: "till-1", tenderID: "cash", want: 250.0 / 7},
+		{tillID: "till-1", tenderID: "card"}, // No counted units
+		{tillID: "till-2", tenderID: "cash"},
+	}
+	for _, tt := range tests {
+		got, err := c.AverageDenominationValue(ctx, testKey, tt.tillID, tt.tenderID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("AverageDenominationValue(%s, %s) = %v, want %v", tt.tillID, tt.tenderID, got, tt.want)
+		}
+	}
+}
+
+func TestGetTenderAmount(t *testing.T) {
+	c, mr := newTestClient(t)
+	ctx := context.Background()
+	euros := Tender{ID: "cash", Currency: "EUR", Amount: 7}
+	mustProcess(t, c, transfer(VaultTill, "till-1", cash(4), euros))
+	mr.Set(testKey.TenderKey("till-2", "cash"), "lots")
+
+	tests := []struct {
+		till, tender string
+		want         Money
+		found        bool
+	}{
+		{"till-1", "cash", 4, true},
+		{"till-1", euros.StoredID(), 7, true},
+		{VaultTill, "cash", -4, true},
+		{"till-1", "card", 0, false},
+		{"till-3", "cash", 0, false},
+	}
+	for _, tt := range tests {
+		before := mr.CommandCount()
+		amount, found, err := c.GetTenderAmount(ctx, testKey, tt.till, tt.tender)
+		if err != nil || amount != tt.want || found != tt.found {
+			t.Errorf("GetTenderAmount(%s, %s) = %v, %t, %v, want %v, %t", tt.till, tt.tender, amount, found, err, tt.want, tt.found)
+		}
+		if n := mr.CommandCount() - before; n != 1 {
+			t.Errorf("GetTenderAmount(%s, %s) sent %d commands, want a single GET", tt.till, tt.tender, n)
+		}
+	}
+
+	var parseErr *ParseError
+	if _, found, err := c.GetTenderAmount(ctx, testKey, "till-2", "cash"); !errors.As(err, &parseErr) || found || parseErr.Value != "lots" {
+		t.Errorf("GetTenderAmount() of a malformed total = %t, %v, want a *ParseError", found, err)
+	}
+}
+
+func TestGetTillBalances(t *testing.T) {
+	c, mr := newTestClient(t)
+	ctx := context.Background()
+	mustProcess(t, c,
+		transfer(VaultTill, "till-1", cash(50), Tender{ID: "card", Amount: 8}),
+		transfer("till-1", "till-2", cash(20)),
+		transfer(VaultTill, "till-3", Tender{ID: "gift", Amount: 4}),
+	)
+	// A missing total counts as zero
+	mr.Del(testKey.TenderKey("till-3", "gift"))
+
+	got, err := c.GetTillBalances(ctx, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]Money{"till-1": 38, "till-2": 20, "till-3": 0}; !reflect.DeepEqual(got, want) {
+		t.Errorf("GetTillBalances() = %v, want %v", got, want)
+	}
+	got, err = c.GetTillBalances(ctx, testKey, WithReservedTills())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]Money{"till-1": 38, "till-2": 20, "till-3": 0, VaultTill: -62}; !reflect.DeepEqual(got, want) {
+		t.Errorf("GetTillBalances(WithReservedTills) = %v, want %v", got, want)
+	}
+}
+
+func TestCountTenders(t *testing.T) {
+	c, _ := newTestClient(t)
+	ctx := context.Background()
+	mustProcess(t, c, transfer(VaultTill, "till-1", cash(10), Tender{ID: "card", Amount: 2}, Tender{ID: "cash", Currency: "EUR", Amount: 1}))
+	tests := []struct {
+		tillID string
+		want   int64
+	}{
+		{tillID: "till-1", want: 3},
+		{tillID: VaultTill, want: 3},
+		{tillID: "till-2"},
+	}
+	for _, tt := range tests {
+		if n, err := c.CountTenders(ctx, testKey, tt.tillID); err != nil || n != tt.want {
+			t.Errorf("CountTenders(%s) = %d, %v, want %d", tt.tillID, n, err, tt.want)
+		}
+	}
+}
+
+func TestGetTenderBreakdown(t *testing.T) {
+	c, _ := newTestClient(t)
+	ctx := context.Background()
+	mustProcess(t, c, transfer(VaultTill, "till-1", cash(4), Tender{ID: "card", Amount: 9}))
+
+	tender, err := c.GetTenderBreakdown(ctx, testKey, "till-1", "cash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := cash(4); !reflect.DeepEqual(tender, want) {
+		t.Errorf("GetTenderBreakdown() = %+v, want %+v", tender, want)
+	}
+	for _, tt := range []struct{ till, tender string }{{"till-1", "check"}, {"till-2", "cash"}} {
+		if _, err := c.GetTenderBreakdown(ctx, testKey, tt.till, tt.tender); !errors.Is(err, ErrTenderNotFound) {
+			t.Errorf("GetTenderBreakdown(%s, %s) error = %v, want %v", tt.till, tt.tender, err, ErrTenderNotFound)
+		}
+	}
+}
+
+func TestGetTenderTotals(t *testing.T) {
+	c, mr := newTestClient(t)
+	ctx := context.Background()
+	euros := Tender{ID: "cash", Currency: "EUR", Amount: 2}
+	mustProcess(t, c,
+		transfer(VaultTill, "till-1", cash(10), Tender{ID: "card", Amount: 4}),
+		transfer(VaultTill, "till-2", cash(5), euros),
+		transfer("till-1", "till-2", cash(3)),
+		transfer(VaultTill, "till-3", Tender{ID: "check", Amount: 6}),
+	)
+	// A tender in its till's set without a total counts as zero
+	mr.Del(testKey.TenderKey("till-3", "check"))
+
+	totals, err := c.GetTenderTotals(ctx, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]Money{"cash": 15, "card": 4, "cash@EUR": 2, "check": 0}; !reflect.DeepEqual(totals, want) {
+		t.Errorf("GetTenderTotals() = %v, want %v", totals, want)
+	}
+	// The vault holds the other side of every transfer
+	if totals, err = c.GetTenderTotals(ctx, testKey, WithReservedTills()); err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]Money{"cash": 0, "card": 0, "cash@EUR": 0, "check": -6}; !reflect.DeepEqual(totals, want) {
+		t.Errorf("GetTenderTotals(WithReservedTills()) = %v, want %v", totals, want)
+	}
+}
+
+func TestGetSettlementSummary(t *testing.T) {
+	c, _ := newTestClient(t)
+	ctx := context.Background()
+	mustProcess(t, c,
+		transfer(VaultTill, "till-2", cash(10), Tender{ID: "card", Amount: 4}),
+		transfer(VaultTill, "till-1", cash(5)),
+		transfer("till-2", "till-1", cash(3)),
+	)
+	summary, err := c.GetSettlementSummary(ctx, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Summary{
+		TillCount:    2,
+		TillIDs:      []string{"till-1", "till-2"},
+		TenderTotals: map[string]Money{"cash": 15, "card": 4},
+		GrandTotal:   19,
+	}
+	if !reflect.DeepEqual(summary, want) {
+		t.Errorf("GetSettlementSummary() = %+v, want %+v", summary, want)
+	}
+	if summary, err = c.GetSettlementSummary(ctx, testKey, WithReservedTills()); err != nil {
+		t.Fatal(err)
+	}
+	if summary.TillCount != 3 || summary.GrandTotal != 0 {
+		t.Errorf("GetSettlementSummary(WithReservedTills()) = %+v, want 3 tills netting to 0", summary)
+	}
+}
+
+func TestCommonDenominations(t *testing.T) {
+	c, _ := newTestClient(t)
+	ctx := context.Background()
+	breakdown := func(names ...string) Tender {
+		tender := Tender{ID: "cash", Amount: Money(len(names))}
+		for _, name := range names {
+			tender.TenderBreakdowns = append(tender.TenderBreakdowns, TenderInfo{Name: name, Count: 1, Amount: 1})
+		}
+		return tender
+	}
+	mustProcess(t, c,
+		transfer(VaultTill, "till-1", breakdown("quarter", "one", "dime")),
+		transfer(VaultTill, "till-2", breakdown("dime", "nickel", "one")),
+		transfer(VaultTill, "till-3", breakdown("penny")),
+	)
+	for _, tt := range []struct {
+		tillA, tillB string
+		want         []string
+	}{
+		{tillA: "till-1", tillB: "till-2", want: []string{"dime", "one"}},
+		{tillA: "till-1", tillB: "till-3", want: []string{}},
+		{tillA: "till-1", tillB: "missing", want: []string{}},
+	} {
+		got, err := c.CommonDenominations(ctx, testKey, tt.tillA, tt.tillB, "cash")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("CommonDenominations(%s, %s) = %#v, want %#v", tt.tillA, tt.tillB, got, tt.want)
+		}
+	}
+}
+
+func TestListTills(t *testing.T) {
+	c, _ := newTestClient(t)
+	ctx := context.Background()
+	if tills, err := c.ListTills(ctx, testKey); err != nil || tills == nil || len(tills) != 0 {
+		t.Errorf("ListTills() of a missing settlement = %#v, %v, want an empty slice", tills, err)
+	}
+	mustProcess(t, c, transfer(VaultTill, "till-b", cash(1)), transfer(VaultTill, "till-a", cash(1)), transfer(BankTill, "reg-1", cash(1)))
+
+	for _, tt := range []struct {
+		opts []ReadOption
+		want []string
+	}{
+		{want: []string{"reg-1", "till-a", "till-b"}},
+		{opts: []ReadOption{WithReservedTills()}, want: []string{BankTill, "reg-1", "till-a", "till-b", VaultTill}},
+		{opts: []ReadOption{WithTillPrefix("till-")}, want: []string{"till-a", "till-b"}},
+	} {
+		tills, err := c.ListTills(ctx, testKey, tt.opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(tills, tt.want) {
+			t.Errorf("ListTills() = %v, want %v", tills, tt.want)
+		}
+	}
+}
+
+func TestNotFoundErrors(t *testing.T) {
+	c, mr := newTestClient(t)
+	ctx := context.Background()
+	read := map[string]func() error{
+		"GetExpectedTenders": func() error { _, err := c.GetExpectedTenders(ctx, testKey); return err },
+		"GetTill":            func() error { _, err := c.GetTill(ctx, testKey, "till-1"); return err },
+		"GetTenderBreakdown": func() error { _, err := c.GetTenderBreakdown(ctx, testKey, "till-1", "card"); return err },
+	}
+	check := func(name string, want error) {
+		t.Helper()
+		if err := read[name](); !errors.Is(err, want) {
+			t.Errorf("%s() error = %v, want %v", name, err, want)
+		}
+	}
+	check("GetExpectedTenders", ErrSettlementNotFound)
+	check("GetTill", ErrSettlementNotFound)
+	check("GetTenderBreakdown", ErrTenderNotFound)
+
+	mustProcess(t, c, transfer(VaultTill, "till-2", cash(1)))
+	check("GetTill", ErrTillNotFound)
+	// A till in the set without tenders is found, just empty
+	mr.SAdd(testKey.TillsSetKey(), "till-1")
+	check("GetTill", nil)
+	check("GetTenderBreakdown", ErrTenderNotFound)
+
+	// A failing Redis is none of them
+	mr.SetError("LOADING")
+	defer mr.SetError("")
+	for name, fn := range read {
+		err := fn()
+		if err == nil || errors.Is(err, ErrSettlementNotFound) || errors.Is(err, ErrTillNotFound) || errors.Is(err, ErrTenderNotFound) {
+			t.Errorf("%s() on a failing server error = %v, want a Redis error", name, err)
+		}
+	}
+}
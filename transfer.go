@@ -0,0 +1,657 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+var ErrInsufficientFunds = errors.New("insufficient funds")
+
+const insufficientFundsReply = "INSUFFICIENT_FUNDS"
+
+// transferIfAvailableScript checks every tender and denomination of the source till
+// before applying anything, so a transfer either moves in full or not at all. Amounts and
+// counts are passed as decimal strings, together with their negations, and compared as
+// strings: Lua numbers are doubles and would lose precision above 2^53.
+//
+// KEYS: tills set, source tenders set, dest tenders set, checksum, updated timestamp, then
+// per tender the source and dest tender keys and denomination sets, followed by per
+// denomination the source and dest denomination hashes.
+// ARGV: source, dest, tender count, checksum delta, 1 to skip the funds check, the
+// updated timestamp, then per
+// tender its ID, amount, negated amount and denomination count, followed by per
+// denomination its name, count, negated count, amount, negated amount and 1 if it is
+// count-only.
+var transferIfAvailableScript = redis.NewScript(`
+local function less(a, b)
+	local na, nb = a:sub(1, 1) == '-', b:sub(1, 1) == '-'
+	if na ~= nb then
+		return na
+	end
+	if na then
+		a, b = b:sub(2), a:sub(2)
+	end
+	if #a ~= #b then
+		return #a < #b
+	end
+	return a < b
+end
+
+local source, dest = ARGV[1], ARGV[2]
+local tenders = {}
+local k, a = 7, 7
+for i = 1, tonumber(ARGV[3]) do
+	local t = {
+		id = ARGV[a], amount = ARGV[a + 1], negated = ARGV[a + 2],
+		srcKey = KEYS[k], dstKey = KEYS[k + 1], srcDenoms = KEYS[k + 2], dstDenoms = KEYS[k + 3],
+		denoms = {},
+	}
+	local n = tonumber(ARGV[a + 3])
+	k, a = k + 4, a + 4
+	for j = 1, n do
+		table.insert(t.denoms, {
+			name = ARGV[a], count = ARGV[a + 1], negatedCount = ARGV[a + 2],
+			amount = ARGV[a + 3], negatedAmount = ARGV[a + 4], countOnly = ARGV[a + 5] == '1',
+			srcKey = KEYS[k], dstKey = KEYS[k + 1],
+		})
+		k, a = k + 2, a + 6
+	end
+	table.insert(tenders, t)
+end
+
+for _, t in ipairs(ARGV[5] == '1' and {} or tenders) do
+	if less(redis.call('GET', t.srcKey) or '0', t.amount) then
+		return redis.error_reply('INSUFFICIENT_FUNDS tender ' .. t.id)
+	end
+	for _, d in ipairs(t.denoms) do
+		if less(redis.call('HGET', d.srcKey, 'count') or '0', d.count) then
+			return redis.error_reply('INSUFFICIENT_FUNDS tender ' .. t.id .. ' denomination ' .. d.name)
+		end
+	end
+end
+
+for _, t in ipairs(tenders) do
+	for _, d in ipairs(t.denoms) do
+		if not d.countOnly then
+			redis.call('HINCRBY', d.srcKey, 'amount', d.negatedAmount)
+			redis.call('HINCRBY', d.dstKey, 'amount', d.amount)
+		end
+		redis.call('HINCRBY', d.srcKey, 'count', d.negatedCount)
+		redis.call('HINCRBY', d.dstKey, 'count', d.count)
+		redis.call('SADD', t.srcDenoms, d.name)
+		redis.call('SADD', t.dstDenoms, d.name)
+	end
+	redis.call('INCRBY', t.srcKey, t.negated)
+	redis.call('INCRBY', t.dstKey, t.amount)
+	redis.call('SADD', KEYS[2], t.id)
+	redis.call('SADD', KEYS[3], t.id)
+end
+redis.call('SADD', KEYS[1], source, dest)
+if ARGV[4] ~= '0' then
+	redis.call('INCRBY', KEYS[4], ARGV[4])
+end
+redis.call('SET', KEYS[5], ARGV[6], 'KEEPTTL')
+redis.call('INCR', KEYS[6])
+return 'OK'
+`)
+
+// TransferIfAvailable moves tenders from source to dest only if the source holds enough
+// of every tender and denomination, returning ErrInsufficientFunds without writing
+// anything otherwise. It is a credit ProcessTransaction with RejectOverdrafts and
+// ScriptTransactions set, so the transaction is validated and every other client option
+// applies as usual, and tenders listed twice are merged before the check. A reserved
+// pseudo-till source is unbounded and never short. The script only writes balances, so
+// with Versioning, EmitEvents, PublishTillChanges or TenderMetadata set the transfer
+// falls back to the WATCHed MULTI/EXEC of RejectOverdrafts: the outcome is the same, but
+// it takes more round trips and contention can fail it with ErrMaxRetriesExceeded.
+func (c Client) TransferIfAvailable(ctx context.Context, key Key, source, dest string, tenders []Tender) error {
+	done, err := c.begin()
+	if err != nil {
+		return err
+	}
+	defer done()
+	t := Transaction{
+		Org:             key.Organization,
+		EU:              key.EnterpriseUnit,
+		SettlementDocID: key.SettlementDocID,
+		Source:          source,
+		Destination:     dest,
+		Direction:       DirectionCredit,
+		Tenders:         tenders,
+	}
+	checked := c
+	checked.RejectOverdrafts, checked.ScriptTransactions, checked.MergeDuplicateTenders = true, true, true
+	start := time.Now()
+	err = checked.processWithRetry(ctx, t)
+	c.observeTransaction("TransferIfAvailable", start, t, err)
+	if errors.Is(err, ErrInsufficientTender) {
+		return fmt.Errorf("%w in till %s: %v", ErrInsufficientFunds, source, err)
+	}
+	return err
+}
+
+// runTransferScript runs transferIfAvailableScript, checking the source's funds unless
+// skipCheck is set. A shortfall is returned as the tender, and denomination, the source is
+// short of. Script.Run sends EVALSHA, loading the script on the first NOSCRIPT reply.
+func (c Client) runTransferScript(ctx context.Context, key Key, source, dest string, tenders []Tender, skipCheck bool) (short string, err error) {
+	var checksumDelta int64
+	if len(c.ChecksumSecret) > 0 {
+		checksumDelta = c.transactionChecksumDelta(key, source, dest, 1, tenders)
+	}
+	keys := []string{key.TillsSetKey(), key.TendersSetKey(source), key.TendersSetKey(dest), key.ChecksumKey(), key.UpdatedKey(), key.UnloggedKey()}
+	skip := 0
+	if skipCheck {
+		skip = 1
+	}
+	args := []interface{}{source, dest, len(tenders), checksumDelta, skip, c.now().UnixMilli()}
+	for _, tender := range tenders {
+		tenderID := tender.StoredID()
+		keys = append(keys,
+			key.TenderKey(source, tenderID),
+			key.TenderKey(dest, tenderID),
+			key.DenominationsSetKey(source, tenderID),
+			key.DenominationsSetKey(dest, tenderID),
+		)
+		args = append(args, tenderID, strconv.FormatInt(int64(tender.Amount), 10), strconv.FormatInt(-int64(tender.Amount), 10), len(tender.TenderBreakdowns))
+		for _, denomination := range tender.TenderBreakdowns {
+			name := denomination.storedName(tender.Currency)
+			keys = append(keys,
+				key.DenominationKey(source, tenderID, name),
+				key.DenominationKey(dest, tenderID, name),
+			)
+			countOnly := 0
+			if denomination.CountOnly {
+				countOnly = 1
+			}
+			args = append(args, name,
+				strconv.FormatInt(int64(denomination.Count), 10), strconv.FormatInt(-int64(denomination.Count), 10),
+				strconv.FormatInt(int64(denomination.Amount), 10), strconv.FormatInt(-int64(denomination.Amount), 10),
+				countOnly)
+		}
+	}
+
+	err = transferIfAvailableScript.Run(ctx, c.Client, keys, args...).Err()
+	if err != nil {
+		// Some servers prefix the script's error reply with the generic ERR code
+		reply := strings.TrimPrefix(err.Error(), "ERR ")
+		if strings.HasPrefix(reply, insufficientFundsReply) {
+			return strings.TrimSpace(strings.TrimPrefix(reply, insufficientFundsReply)), nil
+		}
+	}
+	return "", err
+}
+
+// scriptable reports whether ProcessTransaction can apply t with transferIfAvailableScript:
+// the script does the balance writes and the overdraft check but none of the extra
+// records some transactions and clients ask for.
+func (c Client) scriptable(t Transaction) bool {
+	return c.ScriptTransactions && !c.balancesOnly && t.Source != "" && t.IdempotencyKey == "" && t.TransactionID == "" &&
+		!c.Versioning && !c.EmitEvents && !c.PublishTillChanges && !c.TenderMetadata
+}
+
+// processScripted applies a prepared transaction with transferIfAvailableScript, so the
+// overdraft check and the writes are one atomic call without WATCH retries.
+func (c Client) processScripted(ctx context.Context, key Key, t Transaction, direction int, tenders []Tender) error {
+	source, dest := t.Source, t.Destination
+	if direction < 0 {
+		source, dest = dest, source
+	}
+	coalesced := make([]Tender, len(tenders))
+	for i, tender := range tenders {
+		coalesced[i] = tender
+		if len(tender.TenderBreakdowns) > 0 {
+			coalesced[i].TenderBreakdowns = coalesceBreakdowns(tender)
+		}
+	}
+	short, err := c.runTransferScript(ctx, key, source, dest, coalesced, !c.RejectOverdrafts || c.IsReservedTill(source))
+	if short != "" {
+		return fmt.Errorf("%w: till %s is short of %s", ErrInsufficientTender, source, short)
+	}
+	return err
+}
+
+// Transfer moves tenders from one till to another like a credit ProcessTransaction and
+// returns both tills' resulting tender totals by stored tender ID, read in the same
+// MULTI/EXEC as the writes so no concurrent transaction can come in between. Balances are
+// Money, as everywhere else, rather than the floats the totals would lose precision in.
+// The client's transaction checks apply as for ProcessTransaction.
+func (c Client) Transfer(ctx context.Context, key Key, from, to string, tenders []Tender) (fromBalance, toBalance map[string]Money, err error) {
+	done, err := c.begin()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer done()
+	t := Transaction{
+		Org:             key.Organization,
+		EU:              key.EnterpriseUnit,
+		SettlementDocID: key.SettlementDocID,
+		Source:          from,
+		Destination:     to,
+		Direction:       DirectionCredit,
+		Tenders:         tenders,
+	}
+	key, direction, prepared, err := c.prepareTransaction(ctx, t)
+	if err != nil {
+		return nil, nil, err
+	}
+	write, checks, watched := c.transactionWrite(ctx, t, key, direction, prepared)
+	watched = append(watched, key.TendersSetKey(from), key.TendersSetKey(to))
+
+	err = c.watchRetry(ctx, func(tx *redis.Tx) error {
+		for _, check := range checks {
+			if err := check(tx); err != nil {
+				return err
+			}
+		}
+		// The tenders sets are WATCHed, so the IDs read here are still complete at EXEC
+		tillIDs := []string{from, to}
+		tenderIDs := make([][]string, len(tillIDs))
+		for i, tillID := range tillIDs {
+			members, err := tx.SMembers(ctx, key.TendersSetKey(tillID)).Result()
+			if err != nil {
+				return err
+			}
+			seen := make(map[string]struct{}, len(members)+len(prepared))
+			for _, tenderID := range members {
+				seen[tenderID] = struct{}{}
+			}
+			for _, tender := range prepared {
+				seen[tender.StoredID()] = struct{}{}
+			}
+			tenderIDs[i] = sortedKeys(seen)
+		}
+		totalCmds := make([]*redis.SliceCmd, len(tillIDs))
+		_, err := tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			if err := write(pipe); err != nil {
+				return err
+			}
+			for i, tillID := range tillIDs {
+				tenderKeys := make([]string, len(tenderIDs[i]))
+				for j, tenderID := range tenderIDs[i] {
+					tenderKeys[j] = key.TenderKey(tillID, tenderID)
+				}
+				totalCmds[i] = pipe.MGet(ctx, tenderKeys...)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		balances := make([]map[string]Money, len(tillIDs))
+		for i, cmd := range totalCmds {
+			balances[i] = make(map[string]Money, len(tenderIDs[i]))
+			for j, value := range cmd.Val() {
+				raw, ok := value.(string)
+				if !ok {
+					balances[i][tenderIDs[i][j]] = 0
+					continue
+				}
+				amount, err := parseMoney(raw)
+				if err != nil {
+					return &ParseError{Key: key.TenderKey(tillIDs[i], tenderIDs[i][j]), Value: raw, Err: err}
+				}
+				balances[i][tenderIDs[i][j]] = amount
+			}
+		}
+		fromBalance, toBalance = balances[0], balances[1]
+		return nil
+	}, watched...)
+	if err != nil {
+		return nil, nil, err
+	}
+	if c.SettlementTTL > 0 {
+		if err := c.setSettlementTTL(ctx, key, c.SettlementTTL); err != nil {
+			return nil, nil, err
+		}
+	}
+	return fromBalance, toBalance, nil
+}
+
+// ConvertTender converts a till's entire fromTenderID balance into toTenderID at the given
+// exchange rate: the from-tender and its denominations are zeroed and the to-tender is
+// credited with the converted amount, in one MULTI/EXEC. The rate is taken as the shortest
+// decimal that parses to it, so 1.1 means exactly 11/10, and the converted amount is
+// amount × rate computed exactly and rounded half away from zero to the minor unit, see
+// convertAmount. The conversion is recorded with its rate as an EventConvert entry of the
+// settlement's events stream, whether or not the client has EmitEvents set, and as a
+// version with Versioning. Converting in a till marked closed fails with ErrTillClosed.
+// The from-tender is WATCHed, so a concurrent change to it fails the conversion with
+// redis.TxFailedErr rather than converting a stale amount, and converting a tender the
+// till doesn't hold fails with ErrTenderNotFound.
+func (c Client) ConvertTender(ctx context.Context, key Key, tillID, fromTenderID, toTenderID string, rate float64) error {
+	done, err := c.begin()
+	if err != nil {
+		return err
+	}
+	defer done()
+	if rate <= 0 || math.IsInf(rate, 0) || math.IsNaN(rate) {
+		return fmt.Errorf("invalid exchange rate %v", rate)
+	}
+	if fromTenderID == toTenderID {
+		return fmt.Errorf("cannot convert tender %s into itself", fromTenderID)
+	}
+
+	if c.TillLockTTL > 0 {
+		unlock, err := c.lockTills(ctx, key, tillID)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+	if err := c.checkTillsOpen(ctx, key, tillID); err != nil {
+		return err
+	}
+	exact, text := exchangeRate(rate)
+
+	from := tenderFromStoredID(fromTenderID)
+	fromKey := key.TenderKey(tillID, fromTenderID)
+	denominationsKey := key.DenominationsSetKey(tillID, fromTenderID)
+	err = c.Watch(ctx, func(tx *redis.Tx) error {
+		raw, err := tx.Get(ctx, fromKey).Result()
+		if errors.Is(err, redis.Nil) {
+			return fmt.Errorf("%w: till %s tender %s", ErrTenderNotFound, tillID, fromTenderID)
+		}
+		if err != nil {
+			return err
+		}
+		amount, err := parseMoney(raw)
+		if err != nil {
+			return &ParseError{Key: fromKey, Value: raw, Err: err}
+		}
+		converted, err := convertAmount(amount, exact)
+		if err != nil {
+			return fmt.Errorf("convert till %s tender %s: %w", tillID, fromTenderID, err)
+		}
+		names, err := tx.SMembers(ctx, denominationsKey).Result()
+		if err != nil {
+			return err
+		}
+		denominationKeys := make([]string, len(names))
+		for i, name := range names {
+			denominationKeys[i] = key.DenominationKey(tillID, fromTenderID, name)
+		}
+		if len(denominationKeys) > 0 {
+			if err := tx.Watch(ctx, denominationKeys...).Err(); err != nil {
+				return err
+			}
+		}
+		denominations, err := c.getDenominations(ctx, key, tillID, fromTenderID, ReadOptions{})
+		if err != nil {
+			return err
+		}
+
+		to := tenderFromStoredID(toTenderID)
+		to.Amount = converted
+		from.Amount, from.TenderBreakdowns = amount, denominations
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, fromKey, 0, redis.KeepTTL)
+			c.touchSettlement(ctx, pipe, key)
+			markUnlogged(ctx, pipe, key)
+			deltas := make([]DenomDelta, 0, len(denominations)+2)
+			for _, denomination := range denominations {
+				name := denomination.storedName(from.Currency)
+				deltas = append(deltas, DenomDelta{Till: tillID, Tender: fromTenderID, Denomination: name, Count: -denomination.Count, Amount: -denomination.Amount, CountOnly: denomination.CountOnly})
+				denomination.Count, denomination.Amount = 0, 0
+				setDenomination(ctx, pipe, key.DenominationKey(tillID, fromTenderID, name), denomination)
+			}
+			deltas = append(deltas,
+				DenomDelta{Till: tillID, Tender: fromTenderID, Amount: -amount},
+				DenomDelta{Till: tillID, Tender: toTenderID, Amount: converted},
+			)
+			pipe.IncrBy(ctx, key.TenderKey(tillID, toTenderID), int64(converted))
+			pipe.SAdd(ctx, key.TendersSetKey(tillID), toTenderID)
+			if len(c.ChecksumSecret) > 0 {
+				delta := c.tillChecksum(key, tillID, []Tender{to}) - c.tillChecksum(key, tillID, []Tender{from})
+				pipe.IncrBy(ctx, key.ChecksumKey(), delta)
+			}
+			c.writeEvent(ctx, pipe, key, EventConvert, Transaction{Source: tillID, Destination: tillID, Direction: DirectionCredit}, []Tender{from, to}, "rate", text)
+			if c.Versioning {
+				return writeVersion(ctx, pipe, key, deltas)
+			}
+			return nil
+		})
+		return err
+	}, fromKey, denominationsKey)
+	if err != nil || c.SettlementTTL <= 0 {
+		return err
+	}
+	return c.setSettlementTTL(ctx, key, c.SettlementTTL)
+}
+
+// exchangeRate returns rate as the exact rational of the shortest decimal that parses to
+// it, along with that decimal.
+func exchangeRate(rate float64) (*big.Rat, string) {
+	text := strconv.FormatFloat(rate, 'f', -1, 64)
+	exact, _ := new(big.Rat).SetString(text)
+	return exact, text
+}
+
+// convertAmount returns amount × rate rounded half away from zero to a whole minor unit.
+// It fails if the result doesn't fit in Money.
+func convertAmount(amount Money, rate *big.Rat) (Money, error) {
+	product := new(big.Rat).Mul(new(big.Rat).SetInt64(int64(amount)), rate)
+	quotient, remainder := new(big.Int).QuoRem(product.Num(), product.Denom(), new(big.Int))
+	// Round the magnitude up when the remainder is at least half the denominator
+	if new(big.Int).Mul(new(big.Int).Abs(remainder), big.NewInt(2)).Cmp(product.Denom()) >= 0 {
+		quotient.Add(quotient, big.NewInt(int64(product.Num().Sign())))
+	}
+	if !quotient.IsInt64() {
+		return 0, fmt.Errorf("converted amount %s overflows", quotient)
+	}
+	return Money(quotient.Int64()), nil
+}
+
+// MoveTender moves a tender posted to the wrong till, its total and every denomination,
+// from fromTill to toTill in one WATCHed MULTI/EXEC. The tender's keys are removed from
+// fromTill; if toTill already holds the tender the moved values are added to it. It fails
+// with ErrTenderNotFound if fromTill doesn't hold the tender, and with redis.TxFailedErr
+// if the tender changes while it is being moved.
+func (c Client) MoveTender(ctx context.Context, key Key, fromTill, toTill, tenderID string) error {
+	done, err := c.begin()
+	if err != nil {
+		return err
+	}
+	defer done()
+	if fromTill == toTill {
+		return fmt.Errorf("cannot move tender %s within till %s", tenderID, fromTill)
+	}
+	if c.TillLockTTL > 0 {
+		unlock, err := c.lockTills(ctx, key, fromTill, toTill)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+	if err := c.checkTillsOpen(ctx, key, fromTill, toTill); err != nil {
+		return err
+	}
+
+	tenderKey := key.TenderKey(fromTill, tenderID)
+	denominationsKey := key.DenominationsSetKey(fromTill, tenderID)
+	err = c.Watch(ctx, func(tx *redis.Tx) error {
+		held, err := tx.SIsMember(ctx, key.TendersSetKey(fromTill), tenderID).Result()
+		if err != nil {
+			return err
+		}
+		if !held {
+			return fmt.Errorf("%w: till %s tender %s", ErrTenderNotFound, fromTill, tenderID)
+		}
+		var amount Money
+		raw, err := tx.Get(ctx, tenderKey).Result()
+		switch {
+		case errors.Is(err, redis.Nil):
+		case err != nil:
+			return err
+		default:
+			if amount, err = parseMoney(raw); err != nil {
+				return &ParseError{Key: tenderKey, Value: raw, Err: err}
+			}
+		}
+		names, err := tx.SMembers(ctx, denominationsKey).Result()
+		if err != nil {
+			return err
+		}
+		denominationKeys := make([]string, len(names))
+		for i, name := range names {
+			denominationKeys[i] = key.DenominationKey(fromTill, tenderID, name)
+		}
+		if len(denominationKeys) > 0 {
+			if err := tx.Watch(ctx, denominationKeys...).Err(); err != nil {
+				return err
+			}
+		}
+		denominations, err := c.getDenominations(ctx, key, fromTill, tenderID, ReadOptions{})
+		if err != nil {
+			return err
+		}
+
+		tender := tenderFromStoredID(tenderID)
+		tender.Amount, tender.TenderBreakdowns = amount, denominations
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			c.writeTransaction(ctx, pipe, key, fromTill, toTill, 1, []Tender{tender})
+			markUnlogged(ctx, pipe, key)
+			pipe.Del(ctx, append([]string{tenderKey, denominationsKey, key.TenderMetaKey(fromTill, tenderID)}, denominationKeys...)...)
+			pipe.SRem(ctx, key.TendersSetKey(fromTill), tenderID)
+			return nil
+		})
+		return err
+	}, key.TendersSetKey(fromTill), tenderKey, denominationsKey)
+	if err != nil || c.SettlementTTL <= 0 {
+		return err
+	}
+	return c.setSettlementTTL(ctx, key, c.SettlementTTL)
+}
+
+var (
+	ErrInsufficientTender = errors.New("insufficient tender")
+	ErrMaxRetriesExceeded = errors.New("max retries exceeded")
+	ErrWriteConflict      = errors.New("concurrent write conflict")
+)
+
+// ConflictPolicy is what a transaction does when a concurrent transaction writes the same
+// tender totals or denominations. The writes themselves commute: totals are INCRBY,
+// denomination counts and amounts HINCRBY and memberships SADD, so applying two
+// transactions in either order lands both in full. What doesn't commute are the checks
+// that read before writing, RejectOverdrafts' funds check and the idempotency key and
+// TransactionID checks, which are WATCHed and retried whatever the policy, except that
+// ConflictFail fails them too.
+type ConflictPolicy string
+
+const (
+	// Write blindly and let concurrent increments merge; nothing is WATCHed unless a check
+	// needs it
+	ConflictMerge ConflictPolicy = "merge"
+	// WATCH every key the transaction writes and apply it again after a concurrent write,
+	// up to MaxRetries times, as WatchTransactions does
+	ConflictRetry ConflictPolicy = "retry"
+	// WATCH every key the transaction writes and fail with ErrWriteConflict, writing nothing,
+	// after a concurrent write
+	ConflictFail ConflictPolicy = "fail"
+)
+
+// watchRetries is the default of Client.MaxRetries.
+const watchRetries = 3
+
+// maxRetries returns how often a WATCHed transaction is attempted, see Client.MaxRetries.
+func (c Client) maxRetries() int {
+	if c.MaxRetries > 0 {
+		return c.MaxRetries
+	}
+	return watchRetries
+}
+
+// watchConflicts runs a transaction's fn under WATCH of keys following the client's
+// ConflictPolicy: once with ConflictFail, turning redis.TxFailedErr into ErrWriteConflict,
+// and with watchRetry otherwise.
+func (c Client) watchConflicts(ctx context.Context, fn func(*redis.Tx) error, keys ...string) error {
+	if c.ConflictPolicy != ConflictFail {
+		return c.watchRetry(ctx, fn, keys...)
+	}
+	err := c.Watch(ctx, fn, keys...)
+	if errors.Is(err, redis.TxFailedErr) {
+		return fmt.Errorf("%w: a watched key changed before the transaction was applied", ErrWriteConflict)
+	}
+	return err
+}
+
+// watchRetry runs fn under WATCH of keys like Watch does, retrying on redis.TxFailedErr.
+// After maxRetries conflicting attempts it gives up with ErrMaxRetriesExceeded.
+func (c Client) watchRetry(ctx context.Context, fn func(*redis.Tx) error, keys ...string) error {
+	attempts := c.maxRetries()
+	for attempt := 1; ; attempt++ {
+		err := c.Watch(ctx, fn, keys...)
+		if !errors.Is(err, redis.TxFailedErr) {
+			return err
+		}
+		if attempt == attempts {
+			return fmt.Errorf("%w: %d attempts conflicted with concurrent writes", ErrMaxRetriesExceeded, attempts)
+		}
+	}
+}
+
+// fundsCheck returns the keys to WATCH and a check, to run under that WATCH, that tillID
+// holds at least the given tenders: each tender total and each denomination count must
+// stay non-negative once they are debited. A shortfall fails with ErrInsufficientTender
+// naming the till and tender.
+func fundsCheck(ctx context.Context, key Key, tillID string, tenders []Tender) ([]string, func(*redis.Tx) error) {
+	var tenderKeys, denominationKeys []string
+	amounts := make(map[string]Money)
+	counts := make(map[string]int)
+	names := make(map[string][2]string)
+	for _, tender := range tenders {
+		tenderID := tender.StoredID()
+		tenderKey := key.TenderKey(tillID, tenderID)
+		if _, ok := amounts[tenderKey]; !ok {
+			tenderKeys = append(tenderKeys, tenderKey)
+			names[tenderKey] = [2]string{tenderID}
+		}
+		amounts[tenderKey] += tender.Amount
+		for _, denomination := range tender.TenderBreakdowns {
+			name := denomination.storedName(tender.Currency)
+			denominationKey := key.DenominationKey(tillID, tenderID, name)
+			if _, ok := counts[denominationKey]; !ok {
+				denominationKeys = append(denominationKeys, denominationKey)
+				names[denominationKey] = [2]string{tenderID, name}
+			}
+			counts[denominationKey] += denomination.Count
+		}
+	}
+
+	check := func(tx *redis.Tx) error {
+		for _, tenderKey := range tenderKeys {
+			raw, err := tx.Get(ctx, tenderKey).Result()
+			if err != nil && !errors.Is(err, redis.Nil) {
+				return fmt.Errorf("read %s: %w", tenderKey, err)
+			}
+			var held Money
+			if err == nil {
+				if held, err = parseMoney(raw); err != nil {
+					return &ParseError{Key: tenderKey, Value: raw, Err: err}
+				}
+			}
+			if held < amounts[tenderKey] {
+				return fmt.Errorf("%w: till %s holds %v of tender %s, debit is %v", ErrInsufficientTender, tillID, held, names[tenderKey][0], amounts[tenderKey])
+			}
+		}
+		for _, denominationKey := range denominationKeys {
+			held, err := tx.HGet(ctx, denominationKey, "count").Int()
+			if err != nil && !errors.Is(err, redis.Nil) {
+				return fmt.Errorf("read %s count: %w", denominationKey, err)
+			}
+			if held < counts[denominationKey] {
+				name := names[denominationKey]
+				return fmt.Errorf("%w: till %s holds %d of tender %s denomination %s, debit is %d", ErrInsufficientTender, tillID, held, name[0], name[1], counts[denominationKey])
+			}
+		}
+		return nil
+	}
+	return append(tenderKeys, denominationKeys...), check
+}
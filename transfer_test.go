@@ -0,0 +1,495 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/redis/go-redis/v9"
+)
+
+func TestTransferIfAvailable(t *testing.T) {
+	const large = Money(1<<53 + 1)
+	tests := []struct {
+		name       string
+		setup      func(c *Client) error
+		tenders    []Tender
+		wantErr    error
+		wantSource Money
+		wantDest   Money
+	}{
+		{
+			name:       "available",
+			tenders:    []Tender{cash(40)},
+			wantSource: 60,
+			wantDest:   40,
+		},
+		{
+			name:       "short",
+			tenders:    []Tender{cash(101)},
+			wantErr:    ErrInsufficientFunds,
+			wantSource: 100,
+		},
+		{
+			name:       "duplicate tenders merged before the check",
+			tenders:    []Tender{cash(60), cash(60)},
+			wantErr:    ErrInsufficientFunds,
+			wantSource: 100,
+		},
+		{
+			name:       "invalid tender",
+			tenders:    []Tender{{ID: "cash", Amount: -1}},
+			wantErr:    ErrInvalidTransaction,
+			wantSource: 100,
+		},
+		{
+			name: "closed source",
+			setup: func(c *Client) error {
+				c.RejectClosedTills = true
+				return c.Client.SAdd(context.Background(), testKey.ClosedTillsSetKey(), "till-1").Err()
+			},
+			tenders:    []Tender{cash(1)},
+			wantErr:    ErrTillClosed,
+			wantSource: 100,
+		},
+		{
+			name: "amounts above 2^53 compared exactly",
+			setup: func(c *Client) error {
+				return c.ProcessTransaction(context.Background(), transfer(VaultTill, "till-1", Tender{ID: "card", Amount: large}))
+			},
+			tenders:    []Tender{{ID: "card", Amount: large + 1}},
+			wantErr:    ErrInsufficientFunds,
+			wantSource: 100,
+		},
+	}
+	// EmitEvents makes the transfer fall back from the script to a WATCHed MULTI/EXEC
+	for _, watch := range []bool{false, true} {
+		for _, tt := range tests {
+			t.Run(fmt.Sprintf("%s/watch=%v", tt.name, watch), func(t *testing.T) {
+				c, _ := newTestClient(t)
+				ctx := context.Background()
+				mustProcess(t, c, transfer(VaultTill, "till-1", cash(100)))
+				if tt.setup != nil {
+					if err := tt.setup(&c); err != nil {
+						t.Fatal(err)
+					}
+				}
+				c.EmitEvents = watch
+				var transactions int
+				c.AddHook(countingHook{&transactions})
+				err := c.TransferIfAvailable(ctx, testKey, "till-1", "till-2", tt.tenders)
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("TransferIfAvailable() error = %v, want %v", err, tt.wantErr)
+				}
+				if got := tenderAmount(t, c, "till-1", "cash"); got != tt.wantSource {
+					t.Errorf("source total = %v, want %v", got, tt.wantSource)
+				}
+				if got := tenderAmount(t, c, "till-2", "cash"); got != tt.wantDest {
+					t.Errorf("destination total = %v, want %v", got, tt.wantDest)
+				}
+				if tt.wantErr != nil {
+					return
+				}
+				wantTransactions, wantEvents := 0, 0
+				if watch {
+					wantTransactions, wantEvents = 1, 1
+				}
+				if transactions != wantTransactions {
+					t.Errorf("transfer sent %d MULTI/EXEC blocks, want %d", transactions, wantTransactions)
+				}
+				if got := events(t, c); len(got) != wantEvents {
+					t.Errorf("events = %v, want %d", got, wantEvents)
+				}
+			})
+		}
+	}
+}
+
+func TestTransferIfAvailableExact(t *testing.T) {
+	c, _ := newTestClient(t)
+	ctx := context.Background()
+	const large = Money(1<<53 + 1)
+	mustProcess(t, c, transfer(VaultTill, "till-1", Tender{ID: "card", Amount: large}))
+	if err := c.TransferIfAvailable(ctx, testKey, "till-1", "till-2", []Tender{{ID: "card", Amount: large - 2}}); err != nil {
+		t.Fatal(err)
+	}
+	if got := tenderAmount(t, c, "till-1", "card"); got != 2 {
+		t.Errorf("source total = %v, want 2", got)
+	}
+	if got := tenderAmount(t, c, "till-2", "card"); got != large-2 {
+		t.Errorf("destination total = %v, want %v", got, large-2)
+	}
+}
+
+func TestTransferIfAvailableCountOnly(t *testing.T) {
+	c, _ := newTestClient(t)
+	ctx := context.Background()
+	stamps := func(count int) Tender {
+		return Tender{ID: "stamps", TenderBreakdowns: []TenderInfo{{Name: "stamp", Count: count, CountOnly: true}}}
+	}
+	mustProcess(t, c, transfer(VaultTill, "till-1", stamps(5)))
+	if err := c.TransferIfAvailable(ctx, testKey, "till-1", "till-2", []Tender{stamps(6)}); !errors.Is(err, ErrInsufficientFunds) {
+		t.Fatalf("TransferIfAvailable() error = %v, want %v", err, ErrInsufficientFunds)
+	}
+	if err := c.TransferIfAvailable(ctx, testKey, "till-1", "till-2", []Tender{stamps(3)}); err != nil {
+		t.Fatal(err)
+	}
+	fields, err := c.HGetAll(ctx, testKey.DenominationKey("till-2", "stamps", "stamp")).Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fields["count"] != "3" {
+		t.Errorf("destination count = %q, want 3", fields["count"])
+	}
+	if _, ok := fields["amount"]; ok {
+		t.Errorf("count-only denomination written with amount %q", fields["amount"])
+	}
+}
+
+func TestTransfer(t *testing.T) {
+	c, _ := newTestClient(t)
+	ctx := context.Background()
+	mustProcess(t, c,
+		transfer(VaultTill, "till-1", cash(20), Tender{ID: "card", Amount: 5}),
+		transfer(VaultTill, "till-2", Tender{ID: "check", Amount: 3}),
+	)
+	from, to, err := c.Transfer(ctx, testKey, "till-1", "till-2", []Tender{cash(8), {ID: "card", Amount: 5}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]Money{"cash": 12, "card": 0}; !reflect.DeepEqual(from, want) {
+		t.Errorf("Transfer() source balance = %v, want %v", from, want)
+	}
+	if want := map[string]Money{"cash": 8, "card": 5, "check": 3}; !reflect.DeepEqual(to, want) {
+		t.Errorf("Transfer() destination balance = %v, want %v", to, want)
+	}
+	if got := tenderAmount(t, c, "till-2", "cash"); got != 8 {
+		t.Errorf("till-2 cash = %v, want 8", got)
+	}
+
+	c.RejectOverdrafts = true
+	if _, _, err := c.Transfer(ctx, testKey, "till-1", "till-2", []Tender{cash(13)}); !errors.Is(err, ErrInsufficientTender) {
+		t.Errorf("Transfer() of more than the till holds error = %v, want %v", err, ErrInsufficientTender)
+	}
+	if _, _, err := c.Transfer(ctx, testKey, "till-1", "till-1", []Tender{cash(1)}); !errors.Is(err, ErrInvalidTransaction) {
+		t.Errorf("Transfer() into the same till error = %v, want %v", err, ErrInvalidTransaction)
+	}
+	if got := tenderAmount(t, c, "till-1", "cash"); got != 12 {
+		t.Errorf("till-1 cash after rejected transfers = %v, want 12", got)
+	}
+}
+
+func TestScriptTransactions(t *testing.T) {
+	euros := Tender{ID: "cash", Currency: "EUR", Amount: 7, TenderBreakdowns: []TenderInfo{{Name: "note-5", Count: 1, Amount: 5}, {Name: "coin-2", Count: 1, Amount: 2}}}
+	debit := transfer("till-2", "till-1", cash(2))
+	debit.Direction = DirectionDebit
+	txs := []Transaction{
+		transfer(VaultTill, "till-1", cash(20), Tender{ID: "card", Amount: 5}, euros),
+		transfer("till-1", "till-2", cash(8)),
+		debit,
+		transfer("till-1", "till-2", Tender{ID: "card", Amount: 5}),
+	}
+	overdraft := transfer("till-2", "till-3", cash(50))
+
+	var reads [][]Till
+	var keys [][]string
+	for _, scripted := range []bool{false, true} {
+		c, mr := newTestClient(t)
+		ctx := context.Background()
+		c.ScriptTransactions, c.RejectOverdrafts = scripted, true
+		var transactions int
+		c.AddHook(countingHook{transactions: &transactions})
+		mustProcess(t, c, txs...)
+		if err := c.ProcessTransaction(ctx, overdraft); !errors.Is(err, ErrInsufficientTender) {
+			t.Errorf("scripted %v: overdraft error = %v, want %v", scripted, err, ErrInsufficientTender)
+		}
+		if scripted && transactions != 0 {
+			t.Errorf("scripted transactions sent %d MULTI/EXEC pipelines, want none", transactions)
+		}
+		tills, err := c.GetExpectedTenders(ctx, testKey, WithReservedTills())
+		if err != nil {
+			t.Fatal(err)
+		}
+		reads = append(reads, tills)
+		keys = append(keys, mr.Keys())
+	}
+	if !reflect.DeepEqual(reads[1], reads[0]) {
+		t.Errorf("scripted transactions left %+v, MULTI/EXEC %+v", reads[1], reads[0])
+	}
+	if !reflect.DeepEqual(keys[1], keys[0]) {
+		t.Errorf("scripted transactions wrote keys %v, MULTI/EXEC %v", keys[1], keys[0])
+	}
+}
+
+func TestConvertAmount(t *testing.T) {
+	tests := []struct {
+		amount Money
+		rate   float64
+		want   Money
+	}{
+		{500, 1.1, 550},
+		{15, 0.1, 2},  // 1.5 rounds away from zero
+		{10, 0.15, 2}, // 1.5 exactly, though 0.15 as a float64 is slightly less
+		{14, 0.1, 1},
+		{-15, 0.1, -2},
+		{1 << 60, 1, 1 << 60},
+	}
+	for _, tt := range tests {
+		rate, _ := exchangeRate(tt.rate)
+		got, err := convertAmount(tt.amount, rate)
+		if err != nil || got != tt.want {
+			t.Errorf("convertAmount(%v, %v) = %v, %v, want %v", tt.amount, tt.rate, got, err, tt.want)
+		}
+	}
+	rate, _ := exchangeRate(4)
+	if _, err := convertAmount(1<<62, rate); err == nil {
+		t.Error("convertAmount() of an overflowing amount succeeded")
+	}
+}
+
+func TestConvertTender(t *testing.T) {
+	c, _ := newTestClient(t)
+	ctx := context.Background()
+	mustProcess(t, c, transfer(VaultTill, "till-1", Tender{ID: "cash", Currency: "EUR", Amount: 10}))
+	if err := c.ConvertTender(ctx, testKey, "till-1", "cash@EUR", "cash@USD", 0.15); err != nil {
+		t.Fatal(err)
+	}
+	if got := tenderAmount(t, c, "till-1", "cash@EUR"); got != 0 {
+		t.Errorf("from total = %v, want 0", got)
+	}
+	if got := tenderAmount(t, c, "till-1", "cash@USD"); got != 2 {
+		t.Errorf("to total = %v, want 2", got)
+	}
+	got := events(t, c)
+	if len(got) != 1 || got[0]["type"] != EventConvert || got[0]["rate"] != "0.15" || got[0]["tenders"] != "cash@EUR,cash@USD" || got[0]["amounts"] != "10,2" {
+		t.Errorf("events = %v, want one %s at rate 0.15", got, EventConvert)
+	}
+	if err := c.ConvertTender(ctx, testKey, "till-1", "card", "cash@EUR", 1); !errors.Is(err, ErrTenderNotFound) {
+		t.Errorf("ConvertTender() of a missing tender error = %v, want %v", err, ErrTenderNotFound)
+	}
+
+	c.RejectClosedTills = true
+	if err := c.SAdd(ctx, testKey.ClosedTillsSetKey(), "till-1").Err(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.ConvertTender(ctx, testKey, "till-1", "cash@USD", "cash@EUR", 1); !errors.Is(err, ErrTillClosed) {
+		t.Errorf("ConvertTender() in a closed till error = %v, want %v", err, ErrTillClosed)
+	}
+}
+
+func TestMoveTender(t *testing.T) {
+	c, _ := newTestClient(t)
+	ctx := context.Background()
+	mustProcess(t, c, transfer(VaultTill, "till-1", cash(10)), transfer(VaultTill, "till-2", cash(3)))
+	if err := c.MoveTender(ctx, testKey, "till-1", "till-2", "cash"); err != nil {
+		t.Fatal(err)
+	}
+	if got := tenderAmount(t, c, "till-2", "cash"); got != 13 {
+		t.Errorf("till-2 total = %v, want 13", got)
+	}
+	if held, err := c.SIsMember(ctx, testKey.TendersSetKey("till-1"), "cash").Result(); err != nil || held {
+		t.Errorf("till-1 still holds cash: %v, %v", held, err)
+	}
+	if err := c.MoveTender(ctx, testKey, "till-1", "till-2", "cash"); !errors.Is(err, ErrTenderNotFound) {
+		t.Errorf("MoveTender() of a missing tender error = %v, want %v", err, ErrTenderNotFound)
+	}
+}
+
+// conflictingHook applies a concurrent transaction's writes through other right before the
+// first MULTI/EXEC pipeline is sent, after the caller's WATCH.
+type conflictingHook struct {
+	other *redis.Client
+	sent  *bool
+}
+
+func (conflictingHook) DialHook(next redis.DialHook) redis.DialHook { return next }
+
+func (conflictingHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook { return next }
+
+func (h conflictingHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		if len(cmds) > 0 && strings.EqualFold(cmds[0].Name(), "multi") && !*h.sent {
+			*h.sent = true
+			pipe := h.other.TxPipeline()
+			pipe.IncrBy(ctx, testKey.TenderKey("till-2", "cash"), 1)
+			pipe.HIncrBy(ctx, testKey.DenominationKey("till-2", "cash", "bill"), "count", 1)
+			if _, err := pipe.Exec(ctx); err != nil {
+				return err
+			}
+		}
+		return next(ctx, cmds)
+	}
+}
+
+func TestConflictPolicy(t *testing.T) {
+	tests := []struct {
+		policy    ConflictPolicy
+		wantErr   error
+		wantDest  Money // Including the concurrent transaction's 1
+		wantCount int
+	}{
+		{policy: ConflictMerge, wantDest: 11, wantCount: 11},
+		{policy: ConflictRetry, wantDest: 11, wantCount: 11},
+		{policy: ConflictFail, wantErr: ErrWriteConflict, wantDest: 1, wantCount: 1},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.policy), func(t *testing.T) {
+			c, mr := newTestClient(t)
+			ctx := context.Background()
+			mustProcess(t, c, transfer(VaultTill, "till-1", cash(100)))
+			c.ConflictPolicy = tt.policy
+			other := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+			defer other.Close()
+			var sent bool
+			c.AddHook(conflictingHook{other: other, sent: &sent})
+			if err := c.ProcessTransaction(ctx, transfer("till-1", "till-2", cash(10))); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("ProcessTransaction() error = %v, want %v", err, tt.wantErr)
+			}
+			if got := tenderAmount(t, c, "till-2", "cash"); got != tt.wantDest {
+				t.Errorf("till-2 total = %v, want %v", got, tt.wantDest)
+			}
+			if got := denominationFields(t, c, "till-2", "cash", "bill")["count"]; got != fmt.Sprint(tt.wantCount) {
+				t.Errorf("till-2 bill count = %s, want %d", got, tt.wantCount)
+			}
+			if tt.wantErr != nil {
+				if got := tenderAmount(t, c, "till-1", "cash"); got != 100 {
+					t.Errorf("till-1 total after the conflict = %v, want 100", got)
+				}
+			}
+		})
+	}
+}
+
+func TestConflictPolicyConcurrent(t *testing.T) {
+	const workers, each = 8, 25
+	for _, policy := range []ConflictPolicy{ConflictMerge, ConflictFail} {
+		t.Run(string(policy), func(t *testing.T) {
+			c, _ := newTestClient(t)
+			ctx := context.Background()
+			c.ConflictPolicy = policy
+			var mu sync.Mutex
+			var applied int
+			var wg sync.WaitGroup
+			for w := 0; w < workers; w++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for i := 0; i < each; i++ {
+						err := c.ProcessTransaction(ctx, transfer(VaultTill, "till-1", cash(1)))
+						switch {
+						case err == nil:
+							mu.Lock()
+							applied++
+							mu.Unlock()
+						case policy == ConflictFail && errors.Is(err, ErrWriteConflict):
+						default:
+							t.Error(err)
+							return
+						}
+					}
+				}()
+			}
+			wg.Wait()
+			if policy == ConflictMerge && applied != workers*each {
+				t.Errorf("%d transactions applied, want all %d", applied, workers*each)
+			}
+			// Every applied transaction landed in full and no failed one left a trace
+			if got := tenderAmount(t, c, "till-1", "cash"); got != Money(applied) {
+				t.Errorf("till-1 total = %v, want %d", got, applied)
+			}
+			if got := denominationFields(t, c, "till-1", "cash", "bill")["count"]; got != fmt.Sprint(applied) {
+				t.Errorf("till-1 bill count = %s, want %d", got, applied)
+			}
+		})
+	}
+}
+
+// repeatedConflictHook is conflictingHook for the first conflicts MULTI/EXEC pipelines,
+// counting every one sent in attempts.
+type repeatedConflictHook struct {
+	other     *redis.Client
+	conflicts int
+	attempts  *int
+}
+
+func (repeatedConflictHook) DialHook(next redis.DialHook) redis.DialHook { return next }
+
+func (repeatedConflictHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook { return next }
+
+func (h repeatedConflictHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		if len(cmds) > 0 && strings.EqualFold(cmds[0].Name(), "multi") {
+			*h.attempts++
+			if *h.attempts <= h.conflicts {
+				if err := h.other.IncrBy(ctx, testKey.TenderKey("till-2", "cash"), 1).Err(); err != nil {
+					return err
+				}
+			}
+		}
+		return next(ctx, cmds)
+	}
+}
+
+func TestWatchTransactions(t *testing.T) {
+	tests := []struct {
+		name       string
+		conflicts  int
+		wantErr    error
+		wantSource Money
+		wantDest   Money // Including the concurrent writes of 1 each
+	}{
+		// One write between WATCH and EXEC makes the transaction apply again on top of it
+		{name: "retried", conflicts: 1, wantSource: 90, wantDest: 11},
+		// A write before every EXEC exhausts MaxRetries
+		{name: "exhausted", conflicts: 5, wantErr: ErrMaxRetriesExceeded, wantSource: 100, wantDest: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, mr := newTestClient(t)
+			ctx := context.Background()
+			mustProcess(t, c, transfer(VaultTill, "till-1", cash(100)))
+			c.WatchTransactions = true
+			c.MaxRetries = 2
+			other := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+			defer other.Close()
+			var attempts int
+			c.AddHook(repeatedConflictHook{other: other, conflicts: tt.conflicts, attempts: &attempts})
+			if err := c.ProcessTransaction(ctx, transfer("till-1", "till-2", cash(10))); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("ProcessTransaction() error = %v, want %v", err, tt.wantErr)
+			}
+			if attempts != 2 {
+				t.Errorf("%d MULTI/EXEC attempts, want 2", attempts)
+			}
+			if got := tenderAmount(t, c, "till-1", "cash"); got != tt.wantSource {
+				t.Errorf("till-1 total = %v, want %v", got, tt.wantSource)
+			}
+			if got := tenderAmount(t, c, "till-2", "cash"); got != tt.wantDest {
+				t.Errorf("till-2 total = %v, want %v", got, tt.wantDest)
+			}
+		})
+	}
+}
+
+func TestFormatAmount(t *testing.T) {
+	tests := []struct {
+		amount   Money
+		currency string
+		want     string
+	}{
+		{1234, "EUR", "€12.34"},
+		{-5, "USD", "-$0.05"},
+		{500, "JPY", "¥500"},
+		{7, "", "0.07"},
+		{math.MinInt64, "", "-92233720368547758.08"},
+	}
+	for _, tt := range tests {
+		if got := FormatAmount(tt.amount, tt.currency); got != tt.want {
+			t.Errorf("FormatAmount(%d, %q) = %q, want %q", tt.amount, tt.currency, got, tt.want)
+		}
+	}
+}
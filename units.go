@@ -0,0 +1,38 @@
+package main
+
+import "fmt"
+
+// unitValue returns the registered value of one unit of the denomination. A value
+// registered under the name qualified with the currency, e.g. "note-5@EUR", takes
+// precedence over one under the bare name.
+func (c Client) unitValue(denomination TenderInfo) (Money, bool) {
+	if denomination.Currency != "" {
+		if value, ok := c.DenominationValues[qualifyCurrency(denomination.Name, denomination.Currency)]; ok {
+			return value, true
+		}
+	}
+	value, ok := c.DenominationValues[denomination.Name]
+	return value, ok
+}
+
+// checkUnitValue rejects a denomination whose amount isn't its count times its registered
+// unit value. Amounts are whole minor units, so the check is exact. Unregistered
+// denominations pass unless the client has StrictDenominations set; the
+// RoundingDenomination never has a unit value and is always accepted. Clients without
+// DenominationValues check nothing.
+func (c Client) checkUnitValue(denomination TenderInfo) error {
+	if c.DenominationValues == nil || (c.RoundingDenomination != "" && denomination.Name == c.RoundingDenomination) {
+		return nil
+	}
+	value, ok := c.unitValue(denomination)
+	if !ok {
+		if c.StrictDenominations {
+			return fmt.Errorf("denomination %s has no registered unit value", denomination.Name)
+		}
+		return nil
+	}
+	if want := Money(denomination.Count) * value; denomination.Amount != want {
+		return fmt.Errorf("denomination %s amount %v isn't %d x %v", denomination.Name, denomination.Amount, denomination.Count, value)
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestDenominationValues(t *testing.T) {
+	fives := func(count int, amount Money) Tender {
+		return Tender{ID: "cash", Amount: amount, TenderBreakdowns: []TenderInfo{{Name: "note-5", Count: count, Amount: amount}}}
+	}
+	euros := Tender{ID: "cash", Currency: "EUR", Amount: 10, TenderBreakdowns: []TenderInfo{{Name: "note-5", Count: 1, Amount: 10}}}
+	unknown := Tender{ID: "cash", Amount: 3, TenderBreakdowns: []TenderInfo{{Name: "token", Count: 1, Amount: 3}}}
+	tests := []struct {
+		name   string
+		strict bool
+		tender Tender
+		wantOK bool
+	}{
+		{name: "valid", tender: fives(3, 15), wantOK: true},
+		{name: "mismatched", tender: fives(3, 14)},
+		// A value registered for the currency takes precedence over the bare name's
+		{name: "currency value", tender: euros, wantOK: true},
+		{name: "unregistered", tender: unknown, wantOK: true},
+		{name: "unregistered strict", strict: true, tender: unknown},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := newTestClient(t)
+			c.DenominationValues = map[string]Money{"note-5": 5, "note-5@EUR": 10}
+			c.StrictDenominations = tt.strict
+			err := c.ProcessTransaction(context.Background(), transfer(VaultTill, "till-1", tt.tender))
+			if tt.wantOK && err != nil {
+				t.Errorf("ProcessTransaction() error = %v", err)
+			}
+			if !tt.wantOK && !errors.Is(err, ErrInvalidTransaction) {
+				t.Errorf("ProcessTransaction() error = %v, want %v", err, ErrInvalidTransaction)
+			}
+		})
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// With Client.Versioning set, every transaction bumps the settlement's version counter and
+// appends its deltas to the versions stream in the same MULTI/EXEC, so version N is the
+// state after the Nth versioned transaction and GetExpectedTendersAtVersion can rebuild it
+// by subtracting the deltas of later versions from the current state. Only
+// ProcessTransaction, ProcessTransactions and ReverseTransaction record versions; any other
+// write makes the earlier versions rebuilt from the current state inaccurate.
+
+// writeVersion queues the version bump recording deltas.
+func writeVersion(ctx context.Context, pipe redis.Pipeliner, key Key, deltas []DenomDelta) error {
+	data, err := json.Marshal(deltas)
+	if err != nil {
+		return fmt.Errorf("encode version deltas: %w", err)
+	}
+	pipe.Incr(ctx, key.VersionKey())
+	pipe.XAdd(ctx, &redis.XAddArgs{
+		Stream: key.VersionsStreamKey(),
+		Values: []interface{}{"deltas", data},
+	})
+	return nil
+}
+
+// GetSettlementVersion returns the settlement's current version, 0 before any versioned
+// transaction.
+func (c Client) GetSettlementVersion(ctx context.Context, key Key) (int64, error) {
+	version, err := c.Get(ctx, key.VersionKey()).Int64()
+	if errors.Is(err, redis.Nil) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("read version of settlement %s: %w", key.SettlementDocID, err)
+	}
+	return version, nil
+}
+
+// GetExpectedTendersAtVersion returns the settlement as GetExpectedTenders would have after
+// the given version, reading from the primary. Tills, tenders and denominations first
+// written after that version are listed with zero values. It fails for a version above the
+// current one.
+func (c Client) GetExpectedTendersAtVersion(ctx context.Context, key Key, version int64) ([]Till, error) {
+	if version < 0 {
+		return nil, fmt.Errorf("invalid version %d", version)
+	}
+	o := ReadOptions{Primary: true}
+	for attempt := 1; ; attempt++ {
+		before, err := c.GetSettlementVersion(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		if version > before {
+			return nil, fmt.Errorf("settlement %s is at version %d, before %d", key.SettlementDocID, before, version)
+		}
+		tills, err := c.getExpectedTenders(ctx, key, o)
+		if err != nil && !errors.Is(err, ErrSettlementNotFound) {
+			// A settlement cleared since still has its versions
+			return nil, err
+		}
+		entries, err := c.XRange(ctx, key.VersionsStreamKey(), "-", "+").Result()
+		if err != nil {
+			return nil, fmt.Errorf("read versions of settlement %s: %w", key.SettlementDocID, err)
+		}
+		after, err := c.GetSettlementVersion(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		if after != before || int64(len(entries)) != before {
+			if attempt == c.maxRetries() {
+				return nil, fmt.Errorf("%w: settlement %s kept changing while read", ErrMaxRetriesExceeded, key.SettlementDocID)
+			}
+			continue
+		}
+
+		var later []DenomDelta
+		for _, entry := range entries[version:] {
+			raw, _ := entry.Values["deltas"].(string)
+			var deltas []DenomDelta
+			if err := json.Unmarshal([]byte(raw), &deltas); err != nil {
+				return nil, &ParseError{Key: key.VersionsStreamKey(), Field: entry.ID, Value: raw, Err: err}
+			}
+			later = append(later, deltas...)
+		}
+		return subtractDeltas(tills, later), nil
+	}
+}
+
+// subtractDeltas returns tills with deltas undone. Deltas of tills not in tills, such as
+// reserved pseudo-tills left out of the read, are ignored.
+func subtractDeltas(tills []Till, deltas []DenomDelta) []Till {
+	type tenderIndex struct{ till, tender int }
+	tillIndex := make(map[string]int, len(tills))
+	tenders := make(map[[2]string]tenderIndex)
+	for i, till := range tills {
+		tillIndex[till.ID] = i
+		for j, tender := range till.Tenders {
+			tenders[[2]string{till.ID, tender.StoredID()}] = tenderIndex{i, j}
+		}
+	}
+	for _, delta := range deltas {
+		i, ok := tillIndex[delta.Till]
+		if !ok {
+			continue
+		}
+		ti, ok := tenders[[2]string{delta.Till, delta.Tender}]
+		if !ok {
+			tills[i].Tenders = append(tills[i].Tenders, tenderFromStoredID(delta.Tender))
+			ti = tenderIndex{i, len(tills[i].Tenders) - 1}
+			tenders[[2]string{delta.Till, delta.Tender}] = ti
+		}
+		tender := &tills[ti.till].Tenders[ti.tender]
+		if delta.Denomination == "" {
+			tender.Amount -= delta.Amount
+			continue
+		}
+		found := false
+		for k := range tender.TenderBreakdowns {
+			denomination := &tender.TenderBreakdowns[k]
+			if denomination.storedName(tender.Currency) == delta.Denomination {
+				denomination.Count -= delta.Count
+				denomination.Amount -= delta.Amount
+				found = true
+				break
+			}
+		}
+		if !found {
+			denomination := denominationFromStoredName(delta.Denomination, tender.Currency)
+			denomination.Count, denomination.Amount = -delta.Count, -delta.Amount
+			tender.TenderBreakdowns = append(tender.TenderBreakdowns, denomination)
+		}
+	}
+	return tills
+}
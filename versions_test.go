@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestGetExpectedTendersAtVersion(t *testing.T) {
+	c, _ := newTestClient(t)
+	ctx := context.Background()
+	c.Versioning = true
+	mustProcess(t, c, transfer(VaultTill, "till-1", cash(10)), transfer("till-1", "till-2", cash(4)))
+	if version, err := c.GetSettlementVersion(ctx, testKey); err != nil || version != 2 {
+		t.Fatalf("GetSettlementVersion() = %d, %v, want 2", version, err)
+	}
+
+	current, err := c.GetExpectedTenders(ctx, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Tills and tenders first written later are listed with zero values
+	zero := Tender{ID: "cash", TenderBreakdowns: []TenderInfo{{Name: "bill"}}}
+	for _, tt := range []struct {
+		version int64
+		want    []Till
+	}{
+		{version: 2, want: current},
+		{version: 1, want: []Till{{ID: "till-1", Tenders: []Tender{cash(10)}}, {ID: "till-2", Tenders: []Tender{zero}}}},
+		{version: 0, want: []Till{{ID: "till-1", Tenders: []Tender{zero}}, {ID: "till-2", Tenders: []Tender{zero}}}},
+	} {
+		got, err := c.GetExpectedTendersAtVersion(ctx, testKey, tt.version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("GetExpectedTendersAtVersion(%d) = %+v, want %+v", tt.version, got, tt.want)
+		}
+	}
+	for _, version := range []int64{-1, 3} {
+		if _, err := c.GetExpectedTendersAtVersion(ctx, testKey, version); err == nil {
+			t.Errorf("GetExpectedTendersAtVersion(%d) succeeded", version)
+		}
+	}
+
+	// Transactions of an unversioned client don't bump the version
+	c.Versioning = false
+	mustProcess(t, c, transfer(VaultTill, "till-1", cash(1)))
+	if version, err := c.GetSettlementVersion(ctx, testKey); err != nil || version != 2 {
+		t.Errorf("GetSettlementVersion() after an unversioned transaction = %d, %v, want 2", version, err)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+var ErrOutsideBusinessHours = errors.New("outside business hours")
+
+// Window is a daily time-of-day range. Start and End are offsets from midnight in
+// Location (UTC when nil); a Start after End describes a window spanning midnight.
+type Window struct {
+	Start    time.Duration
+	End      time.Duration
+	Location *time.Location
+}
+
+// Contains reports whether t falls within the window, inclusive of Start and exclusive of End.
+func (w Window) Contains(t time.Time) bool {
+	loc := w.Location
+	if loc == nil {
+		loc = time.UTC
+	}
+	t = t.In(loc)
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+	offset := t.Sub(midnight)
+	if w.Start <= w.End {
+		return offset >= w.Start && offset < w.End
+	}
+	return offset >= w.Start || offset < w.End
+}
+
+func (c Client) now() time.Time {
+	if c.Clock != nil {
+		return c.Clock()
+	}
+	return time.Now()
+}
+
+// checkWindow rejects t with ErrOutsideBusinessHours when an AllowedWindow is configured,
+// the clock is outside it and the transaction doesn't carry an override.
+func (c Client) checkWindow(t Transaction) error {
+	if c.AllowedWindow == nil || t.OverrideWindow {
+		return nil
+	}
+	if !c.AllowedWindow.Contains(c.now()) {
+		return ErrOutsideBusinessHours
+	}
+	return nil
+}
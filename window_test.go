@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestWindowContains(t *testing.T) {
+	day := time.Date(2026, 3, 2, 0, 0, 0, 0, time.UTC)
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skip(err)
+	}
+	tests := []struct {
+		window Window
+		at     time.Duration
+		want   bool
+	}{
+		{window: Window{Start: 9 * time.Hour, End: 17 * time.Hour}, at: 9 * time.Hour, want: true},
+		{window: Window{Start: 9 * time.Hour, End: 17 * time.Hour}, at: 17 * time.Hour},
+		{window: Window{Start: 9 * time.Hour, End: 17 * time.Hour}, at: 8*time.Hour + 59*time.Minute},
+		// Spanning midnight
+		{window: Window{Start: 22 * time.Hour, End: 2 * time.Hour}, at: 23 * time.Hour, want: true},
+		{window: Window{Start: 22 * time.Hour, End: 2 * time.Hour}, at: time.Hour, want: true},
+		{window: Window{Start: 22 * time.Hour, End: 2 * time.Hour}, at: 12 * time.Hour},
+		// 8:30 UTC is 9:30 in Berlin in winter
+		{window: Window{Start: 9 * time.Hour, End: 17 * time.Hour, Location: berlin}, at: 8*time.Hour + 30*time.Minute, want: true},
+		{window: Window{Start: 9 * time.Hour, End: 17 * time.Hour, Location: berlin}, at: 16*time.Hour + 30*time.Minute},
+	}
+	for _, tt := range tests {
+		if got := tt.window.Contains(day.Add(tt.at)); got != tt.want {
+			t.Errorf("%+v.Contains(%s) = %v, want %v", tt.window, tt.at, got, tt.want)
+		}
+	}
+}
+
+func TestAllowedWindow(t *testing.T) {
+	c, _ := newTestClient(t)
+	ctx := context.Background()
+	day := time.Date(2026, 3, 2, 0, 0, 0, 0, time.UTC)
+	clock := &testClock{now: day.Add(8 * time.Hour)}
+	c.Clock, c.AllowedWindow = clock.Now, &Window{Start: 9 * time.Hour, End: 17 * time.Hour}
+
+	if err := c.ProcessTransaction(ctx, transfer(VaultTill, "till-1", cash(10))); !errors.Is(err, ErrOutsideBusinessHours) {
+		t.Errorf("ProcessTransaction() before hours error = %v, want %v", err, ErrOutsideBusinessHours)
+	}
+	if got := tenderAmount(t, c, "till-1", "cash"); got != 0 {
+		t.Errorf("till-1 cash after a rejected transaction = %v, want 0", got)
+	}
+	override := transfer(VaultTill, "till-1", cash(10))
+	override.OverrideWindow = true
+	mustProcess(t, c, override)
+	clock.Set(day.Add(10 * time.Hour))
+	mustProcess(t, c, transfer(VaultTill, "till-1", cash(5)))
+	if got := tenderAmount(t, c, "till-1", "cash"); got != 15 {
+		t.Errorf("till-1 cash = %v, want 15", got)
+	}
+}